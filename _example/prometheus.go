@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/adjust/rmq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func main() {
+	connection := rmq.OpenConnection("prometheus", "tcp", "localhost:6379", 2)
+	prometheus.MustRegister(NewPrometheusCollector(connection))
+	http.Handle("/metrics", promhttp.Handler())
+	log.Printf("metrics listening on http://localhost:3334/metrics")
+	log.Fatal(http.ListenAndServe(":3334", nil))
+}
+
+// PrometheusCollector reports the queue sizes of all open queues and the
+// operation counters of the queues used by the given connection
+type PrometheusCollector struct {
+	connection rmq.Connection
+
+	ready     *prometheus.Desc
+	rejected  *prometheus.Desc
+	unacked   *prometheus.Desc
+	delayed   *prometheus.Desc
+	published *prometheus.Desc
+	consumed  *prometheus.Desc
+	acks      *prometheus.Desc
+	rejects   *prometheus.Desc
+	delays    *prometheus.Desc
+	pushes    *prometheus.Desc
+	requeues  *prometheus.Desc
+	expires   *prometheus.Desc
+}
+
+func NewPrometheusCollector(connection rmq.Connection) *PrometheusCollector {
+	labels := []string{"queue"}
+	return &PrometheusCollector{
+		connection: connection,
+		ready:      prometheus.NewDesc("rmq_ready", "Number of ready deliveries", labels, nil),
+		rejected:   prometheus.NewDesc("rmq_rejected", "Number of rejected deliveries", labels, nil),
+		unacked:    prometheus.NewDesc("rmq_unacked", "Number of unacked deliveries", labels, nil),
+		delayed:    prometheus.NewDesc("rmq_delayed", "Number of delayed deliveries", labels, nil),
+		published:  prometheus.NewDesc("rmq_published_total", "Number of published deliveries", labels, nil),
+		consumed:   prometheus.NewDesc("rmq_consumed_total", "Number of consumed deliveries", labels, nil),
+		acks:       prometheus.NewDesc("rmq_acked_total", "Number of acked deliveries", labels, nil),
+		rejects:    prometheus.NewDesc("rmq_rejected_total", "Number of rejected deliveries", labels, nil),
+		delays:     prometheus.NewDesc("rmq_delayed_total", "Number of delayed deliveries", labels, nil),
+		pushes:     prometheus.NewDesc("rmq_pushed_total", "Number of pushed deliveries", labels, nil),
+		requeues:   prometheus.NewDesc("rmq_requeued_total", "Number of deliveries requeued to the front", labels, nil),
+		expires:    prometheus.NewDesc("rmq_expired_total", "Number of deliveries dropped because their TTL passed", labels, nil),
+	}
+}
+
+func (collector *PrometheusCollector) Describe(descs chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		collector.ready, collector.rejected, collector.unacked, collector.delayed,
+		collector.published, collector.consumed, collector.acks, collector.rejects, collector.delays, collector.pushes, collector.requeues, collector.expires,
+	} {
+		descs <- desc
+	}
+}
+
+func (collector *PrometheusCollector) Collect(metrics chan<- prometheus.Metric) {
+	stats := collector.connection.CollectStats(collector.connection.GetOpenQueues())
+	for queue, stat := range stats.QueueStats {
+		metrics <- prometheus.MustNewConstMetric(collector.ready, prometheus.GaugeValue, float64(stat.ReadyCount), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.rejected, prometheus.GaugeValue, float64(stat.RejectedCount), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.unacked, prometheus.GaugeValue, float64(stat.UnackedCount()), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.delayed, prometheus.GaugeValue, float64(stat.DelayedCount), queue)
+	}
+
+	for queue, counters := range collector.connection.Counters() {
+		metrics <- prometheus.MustNewConstMetric(collector.published, prometheus.CounterValue, float64(counters.Published), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.consumed, prometheus.CounterValue, float64(counters.Consumed), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.acks, prometheus.CounterValue, float64(counters.Acked), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.rejects, prometheus.CounterValue, float64(counters.Rejected), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.delays, prometheus.CounterValue, float64(counters.Delayed), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.pushes, prometheus.CounterValue, float64(counters.Pushed), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.requeues, prometheus.CounterValue, float64(counters.Requeued), queue)
+		metrics <- prometheus.MustNewConstMetric(collector.expires, prometheus.CounterValue, float64(counters.Expired), queue)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/adjust/rmq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func main() {
+	tracer := NewOtelTracer()
+	connection := rmq.OpenConnection("tracing", "tcp", "localhost:6379", 2)
+
+	queue := connection.OpenQueue("things")
+	queue.SetTracer(tracer)
+	queue.StartConsuming(10, time.Second)
+	queue.AddConsumer("tracing", rmq.Consumer(&TracingConsumer{}))
+
+	ctx, span := otel.Tracer("producer").Start(context.Background(), "produce")
+	queue.PublishWithTrace(ctx, "traced delivery")
+	span.End()
+
+	select {}
+}
+
+// OtelTracer implements rmq.Tracer by propagating the trace context with the
+// globally configured OpenTelemetry propagator
+type OtelTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func NewOtelTracer() *OtelTracer {
+	return &OtelTracer{
+		tracer:     otel.Tracer("rmq"),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+func (tracer *OtelTracer) Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	tracer.propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+func (tracer *OtelTracer) StartConsume(ctx context.Context, queue string, traceContext map[string]string) (context.Context, func()) {
+	ctx = tracer.propagator.Extract(ctx, propagation.MapCarrier(traceContext))
+	ctx, span := tracer.tracer.Start(ctx, "rmq consume "+queue, trace.WithSpanKind(trace.SpanKindConsumer))
+	return ctx, func() { span.End() }
+}
+
+type TracingConsumer struct{}
+
+func (consumer *TracingConsumer) Consume(delivery rmq.Delivery) {
+	span := trace.SpanFromContext(delivery.Context())
+	log.Printf("consumed %s in trace %s", delivery.Payload(), span.SpanContext().TraceID())
+	delivery.Ack()
+}
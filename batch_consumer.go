@@ -3,3 +3,18 @@ package rmq
 type BatchConsumer interface {
 	Consume(batch Deliveries)
 }
+
+// taggedBatchConsumer is similar to taggedConsumer, but for batch consumers
+type taggedBatchConsumer struct {
+	tag      string
+	consumer BatchConsumer
+}
+
+func (consumer taggedBatchConsumer) Consume(batch Deliveries) {
+	for _, delivery := range batch {
+		if wrapped, ok := delivery.(*wrapDelivery); ok {
+			wrapped.consumerTag = consumer.tag
+		}
+	}
+	consumer.consumer.Consume(batch)
+}
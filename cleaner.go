@@ -1,6 +1,11 @@
 package rmq
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Cleaner struct {
 	connection *redisConnection
@@ -37,7 +42,7 @@ func (cleaner *Cleaner) CleanConnection(connection *redisConnection) error {
 		cleaner.CleanQueue(queue)
 	}
 
-	if !connection.Close() {
+	if !connection.unregister() {
 		return fmt.Errorf("rmq cleaner failed to close connection %v", connection)
 	}
 
@@ -45,13 +50,102 @@ func (cleaner *Cleaner) CleanConnection(connection *redisConnection) error {
 		return fmt.Errorf("rmq cleaner failed to close all queues %+v %s", connection, err)
 	}
 
-	// log.Printf("rmq cleaner cleaned connection %s", connection)
+	cleaner.connection.logger.debugf("cleaner cleaned connection %s", connection)
 	return nil
 }
 
 func (cleaner *Cleaner) CleanQueue(queue *redisQueue) {
 	returned := queue.ReturnAllUnacked()
+	queue.returnInspected()
 	queue.CloseInConnection()
-	_ = returned
-	// log.Printf("rmq cleaner cleaned queue %s %d", queue, returned)
+	queue.logger.debugf("cleaner cleaned queue %s %d", queue, returned)
+}
+
+// ExpireIdleQueues removes the queues marked with SetEphemeral which have been
+// idle for longer than they were set to, along with the keys tracking them.
+// Queues which still hold ready deliveries of any priority, delayed, rejected,
+// unacked or inspected deliveries are kept. Each queue gets checked and removed
+// in a single script, so a delivery published meanwhile can't get lost.
+// Returns the names of the removed queues
+func (cleaner *Cleaner) ExpireIdleQueues() ([]string, error) {
+	return cleaner.expireIdleQueues(time.Now())
+}
+
+func (cleaner *Cleaner) expireIdleQueues(now time.Time) ([]string, error) {
+	connection := cleaner.connection
+	ephemeralKey := prefixKey(connection.prefix, ephemeralQueuesKey)
+	queueNames, err := connection.redisClient.HKeys(ephemeralKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, queueName := range queueNames {
+		queue := connection.openQueue(queueName)
+		keys, err := cleaner.deliveryKeys(queue)
+		if err != nil {
+			return removed, err
+		}
+
+		keys = append([]string{connection.allQueuesKey, ephemeralKey, queue.activityKey}, keys...)
+		expired, err := connection.redisClient.Eval(expireIdleScript, keys, queueName, now.UnixNano()).Int64()
+		if err != nil {
+			return removed, keyTypeError(err, keys...)
+		}
+		if expired == 1 {
+			removed = append(removed, queueName)
+		}
+	}
+	return removed, nil
+}
+
+// expireIdleScript removes the ephemeral queue ARGV[1] from the set of queues
+// at KEYS[1] and the hash of ephemeral queues at KEYS[2] and deletes its
+// activity key KEYS[3] if it has been idle for longer than the hash says at
+// the unix nanoseconds ARGV[2] and all its delivery keys KEYS[4..] are empty.
+// Redis deletes empty lists and sorted sets, so they mustn't exist. Returns 1
+// if it got removed
+const expireIdleScript = `local idle = redis.call('hget', KEYS[2], ARGV[1])
+if not idle then
+    return 0
+end
+local activity = tonumber(redis.call('get', KEYS[3]) or '0')
+if tonumber(ARGV[2]) - activity <= tonumber(idle) then
+    return 0
+end
+for i = 4, #KEYS do
+    if redis.call('exists', KEYS[i]) == 1 then
+        return 0
+    end
+end
+redis.call('srem', KEYS[1], ARGV[1])
+redis.call('hdel', KEYS[2], ARGV[1])
+redis.call('del', KEYS[3])
+return 1`
+
+// deliveryKeys returns the keys of the queue which hold deliveries: its
+// ready lists of all priorities, its delayed and rejected deliveries and the
+// unacked and inspected deliveries of all connections
+func (cleaner *Cleaner) deliveryKeys(queue *redisQueue) ([]string, error) {
+	connection := cleaner.connection
+	keys := []string{queue.readyKey, queue.delayedKey, queue.rejectedKey}
+	priorityPrefix := queue.readyKey + "::p"
+	err := connection.scan(globEscape(priorityPrefix)+"*", func(key string) {
+		if _, err := strconv.Atoi(strings.TrimPrefix(key, priorityPrefix)); err == nil {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	connectionNames, err := connection.redisClient.SMembers(connection.connectionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, connectionName := range connectionNames {
+		hijacked := connection.hijackConnection(connectionName).openQueue(queue.name)
+		keys = append(keys, hijacked.unackedKey, hijacked.inspectedKey)
+	}
+	return keys, nil
 }
@@ -3,6 +3,7 @@ package rmq
 import (
 	"fmt"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -43,7 +44,7 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 
 	c.Check(queue.UnackedCount(), Equals, 0)
 	queue.StartConsuming(2, time.Millisecond)
-	time.Sleep(2 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
 	c.Check(queue.UnackedCount(), Equals, 2)
 	c.Check(queue.ReadyCount(), Equals, 4)
 
@@ -59,7 +60,7 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 	c.Assert(consumer.LastDelivery, NotNil)
 	c.Check(consumer.LastDelivery.Payload(), Equals, "del1")
 	c.Check(consumer.LastDelivery.Ack(), Equals, true)
-	time.Sleep(2 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
 	c.Check(queue.UnackedCount(), Equals, 2)
 	c.Check(queue.ReadyCount(), Equals, 3)
 
@@ -76,43 +77,44 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 	conn = OpenConnection("cleaner-conn1", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	queue = conn.OpenQueue("q1").(*redisQueue)
 
+	// stopping returned the prefetched del3 and del4 to ready
 	queue.Publish("del7")
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.ReadyCount(), Equals, 5)
 	queue.Publish("del7")
-	c.Check(queue.ReadyCount(), Equals, 4)
+	c.Check(queue.ReadyCount(), Equals, 6)
 	queue.Publish("del8")
-	c.Check(queue.ReadyCount(), Equals, 5)
+	c.Check(queue.ReadyCount(), Equals, 7)
 	queue.Publish("del9")
-	c.Check(queue.ReadyCount(), Equals, 6)
+	c.Check(queue.ReadyCount(), Equals, 8)
 	queue.Publish("del10")
-	c.Check(queue.ReadyCount(), Equals, 7)
+	c.Check(queue.ReadyCount(), Equals, 9)
 
 	c.Check(queue.UnackedCount(), Equals, 0)
 	queue.StartConsuming(2, time.Millisecond)
-	time.Sleep(2 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
 	c.Check(queue.UnackedCount(), Equals, 2)
-	c.Check(queue.ReadyCount(), Equals, 5)
+	c.Check(queue.ReadyCount(), Equals, 7)
 
 	consumer = NewTestConsumer("c-B")
 	consumer.AutoFinish = false
 	consumer.AutoAck = false
 
 	queue.AddConsumer("consumer2", consumer)
-	time.Sleep(2 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
 	c.Check(queue.UnackedCount(), Equals, 3)
-	c.Check(queue.ReadyCount(), Equals, 4)
-	c.Check(consumer.LastDelivery.Payload(), Equals, "del5")
+	c.Check(queue.ReadyCount(), Equals, 6)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "del3")
 
 	consumer.Finish() // unacked
-	time.Sleep(2 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
 	c.Check(queue.UnackedCount(), Equals, 4)
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.ReadyCount(), Equals, 5)
 
-	c.Check(consumer.LastDelivery.Payload(), Equals, "del6")
+	c.Check(consumer.LastDelivery.Payload(), Equals, "del4")
 	c.Check(consumer.LastDelivery.Ack(), Equals, true)
-	time.Sleep(2 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
 	c.Check(queue.UnackedCount(), Equals, 3)
-	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.ReadyCount(), Equals, 5)
 
 	queue.StopConsuming()
 	conn.StopHeartbeat()
@@ -130,7 +132,7 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 	consumer = NewTestConsumer("c-C")
 
 	queue.AddConsumer("consumer3", consumer)
-	time.Sleep(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
 	c.Check(consumer.LastDeliveries, HasLen, 9)
 
 	queue.StopConsuming()
@@ -140,3 +142,83 @@ func (suite *CleanerSuite) TestCleaner(c *C) {
 	c.Check(cleaner.Clean(), IsNil)
 	cleanerConn.StopHeartbeat()
 }
+
+func (suite *CleanerSuite) TestExpireIdleQueues(c *C) {
+	conn := OpenConnection("idle-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	cleaner := NewCleaner(conn)
+	idle := conn.OpenQueue("idle-q").(*redisQueue)
+	busy := conn.OpenQueue("idle-busy-q").(*redisQueue)
+	kept := conn.OpenQueue("idle-kept-q").(*redisQueue)
+	idle.PurgeReady()
+	busy.PurgeReady()
+	busy.PurgeRejected()
+	idle.SetEphemeral(time.Minute)
+	busy.SetEphemeral(time.Minute)
+	c.Check(busy.Publish("idle-busy-d1"), Equals, true)
+
+	removed, err := cleaner.expireIdleQueues(time.Now())
+	c.Check(err, IsNil)
+	c.Check(removed, HasLen, 0) // not idle yet
+
+	// queues which still hold deliveries are kept past the idle window
+	removed, err = cleaner.expireIdleQueues(time.Now().Add(2 * time.Minute))
+	c.Check(err, IsNil)
+	c.Check(removed, DeepEquals, []string{"idle-q"})
+	c.Check(conn.redisClient.SIsMember(conn.allQueuesKey, "idle-q").Val(), Equals, false)
+	c.Check(conn.redisClient.SIsMember(conn.allQueuesKey, "idle-busy-q").Val(), Equals, true)
+	c.Check(conn.redisClient.SIsMember(conn.allQueuesKey, "idle-kept-q").Val(), Equals, true)
+	c.Check(kept.ReadyCount(), Equals, 0)
+
+	// unacked deliveries of any connection keep the queue too
+	deliveries, err := busy.Fetch(1)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	removed, err = cleaner.expireIdleQueues(time.Now().Add(2 * time.Minute))
+	c.Check(err, IsNil)
+	c.Check(removed, HasLen, 0)
+
+	c.Check(deliveries[0].Ack(), Equals, true)
+
+	// ready deliveries of other priorities and inspected ones keep the queue
+	busy.SetMaxPriority(2)
+	c.Check(busy.PublishWithPriority("idle-busy-d2", 2), Equals, true)
+	removed, err = cleaner.expireIdleQueues(time.Now().Add(2 * time.Minute))
+	c.Check(err, IsNil)
+	c.Check(removed, HasLen, 0)
+	deliveries, err = busy.Fetch(1)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Check(deliveries[0].Reject(), Equals, true)
+	inspected, err := busy.RejectedDeliveries(1)
+	c.Check(err, IsNil)
+	c.Assert(inspected, HasLen, 1)
+	removed, err = cleaner.expireIdleQueues(time.Now().Add(2 * time.Minute))
+	c.Check(err, IsNil)
+	c.Check(removed, HasLen, 0)
+	c.Check(inspected[0].Ack(), Equals, true)
+	removed, err = cleaner.expireIdleQueues(time.Now().Add(2 * time.Minute))
+	c.Check(err, IsNil)
+	c.Check(removed, DeepEquals, []string{"idle-busy-q"})
+
+	// activity is recorded once per tenth of the idle time
+	c.Check(busy.Publish("idle-busy-d3"), Equals, true)
+	c.Check(conn.redisClient.Set(busy.activityKey, 1, 0).Err(), IsNil)
+	c.Check(busy.Publish("idle-busy-d4"), Equals, true)
+	c.Check(conn.redisClient.Get(busy.activityKey).Val(), Equals, "1")
+	busy.PurgeReady()
+
+	// activity registers removed queues again
+	atomic.StoreInt64(&idle.touched, 0) // as if a tenth of the idle time passed
+	c.Check(idle.Publish("idle-d1"), Equals, true)
+	c.Check(conn.redisClient.SIsMember(conn.allQueuesKey, "idle-q").Val(), Equals, true)
+	removed, err = cleaner.expireIdleQueues(time.Now().Add(2 * time.Minute))
+	c.Check(err, IsNil)
+	c.Check(removed, HasLen, 0)
+
+	idle.PurgeReady()
+	idle.SetEphemeral(0)
+	removed, err = cleaner.expireIdleQueues(time.Now().Add(2 * time.Minute))
+	c.Check(err, IsNil)
+	c.Check(removed, HasLen, 0) // not ephemeral anymore
+	conn.StopHeartbeat()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/adjust/uniuri"
@@ -12,47 +13,111 @@ import (
 
 const heartbeatDuration = time.Minute
 
+// scanBatchSize is the number of keys scanned or deleted per command
+const scanBatchSize = 100
+
 // Connection is an interface that can be used to test publishing
 type Connection interface {
 	OpenQueue(name string) Queue
+	OpenQueueE(name string) (Queue, error)
 	CollectStats(queueList []string) Stats
 	GetOpenQueues() []string
+	GetOpenQueuesE() ([]string, error)
+	GetConsumingQueuesE() ([]string, error)
+	Counters() map[string]QueueCounters
+	SetConsumerTagGenerator(generator func(tag string) string)
+	SetConsumerTokenLength(length int)
+	SetLogger(logger Logger)
+	SetDebug(debug bool)
+	Ping() error
+	Healthy() bool
+	RedisClient() redis.UniversalClient
+	FindOrphanedKeys() ([]string, error)
+	PruneOrphanedKeys() (int, error)
+	StopAllConsuming() <-chan struct{}
+	Close() bool
+	CloseWithTimeout(timeout time.Duration) bool
 }
 
 // Connection is the entry point. Use a connection to access queues, consumers and deliveries
 // Each connection has a single heartbeat shared among all consumers
 type redisConnection struct {
 	Name             string
+	prefix           string // replaces the rmq prefix of all keys, empty for the default
+	connectionsKey   string // key to set of all connections
+	allQueuesKey     string // key to set of all open queues
 	heartbeatKey     string // key to keep alive
 	queuesKey        string // key to list of queues consumed by this connection
 	redisClient      redis.UniversalClient
 	heartbeatStopped bool
+	consumerNaming   *consumerNaming      // generates consumer names from tags, shared with the queues opened on this connection
+	logger           *logging             // shared with the queues opened on this connection
+	lmove            *serverSupport       // whether LMOVE can replace RPOPLPUSH, shared with the queues opened on this connection
+	multiConsumers   *multiQueueConsumers // consuming queues opened on this connection, stopped on close
+
+	countersLock sync.Mutex
+	counters     map[string]*QueueCounters // by queue name, shared by all queues opened on this connection
+
+	queuesLock sync.Mutex
+	queues     []*redisQueue // opened with OpenQueue, to stop consuming on close
 }
 
 // OpenConnectionWithRedisClient opens and returns a new connection
 func OpenConnectionWithRedisClient(tag string, redisClient redis.UniversalClient) *redisConnection {
+	connection, err := openConnection("", tag, redisClient)
+	if err != nil {
+		log.Panic(err)
+	}
+	return connection
+}
+
+// OpenConnectionWithRedisClientE is similar to OpenConnectionWithRedisClient,
+// but returns an error instead of panicking if redis is unreachable
+func OpenConnectionWithRedisClientE(tag string, redisClient redis.UniversalClient) (Connection, error) {
+	connection, err := openConnection("", tag, redisClient)
+	if err != nil {
+		return nil, err
+	}
+	return connection, nil
+}
+
+// OpenConnectionWithRedisOptions opens and returns a new connection using a
+// client fully configured by the given options (password, db, TLS etc.)
+func OpenConnectionWithRedisOptions(tag string, opts *redis.Options) (Connection, error) {
+	redisClient := redis.NewClient(opts)
+	connection, err := openConnection("", tag, redisClient)
+	if err != nil {
+		redisClient.Close()
+		return nil, err
+	}
+	return connection, nil
+}
+
+func openConnection(prefix, tag string, redisClient redis.UniversalClient) (*redisConnection, error) {
 	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
+	connection := newConnection(prefix, name, redisClient)
 
-	connection := &redisConnection{
-		Name:         name,
-		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
-		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
-		redisClient:  redisClient,
+	if err := redisClient.Ping().Err(); err != nil {
+		return nil, fmt.Errorf("rmq connection failed to reach redis %s: %s", connection, err)
 	}
+	connection.lmove.check(redisClient) // checked again on first use if this fails
 
-	if !connection.updateHeartbeat() { // checks the connection
-		log.Panicf("rmq connection failed to update heartbeat %s", connection)
+	// checks the connection
+	if err := redisClient.Set(connection.heartbeatKey, "1", heartbeatDuration).Err(); err != nil {
+		return nil, fmt.Errorf("rmq connection failed to update heartbeat %s: %s", connection, err)
 	}
 
 	// add to connection set after setting heartbeat to avoid race with cleaner
-	redisErrIsNil(redisClient.SAdd(connectionsKey, name))
+	if err := redisClient.SAdd(connection.connectionsKey, name).Err(); err != nil {
+		return nil, fmt.Errorf("rmq connection failed to register %s: %s", connection, err)
+	}
 
 	go connection.heartbeat()
-	// log.Printf("rmq connection connected to %s %s:%s %d", name, network, address, db)
-	return connection
+	return connection, nil
 }
 
-// OpenConnection opens and returns a new connection
+// OpenConnection opens and returns a new connection to the redis database db,
+// all keys of the connection and the queues opened on it stay in that database
 func OpenConnection(tag, network, address string, db int) *redisConnection {
 	redisClient := redis.NewClient(&redis.Options{
 		Network: network,
@@ -62,25 +127,162 @@ func OpenConnection(tag, network, address string, db int) *redisConnection {
 	return OpenConnectionWithRedisClient(tag, redisClient)
 }
 
+// OpenConnectionE is similar to OpenConnection, but returns an error instead
+// of panicking if redis is unreachable
+func OpenConnectionE(tag, network, address string, db int) (Connection, error) {
+	return OpenConnectionWithRedisOptions(tag, &redis.Options{
+		Network: network,
+		Addr:    address,
+		DB:      db,
+	})
+}
+
+// OpenConnectionWithPrefix is similar to OpenConnection, but uses prefix
+// instead of rmq for all its keys. Connections only see queues and other
+// connections using the same prefix, so independent apps can share a redis
+func OpenConnectionWithPrefix(prefix, tag, network, address string, db int) *redisConnection {
+	redisClient := redis.NewClient(&redis.Options{
+		Network: network,
+		Addr:    address,
+		DB:      db,
+	})
+	connection, err := openConnection(prefix, tag, redisClient)
+	if err != nil {
+		log.Panic(err)
+	}
+	return connection
+}
+
+// newConnection returns a connection with the given name without checking or
+// registering it
+func newConnection(prefix, name string, redisClient redis.UniversalClient) *redisConnection {
+	return &redisConnection{
+		Name:           name,
+		prefix:         prefix,
+		connectionsKey: prefixKey(prefix, connectionsKey),
+		allQueuesKey:   prefixKey(prefix, queuesKey),
+		heartbeatKey:   prefixKey(prefix, strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1)),
+		queuesKey:      prefixKey(prefix, strings.Replace(connectionQueuesTemplate, phConnection, name, 1)),
+		redisClient:    redisClient,
+		logger:         newLogging(),
+		lmove:          newServerSupport(lmoveVersion),
+		consumerNaming: &consumerNaming{},
+		multiConsumers: newMultiQueueConsumers(),
+	}
+}
+
 // OpenQueue opens and returns the queue with a given name
 func (connection *redisConnection) OpenQueue(name string) Queue {
-	redisErrIsNil(connection.redisClient.SAdd(queuesKey, name))
-	queue := newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
+	queue, err := connection.addQueue(name)
+	if err != nil {
+		connection.logger.Panicf("rmq connection failed to open queue %s: %s", name, err)
+	}
 	return queue
 }
 
+// OpenQueueE is similar to OpenQueue, but returns an error instead of
+// panicking if the queue can't be used with the redis client, like a queue
+// without hash tag on a cluster client, or if redis is unreachable
+func (connection *redisConnection) OpenQueueE(name string) (Queue, error) {
+	queue, err := connection.addQueue(name)
+	if err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+// addQueue opens a queue and adds it to the set of queues, unless its keys
+// can't be used together with the redis client
+func (connection *redisConnection) addQueue(name string) (*redisQueue, error) {
+	queue := connection.openQueue(name)
+	if _, ok := connection.redisClient.(*redis.ClusterClient); ok && !queue.inSameSlot() {
+		return nil, fmt.Errorf("rmq queue %s needs a hash tag like {%s} in its name to be used with redis cluster", name, name)
+	}
+	if err := connection.redisClient.SAdd(connection.allQueuesKey, name).Err(); err != nil {
+		return nil, keyTypeError(err, connection.allQueuesKey)
+	}
+
+	connection.queuesLock.Lock()
+	defer connection.queuesLock.Unlock()
+	queues := connection.queues[:0]
+	for _, opened := range connection.queues {
+		if opened.name != name || opened.deliveryChan != nil { // keep the ones which may need to be stopped
+			queues = append(queues, opened)
+		}
+	}
+	connection.queues = append(queues, queue)
+	return queue, nil
+}
+
 func (connection *redisConnection) CollectStats(queueList []string) Stats {
 	return CollectStats(queueList, connection)
 }
 
+// Counters returns the number of operations performed per queue through this
+// connection, without a redis round trip
+func (connection *redisConnection) Counters() map[string]QueueCounters {
+	connection.countersLock.Lock()
+	defer connection.countersLock.Unlock()
+
+	counters := make(map[string]QueueCounters, len(connection.counters))
+	for name, queueCounters := range connection.counters {
+		counters[name] = queueCounters.snapshot()
+	}
+	return counters
+}
+
+func (connection *redisConnection) queueCounters(name string) *QueueCounters {
+	connection.countersLock.Lock()
+	defer connection.countersLock.Unlock()
+
+	if connection.counters == nil {
+		connection.counters = map[string]*QueueCounters{}
+	}
+	counters, ok := connection.counters[name]
+	if !ok {
+		counters = &QueueCounters{}
+		connection.counters[name] = counters
+	}
+	return counters
+}
+
+// SetConsumerTagGenerator sets the function which returns the names of
+// consumers added with the given tag to the queues of this connection,
+// including queues opened before. By default consumer names are the tag
+// followed by a random token. If a generated name is taken, a random token
+// gets appended to keep consumer names unique. nil restores the default
+func (connection *redisConnection) SetConsumerTagGenerator(generator func(tag string) string) {
+	connection.consumerNaming.setGenerator(generator)
+}
+
+// SetConsumerTokenLength sets the length of the random tokens in consumer
+// names, six by default. Lengths below one restore the default
+func (connection *redisConnection) SetConsumerTokenLength(length int) {
+	connection.consumerNaming.setTokenLength(length)
+}
+
+// SetLogger sets the logger rmq logs to for this connection, the queues
+// opened on it and their deliveries, including queues opened before. A nil
+// logger logs to the standard logger, which is the default
+func (connection *redisConnection) SetLogger(logger Logger) {
+	connection.logger.set(logger)
+}
+
+// SetDebug turns debug logging of publishes, consumes, acks and rejects on or
+// off for this connection, its queues and their deliveries. It's off unless
+// the RMQ_DEBUG environment variable is true when opening the connection
+func (connection *redisConnection) SetDebug(debug bool) {
+	connection.logger.setDebug(debug)
+}
+
 func (connection *redisConnection) String() string {
 	return connection.Name
 }
 
 // GetConnections returns a list of all open connections
 func (connection *redisConnection) GetConnections() []string {
-	result := connection.redisClient.SMembers(connectionsKey)
-	if redisErrIsNil(result) {
+	result := connection.redisClient.SMembers(connection.connectionsKey)
+	if connection.logger.redisErrIsNil(result) {
 		return []string{}
 	}
 	return result.Val()
@@ -88,38 +290,133 @@ func (connection *redisConnection) GetConnections() []string {
 
 // Check retuns true if the connection is currently active in terms of heartbeat
 func (connection *redisConnection) Check() bool {
-	heartbeatKey := strings.Replace(connectionHeartbeatTemplate, phConnection, connection.Name, 1)
-	result := connection.redisClient.TTL(heartbeatKey)
-	if redisErrIsNil(result) {
+	result := connection.redisClient.TTL(connection.heartbeatKey)
+	if connection.logger.redisErrIsNil(result) {
 		return false
 	}
 	return result.Val() > 0
 }
 
+// Ping returns the error of a redis PING, nil if redis is reachable
+func (connection *redisConnection) Ping() error {
+	return connection.redisClient.Ping().Err()
+}
+
+// RedisClient returns the redis client of the connection to run commands rmq
+// doesn't offer, like MEMORY USAGE on a queue key. Changing the keys of rmq
+// through it can corrupt the state of its queues, so better only read them
+func (connection *redisConnection) RedisClient() redis.UniversalClient {
+	return connection.redisClient
+}
+
+// Healthy returns true if redis is reachable, use it for readiness probes
+func (connection *redisConnection) Healthy() bool {
+	return connection.Ping() == nil
+}
+
 // StopHeartbeat stops the heartbeat of the connection
 // it does not remove it from the list of connections so it can later be found by the cleaner
 func (connection *redisConnection) StopHeartbeat() bool {
 	connection.heartbeatStopped = true
-	return !redisErrIsNil(connection.redisClient.Del(connection.heartbeatKey))
+	return !connection.logger.redisErrIsNil(connection.redisClient.Del(connection.heartbeatKey))
+}
+
+// StopAllConsuming stops consuming on all queues opened on this connection,
+// returning the deliveries which were fetched but not consumed yet to ready,
+// and stops the multi queue consumers consuming them. The returned channel
+// gets closed once all their consumers finished
+func (connection *redisConnection) StopAllConsuming() <-chan struct{} {
+	connection.queuesLock.Lock()
+	queues := append([]*redisQueue{}, connection.queues...)
+	connection.queuesLock.Unlock()
+
+	for _, queue := range queues {
+		queue.StopConsuming()
+	}
+	multiConsumers := connection.multiConsumers.stop()
+
+	finishedChan := make(chan struct{})
+	go func() {
+		for _, queue := range queues {
+			queue.WaitForConsuming()
+		}
+		for _, multi := range multiConsumers {
+			<-multi.doneChan
+		}
+		close(finishedChan)
+	}()
+	return finishedChan
 }
 
+// Close shuts the connection down gracefully: it stops consuming on all
+// queues opened on this connection and waits for their consumers, returns
+// their unacked deliveries to ready and the ones taken out by
+// RejectedDeliveries to rejected, stops the heartbeat and removes the
+// connection from the list of connections. Unlike Queue.Close it doesn't
+// purge any deliveries. Returns false if the connection wasn't registered
 func (connection *redisConnection) Close() bool {
-	return !redisErrIsNil(connection.redisClient.SRem(connectionsKey, connection.Name))
+	return connection.close(0)
+}
+
+// CloseWithTimeout is similar to Close, but waits at most timeout for the
+// consumers to finish. If they didn't it returns false without returning any
+// deliveries or stopping the heartbeat, so it can be called again
+func (connection *redisConnection) CloseWithTimeout(timeout time.Duration) bool {
+	return connection.close(timeout)
+}
+
+// close closes the connection, waiting for the consumers for at most timeout
+// unless it's zero
+func (connection *redisConnection) close(timeout time.Duration) bool {
+	finishedChan := connection.StopAllConsuming()
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-finishedChan:
+		case <-timer.C:
+			connection.logger.Printf("rmq connection %s failed to close, consumers didn't finish within %s", connection, timeout)
+			return false
+		}
+	} else {
+		<-finishedChan
+	}
+
+	for _, queueName := range connection.GetConsumingQueues() {
+		queue := connection.openQueue(queueName)
+		queue.ReturnAllUnacked()
+		queue.returnInspected()
+		queue.CloseInConnection()
+	}
+	connection.StopHeartbeat()
+	return connection.unregister()
+}
+
+// unregister removes the connection from the list of connections, returns
+// false if it wasn't in there
+func (connection *redisConnection) unregister() bool {
+	result := connection.redisClient.SRem(connection.connectionsKey, connection.Name)
+	if connection.logger.redisErrIsNil(result) {
+		return false
+	}
+	return result.Val() > 0
 }
 
 // GetOpenQueues returns a list of all open queues
 func (connection *redisConnection) GetOpenQueues() []string {
-	result := connection.redisClient.SMembers(queuesKey)
-	if redisErrIsNil(result) {
-		return []string{}
-	}
-	return result.Val()
+	return connection.mustMembers(connection.GetOpenQueuesE())
+}
+
+// GetOpenQueuesE is similar to GetOpenQueues, but returns redis errors
+// instead of panicking
+func (connection *redisConnection) GetOpenQueuesE() ([]string, error) {
+	return connection.members(connection.allQueuesKey)
 }
 
 // CloseAllQueues closes all queues by removing them from the global list
 func (connection *redisConnection) CloseAllQueues() int {
-	result := connection.redisClient.Del(queuesKey)
-	if redisErrIsNil(result) {
+	result := connection.redisClient.Del(connection.allQueuesKey)
+	if connection.logger.redisErrIsNil(result) {
 		return 0
 	}
 	return int(result.Val())
@@ -127,53 +424,194 @@ func (connection *redisConnection) CloseAllQueues() int {
 
 // CloseAllQueuesInConnection closes all queues in the associated connection by removing all related keys
 func (connection *redisConnection) CloseAllQueuesInConnection() error {
-	redisErrIsNil(connection.redisClient.Del(connection.queuesKey))
-	// debug(fmt.Sprintf("connection closed all queues %s %d", connection, connection.queuesKey)) // COMMENTOUT
+	connection.logger.redisErrIsNil(connection.redisClient.Del(connection.queuesKey))
+	connection.logger.debugf("connection closed all queues %s %s", connection, connection.queuesKey)
 	return nil
 }
 
 // GetConsumingQueues returns a list of all queues consumed by this connection
 func (connection *redisConnection) GetConsumingQueues() []string {
-	result := connection.redisClient.SMembers(connection.queuesKey)
-	if redisErrIsNil(result) {
-		return []string{}
+	return connection.mustMembers(connection.GetConsumingQueuesE())
+}
+
+// GetConsumingQueuesE is similar to GetConsumingQueues, but returns redis
+// errors instead of panicking
+func (connection *redisConnection) GetConsumingQueuesE() ([]string, error) {
+	return connection.members(connection.queuesKey)
+}
+
+// FindOrphanedKeys returns the keys of queues which aren't in the set of open
+// queues anymore, for example because closing them failed halfway. It uses
+// SCAN, on all masters of a cluster, so it doesn't block redis but may miss
+// keys created meanwhile
+func (connection *redisConnection) FindOrphanedKeys() ([]string, error) {
+	openQueues, err := connection.GetOpenQueuesE()
+	if err != nil {
+		return nil, err
 	}
-	return result.Val()
+	open := make(map[string]bool, len(openQueues))
+	for _, name := range openQueues {
+		open[name] = true
+	}
+
+	queueKeys := prefixKey(connection.prefix, "rmq::queue::") // the [ would start a character class in the pattern
+	orphaned := []string{}
+	err = connection.scan(queueKeys+"*", func(key string) {
+		if strings.HasPrefix(key, queueKeys+"[") && !ofOpenQueue(key[len(queueKeys)+1:], open) {
+			orphaned = append(orphaned, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphaned, nil
+}
+
+// ofOpenQueue returns whether the part of a queue key after its [ starts with
+// the name of an open queue followed by ]::. Queue names may contain ]:: too,
+// so all places it occurs at are checked
+func ofOpenQueue(key string, open map[string]bool) bool {
+	for end := strings.Index(key, "]::"); end >= 0; {
+		if open[key[:end]] {
+			return true
+		}
+		next := strings.Index(key[end+1:], "]::")
+		if next < 0 {
+			return false
+		}
+		end += 1 + next
+	}
+	return false
+}
+
+// scan calls fn with all keys matching pattern, scanning all masters of a
+// cluster one after the other
+func (connection *redisConnection) scan(pattern string, fn func(key string)) error {
+	cluster, ok := connection.redisClient.(*redis.ClusterClient)
+	if !ok {
+		return scanClient(connection.redisClient, pattern, fn)
+	}
+
+	var lock sync.Mutex // ForEachMaster calls its function concurrently
+	return cluster.ForEachMaster(func(client *redis.Client) error {
+		lock.Lock()
+		defer lock.Unlock()
+		return scanClient(client, pattern, fn)
+	})
+}
+
+// globEscape escapes the characters SCAN patterns treat specially, so key
+// matches itself only
+func globEscape(key string) string {
+	var escaped strings.Builder
+	for _, r := range key {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// scanClient calls fn with all keys matching pattern on the redis of client
+func scanClient(client redis.Cmdable, pattern string, fn func(key string)) error {
+	iter := client.Scan(0, pattern, scanBatchSize).Iterator()
+	for iter.Next() {
+		fn(iter.Val())
+	}
+	return iter.Err()
+}
+
+// PruneOrphanedKeys deletes the keys found by FindOrphanedKeys, returns the
+// number of deleted keys. Don't call it while queues get opened and closed,
+// the keys of a queue opened meanwhile would get deleted. Keys are deleted one
+// by one in pipelines, so keys of different cluster slots can be deleted
+func (connection *redisConnection) PruneOrphanedKeys() (int, error) {
+	orphaned, err := connection.FindOrphanedKeys()
+	if err != nil || len(orphaned) == 0 {
+		return 0, err
+	}
+
+	deleted := 0
+	for len(orphaned) > 0 {
+		n := len(orphaned)
+		if n > scanBatchSize {
+			n = scanBatchSize
+		}
+		results := make([]*redis.IntCmd, n)
+		pipe := connection.redisClient.Pipeline()
+		for i, key := range orphaned[:n] {
+			results[i] = pipe.Del(key)
+		}
+		if _, err := pipe.Exec(); err != nil {
+			return deleted, err
+		}
+		for _, result := range results {
+			deleted += int(result.Val())
+		}
+		orphaned = orphaned[n:]
+	}
+	return deleted, nil
+}
+
+// members returns the members of the set at key, an empty slice if it
+// doesn't exist
+func (connection *redisConnection) members(key string) ([]string, error) {
+	result := connection.redisClient.SMembers(key)
+	if err := result.Err(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if len(result.Val()) == 0 {
+		return []string{}, nil
+	}
+	return result.Val(), nil
+}
+
+func (connection *redisConnection) mustMembers(members []string, err error) []string {
+	if err != nil {
+		connection.logger.Panicf("rmq redis error is not nil %#v", err)
+	}
+	return members
 }
 
 // heartbeat keeps the heartbeat key alive
 func (connection *redisConnection) heartbeat() {
 	for {
 		if !connection.updateHeartbeat() {
-			// log.Printf("rmq connection failed to update heartbeat %s", connection)
+			connection.logger.debugf("connection failed to update heartbeat %s", connection)
 		}
 
 		time.Sleep(time.Second)
 
 		if connection.heartbeatStopped {
-			// log.Printf("rmq connection stopped heartbeat %s", connection)
+			connection.logger.debugf("connection stopped heartbeat %s", connection)
 			return
 		}
 	}
 }
 
 func (connection *redisConnection) updateHeartbeat() bool {
-	return !redisErrIsNil(connection.redisClient.Set(connection.heartbeatKey, "1", heartbeatDuration))
+	return !connection.logger.redisErrIsNil(connection.redisClient.Set(connection.heartbeatKey, "1", heartbeatDuration))
 }
 
 // hijackConnection reopens an existing connection for inspection purposes without starting a heartbeat
 func (connection *redisConnection) hijackConnection(name string) *redisConnection {
-	return &redisConnection{
-		Name:         name,
-		heartbeatKey: strings.Replace(connectionHeartbeatTemplate, phConnection, name, 1),
-		queuesKey:    strings.Replace(connectionQueuesTemplate, phConnection, name, 1),
-		redisClient:  connection.redisClient,
-	}
+	hijacked := newConnection(connection.prefix, name, connection.redisClient)
+	hijacked.logger = connection.logger
+	hijacked.lmove = connection.lmove
+	hijacked.consumerNaming = connection.consumerNaming
+	return hijacked
 }
 
 // openQueue opens a queue without adding it to the set of queues
 func (connection *redisConnection) openQueue(name string) *redisQueue {
-	return newQueue(name, connection.Name, connection.queuesKey, connection.redisClient)
+	queue := newQueue(connection.prefix, name, connection.Name, connection.queuesKey, connection.redisClient, connection.queueCounters(name))
+	queue.logger = connection.logger
+	queue.lmove = connection.lmove
+	queue.consumerNaming = connection.consumerNaming
+	queue.multiConsumers = connection.multiConsumers
+	return queue
 }
 
 // flushDb flushes the redis database to reset everything, used in tests
@@ -1,5 +1,222 @@
 package rmq
 
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type Consumer interface {
 	Consume(delivery Delivery)
 }
+
+// ConsumerHandle refers to a consumer added with AddConsumerWithHandle
+type ConsumerHandle struct {
+	name       string
+	queue      Queue
+	deliveries int64
+	removed    int32         // set once the consumer got removed
+	removeChan chan struct{} // closed to make the consumer return
+}
+
+func newConsumerHandle(name string, queue Queue) *ConsumerHandle {
+	return &ConsumerHandle{name: name, queue: queue, removeChan: make(chan struct{})}
+}
+
+// Name returns the name of the consumer as returned by AddConsumer
+func (handle *ConsumerHandle) Name() string {
+	return handle.name
+}
+
+// Remove removes the consumer from the consumers of its queue, see
+// RemoveConsumer. The consumer returns once it finished consuming its current
+// delivery, without taking further ones
+func (handle *ConsumerHandle) Remove() bool {
+	if atomic.CompareAndSwapInt32(&handle.removed, 0, 1) {
+		close(handle.removeChan)
+	}
+	return handle.queue.RemoveConsumer(handle.name)
+}
+
+// Deliveries returns the number of deliveries the consumer consumed
+func (handle *ConsumerHandle) Deliveries() int64 {
+	return atomic.LoadInt64(&handle.deliveries)
+}
+
+// consumed counts a consumed delivery unless handle is nil
+func (handle *ConsumerHandle) consumed() {
+	if handle != nil {
+		atomic.AddInt64(&handle.deliveries, 1)
+	}
+}
+
+// removing returns a channel which is closed once the consumer got removed,
+// nil if handle is nil so it never fires
+func (handle *ConsumerHandle) removing() chan struct{} {
+	if handle == nil {
+		return nil
+	}
+	return handle.removeChan
+}
+
+// isRemoved returns true if the consumer got removed, false if handle is nil
+func (handle *ConsumerHandle) isRemoved() bool {
+	return handle != nil && atomic.LoadInt32(&handle.removed) == 1
+}
+
+// RetryError can be returned from the function of an ack consumer to delay the
+// delivery by After instead of rejecting it
+type RetryError struct {
+	After time.Duration
+	Err   error
+}
+
+func (err *RetryError) Error() string {
+	return fmt.Sprintf("rmq retry after %s: %s", err.After, err.Err)
+}
+
+// NewAckConsumer returns a consumer which acks deliveries if consume returns
+// nil, delays them if it returns a *RetryError and rejects them otherwise
+func NewAckConsumer(consume func(delivery Delivery) error) Consumer {
+	return ackConsumer(consume)
+}
+
+type ackConsumer func(delivery Delivery) error
+
+func (consume ackConsumer) Consume(delivery Delivery) {
+	switch err := consume(delivery).(type) {
+	case nil:
+		delivery.Ack()
+	case *RetryError:
+		delivery.Delay(err.After)
+	default:
+		delivery.Reject()
+	}
+}
+
+// taggedConsumer passes its tag to the deliveries it consumes, so they record
+// it when getting rejected, see SetRecordRejectedBy
+type taggedConsumer struct {
+	tag      string
+	consumer Consumer
+}
+
+func (consumer taggedConsumer) Consume(delivery Delivery) {
+	if wrapped, ok := delivery.(*wrapDelivery); ok {
+		wrapped.consumerTag = consumer.tag
+	}
+	consumer.consumer.Consume(delivery)
+}
+
+// Confirmation is passed to the function of a deferred consumer along with
+// each delivery. Confirm acks the delivery and Discard rejects it, both return
+// false if it was confirmed, discarded or timed out before or acking or
+// rejecting failed
+type Confirmation interface {
+	Confirm() bool
+	Discard() bool
+}
+
+// NewDeferredConsumer returns a consumer which passes each delivery to
+// consume along with a confirmation, so it can be acked once an external
+// system confirmed it instead of when consume returns. The consumer waits for
+// the confirmation before consuming the next delivery, deliveries neither
+// confirmed nor discarded within timeout get rejected. Zero waits forever.
+// Use AddConsumerWithConcurrency to wait for several confirmations at once
+func NewDeferredConsumer(timeout time.Duration, consume func(delivery Delivery, confirmation Confirmation)) Consumer {
+	return &deferredConsumer{timeout: timeout, consume: consume}
+}
+
+type deferredConsumer struct {
+	timeout time.Duration
+	consume func(delivery Delivery, confirmation Confirmation)
+}
+
+func (consumer *deferredConsumer) Consume(delivery Delivery) {
+	confirmation := &deferredConfirmation{delivery: delivery, done: make(chan struct{})}
+	consumer.consume(delivery, confirmation)
+
+	if consumer.timeout <= 0 {
+		<-confirmation.done
+		return
+	}
+	timer := time.NewTimer(consumer.timeout)
+	defer timer.Stop()
+	select {
+	case <-confirmation.done:
+	case <-timer.C:
+		confirmation.Discard()
+	}
+}
+
+type deferredConfirmation struct {
+	delivery Delivery
+	once     sync.Once
+	done     chan struct{} // closed once confirmed, discarded or timed out
+}
+
+func (confirmation *deferredConfirmation) Confirm() bool {
+	return confirmation.finish(Acked)
+}
+
+func (confirmation *deferredConfirmation) Discard() bool {
+	return confirmation.finish(Rejected)
+}
+
+// finish acks or rejects the delivery unless it was finished before
+func (confirmation *deferredConfirmation) finish(to State) bool {
+	finished := false
+	confirmation.once.Do(func() {
+		if to == Acked {
+			finished = confirmation.delivery.Ack()
+		} else {
+			finished = confirmation.delivery.Reject()
+		}
+		close(confirmation.done)
+	})
+	return finished
+}
+
+// QueueControl is passed to the function of a controllable consumer so it can
+// stop or pause the queue it consumes from
+type QueueControl interface {
+	StopConsuming() bool
+	Pause() bool
+	Resume() bool
+}
+
+// NewControllableConsumer returns a consumer which passes control over queue
+// to consume along with each delivery, so consume can stop consuming on fatal
+// errors. Once it did, deliveries which were already fetched are returned to
+// ready instead of being consumed
+func NewControllableConsumer(queue Queue, consume func(delivery Delivery, control QueueControl)) Consumer {
+	return &controllableConsumer{queue: queue, consume: consume}
+}
+
+type controllableConsumer struct {
+	queue   Queue
+	consume func(delivery Delivery, control QueueControl)
+	stopped int32
+}
+
+func (consumer *controllableConsumer) Consume(delivery Delivery) {
+	if atomic.LoadInt32(&consumer.stopped) == 1 {
+		delivery.RequeueFront()
+		return
+	}
+	consumer.consume(delivery, consumer)
+}
+
+func (consumer *controllableConsumer) StopConsuming() bool {
+	atomic.StoreInt32(&consumer.stopped, 1)
+	return consumer.queue.StopConsuming()
+}
+
+func (consumer *controllableConsumer) Pause() bool {
+	return consumer.queue.Pause()
+}
+
+func (consumer *controllableConsumer) Resume() bool {
+	return consumer.queue.Resume()
+}
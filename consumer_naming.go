@@ -0,0 +1,72 @@
+package rmq
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/adjust/uniuri"
+)
+
+// defaultConsumerTokenLength is the length of the random token consumer
+// names get by default
+const defaultConsumerTokenLength = 6
+
+// maxConsumerNameAttempts limits how often adding a consumer tries another
+// name if the generated one is taken
+const maxConsumerNameAttempts = 10
+
+// consumerNaming generates the names of consumers from their tags. It's
+// shared by a connection and the queues opened on it, so changes apply to
+// queues opened before
+type consumerNaming struct {
+	lock        sync.RWMutex
+	generator   func(tag string) string // nil for the default names
+	tokenLength int                     // of the random tokens, zero for the default
+}
+
+func (naming *consumerNaming) setGenerator(generator func(tag string) string) {
+	naming.lock.Lock()
+	defer naming.lock.Unlock()
+	naming.generator = generator
+}
+
+func (naming *consumerNaming) setTokenLength(length int) {
+	naming.lock.Lock()
+	defer naming.lock.Unlock()
+	naming.tokenLength = length
+}
+
+// name returns the name of a consumer with the given tag, which is the tag
+// followed by a random token unless a generator is set. Appending a random
+// token to a name taken by another consumer makes it unique, see retry
+func (naming *consumerNaming) name(tag string) string {
+	if naming == nil {
+		return fmt.Sprintf("%s-%s", tag, uniuri.NewLen(defaultConsumerTokenLength))
+	}
+
+	naming.lock.RLock()
+	generator := naming.generator
+	naming.lock.RUnlock()
+	if generator != nil {
+		return generator(tag)
+	}
+	return fmt.Sprintf("%s-%s", tag, naming.token())
+}
+
+// retry returns another name for a consumer whose name was taken
+func (naming *consumerNaming) retry(name string) string {
+	return fmt.Sprintf("%s-%s", name, naming.token())
+}
+
+// token returns a new random token of the configured length
+func (naming *consumerNaming) token() string {
+	length := defaultConsumerTokenLength
+	if naming != nil {
+		naming.lock.RLock()
+		if naming.tokenLength > 0 {
+			length = naming.tokenLength
+		}
+		naming.lock.RUnlock()
+	}
+	return uniuri.NewLen(length)
+}
@@ -0,0 +1,107 @@
+package rmq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestConsumerSuite(t *testing.T) {
+	TestingSuiteT(&ConsumerSuite{}, t)
+}
+
+type ConsumerSuite struct{}
+
+func (suite *ConsumerSuite) TestAckConsumer(c *C) {
+	var consumeErr error
+	consumed := []string{}
+	consumer := NewAckConsumer(func(delivery Delivery) error {
+		consumed = append(consumed, delivery.Payload())
+		return consumeErr
+	})
+
+	delivery := NewTestDeliveryString("ack-d1")
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Acked)
+
+	consumeErr = errors.New("failed")
+	delivery = NewTestDeliveryString("ack-d2")
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Rejected)
+
+	consumeErr = &RetryError{After: time.Second, Err: errors.New("busy")}
+	delivery = NewTestDeliveryString("ack-d3")
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Delayed)
+	c.Check(consumeErr, ErrorMatches, "rmq retry after 1s: busy")
+
+	c.Check(consumed, DeepEquals, []string{"ack-d1", "ack-d2", "ack-d3"})
+}
+
+func (suite *ConsumerSuite) TestDeferredConsumer(c *C) {
+	confirmations := make(chan Confirmation, 1)
+	consumer := NewDeferredConsumer(50*time.Millisecond, func(delivery Delivery, confirmation Confirmation) {
+		confirmations <- confirmation // confirmed by the external system later
+	})
+
+	// confirm
+	delivery := NewTestDeliveryString("deferred-d1")
+	consumed := make(chan struct{})
+	go func() {
+		consumer.Consume(delivery)
+		close(consumed)
+	}()
+	confirmation := <-confirmations
+	c.Check(closedWithin(consumed, 10*time.Millisecond), Equals, false) // waits for the confirmation
+	c.Check(delivery.State, Equals, Unacked)
+	c.Check(confirmation.Confirm(), Equals, true)
+	c.Check(closedWithin(consumed, time.Second), Equals, true)
+	c.Check(delivery.State, Equals, Acked)
+	c.Check(confirmation.Discard(), Equals, false) // finished already
+
+	// discard
+	delivery = NewTestDeliveryString("deferred-d2")
+	go func() { (<-confirmations).Discard() }()
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Rejected)
+
+	// timeout
+	delivery = NewTestDeliveryString("deferred-d3")
+	start := time.Now()
+	consumer.Consume(delivery)
+	c.Check(time.Since(start) >= 50*time.Millisecond, Equals, true)
+	c.Check(delivery.State, Equals, Rejected)
+	c.Check((<-confirmations).Confirm(), Equals, false) // too late
+	c.Check(delivery.State, Equals, Rejected)
+}
+
+func (suite *ConsumerSuite) TestControllableConsumer(c *C) {
+	queue := NewTestQueue("controllable-q")
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("controllable-d%d", i)), Equals, true)
+	}
+
+	consumed := []string{}
+	consumer := NewControllableConsumer(queue, func(delivery Delivery, control QueueControl) {
+		consumed = append(consumed, delivery.Payload())
+		delivery.Ack()
+		if len(consumed) == 3 {
+			c.Check(control.StopConsuming(), Equals, true)
+		}
+	})
+	queue.AddConsumer("controllable-cons", consumer)
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+
+	c.Check(consumed, DeepEquals, []string{"controllable-d0", "controllable-d1", "controllable-d2"})
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.Poll(), Equals, 0)
+
+	// deliveries fetched before stopping go back to ready
+	delivery := NewTestDeliveryString("controllable-d5")
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Requeued)
+	c.Check(consumed, HasLen, 3)
+}
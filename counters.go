@@ -0,0 +1,84 @@
+package rmq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// QueueCounters holds the number of operations performed on a queue through a
+// connection. They are counted in process, so reading them doesn't require a
+// redis round trip, but they don't include operations of other connections
+type QueueCounters struct {
+	Published int64 `json:"published"`
+	Consumed  int64 `json:"consumed"`
+	Acked     int64 `json:"acked"`
+	Rejected  int64 `json:"rejected"`
+	Delayed   int64 `json:"delayed"`
+	Pushed    int64 `json:"pushed"`
+	Requeued  int64 `json:"requeued"`
+	Expired   int64 `json:"expired"` // dropped on consume because their TTL passed
+
+	// how late delayed deliveries became ready compared to their schedule
+	DelayLagCount int64         `json:"delay_lag_count"` // number of delayed deliveries the lag was measured for
+	DelayLagTotal time.Duration `json:"delay_lag_total"`
+	DelayLagMax   time.Duration `json:"delay_lag_max"`
+}
+
+// snapshot returns a copy of the counters which is safe to read
+func (counters *QueueCounters) snapshot() QueueCounters {
+	return QueueCounters{
+		Published: atomic.LoadInt64(&counters.Published),
+		Consumed:  atomic.LoadInt64(&counters.Consumed),
+		Acked:     atomic.LoadInt64(&counters.Acked),
+		Rejected:  atomic.LoadInt64(&counters.Rejected),
+		Delayed:   atomic.LoadInt64(&counters.Delayed),
+		Pushed:    atomic.LoadInt64(&counters.Pushed),
+		Requeued:  atomic.LoadInt64(&counters.Requeued),
+		Expired:   atomic.LoadInt64(&counters.Expired),
+
+		DelayLagCount: atomic.LoadInt64(&counters.DelayLagCount),
+		DelayLagTotal: time.Duration(atomic.LoadInt64((*int64)(&counters.DelayLagTotal))),
+		DelayLagMax:   time.Duration(atomic.LoadInt64((*int64)(&counters.DelayLagMax))),
+	}
+}
+
+// DelayLagAvg returns the average lag of delayed deliveries, zero if none
+// became ready yet
+func (counters QueueCounters) DelayLagAvg() time.Duration {
+	if counters.DelayLagCount == 0 {
+		return 0
+	}
+	return counters.DelayLagTotal / time.Duration(counters.DelayLagCount)
+}
+
+// StateCounts returns the number of deliveries which ended up in each state
+// other than Unacked, use State.String() to label them
+func (counters QueueCounters) StateCounts() map[State]int64 {
+	return map[State]int64{
+		Acked:    counters.Acked,
+		Rejected: counters.Rejected,
+		Delayed:  counters.Delayed,
+		Pushed:   counters.Pushed,
+		Requeued: counters.Requeued,
+	}
+}
+
+// delayLag records how late a delayed delivery became ready
+func (counters *QueueCounters) delayLag(lag time.Duration) {
+	atomic.AddInt64(&counters.DelayLagCount, 1)
+	atomic.AddInt64((*int64)(&counters.DelayLagTotal), int64(lag))
+	for {
+		max := atomic.LoadInt64((*int64)(&counters.DelayLagMax))
+		if int64(lag) <= max || atomic.CompareAndSwapInt64((*int64)(&counters.DelayLagMax), max, int64(lag)) {
+			return
+		}
+	}
+}
+
+// count increments the given counter if the operation succeeded and returns ok
+func count(counter *int64, ok bool) bool {
+	if ok {
+		atomic.AddInt64(counter, 1)
+	}
+	return ok
+}
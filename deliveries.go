@@ -1,23 +1,124 @@
 package rmq
 
+import "github.com/go-redis/redis"
+
 type Deliveries []Delivery
 
-func (deliveries Deliveries) Ack() int {
+// Ack acks all deliveries and returns the number of failed acks, along with
+// the first redis error. Deliveries which weren't unacked anymore count as
+// failed without error. Deliveries from the same connection are acked in a
+// single round trip, each like Delivery.AckE
+func (deliveries Deliveries) Ack() (int, error) {
 	failedCount := 0
-	for _, delivery := range deliveries {
-		if !delivery.Ack() {
-			failedCount++
+	var firstErr error
+	for client, batch := range deliveries.byClient() {
+		if client == nil { // no redis deliveries, ack one by one
+			for _, delivery := range batch.others {
+				if err := delivery.AckE(); err != nil {
+					failedCount++
+					firstErr = firstError(firstErr, err)
+				}
+			}
+			continue
+		}
+
+		results := make([]*redis.Cmd, len(batch.deliveries))
+		pipe := client.Pipeline()
+		for i, delivery := range batch.deliveries {
+			results[i] = delivery.ack(pipe)
+		}
+		pipe.Exec() // errors are checked per command below
+
+		for i, result := range results {
+			if err := batch.deliveries[i].acked(result); err != nil {
+				failedCount++
+				firstErr = firstError(firstErr, err)
+			}
 		}
 	}
-	return failedCount
+	return failedCount, firstErr
 }
 
-func (deliveries Deliveries) Reject() int {
+// Reject rejects all deliveries and returns the number of failed rejects,
+// along with the first redis error. Deliveries from the same connection are
+// rejected in a single round trip, each like Delivery.Reject
+func (deliveries Deliveries) Reject() (int, error) {
 	failedCount := 0
+	var firstErr error
+	for client, batch := range deliveries.byClient() {
+		if client == nil { // no redis deliveries, reject one by one
+			for _, delivery := range batch.others {
+				if !delivery.Reject() {
+					failedCount++
+				}
+			}
+			continue
+		}
+
+		results := make([]*redis.Cmd, len(batch.deliveries))
+		pipe := client.Pipeline()
+		for i, delivery := range batch.deliveries {
+			key, payload := delivery.rejectTarget()
+			results[i] = delivery.moveTo(pipe, key, payload)
+		}
+		pipe.Exec() // errors are checked per command below
+
+		for i, result := range results {
+			delivery := batch.deliveries[i]
+			moved, err := delivery.moved(result)
+			firstErr = firstError(firstErr, err)
+			if !delivery.changedState(Rejected, count(&delivery.counters.Rejected, moved)) {
+				failedCount++
+			}
+		}
+	}
+	return failedCount, firstErr
+}
+
+// firstError returns first unless it's nil, err otherwise unless it only
+// says the delivery wasn't found
+func firstError(first, err error) error {
+	if first != nil || err == ErrDeliveryNotFound {
+		return first
+	}
+	return err
+}
+
+// AckAll acks the given deliveries like Deliveries.Ack and returns the number
+// of acked ones, along with the first redis error. Deliveries from the same
+// connection are acked in a single round trip
+func AckAll(deliveries []Delivery) (int, error) {
+	failed, err := Deliveries(deliveries).Ack()
+	return len(deliveries) - failed, err
+}
+
+type deliveryBatch struct {
+	deliveries []*wrapDelivery
+	others     []Delivery // deliveries not backed by redis
+}
+
+// byClient groups the deliveries by their redis client so they can be
+// pipelined, other deliveries are grouped under the nil client
+func (deliveries Deliveries) byClient() map[redis.UniversalClient]*deliveryBatch {
+	batches := map[redis.UniversalClient]*deliveryBatch{}
 	for _, delivery := range deliveries {
-		if !delivery.Reject() {
-			failedCount++
+		wrapped, ok := delivery.(*wrapDelivery)
+		var client redis.UniversalClient
+		if ok {
+			client = wrapped.redisClient
+		}
+
+		batch, ok := batches[client]
+		if !ok {
+			batch = &deliveryBatch{}
+			batches[client] = batch
+		}
+
+		if client == nil {
+			batch.others = append(batch.others, delivery)
+		} else {
+			batch.deliveries = append(batch.deliveries, wrapped)
 		}
 	}
-	return failedCount
+	return batches
 }
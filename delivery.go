@@ -1,6 +1,8 @@
 package rmq
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -9,92 +11,479 @@ import (
 
 type Delivery interface {
 	Payload() string
+	Queue() string
+	Context() context.Context
+	Expired() bool
+	Age() time.Duration
+	Message() Message
+	DeliveryCount() int
+	Headers() map[string]string
 	Ack() bool
+	AckE() error
 	Delay(time.Duration) bool
 	Reject() bool
 	Push() bool
+	Requeue() bool
+	RequeueFront() bool
+	Retry(backoff time.Duration, maxAttempts int, dlq Queue) (State, error)
 }
 
+// ErrDeliveryNotFound is returned when acking a delivery which isn't unacked
+// anymore, because it got acked before or returned by the cleaner for example
+var ErrDeliveryNotFound = errors.New("rmq delivery not found in unacked")
+
 type wrapDelivery struct {
-	payload     string
+	queueName   string   // name of the queue the delivery was consumed from
+	payload     string   // as stored in redis, possibly wrapped in an envelope
+	envelope    Envelope // converts messages to the values stored in redis
+	logger      *logging // shared with the queue, nil logs to the standard logger
+	message     Message  // unwrapped payload
+	ctx         context.Context
+	fetchedAt   time.Time // when the delivery got picked up
+	consumerTag string    // tag of the consumer consuming the delivery, only set if recorded on reject
+	state       State     // Unacked, or Inspected if taken out of rejected by RejectedDeliveries
 	unackedKey  string
 	delayedKey  string
 	rejectedKey string
 	pushKey     string
 	redisClient redis.UniversalClient
+	counters    *QueueCounters
+
+	readyKey      string // ready list of the priority it was fetched from, empty for deliveries which can't be requeued
+	deadlinesKey  string // sorted set of visibility deadlines, empty for deliveries not consumed from a queue
+	deadline      string // member of the visibility deadline in deadlinesKey, empty if the delivery has none
+	deadLetterKey string // if set deliveries rejected maxAttempts times get pushed there
+	maxAttempts   int
+
+	maxRejected    int // zero for no limit
+	rejectedPolicy RejectedPolicy
+	maxPushHops    int // deliveries pushed more often get rejected, zero for no limit
+
+	onStateChange func(payload string, from, to State)                   // nil unless set on the queue
+	onProcessed   func(payload string, to State, duration time.Duration) // nil unless set on the queue
+	lpos          *serverSupport                                         // nil for deliveries not consumed from a queue
+	delayedWakeup chan struct{}                                          // wakes the delayed poller of the queue, nil if not consumed from one
+	serverClock   bool                                                   // if set delays are relative to the time of the redis server
 }
 
-func newDelivery(payload, unackedKey, delayedKey, rejectedKey, pushKey string, redisClient redis.UniversalClient) *wrapDelivery {
+func newDelivery(queueName, payload, unackedKey, delayedKey, rejectedKey, pushKey string, redisClient redis.UniversalClient, counters *QueueCounters) *wrapDelivery {
 	return &wrapDelivery{
+		queueName:   queueName,
 		payload:     payload,
+		envelope:    CompatEnvelope{},
+		message:     unmarshalEnvelope(CompatEnvelope{}, payload),
+		ctx:         context.Background(),
+		fetchedAt:   time.Now(),
 		unackedKey:  unackedKey,
 		delayedKey:  delayedKey,
 		rejectedKey: rejectedKey,
 		pushKey:     pushKey,
 		redisClient: redisClient,
+		counters:    counters,
 	}
 }
 
+// inspect turns the delivery into one taken out of rejected for inspection,
+// which lives in the inspected list at key. Its moves are reported from the
+// Inspected state and not counted as the queue's, as it wasn't consumed, and
+// rejecting puts it back to rejected as is, without attempts or dead letters
+func (delivery *wrapDelivery) inspect(key string) {
+	delivery.state = Inspected
+	delivery.unackedKey = key
+	delivery.deadlinesKey = ""
+	delivery.deadLetterKey = ""
+	delivery.counters = &QueueCounters{}
+}
+
 func (delivery *wrapDelivery) String() string {
 	return fmt.Sprintf("[%s %s]", delivery.payload, delivery.unackedKey)
 }
 
 func (delivery *wrapDelivery) Payload() string {
-	return delivery.payload
+	return delivery.message.Payload
 }
 
-func (delivery *wrapDelivery) Ack() bool {
-	// debug(fmt.Sprintf("delivery ack %s", delivery)) // COMMENTOUT
+// Queue returns the name of the queue the delivery was consumed from
+func (delivery *wrapDelivery) Queue() string {
+	return delivery.queueName
+}
+
+// Context returns the context of the consume span if the delivery was
+// published with a trace context, the background context otherwise
+func (delivery *wrapDelivery) Context() context.Context {
+	return delivery.ctx
+}
+
+// Expired returns true if the delivery was published with a TTL which passed
+func (delivery *wrapDelivery) Expired() bool {
+	return delivery.message.Expires != 0 && time.Now().UnixNano() > delivery.message.Expires
+}
+
+// Age returns how long ago the delivery got picked up from ready
+func (delivery *wrapDelivery) Age() time.Duration {
+	return time.Since(delivery.fetchedAt)
+}
 
-	result := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload)
-	if redisErrIsNil(result) {
+// Message returns the payload along with the metadata kept by the envelope
+func (delivery *wrapDelivery) Message() Message {
+	return delivery.message
+}
+
+// DeliveryCount returns how often the delivery got returned from unacked to
+// ready before, by ReturnAllUnacked, the cleaner or the visibility timeout.
+// It's zero on the first delivery and for payloads stored without the JSON
+// envelope, like plain payloads published by other clients and values of
+// custom envelopes, as the count is kept in the envelope
+func (delivery *wrapDelivery) DeliveryCount() int {
+	return delivery.message.Returns
+}
+
+// Headers returns the headers the delivery was published with, nil if there
+// were none
+func (delivery *wrapDelivery) Headers() map[string]string {
+	return delivery.message.Headers
+}
+
+// marshal returns the value of the message with updated metadata. If the
+// envelope fails to marshal it the metadata is lost and the value as fetched
+// is returned, so the delivery itself doesn't get lost
+func (delivery *wrapDelivery) marshal(message Message) string {
+	value, err := delivery.envelope.Marshal(message)
+	if err != nil {
+		delivery.logger.Printf("rmq delivery failed to marshal %s: %s", delivery, err)
+		return delivery.payload
+	}
+	return value
+}
+
+func (delivery *wrapDelivery) Ack() bool {
+	switch err := delivery.AckE(); err {
+	case nil:
+		return true
+	case ErrDeliveryNotFound:
+		return false
+	default:
+		delivery.logger.Printf("rmq delivery failed to ack %s: %s", delivery, err)
 		return false
 	}
+}
 
-	return result.Val() == 1
+// AckE is similar to Ack, but returns why acking failed. Deliveries stored with
+// an id, see JSONEnvelope, remove exactly this delivery from unacked even if
+// others with the same payload are unacked too. Plain payloads without id
+// remove the occurrence fetched first instead if redis supports LPOS (6.0.6 or
+// later)
+func (delivery *wrapDelivery) AckE() error {
+	delivery.logger.debugf("delivery ack %s", delivery)
+	return delivery.acked(delivery.ack(delivery.redisClient))
+}
+
+// forgetDeadlineLua defines the lua function forgetDeadline(key, member)
+// which removes the visibility deadline member from the sorted set at key. The
+// scripts moving deliveries out of unacked call it, deliveries without
+// deadline pass an empty member
+const forgetDeadlineLua = `local function forgetDeadline(key, member)
+    if member ~= '' then
+        redis.call('zrem', key, member)
+    end
+end
+`
+
+// ackScript removes one occurrence of ARGV[1] from the unacked list at KEYS[1]
+// along with its visibility deadline ARGV[2] in the sorted set at KEYS[2] and
+// returns the number of removed occurrences
+const ackScript = forgetDeadlineLua + `local removed = redis.call('lrem', KEYS[1], 1, ARGV[1])
+if removed == 1 then
+    forgetDeadline(KEYS[2], ARGV[2])
+end
+return removed`
+
+// ack sends the script removing the delivery from unacked to cmdable, which
+// is the redis client or a pipeline acking several deliveries at once. Plain
+// payloads remove the occurrence closest to the tail using LPOS if supported,
+// so acking duplicate payloads removes them in the order they were fetched
+func (delivery *wrapDelivery) ack(cmdable redis.Cmdable) *redis.Cmd {
+	keys := []string{delivery.unackedKey, delivery.deadlineKey()}
+	if delivery.message.ID == "" && delivery.lpos.check(delivery.redisClient) {
+		return cmdable.Eval(ackLastScript, keys, delivery.payload, delivery.deadline, ackedTombstone)
+	}
+	return cmdable.Eval(ackScript, keys, delivery.payload, delivery.deadline)
+}
+
+// deadlineKey returns the key of the visibility deadlines to pass to the
+// scripts moving the delivery out of unacked. Deliveries not consumed from a
+// queue have no deadline, they pass their unacked key so all keys of the
+// scripts stay in the same cluster slot
+func (delivery *wrapDelivery) deadlineKey() string {
+	if delivery.deadlinesKey == "" {
+		return delivery.unackedKey
+	}
+	return delivery.deadlinesKey
+}
+
+// acked checks the result of ack and counts the delivery as acked if it got
+// removed from unacked
+func (delivery *wrapDelivery) acked(result *redis.Cmd) error {
+	if err := result.Err(); err != nil && err != redis.Nil {
+		return keyTypeError(err, delivery.unackedKey)
+	}
+	if removed, _ := result.Val().(int64); removed != 1 {
+		return ErrDeliveryNotFound
+	}
+
+	delivery.changedState(Acked, count(&delivery.counters.Acked, true))
+	return nil
 }
 
 func (delivery *wrapDelivery) Delay(duration time.Duration) bool {
-	zAddResult := delivery.redisClient.ZAdd(
-		delivery.delayedKey,
-		redis.Z{
-			Score:  float64(time.Now().Add(duration).UnixNano()),
-			Member: delivery.payload,
-		},
+	return delivery.changedState(Delayed, count(&delivery.counters.Delayed, delivery.delay(duration, delivery.payload)))
+}
+
+// changedState calls the state change and processed hooks if the delivery
+// changed from unacked to the given state, returns changed
+func (delivery *wrapDelivery) changedState(to State, changed bool) bool {
+	if changed && delivery.onStateChange != nil {
+		delivery.onStateChange(delivery.message.Payload, delivery.state, to)
+	}
+	if changed && delivery.onProcessed != nil && delivery.state == Unacked {
+		delivery.onProcessed(delivery.message.Payload, to, delivery.Age())
+	}
+	return changed
+}
+
+// now returns the current time, of the redis server if the queue of the
+// delivery uses its clock
+func (delivery *wrapDelivery) now() time.Time {
+	if !delivery.serverClock {
+		return time.Now()
+	}
+	return serverTime(delivery.redisClient, delivery.delayedKey, delivery.logger)
+}
+
+// delay moves the delivery from unacked to delayed as payload in a single
+// script, so it can't end up in both. Returns false if the delivery wasn't
+// unacked anymore or the script failed, in which case nothing changed
+func (delivery *wrapDelivery) delay(duration time.Duration, payload string) bool {
+	result := delivery.redisClient.Eval(
+		forgetDeadlineLua+`if redis.call('lrem', KEYS[1], 1, ARGV[1]) == 0 then
+    return 0
+end
+forgetDeadline(KEYS[3], ARGV[4])
+redis.call('zadd', KEYS[2], ARGV[2], ARGV[3])
+return 1`,
+		[]string{delivery.unackedKey, delivery.delayedKey, delivery.deadlineKey()},
+		delivery.payload,
+		delivery.now().Add(duration).UnixNano(),
+		payload,
+		delivery.deadline,
 	)
-	if redisErrIsNil(zAddResult) {
+	if result.Err() != nil {
 		return false
 	}
+	delayed, _ := result.Val().(int64)
+	if delayed == 1 {
+		wakeDelayed(delivery.delayedWakeup)
+	}
+	return delayed == 1
+}
 
-	lRemResult := delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload)
-	if redisErrIsNil(lRemResult) {
-		return false
+// requeueFrontScript moves ARGV[1] from the unacked list at KEYS[1] to the
+// consuming end of the ready list at KEYS[2], unless it isn't unacked anymore,
+// and removes its visibility deadline ARGV[2] from the sorted set at KEYS[3].
+// Returns the number of moved deliveries
+const requeueFrontScript = forgetDeadlineLua + `if redis.call('lrem', KEYS[1], 1, ARGV[1]) == 0 then
+    return 0
+end
+forgetDeadline(KEYS[3], ARGV[2])
+redis.call('rpush', KEYS[2], ARGV[1])
+return 1`
+
+// requeueScript is similar to requeueFrontScript, but moves ARGV[1] to the
+// newest end of the ready list like newly published deliveries
+const requeueScript = forgetDeadlineLua + `if redis.call('lrem', KEYS[1], 1, ARGV[1]) == 0 then
+    return 0
+end
+forgetDeadline(KEYS[3], ARGV[2])
+redis.call('lpush', KEYS[2], ARGV[1])
+return 1`
+
+// maxRetryBackoff limits the delay of retried deliveries, so doubling the
+// backoff for many attempts can't overflow
+const maxRetryBackoff = 24 * time.Hour
+
+// retryBackoff returns backoff doubled for each previous attempt, at most
+// maxRetryBackoff
+func retryBackoff(backoff time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && backoff > 0 && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
 	}
+	if backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// Retry delays the delivery by backoff, doubled for each previous attempt up
+// to a day. Once it got retried more than maxAttempts times it gets moved to
+// the ready list of dlq instead, or to rejected if dlq is nil. Returns the new
+// state
+func (delivery *wrapDelivery) Retry(backoff time.Duration, maxAttempts int, dlq Queue) (State, error) {
+	retried := delivery.message
+	retried.Attempts++
 
-	return zAddResult.Val() == 1 && lRemResult.Val() == 1
+	if retried.Attempts <= maxAttempts {
+		if !delivery.changedState(Delayed, count(&delivery.counters.Delayed, delivery.delay(retryBackoff(backoff, retried.Attempts), delivery.marshal(retried)))) {
+			return delivery.state, fmt.Errorf("rmq delivery failed to delay %s", delivery)
+		}
+		return Delayed, nil
+	}
+
+	if dlq == nil {
+		if !delivery.changedState(Rejected, count(&delivery.counters.Rejected, delivery.move(delivery.rejectedKey, delivery.marshal(retried)))) {
+			return delivery.state, fmt.Errorf("rmq delivery failed to reject %s", delivery)
+		}
+		return Rejected, nil
+	}
+
+	redisDlq, ok := dlq.(*redisQueue)
+	if !ok {
+		return delivery.state, fmt.Errorf("rmq delivery %s can't be moved to %T, only to queues opened from a connection", delivery, dlq)
+	}
+	if !delivery.changedState(Pushed, count(&delivery.counters.Pushed, delivery.move(redisDlq.readyKey, delivery.marshal(retried)))) {
+		return delivery.state, fmt.Errorf("rmq delivery failed to move %s to %s", delivery, redisDlq)
+	}
+	return Pushed, nil
 }
 
 func (delivery *wrapDelivery) Reject() bool {
-	return delivery.move(delivery.rejectedKey)
+	key, payload := delivery.rejectTarget()
+	return delivery.changedState(Rejected, count(&delivery.counters.Rejected, delivery.move(key, payload)))
 }
 
+// rejectTarget returns the key of the list to move the rejected delivery to
+// and its payload. With a dead letter queue the number of attempts is kept in
+// the payload and the delivery goes to the dead letter queue after the last.
+// The tag of the consuming consumer is kept in the payload if it's recorded
+func (delivery *wrapDelivery) rejectTarget() (key, payload string) {
+	rejected := delivery.message
+	if delivery.consumerTag != "" {
+		rejected.RejectedBy = delivery.consumerTag
+	}
+	if delivery.deadLetterKey == "" {
+		if delivery.consumerTag == "" {
+			return delivery.rejectedKey, delivery.payload
+		}
+		return delivery.rejectedKey, delivery.marshal(rejected)
+	}
+
+	rejected.Attempts++
+	if rejected.Attempts >= delivery.maxAttempts {
+		return delivery.deadLetterKey, delivery.marshal(rejected)
+	}
+	return delivery.rejectedKey, delivery.marshal(rejected)
+}
+
+// Push moves the delivery to the push queue, counting the hops in its
+// payload. Deliveries pushed more than maxPushHops times, probably in a cycle
+// of push queues, and deliveries of queues without push queue get rejected
 func (delivery *wrapDelivery) Push() bool {
-	if delivery.pushKey != "" {
-		return delivery.move(delivery.pushKey)
-	} else {
-		return delivery.move(delivery.rejectedKey)
+	pushed := delivery.message
+	pushed.Hops++
+	if delivery.pushKey == "" || (delivery.maxPushHops > 0 && pushed.Hops > delivery.maxPushHops) {
+		return delivery.changedState(Rejected, count(&delivery.counters.Rejected, delivery.move(delivery.rejectedKey, delivery.payload)))
 	}
+	return delivery.changedState(Pushed, count(&delivery.counters.Pushed, delivery.move(delivery.pushKey, delivery.marshal(pushed))))
 }
 
-func (delivery *wrapDelivery) move(key string) bool {
-	if redisErrIsNil(delivery.redisClient.LPush(key, delivery.payload)) {
+// Requeue moves the delivery back to the ready list like a newly published
+// one, so it gets consumed again after the other ready deliveries of its
+// priority, unlike RequeueFront which puts it before them. Like RequeueFront
+// it only moves deliveries which are still unacked, in a single atomic step
+func (delivery *wrapDelivery) Requeue() bool {
+	if delivery.readyKey == "" {
 		return false
 	}
 
-	if redisErrIsNil(delivery.redisClient.LRem(delivery.unackedKey, 1, delivery.payload)) {
+	result := delivery.redisClient.Eval(requeueScript, []string{delivery.unackedKey, delivery.readyKey, delivery.deadlineKey()}, delivery.payload, delivery.deadline)
+	if delivery.logger.redisErrIsNil(result) {
 		return false
 	}
+	requeued, _ := result.Val().(int64)
+	return delivery.changedState(Requeued, count(&delivery.counters.Requeued, requeued == 1))
+}
 
-	// debug(fmt.Sprintf("delivery rejected %s", delivery)) // COMMENTOUT
-	return true
+// RequeueFront moves the delivery back to the consume end of the ready list of
+// its priority, so it gets consumed again before all other ready deliveries of
+// that priority unlike returned rejected deliveries, which get consumed after
+// those. Like Requeue it only moves deliveries which are still unacked
+func (delivery *wrapDelivery) RequeueFront() bool {
+	if delivery.readyKey == "" {
+		return false
+	}
+
+	result := delivery.redisClient.Eval(requeueFrontScript, []string{delivery.unackedKey, delivery.readyKey, delivery.deadlineKey()}, delivery.payload, delivery.deadline)
+	if delivery.logger.redisErrIsNil(result) {
+		return false
+	}
+	requeued, _ := result.Val().(int64)
+	return delivery.changedState(Requeued, count(&delivery.counters.Requeued, requeued == 1))
+}
+
+// move moves the delivery from unacked to the list at key as payload in a
+// single script, so it can't end up in both lists. Returns false if it wasn't
+// unacked anymore, or if key is the rejected list and it's full
+func (delivery *wrapDelivery) move(key, payload string) bool {
+	moved, err := delivery.moved(delivery.moveTo(delivery.redisClient, key, payload))
+	if err != nil {
+		delivery.logger.Printf("rmq delivery failed to move %s: %s", delivery, err)
+	}
+	if moved {
+		delivery.logger.debugf("delivery rejected %s", delivery)
+	}
+	return moved
+}
+
+// moveScript moves ARGV[2] from the unacked list at KEYS[2] to the list at
+// KEYS[1] as ARGV[1] and removes its visibility deadline ARGV[5] from the
+// sorted set at KEYS[3]. If ARGV[3] is positive the list is limited to that
+// many entries, by refusing the move or by dropping the oldest entries
+// depending on ARGV[4]. Returns the number of moved deliveries
+const moveScript = forgetDeadlineLua + `local limit = tonumber(ARGV[3])
+if limit > 0 and ARGV[4] == 'refuse' and redis.call('llen', KEYS[1]) >= limit then
+    return 0
+end
+if redis.call('lrem', KEYS[2], 1, ARGV[2]) == 0 then
+    return 0
+end
+forgetDeadline(KEYS[3], ARGV[5])
+redis.call('lpush', KEYS[1], ARGV[1])
+if limit > 0 and ARGV[4] == 'trim' then
+    redis.call('ltrim', KEYS[1], 0, limit - 1)
+end
+return 1`
+
+// moveTo sends the script moving the delivery to the list at key as payload
+// to cmdable, which is the redis client or a pipeline moving several
+// deliveries at once. Only the rejected list is limited, see SetMaxRejected
+func (delivery *wrapDelivery) moveTo(cmdable redis.Cmdable, key, payload string) *redis.Cmd {
+	limit, policy := 0, ""
+	if key == delivery.rejectedKey && delivery.maxRejected > 0 {
+		limit = delivery.maxRejected
+		switch delivery.rejectedPolicy {
+		case RefuseNewRejected:
+			policy = "refuse"
+		case DropOldestRejected:
+			policy = "trim"
+		}
+	}
+	return cmdable.Eval(moveScript, []string{key, delivery.unackedKey, delivery.deadlineKey()}, payload, delivery.payload, limit, policy, delivery.deadline)
+}
+
+// moved returns true if the script sent by moveTo moved the delivery
+func (delivery *wrapDelivery) moved(result *redis.Cmd) (bool, error) {
+	if err := result.Err(); err != nil && err != redis.Nil {
+		return false, keyTypeError(err, delivery.unackedKey)
+	}
+	moved, _ := result.Val().(int64)
+	return moved == 1, nil
 }
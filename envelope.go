@@ -0,0 +1,156 @@
+package rmq
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/adjust/uniuri"
+)
+
+// envelopePrefix marks payloads which are wrapped in an envelope to carry
+// metadata along with the payload. Payloads without it are delivered as is
+const envelopePrefix = "rmq::envelope::"
+
+// Envelope converts between messages and the values stored in redis. Set the
+// same envelope on the producers and the consumers of a queue with SetEnvelope
+type Envelope interface {
+	Marshal(message Message) (string, error)
+	Unmarshal(value string) (Message, error)
+}
+
+// Message is a payload along with the metadata rmq keeps for it. Features
+// relying on metadata an envelope doesn't keep don't work with that envelope
+type Message struct {
+	ID         string            `json:"id,omitempty"` // makes deliveries with equal payloads distinguishable
+	Payload    string            `json:"payload"`
+	Trace      map[string]string `json:"trace,omitempty"`       // trace context injected on publish
+	Expires    int64             `json:"expires,omitempty"`     // unix nanoseconds after which the delivery is dropped
+	EnqueuedAt int64             `json:"enqueued,omitempty"`    // unix nanoseconds when the delivery got published
+	Attempts   int               `json:"attempts,omitempty"`    // number of failed attempts to consume the delivery
+	Hops       int               `json:"hops,omitempty"`        // number of times the delivery got pushed
+	Headers    map[string]string `json:"headers,omitempty"`     // set on publish, kept when the delivery moves
+	RejectedBy string            `json:"rejected_by,omitempty"` // tag of the consumer which rejected the delivery, see SetRecordRejectedBy
+	Returns    int               `json:"returns,omitempty"`     // number of times the delivery got returned from unacked to ready, must stay last
+}
+
+// CompatEnvelope is the default envelope, it stores payloads without metadata
+// as is, so consumers of older rmq versions and other clients can still read
+// them. Messages with metadata like TTLs, headers or attempts are stored like
+// JSONEnvelope does. Ids and publish times aren't kept, so deliveries with
+// equal payloads published without metadata can't be told apart and their
+// delivery counts aren't kept
+type CompatEnvelope struct{}
+
+func (CompatEnvelope) Marshal(message Message) (string, error) {
+	if message.plain() {
+		return message.Payload, nil
+	}
+	return JSONEnvelope{}.Marshal(message)
+}
+
+func (CompatEnvelope) Unmarshal(value string) (Message, error) {
+	return JSONEnvelope{}.Unmarshal(value)
+}
+
+// plain returns whether the message carries no metadata except its id and
+// publish time, and its payload can't be mistaken for an envelope
+func (message Message) plain() bool {
+	return len(message.Trace) == 0 && message.Expires == 0 && message.Attempts == 0 &&
+		message.Hops == 0 && len(message.Headers) == 0 && message.RejectedBy == "" &&
+		message.Returns == 0 && !strings.HasPrefix(message.Payload, envelopePrefix)
+}
+
+// JSONEnvelope keeps all metadata by storing messages as prefixed JSON, so
+// each delivery keeps its id even if other deliveries have the same payload.
+// Values without the prefix, like the ones published by other clients, are
+// unmarshalled as plain payloads. Consumers of older rmq versions receive the
+// prefixed JSON as payload, so update all consumers before opting in
+type JSONEnvelope struct{}
+
+func (JSONEnvelope) Marshal(message Message) (string, error) {
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	return envelopePrefix + string(bytes), nil
+}
+
+func (JSONEnvelope) Unmarshal(value string) (Message, error) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return Message{Payload: value}, nil
+	}
+
+	var message Message
+	if err := json.Unmarshal([]byte(value[len(envelopePrefix):]), &message); err != nil {
+		return Message{Payload: value}, err
+	}
+	return message, nil
+}
+
+// RawEnvelope stores plain payloads without metadata, for queues shared with
+// clients which don't understand envelopes. Deliveries with equal payloads
+// can't be told apart and TTLs, traces, headers, attempts, push hops and
+// delivery counts aren't kept
+type RawEnvelope struct{}
+
+func (RawEnvelope) Marshal(message Message) (string, error) {
+	return message.Payload, nil
+}
+
+func (RawEnvelope) Unmarshal(value string) (Message, error) {
+	return Message{Payload: value}, nil
+}
+
+// returnedLua defines the lua function returned(value) which returns value
+// with the returns count of its envelope incremented. The envelope is decoded
+// to read the count, but only the count at its end is rewritten, so the other
+// fields aren't reformatted by cjson. Values which aren't a JSON object with
+// the envelope prefix, like plain payloads and values of envelopes other than
+// JSONEnvelope, and envelopes whose count isn't the last field are returned
+// unchanged, so their delivery count stays zero
+const returnedLua = `local function returned(value)
+    if string.sub(value, 1, #ARGV[1]) ~= ARGV[1] or string.sub(value, #ARGV[1] + 1, #ARGV[1] + 1) ~= '{' then
+        return value
+    end
+    local ok, message = pcall(cjson.decode, string.sub(value, #ARGV[1] + 1))
+    if not ok or type(message) ~= 'table' then
+        return value
+    end
+    if message['returns'] == nil then
+        if next(message) == nil then
+            return ARGV[1] .. '{"returns":1}'
+        end
+        return string.sub(value, 1, -2) .. ',"returns":1}'
+    end
+    local head, returns = string.match(value, '^(.*),"returns":(%d+)}$')
+    if not head or tonumber(returns) ~= message['returns'] then
+        return value
+    end
+    return head .. ',"returns":' .. (tonumber(returns) + 1) .. '}'
+end
+`
+
+// newMessage returns a message with a new unique id for the given payload
+func newMessage(payload string) Message {
+	return Message{ID: uniuri.NewLen(16), Payload: payload, EnqueuedAt: time.Now().UnixNano()}
+}
+
+// marshal returns the value of the message in JSONEnvelope
+func (message Message) marshal() string {
+	value, err := JSONEnvelope{}.Marshal(message)
+	if err != nil {
+		return message.Payload // can't happen for strings and maps of strings
+	}
+	return value
+}
+
+// unmarshalEnvelope returns the message of the given redis value, values the
+// envelope fails to unmarshal are returned as plain payloads
+func unmarshalEnvelope(envelope Envelope, value string) Message {
+	message, err := envelope.Unmarshal(value)
+	if err != nil {
+		return Message{Payload: value}
+	}
+	return message
+}
@@ -0,0 +1,123 @@
+package rmq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestEnvelopeSuite(t *testing.T) {
+	TestingSuiteT(&EnvelopeSuite{}, t)
+}
+
+type EnvelopeSuite struct{}
+
+func (suite *EnvelopeSuite) TestEnvelope(c *C) {
+	c.Check(unmarshalEnvelope(JSONEnvelope{}, "plain"), DeepEquals, Message{Payload: "plain"})
+	c.Check(unmarshalEnvelope(JSONEnvelope{}, envelopePrefix+"{broken"), DeepEquals, Message{Payload: envelopePrefix + "{broken"})
+
+	wrapped := Message{Payload: "p", Trace: map[string]string{"traceparent": "00-01"}}
+	c.Check(wrapped.marshal(), Matches, envelopePrefix+".*")
+	c.Check(unmarshalEnvelope(JSONEnvelope{}, wrapped.marshal()), DeepEquals, wrapped)
+
+	delivery := newDelivery("q", wrapped.marshal(), "unacked", "delayed", "rejected", "", nil, &QueueCounters{})
+	c.Check(delivery.Payload(), Equals, "p")
+	c.Check(delivery.Queue(), Equals, "q")
+	c.Check(delivery.Context(), NotNil)
+}
+
+func (suite *EnvelopeSuite) TestExpired(c *C) {
+	c.Check(newDelivery("q", "plain", "unacked", "delayed", "rejected", "", nil, &QueueCounters{}).Expired(), Equals, false)
+
+	future := Message{Payload: "p", Expires: time.Now().Add(time.Minute).UnixNano()}
+	c.Check(newDelivery("q", future.marshal(), "unacked", "delayed", "rejected", "", nil, &QueueCounters{}).Expired(), Equals, false)
+
+	past := Message{Payload: "p", Expires: time.Now().Add(-time.Millisecond).UnixNano()}
+	delivery := newDelivery("q", past.marshal(), "unacked", "delayed", "rejected", "", nil, &QueueCounters{})
+	c.Check(delivery.Expired(), Equals, true)
+	c.Check(delivery.Payload(), Equals, "p")
+}
+
+func (suite *EnvelopeSuite) TestNewMessage(c *C) {
+	first := newMessage("p")
+	second := newMessage("p")
+	c.Check(first.ID, HasLen, 16)
+	c.Check(first.ID, Not(Equals), second.ID)
+	c.Check(first.marshal(), Not(Equals), second.marshal())
+	c.Check(unmarshalEnvelope(JSONEnvelope{}, first.marshal()), DeepEquals, first)
+	c.Check(time.Since(time.Unix(0, first.EnqueuedAt)) < time.Minute, Equals, true)
+}
+
+func (suite *EnvelopeSuite) TestJSONEnvelope(c *C) {
+	message := Message{ID: "id", Payload: "p", Trace: map[string]string{"traceparent": "00-01"}, Expires: 2, EnqueuedAt: 1, Attempts: 3, Hops: 4, Returns: 5}
+	value, err := JSONEnvelope{}.Marshal(message)
+	c.Check(err, IsNil)
+	c.Check(value, Matches, envelopePrefix+`\{.*,"returns":5\}`) // returns must stay last for returnedLua
+	unmarshalled, err := JSONEnvelope{}.Unmarshal(value)
+	c.Check(err, IsNil)
+	c.Check(unmarshalled, DeepEquals, message)
+
+	unmarshalled, err = JSONEnvelope{}.Unmarshal("plain")
+	c.Check(err, IsNil)
+	c.Check(unmarshalled, DeepEquals, Message{Payload: "plain"})
+
+	unmarshalled, err = JSONEnvelope{}.Unmarshal(envelopePrefix + "{broken")
+	c.Check(err, NotNil)
+	c.Check(unmarshalled, DeepEquals, Message{Payload: envelopePrefix + "{broken"})
+}
+
+func (suite *EnvelopeSuite) TestRawEnvelope(c *C) {
+	value, err := RawEnvelope{}.Marshal(newMessage("p"))
+	c.Check(err, IsNil)
+	c.Check(value, Equals, "p")
+
+	unmarshalled, err := RawEnvelope{}.Unmarshal(envelopePrefix + `{"payload":"p"}`)
+	c.Check(err, IsNil)
+	c.Check(unmarshalled, DeepEquals, Message{Payload: envelopePrefix + `{"payload":"p"}`})
+}
+
+func (suite *EnvelopeSuite) TestCompatEnvelope(c *C) {
+	value, err := CompatEnvelope{}.Marshal(newMessage("p"))
+	c.Check(err, IsNil)
+	c.Check(value, Equals, "p")
+
+	message := Message{ID: "id", Payload: "p", EnqueuedAt: 1, Attempts: 2}
+	value, err = CompatEnvelope{}.Marshal(message)
+	c.Check(err, IsNil)
+	c.Check(value, Equals, message.marshal())
+	unmarshalled, err := CompatEnvelope{}.Unmarshal(value)
+	c.Check(err, IsNil)
+	c.Check(unmarshalled, DeepEquals, message)
+
+	// plain payloads looking like an envelope get wrapped to be read back as is
+	value, err = CompatEnvelope{}.Marshal(Message{Payload: envelopePrefix + "{}"})
+	c.Check(err, IsNil)
+	unmarshalled, err = CompatEnvelope{}.Unmarshal(value)
+	c.Check(err, IsNil)
+	c.Check(unmarshalled, DeepEquals, Message{Payload: envelopePrefix + "{}"})
+}
+
+// failingEnvelope fails to marshal messages of the payload fail
+type failingEnvelope struct {
+	RawEnvelope
+}
+
+func (envelope failingEnvelope) Marshal(message Message) (string, error) {
+	if message.Payload == "fail" {
+		return "", errors.New("injected failure")
+	}
+	return envelope.RawEnvelope.Marshal(message)
+}
+
+func (suite *EnvelopeSuite) TestDeliveryEnvelope(c *C) {
+	delivery := newDelivery("q", "p", "unacked", "delayed", "rejected", "", nil, &QueueCounters{})
+	delivery.envelope = failingEnvelope{}
+	c.Check(delivery.marshal(Message{Payload: "q"}), Equals, "q")
+	c.Check(delivery.marshal(Message{Payload: "fail"}), Equals, "p") // as fetched
+
+	message := Message{ID: "id", Payload: "p", EnqueuedAt: 1}
+	delivery = newDelivery("q", message.marshal(), "unacked", "delayed", "rejected", "", nil, &QueueCounters{})
+	c.Check(delivery.Message(), DeepEquals, message)
+}
@@ -0,0 +1,55 @@
+//go:build go1.18
+// +build go1.18
+
+package rmq
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PublishJSON publishes v marshalled as JSON to the queue
+func PublishJSON[T any](queue Queue, v T) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if !queue.Publish(string(bytes)) {
+		return fmt.Errorf("rmq failed to publish to %s", queue)
+	}
+	return nil
+}
+
+// UnmarshalDelivery returns the JSON payload of the delivery unmarshalled as T
+func UnmarshalDelivery[T any](delivery Delivery) (T, error) {
+	var v T
+	err := json.Unmarshal([]byte(delivery.Payload()), &v)
+	return v, err
+}
+
+// typedConsumer is the consumer returned by NewTypedConsumer
+type typedConsumer[T any] struct {
+	consume func(T, Delivery) error
+}
+
+// NewTypedConsumer returns a consumer which unmarshals the JSON payload of
+// each delivery as T and passes it to consume. The delivery gets acked if
+// consume returns nil and rejected otherwise. Deliveries which fail to
+// unmarshal are rejected right away without calling consume, so they end up
+// in rejected (or the dead letter queue) instead of being redelivered forever
+func NewTypedConsumer[T any](consume func(T, Delivery) error) Consumer {
+	return &typedConsumer[T]{consume: consume}
+}
+
+func (consumer *typedConsumer[T]) Consume(delivery Delivery) {
+	v, err := UnmarshalDelivery[T](delivery)
+	if err != nil {
+		delivery.Reject()
+		return
+	}
+	if err := consumer.consume(v, delivery); err != nil {
+		delivery.Reject()
+		return
+	}
+	delivery.Ack()
+}
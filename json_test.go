@@ -0,0 +1,84 @@
+//go:build go1.18
+// +build go1.18
+
+package rmq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestJSONSuite(t *testing.T) {
+	TestingSuiteT(&JSONSuite{}, t)
+}
+
+type JSONSuite struct{}
+
+type jsonTask struct {
+	ID   int      `json:"id"`
+	Tags []string `json:"tags"`
+}
+
+func (suite *JSONSuite) TestRoundTrip(c *C) {
+	queue := NewTestQueue("json-q")
+	c.Check(PublishJSON(queue, jsonTask{ID: 1, Tags: []string{"a", "b"}}), IsNil)
+	c.Assert(queue.LastDeliveries, HasLen, 1)
+	c.Check(queue.LastDeliveries[0], Equals, `{"id":1,"tags":["a","b"]}`)
+
+	task, err := UnmarshalDelivery[jsonTask](NewTestDeliveryString(queue.LastDeliveries[0]))
+	c.Check(err, IsNil)
+	c.Check(task, DeepEquals, jsonTask{ID: 1, Tags: []string{"a", "b"}})
+}
+
+func (suite *JSONSuite) TestErrors(c *C) {
+	queue := NewTestQueue("json-q")
+	c.Check(PublishJSON(queue, make(chan int)), NotNil)
+	c.Check(queue.LastDeliveries, HasLen, 0)
+
+	task, err := UnmarshalDelivery[jsonTask](NewTestDeliveryString(`{"id":`))
+	c.Check(err, NotNil)
+	c.Check(task, DeepEquals, jsonTask{})
+}
+
+func (suite *JSONSuite) TestTypedConsumer(c *C) {
+	var consumed []jsonTask
+	consumer := NewTypedConsumer(func(task jsonTask, delivery Delivery) error {
+		consumed = append(consumed, task)
+		if task.ID < 0 {
+			return errors.New("negative id")
+		}
+		return nil
+	})
+
+	delivery := NewTestDeliveryString(`{"id":1,"tags":["a"]}`)
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Acked)
+	c.Check(consumed, DeepEquals, []jsonTask{{ID: 1, Tags: []string{"a"}}})
+
+	delivery = NewTestDeliveryString(`{"id":-1}`)
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Rejected)
+	c.Check(consumed, HasLen, 2)
+
+	delivery = NewTestDeliveryString(`{"id":`)
+	consumer.Consume(delivery)
+	c.Check(delivery.State, Equals, Rejected)
+	c.Check(consumed, HasLen, 2) // not called for malformed payloads
+}
+
+func (suite *JSONSuite) TestTypedConsumerQueue(c *C) {
+	queue := NewTestQueue("json-typed-q")
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	queue.AddConsumer("json-typed-cons", NewTypedConsumer(func(task jsonTask, delivery Delivery) error {
+		return nil
+	}))
+
+	c.Check(PublishJSON(queue, jsonTask{ID: 1}), IsNil)
+	c.Check(queue.Publish("malformed"), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1) // not redelivered
+}
@@ -0,0 +1,31 @@
+package rmq
+
+import "github.com/go-redis/redis"
+
+// lmoveVersion is the first redis version supporting LMOVE, which replaces the
+// deprecated RPOPLPUSH
+var lmoveVersion = []int{6, 2, 0}
+
+// list ends to move elements from and to with LMOVE
+const (
+	listLeft  = "left"  // where LPUSH adds, the newest end of rmq lists
+	listRight = "right" // where deliveries get consumed from, the oldest end
+)
+
+// lmove moves the element at the from end of source to the to end of
+// destination and returns it, redis.Nil if source is empty. The redis client
+// doesn't know LMOVE yet, so the command is built by hand
+func lmove(redisClient redis.UniversalClient, source, destination, from, to string) *redis.StringCmd {
+	cmd := redis.NewStringCmd("lmove", source, destination, from, to)
+	redisClient.Process(cmd)
+	return cmd
+}
+
+// popPush moves the oldest element of source to the newest end of destination
+// and returns it like RPOPLPUSH, using LMOVE if the server supports it
+func (queue *redisQueue) popPush(source, destination string) *redis.StringCmd {
+	if queue.lmove.check(queue.redisClient) {
+		return lmove(queue.redisClient, source, destination, listRight, listLeft)
+	}
+	return queue.redisClient.RPopLPush(source, destination)
+}
@@ -0,0 +1,110 @@
+package rmq
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis"
+)
+
+// Logger receives the log messages of rmq, *log.Logger implements it. Panicf
+// is expected to panic after logging, rmq relies on it not returning
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Panicf(format string, v ...interface{})
+}
+
+// stdLogger logs to the standard logger of the log package
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (stdLogger) Panicf(format string, v ...interface{}) {
+	log.Panicf(format, v...)
+}
+
+// debugEnv is the environment variable turning on debug logging for new
+// connections when set to a true value like 1 or true
+const debugEnv = "RMQ_DEBUG"
+
+// logging holds the logger of a connection, it's shared with the queues
+// opened from the connection and their deliveries so setting a logger affects
+// all of them. A nil logging logs to the standard logger
+type logging struct {
+	debug int32 // log debug messages if 1, accessed atomically
+
+	lock   sync.RWMutex
+	logger Logger
+}
+
+// newLogging returns a logging to the standard logger, with debug logging on
+// if the RMQ_DEBUG environment variable is true
+func newLogging() *logging {
+	logging := &logging{}
+	if debug, err := strconv.ParseBool(os.Getenv(debugEnv)); err == nil {
+		logging.setDebug(debug)
+	}
+	return logging
+}
+
+func (logging *logging) get() Logger {
+	if logging == nil {
+		return stdLogger{}
+	}
+
+	logging.lock.RLock()
+	defer logging.lock.RUnlock()
+	if logging.logger == nil {
+		return stdLogger{}
+	}
+	return logging.logger
+}
+
+func (logging *logging) set(logger Logger) {
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	logging.logger = logger
+}
+
+func (logging *logging) setDebug(debug bool) {
+	value := int32(0)
+	if debug {
+		value = 1
+	}
+	atomic.StoreInt32(&logging.debug, value)
+}
+
+func (logging *logging) Printf(format string, v ...interface{}) {
+	logging.get().Printf(format, v...)
+}
+
+func (logging *logging) Panicf(format string, v ...interface{}) {
+	logging.get().Panicf(format, v...)
+}
+
+// debugf logs the message prefixed with "rmq debug: " if debug logging is on.
+// Otherwise it returns right away without formatting the message
+func (logging *logging) debugf(format string, v ...interface{}) {
+	if logging == nil || atomic.LoadInt32(&logging.debug) == 0 {
+		return
+	}
+	logging.get().Printf("rmq debug: "+format, v...)
+}
+
+// redisErrIsNil returns false if there is no error, true if the result error is nil and panics if there's another error
+func (logging *logging) redisErrIsNil(result redis.Cmder) bool {
+	switch result.Err() {
+	case nil:
+		return false
+	case redis.Nil:
+		return true
+	default:
+		logging.Panicf("rmq redis error is not nil %#v", result.Err())
+		return false
+	}
+}
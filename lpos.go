@@ -0,0 +1,88 @@
+package rmq
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// lposVersion is the first redis version supporting LPOS
+var lposVersion = []int{6, 0, 6}
+
+// ackedTombstone temporarily replaces the acked occurrence of a payload so
+// exactly that one gets removed from unacked
+const ackedTombstone = "rmq::acked"
+
+// ackLastScript removes the occurrence of ARGV[1] closest to the tail of the
+// list at KEYS[1], which is the one fetched first as fetching pushes to the
+// head, along with its visibility deadline ARGV[2] in the sorted set at
+// KEYS[2]. ARGV[3] is the tombstone. Returns the number of removed occurrences
+const ackLastScript = forgetDeadlineLua + `local index = redis.call('lpos', KEYS[1], ARGV[1], 'RANK', -1)
+if not index then
+    return 0
+end
+redis.call('lset', KEYS[1], index, ARGV[3])
+forgetDeadline(KEYS[2], ARGV[2])
+return redis.call('lrem', KEYS[1], -1, ARGV[3])`
+
+// serverSupport checks whether the redis server is at least version, to use
+// commands only newer servers support. The result is cached once the check
+// succeeded
+type serverSupport struct {
+	version []int
+
+	lock      sync.Mutex
+	checked   bool
+	supported bool
+}
+
+func newServerSupport(version []int) *serverSupport {
+	return &serverSupport{version: version}
+}
+
+func (support *serverSupport) check(redisClient redis.UniversalClient) bool {
+	if support == nil {
+		return false
+	}
+
+	support.lock.Lock()
+	defer support.lock.Unlock()
+	if !support.checked {
+		info, err := redisClient.Info("server").Result()
+		if err != nil {
+			return false // check again next time
+		}
+		support.checked = true
+		support.supported = redisVersionAtLeast(info, support.version)
+	}
+	return support.supported
+}
+
+// redisVersionAtLeast returns true if the redis_version in the given INFO
+// output is at least version
+func redisVersionAtLeast(info string, version []int) bool {
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "redis_version:") {
+			continue
+		}
+
+		parts := strings.Split(strings.TrimPrefix(line, "redis_version:"), ".")
+		for i, want := range version {
+			if i >= len(parts) {
+				return false
+			}
+			got, err := strconv.Atoi(parts[i])
+			if err != nil {
+				return false
+			}
+			if got != want {
+				return got > want
+			}
+		}
+		return true
+	}
+	return false
+}
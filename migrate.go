@@ -0,0 +1,130 @@
+package rmq
+
+import (
+	"fmt"
+
+	"github.com/go-redis/redis"
+)
+
+// migratingSuffix is appended to a list key to get the key of the list
+// holding the delivery which is currently being migrated from it
+const migratingSuffix = "::migrating"
+
+// migrateBatchSize is the number of deliveries MigrateQueue moves per round
+// trip to each redis
+const migrateBatchSize = 100
+
+// migrateParkScript moves up to ARGV[1] of the oldest elements of the list at
+// KEYS[1] to the migrating list at KEYS[2], unless the migrating list still
+// holds elements left over by a failed migration. Returns the migrating list
+const migrateParkScript = `if redis.call('llen', KEYS[2]) == 0 then
+    for i = 1, tonumber(ARGV[1]) do
+        if not redis.call('rpoplpush', KEYS[1], KEYS[2]) then
+            break
+        end
+    end
+end
+return redis.call('lrange', KEYS[2], 0, -1)`
+
+// MigrateQueue moves all ready, delayed and rejected deliveries of src to
+// dst, usually a queue with the same name opened from a connection to
+// another redis. Order and delayed scores are kept, returns the number of
+// moved deliveries. Deliveries are moved in batches, each parked in a list
+// next to its source list until it's in dst, so calling it again after a
+// failure resumes the migration without losing deliveries, the ones of one
+// batch may end up in dst twice though. Returns an error if src and dst are
+// the same queue
+func MigrateQueue(src, dst Queue) (int, error) {
+	from, ok := src.(*redisQueue)
+	if !ok {
+		return 0, fmt.Errorf("rmq can't migrate from %T, only from queues opened from a connection", src)
+	}
+	to, ok := dst.(*redisQueue)
+	if !ok {
+		return 0, fmt.Errorf("rmq can't migrate to %T, only to queues opened from a connection", dst)
+	}
+	if from.redisClient == to.redisClient && from.readyKey == to.readyKey {
+		return 0, fmt.Errorf("rmq can't migrate queue %s to itself", from)
+	}
+
+	moved := 0
+	for priority, readyKey := range from.priorityKeys {
+		toKey := to.priorityKeys[len(to.priorityKeys)-1]
+		if priority < len(to.priorityKeys) {
+			toKey = to.priorityKeys[priority]
+		}
+		n, err := migrateList(from.redisClient, readyKey, to.redisClient, toKey)
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	n, err := migrateList(from.redisClient, from.rejectedKey, to.redisClient, to.rejectedKey)
+	moved += n
+	if err != nil {
+		return moved, err
+	}
+
+	n, err = migrateSortedSet(from.redisClient, from.delayedKey, to.redisClient, to.delayedKey)
+	moved += n
+	return moved, err
+}
+
+// migrateList moves all elements of fromKey to toKey oldest first in batches,
+// starting with the ones left over in the migrating list by a failed
+// migration
+func migrateList(fromClient redis.UniversalClient, fromKey string, toClient redis.UniversalClient, toKey string) (int, error) {
+	migratingKey := fromKey + migratingSuffix
+	moved := 0
+	for {
+		result := fromClient.Eval(migrateParkScript, []string{fromKey, migratingKey}, migrateBatchSize)
+		if err := result.Err(); err != nil {
+			return moved, err
+		}
+		parked, _ := result.Val().([]interface{})
+		if len(parked) == 0 {
+			return moved, nil // all moved
+		}
+
+		// parked is newest first, push the oldest first to keep the order
+		payloads := make([]interface{}, len(parked))
+		for i, payload := range parked {
+			payloads[len(parked)-1-i] = payload
+		}
+		if err := toClient.LPush(toKey, payloads...).Err(); err != nil {
+			return moved, err
+		}
+		if err := fromClient.Del(migratingKey).Err(); err != nil {
+			return moved, err
+		}
+		moved += len(parked)
+	}
+}
+
+// migrateSortedSet moves all members of fromKey to toKey with their scores in
+// batches, adding members again after a failed migration doesn't change toKey
+func migrateSortedSet(fromClient redis.UniversalClient, fromKey string, toClient redis.UniversalClient, toKey string) (int, error) {
+	moved := 0
+	for {
+		members, err := fromClient.ZRangeWithScores(fromKey, 0, migrateBatchSize-1).Result()
+		if err != nil {
+			return moved, err
+		}
+		if len(members) == 0 {
+			return moved, nil // all moved
+		}
+
+		if err := toClient.ZAdd(toKey, members...).Err(); err != nil {
+			return moved, err
+		}
+		names := make([]interface{}, len(members))
+		for i, member := range members {
+			names[i] = member.Member
+		}
+		if err := fromClient.ZRem(fromKey, names...).Err(); err != nil {
+			return moved, err
+		}
+		moved += len(members)
+	}
+}
@@ -0,0 +1,209 @@
+package rmq
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MultiQueueConsumer consumes from several queues in a single goroutine,
+// see ConsumeQueues
+type MultiQueueConsumer struct {
+	consumer     Consumer
+	pollDuration time.Duration
+
+	queuesLock sync.Mutex
+	queues     []*redisQueue
+
+	stopped  int32
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// ConsumeQueues starts consuming from all given queues with a single consumer
+// in a single goroutine. Each round it consumes at most one delivery from
+// each queue, so busy queues can't starve the others. Empty and paused queues
+// are skipped and if all of them are empty it sleeps for pollDuration
+// panics if one of the queues wasn't opened from a connection!
+func ConsumeQueues(queues []Queue, pollDuration time.Duration, consumer Consumer) *MultiQueueConsumer {
+	multi := &MultiQueueConsumer{
+		consumer:     consumer,
+		pollDuration: pollDuration,
+		stopChan:     make(chan struct{}),
+		doneChan:     make(chan struct{}),
+	}
+	for _, queue := range queues {
+		multi.AddQueue(queue)
+	}
+	go multi.consume()
+	return multi
+}
+
+// AddQueue adds a queue to consume from, returns false if it was added before
+// panics if the queue wasn't opened from a connection!
+func (multi *MultiQueueConsumer) AddQueue(queue Queue) bool {
+	redisQueue, ok := queue.(*redisQueue)
+	if !ok {
+		log.Panicf("rmq multi queue consumer can't consume %T, only queues opened from a connection", queue)
+	}
+
+	multi.queuesLock.Lock()
+	defer multi.queuesLock.Unlock()
+	for _, added := range multi.queues {
+		if added == redisQueue {
+			return false
+		}
+	}
+
+	// add queue to list of queues consumed on this connection, so the cleaner
+	// returns its unacked deliveries if this connection dies
+	if redisQueue.logger.redisErrIsNil(redisQueue.redisClient.SAdd(redisQueue.queuesKey, redisQueue.name)) {
+		redisQueue.logger.Panicf("rmq multi queue consumer failed to add %s", redisQueue)
+	}
+	multi.queues = append(multi.queues, redisQueue)
+	redisQueue.multiConsumers.add(multi)
+	return true
+}
+
+// RemoveQueue stops consuming from the queue, returns false if it wasn't added
+func (multi *MultiQueueConsumer) RemoveQueue(queue Queue) bool {
+	multi.queuesLock.Lock()
+	defer multi.queuesLock.Unlock()
+	for i, added := range multi.queues {
+		if added == queue {
+			multi.queues = append(multi.queues[:i:i], multi.queues[i+1:]...)
+			if !multi.consumes(added.multiConsumers) {
+				added.multiConsumers.remove(multi)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// consumes returns true if one of the queues was opened on the connection of
+// consumers, must be called locked
+func (multi *MultiQueueConsumer) consumes(consumers *multiQueueConsumers) bool {
+	for _, queue := range multi.queues {
+		if queue.multiConsumers == consumers {
+			return true
+		}
+	}
+	return false
+}
+
+// StopConsuming stops consuming and waits for the current delivery to be
+// consumed, returns false if it was stopped before
+func (multi *MultiQueueConsumer) StopConsuming() bool {
+	if !multi.stop() {
+		return false
+	}
+	<-multi.doneChan
+	return true
+}
+
+// stop stops consuming without waiting, returns false if it was stopped before
+func (multi *MultiQueueConsumer) stop() bool {
+	if !atomic.CompareAndSwapInt32(&multi.stopped, 0, 1) {
+		return false
+	}
+	close(multi.stopChan)
+
+	multi.queuesLock.Lock()
+	defer multi.queuesLock.Unlock()
+	for _, queue := range multi.queues {
+		queue.multiConsumers.remove(multi)
+	}
+	return true
+}
+
+func (multi *MultiQueueConsumer) consume() {
+	defer close(multi.doneChan)
+	for atomic.LoadInt32(&multi.stopped) == 0 {
+		if multi.consumeRound() {
+			continue
+		}
+
+		select {
+		case <-multi.stopChan:
+		case <-time.After(multi.pollDuration):
+		}
+	}
+}
+
+// consumeRound consumes at most one delivery from each queue, returns false
+// if all queues were empty
+func (multi *MultiQueueConsumer) consumeRound() bool {
+	multi.queuesLock.Lock()
+	queues := multi.queues
+	multi.queuesLock.Unlock()
+
+	consumed := false
+	for _, queue := range queues {
+		if atomic.LoadInt32(&multi.stopped) == 1 {
+			return true
+		}
+		if queue.IsPaused() {
+			continue
+		}
+
+		token := queue.deadlineToken()
+		result, readyKey := queue.consumeOne(token)
+		if queue.logger.redisErrIsNil(result) {
+			continue // empty
+		}
+
+		consumed = true
+		delivery, ok := queue.fetched(result.Val(), readyKey, token)
+		if !ok {
+			continue
+		}
+		queue.consumerConsumeDelivery(multi.consumer, delivery)
+	}
+	return consumed
+}
+
+// multiQueueConsumers are the multi queue consumers consuming queues of a
+// connection, so closing the connection can stop them
+type multiQueueConsumers struct {
+	lock      sync.Mutex
+	consumers map[*MultiQueueConsumer]struct{}
+}
+
+func newMultiQueueConsumers() *multiQueueConsumers {
+	return &multiQueueConsumers{consumers: map[*MultiQueueConsumer]struct{}{}}
+}
+
+func (consumers *multiQueueConsumers) add(multi *MultiQueueConsumer) {
+	if consumers == nil {
+		return
+	}
+	consumers.lock.Lock()
+	defer consumers.lock.Unlock()
+	consumers.consumers[multi] = struct{}{}
+}
+
+func (consumers *multiQueueConsumers) remove(multi *MultiQueueConsumer) {
+	if consumers == nil {
+		return
+	}
+	consumers.lock.Lock()
+	defer consumers.lock.Unlock()
+	delete(consumers.consumers, multi)
+}
+
+// stop stops all multi queue consumers and returns them, to wait for them
+func (consumers *multiQueueConsumers) stop() []*MultiQueueConsumer {
+	consumers.lock.Lock()
+	stopping := make([]*MultiQueueConsumer, 0, len(consumers.consumers))
+	for multi := range consumers.consumers {
+		stopping = append(stopping, multi)
+	}
+	consumers.lock.Unlock()
+
+	for _, multi := range stopping {
+		multi.stop() // removes it from consumers
+	}
+	return stopping
+}
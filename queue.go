@@ -1,8 +1,11 @@
 package rmq
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,87 +21,305 @@ const (
 	connectionQueuesTemplate         = "rmq::connection::{connection}::queues"                      // Set of queues consumers of {connection} are consuming
 	connectionQueueConsumersTemplate = "rmq::connection::{connection}::queue::[{queue}]::consumers" // Set of all consumers from {connection} consuming from {queue}
 	connectionQueueUnackedTemplate   = "rmq::connection::{connection}::queue::[{queue}]::unacked"   // List of deliveries consumers of {connection} are currently consuming
+	connectionQueueDeadlinesTemplate = "rmq::connection::{connection}::queue::[{queue}]::deadlines" // Sorted set of unacked deliveries by the time they become visible again
+	connectionQueueInspectedTemplate = "rmq::connection::{connection}::queue::[{queue}]::inspected" // List of rejected deliveries {connection} took out for inspection
 
-	queuesKey             = "rmq::queues"                     // Set of all open queues
-	queueReadyTemplate    = "rmq::queue::[{queue}]::ready"    // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
-	queueRejectedTemplate = "rmq::queue::[{queue}]::rejected" // List of rejected deliveries from that {queue}
-	queueDelayedTemplate  = "rmq::queue::[{queue}]::delayed"  // List of rejected deliveries from that {queue}
+	queuesKey             = "rmq::queues"                           // Set of all open queues
+	queueReadyTemplate    = "rmq::queue::[{queue}]::ready"          // List of deliveries in that {queue} (right is first and oldest, left is last and youngest)
+	queueRejectedTemplate = "rmq::queue::[{queue}]::rejected"       // List of rejected deliveries from that {queue}
+	queueDelayedTemplate  = "rmq::queue::[{queue}]::delayed"        // Sorted set of delayed deliveries from that {queue} by when they become ready, see unixScore
+	queueDedupTemplate    = "rmq::queue::[{queue}]::dedup::{dedup}" // guards against publishing a delivery with that {dedup} key again
+	queueActivityTemplate = "rmq::queue::[{queue}]::activity"       // unix nanoseconds of the last publish or consume of an ephemeral {queue}
+	ephemeralQueuesKey    = "rmq::queues::ephemeral"                // Hash of ephemeral queues to the nanoseconds they may stay idle
 
 	phConnection = "{connection}" // connection name
 	phQueue      = "{queue}"      // queue name
+	phDedup      = "{dedup}"      // deduplication key
 
 	defaultBatchTimeout = time.Second
+	maxBatchWaits       = 10 // timeouts a batch below its minimum size waits at most
 	purgeBatchSize      = 100
+	returnBatchSize     = 100 // deliveries returned or recovered per script
 )
 
 type Queue interface {
 	Publish(payload string) bool
+	PublishFront(payload string) bool
+	PublishUnique(dedupKey, payload string, window time.Duration) (bool, error)
+	PublishBounded(payload string, maxReady int) (bool, error)
+	PublishWithTrace(ctx context.Context, payload string) bool
+	PublishWithHeaders(payload string, headers map[string]string) bool
+	PublishWithPriority(payload string, priority int) bool
+	PublishWithTTL(payload string, ttl time.Duration) bool
 	PublishToDelayedQueue(payload string, delayedTime time.Duration) bool
+	PublishAt(payload string, runAt time.Time) bool
+	PublishToDelayedQueueBatch(items []DelayedItem) (int, error)
+	CancelDelayed(payload string) (bool, error)
+	RescheduleDelayed(payload string, newDelay time.Duration) bool
+	SetMaxPriority(maxPriority int)
 	SetPushQueue(pushQueue Queue)
+	SetPushQueueE(pushQueue Queue) error
+	SetPushQueueByName(name string) error
+	SetEnvelope(envelope Envelope)
+	SetMaxPushHops(maxHops int)
+	SetRecordRejectedBy(record bool)
+	SetDeadLetterQueue(deadLetterQueue Queue, maxAttempts int)
+	SetDeadLetterQueueE(deadLetterQueue Queue, maxAttempts int) error
+	SetMaxRejected(maxRejected int, policy RejectedPolicy)
+	SetDelayedChunkSize(chunkSize int)
+	SetMaxDelayedWait(maxWait time.Duration)
+	SetServerClock(serverClock bool)
+	SetVisibilityTimeout(timeout time.Duration)
+	SetDefaultBatchTimeout(timeout time.Duration)
+	SetPurgeBatchSize(batchSize int)
+	SetDrainedSettle(settle time.Duration)
+	DrainedChan() <-chan struct{}
+	SetTracer(tracer Tracer)
+	SetOnStateChange(onStateChange func(payload string, from, to State))
+	SetOnBackpressure(onBackpressure func(queueName string, bufferLen, prefetchLimit int))
+	SetOnProcessed(onProcessed func(payload string, to State, duration time.Duration))
+	SetConsumePanicHandler(onPanic func(recovered interface{}, delivery Delivery))
+	SetStrict(strict bool)
+	SetEphemeral(idle time.Duration)
 	StartConsuming(prefetchLimit int, pollDuration time.Duration) bool
+	StartConsumingE(prefetchLimit int, pollDuration time.Duration) error
+	StartConsumingWithBackoff(prefetchLimit int, pollDuration, maxPollDuration time.Duration) bool
+	StartConsumingBlocking(prefetchLimit int, blockTimeout time.Duration) bool
+	StartConsumingWithOptions(options StartConsumingOptions) error
 	StopConsuming() bool
+	StopConsumingAndDrain(timeout time.Duration) error
+	Pause() bool
+	Resume() bool
+	IsPaused() bool
 	WaitForConsuming()
+	WaitForConsumingWithTimeout(timeout time.Duration) bool
 	AddConsumer(tag string, consumer Consumer) string
+	AddConsumerE(tag string, consumer Consumer) (string, error)
+	AddConsumerWithHandle(tag string, consumer Consumer) *ConsumerHandle
+	AddReadyConsumer(tag string, consumer Consumer) string
+	AddDelayedConsumer(tag string, consumer Consumer) string
+	AddConsumerWithPrefetch(tag string, prefetch int, consumer Consumer) string
+	AddConsumerWithConcurrency(tag string, concurrency int, consumer Consumer) string
+	AddConsumerWithWeight(tag string, weight int, consumer Consumer) string
 	AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string
 	AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string
+	AddBatchConsumerWithOptions(tag string, minSize, maxSize int, timeout time.Duration, consumer BatchConsumer) string
+	AddBatchConsumerE(tag string, batchSize int, consumer BatchConsumer) (string, error)
+	Fetch(count int) ([]Delivery, error)
+	ConsumeN(n int, timeout time.Duration, consumer Consumer) (int, error)
+	GetConsumers() []string
+	LocalConsumerCount() int
+	RemoveConsumer(name string) bool
+	RemoveAllConsumers() int
+	ReadyCount() int
+	Counters() QueueCounters
+	RejectedCount() int
+	UnackedCount() int
+	DelayedCount() int
+	TotalCount(includeRejected bool) int
+	TotalCountE(includeRejected bool) (int, error)
 	PurgeReady() int
 	PurgeRejected() int
+	PurgeDelayed() int
+	PeekReady(count int) ([]string, error)
+	PeekRejected(count int) ([]string, error)
+	PeekRejectedDeliveries(count int) ([]RejectedDelivery, error)
+	PeekDelayed(count int) ([]DelayedDelivery, error)
 	ReturnRejected(count int) int
+	ReturnRejectedWithRate(ctx context.Context, count int, perSecond int) int
+	ReturnRejectedMatching(pred func(payload string) bool, max int) (int, error)
+	ReturnRejectedOrdered(count int) (int, error)
 	ReturnAllRejected() int
+	ReturnAllUnacked() int
+	ReturnUnacked(count int) int
+	RecoverUnacked() (int, error)
+	RecoverUnackedOrdered() (int, error)
+	RejectedDeliveries(count int) ([]Delivery, error)
 	Close() bool
 }
 
 type redisQueue struct {
 	name           string
 	connectionName string
-	queuesKey      string // key to list of queues consumed by this connection
-	consumersKey   string // key to set of consumers using this connection
-	readyKey       string // key to list of ready deliveries
-	delayedKey     string // key to list of delayed deliveries
-	rejectedKey    string // key to list of rejected deliveries
-	unackedKey     string // key to list of currently consuming deliveries
-	pushKey        string // key to list of pushed deliveries
+	prefix         string   // replaces the rmq prefix of all keys, empty for the default
+	allQueuesKey   string   // key to set of all open queues
+	queuesKey      string   // key to list of queues consumed by this connection
+	consumersKey   string   // key to set of consumers using this connection
+	readyKey       string   // key to list of ready deliveries
+	priorityKeys   []string // keys to lists of ready deliveries by priority, starting with readyKey
+	delayedKey     string   // key to list of delayed deliveries
+	rejectedKey    string   // key to list of rejected deliveries
+	unackedKey     string   // key to list of currently consuming deliveries
+	deadlinesKey   string   // key to sorted set of unacked deliveries by visibility deadline
+	inspectedKey   string   // key to list of rejected deliveries taken out by RejectedDeliveries
+	activityKey    string   // key to the time of the last publish or consume, only kept for ephemeral queues
+	ephemeralKey   string   // key to hash of all ephemeral queues
+	pushKey        string   // key to list of pushed deliveries
+	deadLetterKey  string   // key to list of deliveries rejected maxAttempts times
+	maxAttempts    int
+	maxRejected    int // zero for no limit
+	rejectedPolicy RejectedPolicy
+	maxPushHops    int // zero for no limit
 	redisClient    redis.UniversalClient
+	counters       *QueueCounters
+	tracer         Tracer   // nil unless tracing is enabled
+	envelope       Envelope // converts messages to the values stored in redis
+	logger         *logging // shared with the connection, nil logs to the standard logger
+	onStateChange  func(payload string, from, to State)
+	onBackpressure func(queueName string, bufferLen, prefetchLimit int)
+	onProcessed    func(payload string, to State, duration time.Duration)
+	onPanic        func(recovered interface{}, delivery Delivery) // nil to log and reject
+	consumerNaming *consumerNaming                                // shared with the connection, nil for the default consumer names
+	lpos           *serverSupport                                 // whether acks can use LPOS, checked on first use
+	lmove          *serverSupport                                 // whether LMOVE can replace RPOPLPUSH, shared with the connection
+	multiConsumers *multiQueueConsumers                           // consuming this queue, shared with the connection so closing it stops them
 
 	deliveryChan                chan Delivery // nil for publish channels, not nil for consuming channels
 	deliveryChanForDelayedQueue chan Delivery // nil for publish channels, not nil for consuming channels
 
+	prefetchChansLock sync.Mutex
+	prefetchChans     []chan Delivery // channels of consumers added with their own prefetch limit
+
+	localConsumersLock sync.Mutex
+	localConsumers     map[string]bool // names of consumers added through this instance
+
+	weightedLock sync.Mutex
+	weighted     *weightedDispatcher // nil until a consumer is added with a weight
+
+	drainedLock   sync.Mutex
+	drained       chan struct{} // nil until DrainedChan got called, closed once drained
+	drainedClosed bool
+	emptySince    time.Time     // when ready and unacked were first seen empty, zero while they aren't
+	drainedSettle time.Duration // how long ready and unacked need to stay empty to count as drained
+
 	consumerWaitGroup *sync.WaitGroup // WaitGroup to make sure that consuming finished in case of stop consuming
+	fetcherWaitGroup  *sync.WaitGroup // WaitGroup to make sure that fetching into the channels finished
 
 	// max number of prefetched deliveries number of unacked can go up to prefetchLimit + numConsumers
 	prefetchLimit int
 
-	pollDuration     time.Duration
-	consumingStopped int32
+	pollDuration      time.Duration
+	delayedChunkSize  int           // number of due delayed deliveries pushed to unacked per LPUSH
+	maxDelayedWait    time.Duration // longest the delayed poller waits for the next delayed delivery to become due, zero for the poll duration
+	delayedWakeup     chan struct{} // wakes the delayed poller when deliveries got delayed through this instance
+	serverClock       bool          // if set delays are relative to the time of the redis server, see SetServerClock
+	visibilityTimeout time.Duration // unacked deliveries return to ready after this, zero to disable
+	batchTimeout      time.Duration // timeout of batch consumers added with AddBatchConsumer
+	purgeBatchSize    int           // number of deliveries removed per command while purging
+	maxPollDuration   time.Duration // poll duration backs off up to this while the queue is empty
+	strict            bool          // if set adding consumers before StartConsuming panics
+	recordRejectedBy  bool          // if set rejected deliveries record the tag of their consumer
+	fetchImmediate    bool          // set unless consuming only delayed deliveries, see StartConsumingWithOptions
+	idleExpiry        time.Duration // ephemeral queues get removed after being idle for this, zero to keep
+	touched           int64         // unix nanoseconds this instance last recorded activity at, accessed atomically
+	consumingStopped  int32
+	consumingDrained  int32 // if set consumers get to consume buffered deliveries after stop
+	consumingPaused   int32
+	consumersStopped  int32         // set once the consumers got stopped, see stopConsumers
+	consumersStop     chan struct{} // closed to make the consumers return
 }
 
-func newQueue(name, connectionName, queuesKey string, redisClient redis.UniversalClient) *redisQueue {
+const defaultDelayedChunkSize = 100
+
+// defaultDrainedSettle is how long ready and unacked need to stay empty by
+// default before DrainedChan gets closed
+const defaultDrainedSettle = time.Second
+
+// defaultMaxPushHops is how often a delivery can be pushed by default before
+// it gets rejected instead, to end cycles of push queues
+const defaultMaxPushHops = 10
+
+// blockingWaitDuration is how long blocking consumers wait while the queue is
+// paused or their buffer is full
+const blockingWaitDuration = 10 * time.Millisecond
+
+func newQueue(prefix, name, connectionName, connectionQueuesKey string, redisClient redis.UniversalClient, counters *QueueCounters) *redisQueue {
 	consumersKey := strings.Replace(connectionQueueConsumersTemplate, phConnection, connectionName, 1)
-	consumersKey = strings.Replace(consumersKey, phQueue, name, 1)
+	consumersKey = prefixKey(prefix, strings.Replace(consumersKey, phQueue, name, 1))
 
-	readyKey := strings.Replace(queueReadyTemplate, phQueue, name, 1)
-	delayedKey := strings.Replace(queueDelayedTemplate, phQueue, name, 1)
-	rejectedKey := strings.Replace(queueRejectedTemplate, phQueue, name, 1)
+	readyKey := prefixKey(prefix, strings.Replace(queueReadyTemplate, phQueue, name, 1))
+	delayedKey := prefixKey(prefix, strings.Replace(queueDelayedTemplate, phQueue, name, 1))
+	rejectedKey := prefixKey(prefix, strings.Replace(queueRejectedTemplate, phQueue, name, 1))
 
 	unackedKey := strings.Replace(connectionQueueUnackedTemplate, phConnection, connectionName, 1)
-	unackedKey = strings.Replace(unackedKey, phQueue, name, 1)
+	unackedKey = prefixKey(prefix, strings.Replace(unackedKey, phQueue, name, 1))
+
+	deadlinesKey := strings.Replace(connectionQueueDeadlinesTemplate, phConnection, connectionName, 1)
+	deadlinesKey = prefixKey(prefix, strings.Replace(deadlinesKey, phQueue, name, 1))
+
+	inspectedKey := strings.Replace(connectionQueueInspectedTemplate, phConnection, connectionName, 1)
+	inspectedKey = prefixKey(prefix, strings.Replace(inspectedKey, phQueue, name, 1))
+
+	activityKey := prefixKey(prefix, strings.Replace(queueActivityTemplate, phQueue, name, 1))
 
 	queue := &redisQueue{
 		name:              name,
 		connectionName:    connectionName,
-		queuesKey:         queuesKey,
+		prefix:            prefix,
+		allQueuesKey:      prefixKey(prefix, queuesKey),
+		queuesKey:         connectionQueuesKey,
 		consumersKey:      consumersKey,
 		readyKey:          readyKey,
+		priorityKeys:      []string{readyKey},
 		delayedKey:        delayedKey,
 		rejectedKey:       rejectedKey,
 		unackedKey:        unackedKey,
+		deadlinesKey:      deadlinesKey,
+		inspectedKey:      inspectedKey,
+		activityKey:       activityKey,
+		ephemeralKey:      prefixKey(prefix, ephemeralQueuesKey),
 		redisClient:       redisClient,
+		counters:          counters,
 		consumerWaitGroup: new(sync.WaitGroup),
+		fetcherWaitGroup:  new(sync.WaitGroup),
 		consumingStopped:  0,
+		delayedChunkSize:  defaultDelayedChunkSize,
+		delayedWakeup:     make(chan struct{}, 1),
+		consumersStop:     make(chan struct{}),
+		batchTimeout:      defaultBatchTimeout,
+		drainedSettle:     defaultDrainedSettle,
+		purgeBatchSize:    purgeBatchSize,
+		maxPushHops:       defaultMaxPushHops,
+		lpos:              newServerSupport(lposVersion),
+		lmove:             newServerSupport(lmoveVersion),
+		envelope:          CompatEnvelope{},
 	}
 	return queue
 }
 
+// prefixKey replaces the rmq prefix of the given key if prefix isn't empty
+func prefixKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + strings.TrimPrefix(key, "rmq")
+}
+
+// inSameSlot returns whether all keys used together in multi key commands
+// and scripts hash to the same redis cluster slot
+func (queue *redisQueue) inSameSlot() bool {
+	tag := keyHashTag(queue.readyKey)
+	return keyHashTag(queue.unackedKey) == tag &&
+		keyHashTag(queue.deadlinesKey) == tag &&
+		keyHashTag(queue.inspectedKey) == tag &&
+		keyHashTag(queue.delayedKey) == tag &&
+		keyHashTag(queue.rejectedKey) == tag
+}
+
+// keyHashTag returns the part of the key redis cluster uses to pick its slot,
+// that is the content of the first non empty {hash tag} or the whole key
+func keyHashTag(key string) string {
+	start := strings.Index(key, "{")
+	if start < 0 {
+		return key
+	}
+	end := strings.Index(key[start+1:], "}")
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
 func (queue *redisQueue) increaseConsumerCount() {
 	queue.consumerWaitGroup.Add(1)
 }
@@ -107,8 +328,21 @@ func (queue *redisQueue) decreaseConsumerCount() {
 	queue.consumerWaitGroup.Done()
 }
 
+// WaitForConsuming waits until all consumers finished consuming after stop
+// consuming and all buffered deliveries are returned
 func (queue *redisQueue) WaitForConsuming() {
 	queue.consumerWaitGroup.Wait()
+	queue.fetcherWaitGroup.Wait()
+}
+
+// WaitForConsumingWithTimeout is similar to WaitForConsuming, but waits at
+// most timeout and returns false if consuming didn't finish by then
+func (queue *redisQueue) WaitForConsumingWithTimeout(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	if !waitTimeout(queue.consumerWaitGroup, timeout) {
+		return false
+	}
+	return waitTimeout(queue.fetcherWaitGroup, time.Until(deadline))
 }
 
 func (queue *redisQueue) String() string {
@@ -117,27 +351,310 @@ func (queue *redisQueue) String() string {
 
 // Publish adds a delivery with the given payload to the queue
 func (queue *redisQueue) Publish(payload string) bool {
-	// debug(fmt.Sprintf("publish %s %s", payload, queue)) // COMMENTOUT
-	return !redisErrIsNil(queue.redisClient.LPush(queue.readyKey, payload))
+	return queue.publish(queue.readyKey, newMessage(payload))
+}
+
+// publish adds the message to the ready list at key, the unique id of the
+// message makes sure acks remove exactly this delivery from unacked
+func (queue *redisQueue) publish(key string, message Message) bool {
+	queue.logger.debugf("publish %s %s", message.Payload, queue)
+	queue.mustTouch()
+	value, ok := queue.marshal(message)
+	if !ok {
+		return false
+	}
+	return count(&queue.counters.Published, !queue.logger.redisErrIsNil(queue.redisClient.LPush(key, value)))
+}
+
+// PublishFront adds a delivery with the given payload to the consuming end of
+// the ready list, so it gets consumed before all deliveries which are ready
+// already, last in first out. Deliveries of higher priorities and the ones
+// consumers prefetched before still get consumed first
+func (queue *redisQueue) PublishFront(payload string) bool {
+	queue.mustTouch()
+	value, ok := queue.marshal(newMessage(payload))
+	if !ok {
+		return false
+	}
+	return count(&queue.counters.Published, !queue.logger.redisErrIsNil(queue.redisClient.RPush(queue.readyKey, value)))
+}
+
+// marshal returns the value of the message in the queue's envelope, logs and
+// returns false if that failed
+func (queue *redisQueue) marshal(message Message) (string, bool) {
+	value, err := queue.envelope.Marshal(message)
+	if err != nil {
+		queue.logger.Printf("rmq queue %s failed to marshal message: %s", queue, err)
+		return "", false
+	}
+	return value, true
+}
+
+// CancelDelayed removes the delayed delivery with the given payload which
+// becomes ready first, returns false if there was no such delivery. Delayed
+// deliveries are stored in the queue's envelope, so they're found by reading
+// the delayed set in pages, which takes time linear in its size
+func (queue *redisQueue) CancelDelayed(payload string) (bool, error) {
+	member, found, err := queue.findDelayed(payload)
+	if err != nil || !found {
+		return false, err
+	}
+	removed, err := queue.redisClient.ZRem(queue.delayedKey, member).Result()
+	if err != nil {
+		return false, keyTypeError(err, queue.delayedKey)
+	}
+	return removed == 1, nil // zero if it became ready in the meantime
+}
+
+// RescheduleDelayed makes the delayed delivery with the given payload which
+// becomes ready first ready after newDelay from now instead, returns false if
+// there was no such delivery. Finds it like CancelDelayed
+func (queue *redisQueue) RescheduleDelayed(payload string, newDelay time.Duration) bool {
+	member, found, err := queue.findDelayed(payload)
+	if err != nil {
+		queue.logger.Printf("rmq queue %s failed to reschedule delayed delivery: %s", queue, err)
+		return false
+	}
+	if !found {
+		return false
+	}
+
+	result := queue.redisClient.ZAddXXCh(
+		queue.delayedKey,
+		redis.Z{
+			Member: member,
+			Score:  unixScore(queue.now().Add(newDelay)),
+		},
+	)
+	if queue.logger.redisErrIsNil(result) {
+		return false
+	}
+	wakeDelayed(queue.delayedWakeup)
+	return result.Val() == 1
+}
+
+// findDelayed returns the member of the delayed set with the given payload
+// which becomes ready first. Members are compared by the payload of their
+// message, as they can carry metadata like an id in the envelope
+func (queue *redisQueue) findDelayed(payload string) (string, bool, error) {
+	pageSize := int64(queue.delayedChunkSize)
+	for start := int64(0); ; start += pageSize {
+		members, err := queue.redisClient.ZRange(queue.delayedKey, start, start+pageSize-1).Result()
+		if err != nil {
+			return "", false, keyTypeError(err, queue.delayedKey)
+		}
+		for _, member := range members {
+			if unmarshalEnvelope(queue.envelope, member).Payload == payload {
+				return member, true, nil
+			}
+		}
+		if int64(len(members)) < pageSize {
+			return "", false, nil
+		}
+	}
+}
+
+// PublishWithPriority adds a delivery with the given payload to the ready list
+// of the given priority, deliveries of higher priorities get consumed first
+// priorities are capped to the range set by SetMaxPriority
+func (queue *redisQueue) PublishWithPriority(payload string, priority int) bool {
+	if priority < 0 {
+		priority = 0
+	}
+	if max := len(queue.priorityKeys) - 1; priority > max {
+		priority = max
+	}
+	return queue.publish(queue.priorityKeys[priority], newMessage(payload))
+}
+
+// SetMaxPriority enables priorities from 0 (same as Publish) to maxPriority
+// must be called on publishing and consuming queues before using them
+func (queue *redisQueue) SetMaxPriority(maxPriority int) {
+	priorityKeys := []string{queue.readyKey}
+	for priority := 1; priority <= maxPriority; priority++ {
+		priorityKeys = append(priorityKeys, fmt.Sprintf("%s::p%d", queue.readyKey, priority))
+	}
+	queue.priorityKeys = priorityKeys
+}
+
+// PublishWithTTL adds a delivery with the given payload to the queue which
+// gets dropped instead of consumed if it's still ready after ttl
+func (queue *redisQueue) PublishWithTTL(payload string, ttl time.Duration) bool {
+	message := newMessage(payload)
+	message.Expires = time.Now().Add(ttl).UnixNano()
+	return queue.publish(queue.readyKey, message)
+}
+
+// PublishUnique adds a delivery with the given payload to the queue unless a
+// delivery with the same dedupKey was published within window (0 = forever)
+// returns false without error if the delivery was a duplicate
+func (queue *redisQueue) PublishUnique(dedupKey, payload string, window time.Duration) (bool, error) {
+	key := strings.Replace(queueDedupTemplate, phQueue, queue.name, 1)
+	key = prefixKey(queue.prefix, strings.Replace(key, phDedup, dedupKey, 1))
+
+	value, err := queue.envelope.Marshal(newMessage(payload))
+	if err != nil {
+		return false, err
+	}
+	windowMillis := int64(window / time.Millisecond)
+	if window > 0 && windowMillis == 0 {
+		windowMillis = 1 // PX doesn't take fractions
+	}
+	if err := queue.touch(); err != nil {
+		return false, err
+	}
+
+	result := queue.redisClient.Eval(publishUniqueScript, []string{key, queue.readyKey}, value, windowMillis)
+	if err := result.Err(); err != nil && err != redis.Nil {
+		return false, keyTypeError(err, key, queue.readyKey)
+	}
+	if published, _ := result.Val().(int64); published != 1 {
+		return false, nil
+	}
+	return count(&queue.counters.Published, true), nil
+}
+
+// publishUniqueScript pushes ARGV[1] to the ready list at KEYS[2] unless the
+// dedup key at KEYS[1] exists, and sets the dedup key to expire after ARGV[2]
+// milliseconds, never if it's zero. Returns the number of pushed deliveries
+const publishUniqueScript = `local set
+if tonumber(ARGV[2]) > 0 then
+    set = redis.call('set', KEYS[1], 1, 'NX', 'PX', ARGV[2])
+else
+    set = redis.call('set', KEYS[1], 1, 'NX')
+end
+if not set then
+    return 0
+end
+redis.call('lpush', KEYS[2], ARGV[1])
+return 1`
+
+// PublishBounded adds a delivery with the given payload to the queue unless
+// it already has maxReady or more ready deliveries, checked atomically in a
+// single script. Returns false without error if the queue was full
+func (queue *redisQueue) PublishBounded(payload string, maxReady int) (bool, error) {
+	if err := queue.touch(); err != nil {
+		return false, err
+	}
+	value, err := queue.envelope.Marshal(newMessage(payload))
+	if err != nil {
+		return false, err
+	}
+
+	result := queue.redisClient.Eval(
+		`if redis.call('llen', KEYS[1]) >= tonumber(ARGV[1]) then
+    return 0
+end
+redis.call('lpush', KEYS[1], ARGV[2])
+return 1`,
+		[]string{queue.readyKey},
+		maxReady,
+		value,
+	)
+	if err := result.Err(); err != nil {
+		return false, keyTypeError(err, queue.readyKey)
+	}
+	published, _ := result.Val().(int64)
+	return count(&queue.counters.Published, published == 1), nil
+}
+
+// PublishWithTrace is similar to Publish, but also publishes the trace context
+// of ctx so the consumption can be traced as part of it. Falls back to Publish
+// if no tracer is set
+func (queue *redisQueue) PublishWithTrace(ctx context.Context, payload string) bool {
+	if queue.tracer == nil {
+		return queue.Publish(payload)
+	}
+
+	message := newMessage(payload)
+	message.Trace = queue.tracer.Inject(ctx)
+	return queue.publish(queue.readyKey, message)
+}
+
+// PublishWithHeaders adds a delivery with the given payload and headers to the
+// queue. Consumers get the headers from Delivery.Headers, they stay with the
+// delivery when it gets rejected, delayed, pushed or returned
+func (queue *redisQueue) PublishWithHeaders(payload string, headers map[string]string) bool {
+	message := newMessage(payload)
+	message.Headers = headers
+	return queue.publish(queue.readyKey, message)
 }
 
 // PublishToDelayedQueue adds a delivery with the given payload to a delayed queue
+// delayed payloads must be unique, publishing the same payload again only
+// changes the time it becomes ready
 func (queue *redisQueue) PublishToDelayedQueue(payload string, delayedTime time.Duration) bool {
-	// debug(fmt.Sprintf("publish %s %s", payload, queue)) // COMMENTOUT
-	return !redisErrIsNil(
+	return queue.PublishAt(payload, queue.now().Add(delayedTime))
+}
+
+// PublishAt adds a delivery with the given payload to the delayed queue which
+// becomes ready to be consumed at runAt
+func (queue *redisQueue) PublishAt(payload string, runAt time.Time) bool {
+	queue.logger.debugf("publish %s %s", payload, queue)
+	queue.mustTouch()
+	value, ok := queue.marshal(newMessage(payload))
+	if !ok {
+		return false
+	}
+	defer wakeDelayed(queue.delayedWakeup)
+	return count(&queue.counters.Published, !queue.logger.redisErrIsNil(
 		queue.redisClient.ZAdd(
 			queue.delayedKey,
 			redis.Z{
-				Member: payload,
-				Score:  float64(time.Now().Add(delayedTime).UnixNano()),
+				Member: value,
+				Score:  unixScore(runAt),
 			},
 		),
-	)
+	))
+}
+
+// DelayedItem is a delivery to publish with PublishToDelayedQueueBatch which
+// becomes ready after Delay
+type DelayedItem struct {
+	Payload string
+	Delay   time.Duration
+}
+
+// PublishToDelayedQueueBatch adds deliveries with the payloads of items to the
+// delayed queue in one ZADD. Like for PublishToDelayedQueue each item becomes
+// a delivery of its own, unless the queue's envelope doesn't keep ids. Then a
+// payload which is already delayed or occurs more than once in items only
+// changes the time it becomes ready (to the one of its last occurrence).
+// Returns the number of newly delayed deliveries
+func (queue *redisQueue) PublishToDelayedQueueBatch(items []DelayedItem) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	queue.logger.debugf("publish %d delayed %s", len(items), queue)
+	if err := queue.touch(); err != nil {
+		return 0, err
+	}
+	now := queue.now()
+	members := make([]redis.Z, len(items))
+	for i, item := range items {
+		value, err := queue.envelope.Marshal(newMessage(item.Payload))
+		if err != nil {
+			return 0, err
+		}
+		members[i] = redis.Z{Member: value, Score: unixScore(now.Add(item.Delay))}
+	}
+	added, err := queue.redisClient.ZAdd(queue.delayedKey, members...).Result()
+	if err != nil {
+		return 0, keyTypeError(err, queue.delayedKey)
+	}
+	atomic.AddInt64(&queue.counters.Published, int64(len(items)))
+	wakeDelayed(queue.delayedWakeup)
+	return int(added), nil
 }
 
 // PurgeReady removes all ready deliveries from the queue and returns the number of purged deliveries
 func (queue *redisQueue) PurgeReady() int {
-	return queue.deleteRedisList(queue.readyKey)
+	purged := 0
+	for _, key := range queue.priorityKeys {
+		purged += queue.deleteRedisList(key)
+	}
+	return purged
 }
 
 // PurgeDelayed removes all delayed deliveries from the queue and returns the number of purged deliveries
@@ -150,29 +667,41 @@ func (queue *redisQueue) PurgeRejected() int {
 	return queue.deleteRedisList(queue.rejectedKey)
 }
 
-// Close purges and removes the queue from the list of queues
+// Close purges all ready, delayed and rejected deliveries of the queue and
+// removes it from the list of queues. Use StopConsuming or Connection.Close
+// instead to stop consuming without losing deliveries
 func (queue *redisQueue) Close() bool {
 	queue.PurgeRejected()
 	queue.PurgeDelayed()
 	queue.PurgeReady()
-	result := queue.redisClient.SRem(queuesKey, queue.name)
-	if redisErrIsNil(result) {
+	result := queue.redisClient.SRem(queue.allQueuesKey, queue.name)
+	if queue.logger.redisErrIsNil(result) {
 		return false
 	}
 	return result.Val() > 0
 }
 
+// Counters returns the number of operations performed on this queue through
+// its connection, without a redis round trip. See Connection.Counters
+func (queue *redisQueue) Counters() QueueCounters {
+	return queue.counters.snapshot()
+}
+
+// ReadyCount returns the number of ready deliveries of all priorities
 func (queue *redisQueue) ReadyCount() int {
-	result := queue.redisClient.LLen(queue.readyKey)
-	if redisErrIsNil(result) {
-		return 0
+	readyCount := 0
+	for _, key := range queue.priorityKeys {
+		result := queue.redisClient.LLen(key)
+		if !queue.logger.redisErrIsNil(result) {
+			readyCount += int(result.Val())
+		}
 	}
-	return int(result.Val())
+	return readyCount
 }
 
 func (queue *redisQueue) DelayedCount() int {
 	result := queue.redisClient.ZCount(queue.delayedKey, "-inf", "+inf")
-	if redisErrIsNil(result) {
+	if queue.logger.redisErrIsNil(result) {
 		return 0
 	}
 	return int(result.Val())
@@ -180,7 +709,7 @@ func (queue *redisQueue) DelayedCount() int {
 
 func (queue *redisQueue) UnackedCount() int {
 	result := queue.redisClient.LLen(queue.unackedKey)
-	if redisErrIsNil(result) {
+	if queue.logger.redisErrIsNil(result) {
 		return 0
 	}
 	return int(result.Val())
@@ -188,37 +717,270 @@ func (queue *redisQueue) UnackedCount() int {
 
 func (queue *redisQueue) RejectedCount() int {
 	result := queue.redisClient.LLen(queue.rejectedKey)
-	if redisErrIsNil(result) {
+	if queue.logger.redisErrIsNil(result) {
 		return 0
 	}
 	return int(result.Val())
 }
 
-// ReturnAllUnacked moves all unacked deliveries back to the ready
-// queue and deletes the unacked key afterwards, returns number of returned
-// deliveries
+// TotalCount returns the number of ready, unacked and delayed deliveries, so
+// all outstanding work, and rejected ones too if includeRejected is set. Like
+// UnackedCount it only counts deliveries unacked in this connection. All
+// counts are read in a single round trip
+func (queue *redisQueue) TotalCount(includeRejected bool) int {
+	total, err := queue.TotalCountE(includeRejected)
+	if err != nil {
+		queue.logger.Panicf("rmq redis error is not nil %#v", err)
+	}
+	return total
+}
+
+// TotalCountE is similar to TotalCount, but returns redis errors instead of
+// panicking
+func (queue *redisQueue) TotalCountE(includeRejected bool) (int, error) {
+	pipe := queue.redisClient.Pipeline()
+	results := []*redis.IntCmd{}
+	for _, key := range queue.priorityKeys {
+		results = append(results, pipe.LLen(key))
+	}
+	results = append(results, pipe.LLen(queue.unackedKey), pipe.ZCard(queue.delayedKey))
+	if includeRejected {
+		results = append(results, pipe.LLen(queue.rejectedKey))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		keys := append([]string{queue.unackedKey, queue.delayedKey, queue.rejectedKey}, queue.priorityKeys...)
+		return 0, keyTypeError(err, keys...)
+	}
+
+	total := 0
+	for _, result := range results {
+		total += int(result.Val())
+	}
+	return total, nil
+}
+
+// PeekReady returns up to count ready payloads without consuming them in the
+// order they would be consumed, so highest priority and oldest first
+func (queue *redisQueue) PeekReady(count int) ([]string, error) {
+	payloads := []string{}
+	for priority := len(queue.priorityKeys) - 1; priority >= 0 && len(payloads) < count; priority-- {
+		peeked, err := queue.peekList(queue.priorityKeys[priority], count-len(payloads))
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, peeked...)
+	}
+	return payloads, nil
+}
+
+// PeekRejected returns up to count rejected payloads without removing them,
+// oldest first which is the order ReturnRejected returns them in
+func (queue *redisQueue) PeekRejected(count int) ([]string, error) {
+	if count <= 0 {
+		return []string{}, nil
+	}
+	return queue.peekList(queue.rejectedKey, count)
+}
+
+// RejectedDelivery is a rejected payload along with its metadata
+type RejectedDelivery struct {
+	Payload string
+	message Message
+}
+
+// RejectedBy returns the tag of the consumer which rejected the delivery,
+// empty unless it got rejected while recording it, see SetRecordRejectedBy
+func (delivery RejectedDelivery) RejectedBy() string {
+	return delivery.message.RejectedBy
+}
+
+// Message returns the payload of the delivery along with its metadata
+func (delivery RejectedDelivery) Message() Message {
+	return delivery.message
+}
+
+// PeekRejectedDeliveries is similar to PeekRejected, but returns the rejected
+// deliveries along with their metadata
+func (queue *redisQueue) PeekRejectedDeliveries(count int) ([]RejectedDelivery, error) {
+	if count <= 0 {
+		return []RejectedDelivery{}, nil
+	}
+
+	messages, err := queue.peekMessages(queue.rejectedKey, count)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]RejectedDelivery, len(messages))
+	for i, message := range messages {
+		deliveries[i] = RejectedDelivery{Payload: message.Payload, message: message}
+	}
+	return deliveries, nil
+}
+
+// DelayedDelivery is a delayed payload along with the time it becomes ready
+type DelayedDelivery struct {
+	Payload string
+	RunAt   time.Time // rounded like the stored score, see unixScore
+}
+
+// PeekDelayed returns up to count delayed payloads without consuming them,
+// the ones which become ready first come first. RunAt is read back from the
+// float64 score, so it's only precise to 256ns for current times
+func (queue *redisQueue) PeekDelayed(count int) ([]DelayedDelivery, error) {
+	if count <= 0 {
+		return []DelayedDelivery{}, nil
+	}
+
+	values, err := queue.redisClient.ZRangeWithScores(queue.delayedKey, 0, int64(count-1)).Result()
+	if err != nil {
+		return nil, keyTypeError(err, queue.delayedKey)
+	}
+
+	deliveries := make([]DelayedDelivery, len(values))
+	for i, value := range values {
+		member, _ := value.Member.(string)
+		deliveries[i] = DelayedDelivery{
+			Payload: unmarshalEnvelope(queue.envelope, member).Payload,
+			RunAt:   time.Unix(0, int64(value.Score)),
+		}
+	}
+	return deliveries, nil
+}
+
+// peekList returns up to count payloads from the right (oldest) end of a list
+func (queue *redisQueue) peekList(key string, count int) ([]string, error) {
+	messages, err := queue.peekMessages(key, count)
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := make([]string, len(messages))
+	for i, message := range messages {
+		payloads[i] = message.Payload
+	}
+	return payloads, nil
+}
+
+// peekMessages is similar to peekList, but returns the messages
+func (queue *redisQueue) peekMessages(key string, count int) ([]Message, error) {
+	values, err := queue.redisClient.LRange(key, int64(-count), -1).Result()
+	if err != nil {
+		return nil, keyTypeError(err, key)
+	}
+
+	messages := make([]Message, len(values))
+	for i, value := range values {
+		messages[len(values)-1-i] = unmarshalEnvelope(queue.envelope, value)
+	}
+	return messages, nil
+}
+
+// ReturnAllUnacked moves all unacked deliveries back to the ready queue one
+// by one until there are none left, so deliveries acked in the meantime are
+// neither missed nor returned. Returns the number of returned deliveries
 func (queue *redisQueue) ReturnAllUnacked() int {
-	result := queue.redisClient.LLen(queue.unackedKey)
-	if redisErrIsNil(result) {
-		return 0
+	for returned := 0; ; returned++ {
+		if !queue.returnOneUnacked() {
+			return returned
+		}
 	}
+}
 
-	unackedCount := int(result.Val())
-	for i := 0; i < unackedCount; i++ {
-		if redisErrIsNil(queue.redisClient.RPopLPush(queue.unackedKey, queue.readyKey)) {
-			return i
+// ReturnUnacked is similar to ReturnAllUnacked, but returns at most count of
+// the unacked deliveries, the ones fetched first. Useful to return only those
+// most likely stuck. Returns the number of returned deliveries
+func (queue *redisQueue) ReturnUnacked(count int) int {
+	for returned := 0; returned < count; returned++ {
+		if !queue.returnOneUnacked() {
+			return returned
 		}
-		// debug(fmt.Sprintf("rmq queue returned unacked delivery %s %s", result.Val(), queue.readyKey)) // COMMENTOUT
 	}
+	return count
+}
 
-	return unackedCount
+// returnOneUnacked moves the unacked delivery fetched first back to the ready
+// queue, returns false if there are no unacked deliveries
+func (queue *redisQueue) returnOneUnacked() bool {
+	result := queue.redisClient.Eval(returnedLua+`local value = redis.call('rpop', KEYS[1])
+if not value then
+    return false
+end
+redis.call('lpush', KEYS[2], returned(value))
+return 1`,
+		[]string{queue.unackedKey, queue.readyKey},
+		envelopePrefix,
+	)
+	if queue.logger.redisErrIsNil(result) {
+		return false
+	}
+	queue.logger.debugf("queue returned unacked delivery %s", queue.readyKey)
+	return true
 }
 
+// RecoverUnacked returns the deliveries left unacked by a previous run using
+// the same connection name to ready, so they get consumed again. It must be
+// called before StartConsuming or after StopConsuming once the consumers
+// finished, see WaitForConsuming, as while consuming the unacked deliveries
+// might be in flight. Returns the number of recovered deliveries
+func (queue *redisQueue) RecoverUnacked() (int, error) {
+	if queue.consuming() {
+		return 0, fmt.Errorf("rmq queue %s is consuming, can't recover its unacked deliveries", queue)
+	}
+	return queue.ReturnAllUnacked(), nil
+}
+
+// consuming returns whether the queue started consuming and didn't stop since
+func (queue *redisQueue) consuming() bool {
+	return queue.deliveryChan != nil && atomic.LoadInt32(&queue.consumingStopped) == 0
+}
+
+// RecoverUnackedOrdered is similar to RecoverUnacked, but returns the
+// deliveries to the front of ready in the order they were fetched, so they get
+// consumed before the ones which became ready in the meantime. Use it to keep
+// consuming first in first out across restarts. Unacked deliveries don't keep
+// the priority they were fetched from, so with SetMaxPriority they return to
+// the list of the highest priority to still get consumed first. They are
+// moved in chunks of returnBatchSize per script
+func (queue *redisQueue) RecoverUnackedOrdered() (int, error) {
+	if queue.consuming() {
+		return 0, fmt.Errorf("rmq queue %s is consuming, can't recover its unacked deliveries", queue)
+	}
+
+	readyKey := queue.priorityKeys[len(queue.priorityKeys)-1]
+	recovered := 0
+	for {
+		moved, err := queue.redisClient.Eval(recoverOrderedScript, []string{queue.unackedKey, readyKey}, envelopePrefix, returnBatchSize).Int64()
+		if err != nil {
+			return recovered, keyTypeError(err, queue.unackedKey, readyKey)
+		}
+		recovered += int(moved)
+		if moved < returnBatchSize {
+			return recovered, nil
+		}
+	}
+}
+
+// recoverOrderedScript moves up to ARGV[2] deliveries from the newest end of
+// the unacked list at KEYS[1] to the consuming end of the ready list at
+// KEYS[2], counting them as returned. Unacked has the first fetched delivery
+// at its oldest end, so moving the last fetched one first keeps their order.
+// Returns the number of moved deliveries
+const recoverOrderedScript = returnedLua + `local recovered = 0
+while recovered < tonumber(ARGV[2]) do
+    local value = redis.call('lpop', KEYS[1])
+    if not value then
+        break
+    end
+    redis.call('rpush', KEYS[2], returned(value))
+    recovered = recovered + 1
+end
+return recovered`
+
 // ReturnAllRejected moves all rejected deliveries back to the ready
 // list and returns the number of returned deliveries
 func (queue *redisQueue) ReturnAllRejected() int {
 	result := queue.redisClient.LLen(queue.rejectedKey)
-	if redisErrIsNil(result) {
+	if queue.logger.redisErrIsNil(result) {
 		return 0
 	}
 
@@ -227,177 +989,1336 @@ func (queue *redisQueue) ReturnAllRejected() int {
 }
 
 // ReturnRejected tries to return count rejected deliveries back to
-// the ready list and returns the number of returned deliveries
+// the ready list and returns the number of returned deliveries. They get
+// consumed in the order they were rejected in, see ReturnRejectedOrdered
 func (queue *redisQueue) ReturnRejected(count int) int {
 	if count == 0 {
 		return 0
 	}
 
 	for i := 0; i < count; i++ {
-		result := queue.redisClient.RPopLPush(queue.rejectedKey, queue.readyKey)
-		if redisErrIsNil(result) {
+		result := queue.popPush(queue.rejectedKey, queue.readyKey)
+		if queue.logger.redisErrIsNil(result) {
 			return i
 		}
-		// debug(fmt.Sprintf("rmq queue returned rejected delivery %s %s", result.Val(), queue.readyKey)) // COMMENTOUT
+		queue.logger.debugf("queue returned rejected delivery %s %s", result.Val(), queue.readyKey)
 	}
 
 	return count
 }
 
+// ReturnRejectedOrdered is similar to ReturnRejected, but the returned
+// deliveries get consumed in the order they were originally published in
+// instead of the order they were rejected in. Plain payloads not published by
+// rmq have no publish time, they keep their order and get consumed first
+func (queue *redisQueue) ReturnRejectedOrdered(count int) (int, error) {
+	if count <= 0 {
+		return 0, nil
+	}
+
+	// the oldest rejected deliveries, newest first
+	values, err := queue.redisClient.LRange(queue.rejectedKey, int64(-count), -1).Result()
+	if err != nil {
+		return 0, keyTypeError(err, queue.rejectedKey)
+	}
+
+	// the first argument gets pushed to ready first, so it gets consumed first
+	enqueuedAt := make(map[string]int64, len(values))
+	args := make([]interface{}, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		enqueuedAt[values[i]] = unmarshalEnvelope(queue.envelope, values[i]).EnqueuedAt
+		args = append(args, values[i])
+	}
+	sort.SliceStable(args, func(i, j int) bool {
+		return enqueuedAt[args[i].(string)] < enqueuedAt[args[j].(string)]
+	})
+
+	result := queue.redisClient.Eval(
+		`local returned = 0
+for i = 1, #ARGV do
+    if redis.call('lrem', KEYS[1], -1, ARGV[i]) == 1 then
+        redis.call('lpush', KEYS[2], ARGV[i])
+        returned = returned + 1
+    end
+end
+return returned`,
+		[]string{queue.rejectedKey, queue.readyKey},
+		args...,
+	)
+	if err := result.Err(); err != nil {
+		return 0, keyTypeError(err, queue.rejectedKey, queue.readyKey)
+	}
+	returned, _ := result.Val().(int64)
+	return int(returned), nil
+}
+
+// rejectedPageSize is the number of rejected deliveries read per LRANGE
+const rejectedPageSize = 100
+
+// ReturnRejectedMatching returns up to max rejected deliveries for whose
+// payload pred returns true to ready, oldest first. The others stay rejected
+// in their order. Returns the number of returned deliveries
+func (queue *redisQueue) ReturnRejectedMatching(pred func(payload string) bool, max int) (int, error) {
+	returned := 0
+	kept := 0 // number of not matching deliveries at the oldest end
+	for returned < max {
+		// read the next page from the oldest end, skipping the kept ones
+		values, err := queue.redisClient.LRange(queue.rejectedKey, int64(-kept-rejectedPageSize), int64(-kept-1)).Result()
+		if err != nil {
+			return returned, keyTypeError(err, queue.rejectedKey)
+		}
+
+		for i := len(values) - 1; i >= 0 && returned < max; i-- {
+			if !pred(unmarshalEnvelope(queue.envelope, values[i]).Payload) {
+				kept++
+				continue
+			}
+
+			moved, err := queue.returnRejectedValue(values[i])
+			if err != nil {
+				return returned, err
+			}
+			if moved {
+				returned++
+			}
+		}
+
+		if len(values) < rejectedPageSize {
+			break // reached the newest end
+		}
+	}
+	return returned, nil
+}
+
+// returnRejectedValue moves the oldest occurrence of value from rejected to
+// ready, returns false if it isn't rejected anymore
+func (queue *redisQueue) returnRejectedValue(value string) (bool, error) {
+	result := queue.redisClient.Eval(
+		`if redis.call('lrem', KEYS[1], -1, ARGV[1]) == 0 then
+    return 0
+end
+redis.call('lpush', KEYS[2], ARGV[1])
+return 1`,
+		[]string{queue.rejectedKey, queue.readyKey},
+		value,
+	)
+	if err := result.Err(); err != nil {
+		return false, keyTypeError(err, queue.rejectedKey, queue.readyKey)
+	}
+	moved, _ := result.Val().(int64)
+	return moved == 1, nil
+}
+
+// RejectedDeliveries takes up to count of the oldest rejected deliveries out
+// of the rejected list to inspect them. Ack drops a delivery, Reject puts it
+// back to the newest end of rejected, Push, RequeueFront and the like move it
+// as usual. Their state changes from Inspected and aren't counted as the
+// queue's acks or rejects. Deliveries neither acked nor moved return to
+// rejected when the connection gets closed or cleaned
+func (queue *redisQueue) RejectedDeliveries(count int) ([]Delivery, error) {
+	if count <= 0 {
+		return []Delivery{}, nil
+	}
+
+	// add queue to list of queues consumed on this connection, so the cleaner
+	// returns the inspected deliveries if this connection dies
+	if err := queue.redisClient.SAdd(queue.queuesKey, queue.name).Err(); err != nil {
+		return nil, keyTypeError(err, queue.queuesKey)
+	}
+
+	deliveries := make([]Delivery, 0, count)
+	for len(deliveries) < count {
+		payload, err := queue.popPush(queue.rejectedKey, queue.inspectedKey).Result()
+		switch err {
+		case nil:
+		case redis.Nil:
+			return deliveries, nil // empty
+		default:
+			return deliveries, keyTypeError(err, queue.rejectedKey, queue.inspectedKey)
+		}
+
+		delivery := queue.newDelivery(payload)
+		delivery.inspect(queue.inspectedKey)
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// returnInspectedScript moves up to ARGV[1] deliveries from the oldest end of
+// the inspected list at KEYS[1] to the oldest end of the rejected list at
+// KEYS[2], keeping their order. Returns the number of moved deliveries
+const returnInspectedScript = `local returned = 0
+while returned < tonumber(ARGV[1]) do
+    local value = redis.call('lpop', KEYS[1])
+    if not value then
+        break
+    end
+    redis.call('rpush', KEYS[2], value)
+    returned = returned + 1
+end
+return returned`
+
+// returnInspected moves the deliveries taken out by RejectedDeliveries back
+// to the oldest end of rejected in their order, in chunks of returnBatchSize
+// so redis isn't blocked for long. Returns their number
+func (queue *redisQueue) returnInspected() int {
+	returned := 0
+	for {
+		result := queue.redisClient.Eval(returnInspectedScript, []string{queue.inspectedKey, queue.rejectedKey}, returnBatchSize)
+		if queue.logger.redisErrIsNil(result) {
+			return returned
+		}
+		moved, _ := result.Val().(int64)
+		returned += int(moved)
+		if moved < returnBatchSize {
+			return returned
+		}
+	}
+}
+
+// ReturnRejectedWithRate is similar to ReturnRejected, but returns at most
+// perSecond deliveries per second (<= 0 means unlimited) to not overwhelm
+// the consumers. Stops early if ctx is done
+func (queue *redisQueue) ReturnRejectedWithRate(ctx context.Context, count int, perSecond int) int {
+	if perSecond <= 0 {
+		return queue.returnRejectedPaced(ctx, count, 0, sleepContext)
+	}
+	return queue.returnRejectedPaced(ctx, count, time.Second/time.Duration(perSecond), sleepContext)
+}
+
+// returnRejectedPaced returns up to count rejected deliveries and sleeps for
+// interval between them, sleep returns false if it got interrupted
+func (queue *redisQueue) returnRejectedPaced(ctx context.Context, count int, interval time.Duration, sleep func(context.Context, time.Duration) bool) int {
+	for i := 0; i < count; i++ {
+		if i > 0 && interval > 0 && !sleep(ctx, interval) {
+			return i
+		}
+		if ctx.Err() != nil {
+			return i
+		}
+
+		result := queue.popPush(queue.rejectedKey, queue.readyKey)
+		if queue.logger.redisErrIsNil(result) {
+			return i
+		}
+	}
+
+	return count
+}
+
+// sleepContext sleeps for duration and returns false if ctx got done before
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
 // CloseInConnection closes the queue in the associated connection by removing all related keys
 func (queue *redisQueue) CloseInConnection() {
-	redisErrIsNil(queue.redisClient.Del(queue.unackedKey))
-	redisErrIsNil(queue.redisClient.Del(queue.consumersKey))
-	redisErrIsNil(queue.redisClient.SRem(queue.queuesKey, queue.name))
+	queue.logger.redisErrIsNil(queue.redisClient.Del(queue.unackedKey))
+	queue.logger.redisErrIsNil(queue.redisClient.Del(queue.deadlinesKey))
+	queue.logger.redisErrIsNil(queue.redisClient.Del(queue.inspectedKey))
+	queue.logger.redisErrIsNil(queue.redisClient.Del(queue.consumersKey))
+	queue.logger.redisErrIsNil(queue.redisClient.SRem(queue.queuesKey, queue.name))
 }
 
+// SetPushQueue sets the queue deliveries get pushed to by Delivery.Push
+// logs and keeps pushing to rejected if pushQueue isn't a redis queue or the
+// queue itself
 func (queue *redisQueue) SetPushQueue(pushQueue Queue) {
+	if err := queue.SetPushQueueE(pushQueue); err != nil {
+		queue.logger.Printf("%s", err)
+	}
+}
+
+// SetPushQueueE is similar to SetPushQueue, but returns an error if pushQueue
+// isn't a queue opened from a redis connection
+func (queue *redisQueue) SetPushQueueE(pushQueue Queue) error {
 	redisPushQueue, ok := pushQueue.(*redisQueue)
 	if !ok {
-		return
+		return fmt.Errorf("rmq queue %s can't push to %T, only to queues opened from a connection", queue, pushQueue)
+	}
+	if redisPushQueue.readyKey == queue.readyKey {
+		return fmt.Errorf("rmq queue %s can't push to itself", queue)
 	}
 
 	queue.pushKey = redisPushQueue.readyKey
+	return nil
+}
+
+// SetPushQueueByName is similar to SetPushQueueE, but takes the name of the
+// queue to push to, so it doesn't need to be opened here. The queue gets the
+// key prefix of this queue's connection
+func (queue *redisQueue) SetPushQueueByName(name string) error {
+	if name == "" {
+		return fmt.Errorf("rmq queue %s can't push to a queue without name", queue)
+	}
+	pushKey := prefixKey(queue.prefix, strings.Replace(queueReadyTemplate, phQueue, name, 1))
+	if pushKey == queue.readyKey {
+		return fmt.Errorf("rmq queue %s can't push to itself", queue)
+	}
+
+	queue.pushKey = pushKey
+	return nil
+}
+
+// SetEnvelope sets how payloads and their metadata are stored in redis,
+// defaults to CompatEnvelope. Producers and consumers of the queue must use
+// the same envelope, nil restores the default
+func (queue *redisQueue) SetEnvelope(envelope Envelope) {
+	if envelope == nil {
+		envelope = CompatEnvelope{}
+	}
+	queue.envelope = envelope
+}
+
+// SetRecordRejectedBy makes deliveries rejected by consumers added afterwards
+// record the tag of their consumer, see RejectedDelivery.RejectedBy. This
+// rewrites the payloads of rejected deliveries, so it's off by default
+func (queue *redisQueue) SetRecordRejectedBy(record bool) {
+	queue.recordRejectedBy = record
+}
+
+// tagged returns consumer, passing tag to its deliveries if recorded on reject
+func (queue *redisQueue) tagged(tag string, consumer Consumer) Consumer {
+	if !queue.recordRejectedBy {
+		return consumer
+	}
+	return taggedConsumer{tag: tag, consumer: consumer}
+}
+
+// taggedBatch is similar to tagged, but for batch consumers
+func (queue *redisQueue) taggedBatch(tag string, consumer BatchConsumer) BatchConsumer {
+	if !queue.recordRejectedBy {
+		return consumer
+	}
+	return taggedBatchConsumer{tag: tag, consumer: consumer}
+}
+
+// SetMaxPushHops sets how often a delivery can be pushed before Push rejects
+// it instead, to end cycles of push queues like A to B to A. Defaults to 10,
+// zero for no limit
+func (queue *redisQueue) SetMaxPushHops(maxHops int) {
+	queue.maxPushHops = maxHops
+}
+
+// SetDeadLetterQueue makes deliveries which got rejected maxAttempts times go
+// to the ready list of deadLetterQueue instead of the rejected list
+// logs and keeps rejecting to rejected if deadLetterQueue isn't a redis queue
+// or the queue itself
+func (queue *redisQueue) SetDeadLetterQueue(deadLetterQueue Queue, maxAttempts int) {
+	if err := queue.SetDeadLetterQueueE(deadLetterQueue, maxAttempts); err != nil {
+		queue.logger.Printf("%s", err)
+	}
+}
+
+// SetDeadLetterQueueE is similar to SetDeadLetterQueue, but returns an error
+// if deadLetterQueue isn't a queue opened from a redis connection
+func (queue *redisQueue) SetDeadLetterQueueE(deadLetterQueue Queue, maxAttempts int) error {
+	redisDeadLetterQueue, ok := deadLetterQueue.(*redisQueue)
+	if !ok {
+		return fmt.Errorf("rmq queue %s can't use %T as dead letter queue, only queues opened from a connection", queue, deadLetterQueue)
+	}
+	if redisDeadLetterQueue.readyKey == queue.readyKey {
+		return fmt.Errorf("rmq queue %s can't be its own dead letter queue", queue)
+	}
+
+	queue.deadLetterKey = redisDeadLetterQueue.readyKey
+	queue.maxAttempts = maxAttempts
+	return nil
+}
+
+// RejectedPolicy decides what happens to deliveries rejected while the
+// rejected list is full, see SetMaxRejected
+type RejectedPolicy int
+
+const (
+	DropOldestRejected RejectedPolicy = iota // the oldest rejected delivery gets dropped
+	RefuseNewRejected                        // rejecting fails and the delivery stays unacked
+)
+
+// SetMaxRejected limits the rejected list to maxRejected deliveries, zero
+// removes the limit. Once it's full, policy decides whether the oldest
+// rejected delivery gets dropped or the new one doesn't get rejected
+func (queue *redisQueue) SetMaxRejected(maxRejected int, policy RejectedPolicy) {
+	queue.maxRejected = maxRejected
+	queue.rejectedPolicy = policy
+}
+
+// SetDelayedChunkSize sets how many due delayed deliveries are pushed to
+// unacked per command while moving them, defaults to 100
+func (queue *redisQueue) SetDelayedChunkSize(chunkSize int) {
+	if chunkSize < 1 {
+		chunkSize = defaultDelayedChunkSize
+	}
+	queue.delayedChunkSize = chunkSize
+}
+
+// SetMaxDelayedWait sets how long consuming waits at most before checking the
+// delayed queue again, defaults to the poll duration. Consuming waits until
+// the next delayed delivery is due, and is woken right away by deliveries
+// delayed through this queue instance. Deliveries delayed by other processes
+// which become due earlier than the next known one may get consumed up to
+// maxWait late, so a longer maxWait saves polls at the cost of their latency.
+// Poll durations longer than maxWait are kept, zero resets it to the default
+func (queue *redisQueue) SetMaxDelayedWait(maxWait time.Duration) {
+	if maxWait < 0 {
+		maxWait = 0
+	}
+	queue.maxDelayedWait = maxWait
+}
+
+// SetServerClock makes delays relative to the time of the redis server instead
+// of the local time, so publishers and consumers with skewed clocks agree on
+// when delayed deliveries are due. This costs a round trip to read the time
+// on each delayed publish, delay and poll of the delayed queue. Set it on all
+// queue instances publishing or consuming delayed deliveries
+func (queue *redisQueue) SetServerClock(serverClock bool) {
+	queue.serverClock = serverClock
+}
+
+// now returns the current time, of the redis server if the queue uses its clock
+func (queue *redisQueue) now() time.Time {
+	if !queue.serverClock {
+		return time.Now()
+	}
+	return serverTime(queue.redisClient, queue.delayedKey, queue.logger)
+}
+
+// SetVisibilityTimeout makes deliveries which stay unacked for longer than
+// timeout return to ready while consuming, zero disables it. Consumers which
+// are just slow may ack after their delivery got redelivered, so deliveries
+// can be consumed more than once
+func (queue *redisQueue) SetVisibilityTimeout(timeout time.Duration) {
+	queue.visibilityTimeout = timeout
+}
+
+// SetDefaultBatchTimeout sets the timeout of batch consumers added with
+// AddBatchConsumer afterwards, defaults to one second
+func (queue *redisQueue) SetDefaultBatchTimeout(timeout time.Duration) {
+	queue.batchTimeout = timeout
+}
+
+// SetEphemeral marks the queue as ephemeral, so Cleaner.ExpireIdleQueues
+// removes it once nothing got published to or consumed from it for idle. It
+// needs to be set on all queue instances publishing to or consuming from the
+// queue to track their activity. Zero keeps the queue, which is the default
+func (queue *redisQueue) SetEphemeral(idle time.Duration) {
+	queue.idleExpiry = idle
+	atomic.StoreInt64(&queue.touched, 0)
+	if idle <= 0 {
+		queue.logger.redisErrIsNil(queue.redisClient.HDel(queue.ephemeralKey, queue.name))
+		queue.logger.redisErrIsNil(queue.redisClient.Del(queue.activityKey))
+		return
+	}
+	queue.mustTouch()
+}
+
+// touchFraction is the part of their idle time within which ephemeral queues
+// record activity only once, so not every publish and consume writes it
+const touchFraction = 10
+
+// touch records activity on ephemeral queues and registers them again in
+// case they got removed for being idle in between. An instance records it at
+// most once per tenth of the idle time, long before the cleaner could consider
+// the queue idle. Queues which aren't ephemeral return right away
+func (queue *redisQueue) touch() error {
+	if queue.idleExpiry <= 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&queue.touched) < int64(queue.idleExpiry/touchFraction) {
+		return nil
+	}
+
+	pipe := queue.redisClient.Pipeline()
+	pipe.SAdd(queue.allQueuesKey, queue.name)
+	pipe.HSet(queue.ephemeralKey, queue.name, int64(queue.idleExpiry))
+	pipe.Set(queue.activityKey, now, 0)
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&queue.touched, now)
+	return nil
+}
+
+// mustTouch is touch for methods which panic on redis errors
+func (queue *redisQueue) mustTouch() {
+	if err := queue.touch(); err != nil {
+		queue.logger.Panicf("rmq redis error is not nil %#v", err)
+	}
+}
+
+// SetDrainedSettle sets how long ready and unacked need to stay empty before
+// the channel returned by DrainedChan gets closed, to not report brief lulls
+// as drained. Defaults to one second
+func (queue *redisQueue) SetDrainedSettle(settle time.Duration) {
+	queue.drainedLock.Lock()
+	defer queue.drainedLock.Unlock()
+	queue.drainedSettle = settle
+}
+
+// DrainedChan returns a channel which gets closed once consuming found ready
+// and unacked of this connection empty for the settle duration, see
+// SetDrainedSettle. Once new deliveries arrive afterwards, DrainedChan returns
+// a new channel for the next time the queue is drained. Only consumers
+// fetching ready deliveries detect it, so not while only consuming delayed
+// deliveries or while paused
+func (queue *redisQueue) DrainedChan() <-chan struct{} {
+	queue.drainedLock.Lock()
+	defer queue.drainedLock.Unlock()
+	if queue.drained == nil {
+		queue.drained = make(chan struct{})
+	}
+	return queue.drained
+}
+
+// checkDrained closes the drained channel if ready was found empty and
+// there are no unacked deliveries for the settle duration, and re-arms it
+// once there are deliveries again
+func (queue *redisQueue) checkDrained(readyEmpty bool) {
+	queue.drainedLock.Lock()
+	armed := queue.drained != nil
+	closed := queue.drainedClosed
+	queue.drainedLock.Unlock()
+	if !armed || (closed && readyEmpty) {
+		return // nobody waits or nothing changed
+	}
+
+	drained := readyEmpty
+	if drained {
+		unacked, err := queue.redisClient.LLen(queue.unackedKey).Result()
+		drained = err == nil && unacked == 0
+	}
+
+	queue.drainedLock.Lock()
+	defer queue.drainedLock.Unlock()
+	switch {
+	case !drained:
+		queue.emptySince = time.Time{}
+		if queue.drainedClosed {
+			queue.drained = make(chan struct{})
+			queue.drainedClosed = false
+		}
+	case queue.drainedClosed:
+	case queue.emptySince.IsZero():
+		queue.emptySince = time.Now()
+		fallthrough
+	default:
+		if time.Since(queue.emptySince) >= queue.drainedSettle {
+			close(queue.drained)
+			queue.drainedClosed = true
+		}
+	}
+}
+
+// SetPurgeBatchSize sets how many deliveries are removed per command while
+// purging, defaults to 100
+func (queue *redisQueue) SetPurgeBatchSize(batchSize int) {
+	if batchSize < 1 {
+		batchSize = purgeBatchSize
+	}
+	queue.purgeBatchSize = batchSize
+}
+
+// SetStrict makes adding consumers before calling StartConsuming panic
+// instead of logging and returning an empty name, to fail fast on misuse
+func (queue *redisQueue) SetStrict(strict bool) {
+	queue.strict = strict
+}
+
+// SetTracer enables tracing deliveries published with PublishWithTrace
+func (queue *redisQueue) SetTracer(tracer Tracer) {
+	queue.tracer = tracer
+}
+
+// SetOnStateChange sets a hook which gets called after each successful state
+// change of deliveries consumed afterwards, like when a delivery got acked.
+// It's called synchronously from Ack, Delay, Reject and the like, so keep it
+// cheap. Deliveries taken out by RejectedDeliveries change from Inspected
+// instead of Unacked. Pass nil to remove it
+func (queue *redisQueue) SetOnStateChange(onStateChange func(payload string, from, to State)) {
+	queue.onStateChange = onStateChange
+}
+
+// SetOnProcessed sets a hook which gets called like the one set with
+// SetOnStateChange, but with how long the delivery was held since it got
+// picked up from ready. Use it to measure consumer latency. It isn't called
+// for deliveries taken out by RejectedDeliveries. Pass nil to remove it
+func (queue *redisQueue) SetOnProcessed(onProcessed func(payload string, to State, duration time.Duration)) {
+	queue.onProcessed = onProcessed
+}
+
+// SetConsumePanicHandler sets a handler which gets called with the recovered
+// value and the delivery if a consumer panics, instead of logging the panic
+// and rejecting the delivery. Either way the consumer keeps consuming. Pass
+// nil to restore the default
+func (queue *redisQueue) SetConsumePanicHandler(onPanic func(recovered interface{}, delivery Delivery)) {
+	queue.onPanic = onPanic
+}
+
+// SetOnBackpressure sets a hook which gets called whenever the queue stops
+// fetching because the buffer of prefetched deliveries is full, meaning the
+// consumers can't keep up. It's called synchronously from the fetching loop,
+// so keep it cheap. Pass nil to remove it
+func (queue *redisQueue) SetOnBackpressure(onBackpressure func(queueName string, bufferLen, prefetchLimit int)) {
+	queue.onBackpressure = onBackpressure
+}
+
+// StartConsuming starts consuming into a channel of size prefetchLimit
+// must be called before consumers can be added!
+// pollDuration is the duration the queue sleeps before checking for new deliveries
+func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
+	return queue.StartConsumingWithBackoff(prefetchLimit, pollDuration, pollDuration)
+}
+
+// ErrAlreadyConsuming is returned when starting to consume a queue twice
+var ErrAlreadyConsuming = errors.New("rmq queue is already consuming")
+
+// StartConsumingE is similar to StartConsuming, but returns redis errors
+// instead of panicking, so starting can be retried
+func (queue *redisQueue) StartConsumingE(prefetchLimit int, pollDuration time.Duration) error {
+	return queue.startConsuming(prefetchLimit, pollDuration, pollDuration, false, true, true)
+}
+
+// StartConsumingWithBackoff is similar to StartConsuming, but while the queue
+// is empty the poll duration doubles with each poll up to maxPollDuration
+// it's reset to pollDuration as soon as there are deliveries again
+func (queue *redisQueue) StartConsumingWithBackoff(prefetchLimit int, pollDuration, maxPollDuration time.Duration) bool {
+	return mustStartConsuming(queue, queue.startConsuming(prefetchLimit, pollDuration, maxPollDuration, false, true, true))
+}
+
+// StartConsumingBlocking is similar to StartConsuming, but instead of polling
+// the ready list it waits for new deliveries with BRPOPLPUSH, so they get
+// consumed right after they were published. This blocks one connection of the
+// redis client pool for as long as the queue is consuming. blockTimeout is
+// rounded up to whole seconds and is how long stopping may take at most
+func (queue *redisQueue) StartConsumingBlocking(prefetchLimit int, blockTimeout time.Duration) bool {
+	if blockTimeout < time.Second {
+		blockTimeout = time.Second // BRPOPLPUSH supports whole seconds only, zero would block forever
+	}
+	blockTimeout = (blockTimeout + time.Second - 1).Truncate(time.Second)
+	return mustStartConsuming(queue, queue.startConsuming(prefetchLimit, blockTimeout, blockTimeout, true, true, true))
+}
+
+// mustStartConsuming returns false if the queue was consuming already and
+// panics on other errors
+func mustStartConsuming(queue *redisQueue, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case ErrAlreadyConsuming:
+		return false
+	default:
+		queue.logger.Panicf("rmq queue failed to start consuming %s: %s", queue, err)
+		return false
+	}
+}
+
+// StartConsumingOptions configures StartConsumingWithOptions
+type StartConsumingOptions struct {
+	PrefetchLimit int           // size of the channels deliveries are fetched into
+	PollDuration  time.Duration // how long the queue sleeps before checking for new deliveries
+	Immediate     bool          // fetch deliveries from ready
+	Delayed       bool          // fetch delayed deliveries once their delay passed
+}
+
+// ErrNothingToConsume is returned when starting to consume neither immediate
+// nor delayed deliveries
+var ErrNothingToConsume = errors.New("rmq queue would consume neither immediate nor delayed deliveries")
+
+// StartConsumingWithOptions is similar to StartConsumingE, but only fetches
+// the kinds of deliveries enabled in options. A scheduler worker only
+// consuming delayed deliveries, for example, doesn't poll the ready list.
+// Consumers of the disabled kind return right away, like ready consumers or
+// consumers added with their own prefetch when Immediate is off
+func (queue *redisQueue) StartConsumingWithOptions(options StartConsumingOptions) error {
+	if !options.Immediate && !options.Delayed {
+		return ErrNothingToConsume
+	}
+	return queue.startConsuming(options.PrefetchLimit, options.PollDuration, options.PollDuration, false, options.Immediate, options.Delayed)
+}
+
+func (queue *redisQueue) startConsuming(prefetchLimit int, pollDuration, maxPollDuration time.Duration, blocking, immediate, delayed bool) error {
+	if queue.deliveryChan != nil {
+		return ErrAlreadyConsuming
+	}
+
+	// add queue to list of queues consumed on this connection
+	if err := queue.redisClient.SAdd(queue.queuesKey, queue.name).Err(); err != nil {
+		return err
+	}
+
+	queue.prefetchLimit = prefetchLimit
+	queue.pollDuration = pollDuration
+	queue.maxPollDuration = maxPollDuration
+	queue.deliveryChan = make(chan Delivery, prefetchLimit)
+	queue.deliveryChanForDelayedQueue = make(chan Delivery, prefetchLimit)
+	queue.fetchImmediate = immediate
+	queue.logger.debugf("queue started consuming %s %d %s", queue, prefetchLimit, pollDuration)
+	switch {
+	case !immediate:
+		close(queue.deliveryChan) // so its consumers return right away
+	case blocking:
+		queue.fetcherWaitGroup.Add(1)
+		go queue.consumeBlocking(queue.deliveryChan, prefetchLimit)
+	default:
+		queue.fetcherWaitGroup.Add(1)
+		go queue.consume(queue.deliveryChan, prefetchLimit)
+	}
+	if delayed {
+		queue.fetcherWaitGroup.Add(1)
+		go queue.consumeForDelayedQueue()
+	} else {
+		close(queue.deliveryChanForDelayedQueue)
+	}
+	if queue.visibilityTimeout > 0 {
+		queue.fetcherWaitGroup.Add(1)
+		go queue.returnInvisibleLoop()
+	}
+	return nil
+}
+
+// StopConsuming stops fetching new deliveries, deliveries which were already
+// fetched but not yet consumed are returned to ready
+func (queue *redisQueue) StopConsuming() bool {
+	return queue.stopConsuming(false)
+}
+
+// StopConsumingAndDrain stops fetching new deliveries and waits up to timeout
+// for the consumers to consume the deliveries which were already fetched.
+// Fetched deliveries which weren't consumed in time are returned to ready
+func (queue *redisQueue) StopConsumingAndDrain(timeout time.Duration) error {
+	if !queue.stopConsuming(true) {
+		return fmt.Errorf("rmq queue failed to stop consuming %s", queue)
+	}
+
+	consumed := waitTimeout(queue.consumerWaitGroup, timeout)
+	if !consumed {
+		queue.stopConsumers() // so they don't race returning the buffered deliveries
+	}
+	queue.fetcherWaitGroup.Wait() // all channels are closed afterwards
+
+	returned := queue.returnBuffered(queue.deliveryChan)
+	returned += queue.returnBuffered(queue.deliveryChanForDelayedQueue)
+	queue.prefetchChansLock.Lock()
+	for _, deliveryChan := range queue.prefetchChans {
+		returned += queue.returnBuffered(deliveryChan)
+	}
+	queue.prefetchChansLock.Unlock()
+
+	if !consumed {
+		return fmt.Errorf("rmq queue failed to drain %s within %s, returned %d deliveries", queue, timeout, returned)
+	}
+	return nil
+}
+
+// stopConsumers makes the consumers return once they finished consuming their
+// current delivery, without taking further ones from the delivery channels
+func (queue *redisQueue) stopConsumers() {
+	if atomic.CompareAndSwapInt32(&queue.consumersStopped, 0, 1) {
+		close(queue.consumersStop)
+	}
+}
+
+func (queue *redisQueue) stopConsuming(drain bool) bool {
+	if queue.deliveryChan == nil || queue.deliveryChanForDelayedQueue == nil || atomic.LoadInt32(&queue.consumingStopped) == 1 {
+		return false // not consuming or already stopped
+	}
+
+	if drain {
+		atomic.StoreInt32(&queue.consumingDrained, 1)
+	}
+	defer wakeDelayed(queue.delayedWakeup) // so stopping doesn't wait for the next delayed delivery
+	return atomic.CompareAndSwapInt32(&queue.consumingStopped, 0, 1)
+}
+
+// Pause stops fetching new deliveries until Resume is called, consumers stay
+// registered and keep consuming the deliveries which were already fetched
+func (queue *redisQueue) Pause() bool {
+	if queue.deliveryChan == nil || atomic.LoadInt32(&queue.consumingStopped) == 1 {
+		return false // not consuming or already stopped
+	}
+	return atomic.CompareAndSwapInt32(&queue.consumingPaused, 0, 1)
+}
+
+// Resume continues fetching new deliveries after Pause
+func (queue *redisQueue) Resume() bool {
+	return atomic.CompareAndSwapInt32(&queue.consumingPaused, 1, 0)
+}
+
+func (queue *redisQueue) IsPaused() bool {
+	return atomic.LoadInt32(&queue.consumingPaused) == 1
+}
+
+// AddConsumer adds a consumer to the queue and returns its internal name.
+// If StartConsuming wasn't called before it logs and returns an empty name,
+// unless the queue is strict, see SetStrict
+func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) string {
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return ""
+	}
+	consumer = queue.tagged(tag, consumer)
+	go queue.consumerConsume(queue.deliveryChan, consumer, nil)
+	go queue.consumerConsumeDelayedQueue(consumer, nil)
+	return name
+}
+
+// AddConsumerE is similar to AddConsumer, but returns an error instead of
+// panicking if the consumer couldn't be registered
+func (queue *redisQueue) AddConsumerE(tag string, consumer Consumer) (string, error) {
+	name, err := queue.addConsumerE(tag)
+	if err != nil {
+		return "", err
+	}
+	consumer = queue.tagged(tag, consumer)
+	go queue.consumerConsume(queue.deliveryChan, consumer, nil)
+	go queue.consumerConsumeDelayedQueue(consumer, nil)
+	return name, nil
+}
+
+// AddConsumerWithHandle is similar to AddConsumer, but returns a handle to
+// remove the consumer and to get the number of deliveries it consumed
+// returns nil if StartConsuming wasn't called before, see AddConsumer
+func (queue *redisQueue) AddConsumerWithHandle(tag string, consumer Consumer) *ConsumerHandle {
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return nil
+	}
+	consumer = queue.tagged(tag, consumer)
+	handle := newConsumerHandle(name, queue)
+	go queue.consumerConsume(queue.deliveryChan, consumer, handle)
+	go queue.consumerConsumeDelayedQueue(consumer, handle)
+	return handle
+}
+
+// AddReadyConsumer is similar to AddConsumer, but the consumer only consumes
+// deliveries published without delay. Use AddDelayedConsumer to add a
+// separate consumer for the delayed ones, otherwise they don't get consumed
+// returns an empty name if StartConsuming wasn't called before, see AddConsumer
+func (queue *redisQueue) AddReadyConsumer(tag string, consumer Consumer) string {
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return ""
+	}
+	consumer = queue.tagged(tag, consumer)
+	go queue.consumerConsume(queue.deliveryChan, consumer, nil)
+	return name
+}
+
+// AddDelayedConsumer is similar to AddConsumer, but the consumer only consumes
+// deliveries once their delay passed, see AddReadyConsumer
+// returns an empty name if StartConsuming wasn't called before, see AddConsumer
+func (queue *redisQueue) AddDelayedConsumer(tag string, consumer Consumer) string {
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return ""
+	}
+	consumer = queue.tagged(tag, consumer)
+	go queue.consumerConsumeDelayedQueue(consumer, nil)
+	return name
+}
+
+// AddConsumerWithPrefetch is similar to AddConsumer, but the consumer gets its
+// own intake of up to prefetch deliveries instead of sharing the one set up by
+// StartConsuming. Use it to keep slow consumers from hogging unacked deliveries
+// returns an empty name if StartConsuming wasn't called before, see AddConsumer
+func (queue *redisQueue) AddConsumerWithPrefetch(tag string, prefetch int, consumer Consumer) string {
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return ""
+	}
+	consumer = queue.tagged(tag, consumer)
+	deliveryChan := make(chan Delivery, prefetch)
+	queue.prefetchChansLock.Lock()
+	queue.prefetchChans = append(queue.prefetchChans, deliveryChan)
+	queue.prefetchChansLock.Unlock()
+
+	if queue.fetchImmediate {
+		queue.fetcherWaitGroup.Add(1)
+		go queue.consume(deliveryChan, prefetch)
+	} else {
+		close(deliveryChan)
+	}
+	go queue.consumerConsume(deliveryChan, consumer, nil)
+	go queue.consumerConsumeDelayedQueue(consumer, nil)
+	return name
+}
+
+// AddConsumerWithConcurrency is similar to AddConsumer, but the consumer
+// consumes up to concurrency deliveries at the same time
+// returns an empty name if StartConsuming wasn't called before, see AddConsumer
+func (queue *redisQueue) AddConsumerWithConcurrency(tag string, concurrency int, consumer Consumer) string {
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return ""
+	}
+	consumer = queue.tagged(tag, consumer)
+	semaphore := make(chan struct{}, concurrency) // shared by ready and delayed deliveries
+	go queue.consumerConsumeConcurrently(queue.deliveryChan, semaphore, consumer)
+	go queue.consumerConsumeConcurrently(queue.deliveryChanForDelayedQueue, semaphore, consumer)
+	return name
+}
+
+// AddConsumerWithWeight is similar to AddConsumer, but the consumers added
+// with a weight share the deliveries they get proportionally to their weights.
+// Together they compete with the other consumers like a single one
+// returns an empty name if StartConsuming wasn't called before, see AddConsumer
+func (queue *redisQueue) AddConsumerWithWeight(tag string, weight int, consumer Consumer) string {
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return ""
+	}
+	consumer = queue.tagged(tag, consumer)
+	queue.weightedLock.Lock()
+	if queue.weighted == nil {
+		queue.weighted = newWeightedDispatcher(queue.deliveryChan, queue.consumersStop, queue.returnDelivery)
+	}
+	deliveryChan := queue.weighted.add(weight)
+	queue.weightedLock.Unlock()
+
+	go queue.consumerConsume(deliveryChan, consumer, nil)
+	go queue.consumerConsumeDelayedQueue(consumer, nil)
+	return name
+}
+
+// AddBatchConsumer is similar to AddConsumer, but for batches of deliveries
+func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
+	return queue.AddBatchConsumerWithTimeout(tag, batchSize, queue.batchTimeout, consumer)
+}
+
+func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return ""
+	}
+	consumer = queue.taggedBatch(tag, consumer)
+	go queue.consumerBatchConsume(1, batchSize, timeout, consumer)
+	go queue.consumerBatchConsumeDelayedQueue(1, batchSize, timeout, consumer)
+	return name
+}
+
+// AddBatchConsumerWithOptions is similar to AddBatchConsumerWithTimeout, but
+// when the timeout fires with fewer than minSize deliveries the batch keeps
+// waiting for another timeout instead of getting consumed. To not starve on
+// low traffic a batch is consumed anyway once it waited maxBatchWaits timeouts
+func (queue *redisQueue) AddBatchConsumerWithOptions(tag string, minSize, maxSize int, timeout time.Duration, consumer BatchConsumer) string {
+	if minSize > maxSize {
+		minSize = maxSize
+	}
+	name, ok := queue.addConsumer(tag)
+	if !ok {
+		return ""
+	}
+	consumer = queue.taggedBatch(tag, consumer)
+	go queue.consumerBatchConsume(minSize, maxSize, timeout, consumer)
+	go queue.consumerBatchConsumeDelayedQueue(minSize, maxSize, timeout, consumer)
+	return name
+}
+
+// AddBatchConsumerE is similar to AddBatchConsumer, but returns an error
+// instead of panicking or logging if the consumer couldn't be registered
+func (queue *redisQueue) AddBatchConsumerE(tag string, batchSize int, consumer BatchConsumer) (string, error) {
+	name, err := queue.addConsumerE(tag)
+	if err != nil {
+		return "", err
+	}
+	consumer = queue.taggedBatch(tag, consumer)
+	go queue.consumerBatchConsume(1, batchSize, queue.batchTimeout, consumer)
+	go queue.consumerBatchConsumeDelayedQueue(1, batchSize, queue.batchTimeout, consumer)
+	return name, nil
 }
 
-// StartConsuming starts consuming into a channel of size prefetchLimit
-// must be called before consumers can be added!
-// pollDuration is the duration the queue sleeps before checking for new deliveries
-func (queue *redisQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
-	if queue.deliveryChan != nil {
-		return false // already consuming
+// Fetch moves up to count ready deliveries to unacked and returns them, so
+// they can be consumed in your own goroutines without calling StartConsuming.
+// They get acked and rejected like consumed deliveries. Returns fewer if the
+// queue doesn't have as many ready, along with the error if fetching failed.
+// Returns no deliveries if count isn't positive
+func (queue *redisQueue) Fetch(count int) ([]Delivery, error) {
+	if count <= 0 {
+		return []Delivery{}, nil
 	}
 
-	// add queue to list of queues consumed on this connection
-	if redisErrIsNil(queue.redisClient.SAdd(queue.queuesKey, queue.name)) {
-		log.Panicf("rmq queue failed to start consuming %s", queue)
+	// add queue to list of queues consumed on this connection, so the cleaner
+	// returns the fetched deliveries if this connection dies
+	if err := queue.redisClient.SAdd(queue.queuesKey, queue.name).Err(); err != nil {
+		return nil, keyTypeError(err, queue.queuesKey)
 	}
 
-	queue.prefetchLimit = prefetchLimit
-	queue.pollDuration = pollDuration
-	queue.deliveryChan = make(chan Delivery, prefetchLimit)
-	queue.deliveryChanForDelayedQueue = make(chan Delivery, prefetchLimit)
-	// log.Printf("rmq queue started consuming %s %d %s", queue, prefetchLimit, pollDuration)
-	go queue.consume()
-	go queue.consumeForDelayedQueue()
-	return true
-}
+	deliveries := make([]Delivery, 0, count)
+	for len(deliveries) < count {
+		token := queue.deadlineToken()
+		result, readyKey := queue.consumeOne(token)
+		switch err := result.Err(); err {
+		case nil:
+		case redis.Nil:
+			return deliveries, nil // empty
+		default:
+			keys := append([]string{queue.unackedKey}, queue.priorityKeys...)
+			return deliveries, keyTypeError(err, keys...)
+		}
 
-func (queue *redisQueue) StopConsuming() bool {
-	if queue.deliveryChan == nil || queue.deliveryChanForDelayedQueue == nil || atomic.LoadInt32(&queue.consumingStopped) == 1 {
-		return false // not consuming or already stopped
+		delivery, ok := queue.fetched(result.Val(), readyKey, token)
+		if !ok {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
 	}
-
-	atomic.StoreInt32(&queue.consumingStopped, 1)
-	return true
+	return deliveries, nil
 }
 
-// AddConsumer adds a consumer to the queue and returns its internal name
-// panics if StartConsuming wasn't called before!
-func (queue *redisQueue) AddConsumer(tag string, consumer Consumer) string {
-	name := queue.addConsumer(tag)
-	go queue.consumerConsume(consumer)
-	go queue.consumerConsumeDelayedQueue(consumer)
-	return name
-}
+// consumeNBatchSize limits how many deliveries ConsumeN fetches at once
+const consumeNBatchSize = 100
+
+// consumeNPollDuration is how long ConsumeN waits before fetching again while
+// ready is empty but unacked deliveries may still get returned to it
+const consumeNPollDuration = 100 * time.Millisecond
+
+// ConsumeN passes up to n ready deliveries to the consumer one after another
+// in the calling goroutine and returns how many it passed. It fetches them in
+// batches and returns early once both ready and unacked are empty, or once the
+// timeout passed, so jobs can drain a queue and exit instead of running
+// consumers. While ready is empty but unacked isn't it waits for deliveries to
+// get returned. Fetched deliveries left over on timeout get returned to ready.
+// A timeout of zero waits without limit. It doesn't need StartConsuming, the
+// consumer is expected to ack or reject each delivery before returning
+func (queue *redisQueue) ConsumeN(n int, timeout time.Duration, consumer Consumer) (int, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	timedOut := func() bool { return !deadline.IsZero() && !time.Now().Before(deadline) }
 
-// AddBatchConsumer is similar to AddConsumer, but for batches of deliveries
-func (queue *redisQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
-	return queue.AddBatchConsumerWithTimeout(tag, batchSize, defaultBatchTimeout, consumer)
-}
+	consumed := 0
+	for consumed < n && !timedOut() {
+		batchSize := n - consumed
+		if batchSize > consumeNBatchSize {
+			batchSize = consumeNBatchSize
+		}
+		deliveries, err := queue.Fetch(batchSize)
+		if err != nil {
+			return consumed, err
+		}
 
-func (queue *redisQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
-	name := queue.addConsumer(tag)
-	go queue.consumerBatchConsume(batchSize, timeout, consumer)
-	go queue.consumerBatchConsumeDelayedQueue(batchSize, timeout, consumer)
-	return name
+		if len(deliveries) == 0 {
+			if queue.UnackedCount() == 0 {
+				return consumed, nil // drained
+			}
+			wait := consumeNPollDuration
+			if !deadline.IsZero() && time.Until(deadline) < wait {
+				wait = time.Until(deadline)
+			}
+			time.Sleep(wait)
+			continue
+		}
+
+		for i, delivery := range deliveries {
+			if timedOut() {
+				queue.returnBatch(deliveries[i:])
+				return consumed, nil
+			}
+			queue.consumerConsumeDelivery(consumer, delivery)
+			consumed++
+		}
+	}
+	return consumed, nil
 }
 
 func (queue *redisQueue) GetConsumers() []string {
 	result := queue.redisClient.SMembers(queue.consumersKey)
-	if redisErrIsNil(result) {
+	if queue.logger.redisErrIsNil(result) {
 		return []string{}
 	}
 	return result.Val()
 }
 
+// LocalConsumerCount returns the number of consumers added and not removed
+// through this queue instance without a redis round trip. It doesn't see
+// consumers of other processes or queue instances, use GetConsumers for those
+func (queue *redisQueue) LocalConsumerCount() int {
+	queue.localConsumersLock.Lock()
+	defer queue.localConsumersLock.Unlock()
+	return len(queue.localConsumers)
+}
+
 func (queue *redisQueue) RemoveConsumer(name string) bool {
 	result := queue.redisClient.SRem(queue.consumersKey, name)
-	if redisErrIsNil(result) {
+	if queue.logger.redisErrIsNil(result) {
 		return false
 	}
+
+	queue.localConsumersLock.Lock()
+	delete(queue.localConsumers, name)
+	queue.localConsumersLock.Unlock()
 	return result.Val() > 0
 }
 
-func (queue *redisQueue) addConsumer(tag string) string {
+// ErrNotConsuming is returned when adding a consumer to a queue which isn't
+// consuming yet
+var ErrNotConsuming = errors.New("rmq queue failed to add consumer, call StartConsuming first")
+
+// addConsumer registers a consumer, returns false if the queue isn't
+// consuming yet. Panics on redis errors and if the queue is strict
+func (queue *redisQueue) addConsumer(tag string) (string, bool) {
+	name, err := queue.addConsumerE(tag)
+	switch {
+	case err == ErrNotConsuming && !queue.strict:
+		queue.logger.Printf("rmq queue %s failed to add consumer %s, call StartConsuming first", queue, tag)
+		return "", false
+	case err != nil:
+		queue.logger.Panicf("%s", err)
+	}
+	return name, true
+}
+
+func (queue *redisQueue) addConsumerE(tag string) (string, error) {
 	if queue.deliveryChan == nil {
-		log.Panicf("rmq queue failed to add consumer, call StartConsuming first! %s", queue)
+		return "", ErrNotConsuming
 	}
 
-	name := fmt.Sprintf("%s-%s", tag, uniuri.NewLen(6))
+	// add consumer to list of consumers of this queue, under another name if
+	// the generated one is taken by a consumer of any connection
+	name := queue.consumerNaming.name(tag)
+	for attempts := 1; ; attempts++ {
+		added, err := queue.redisClient.SAdd(queue.consumersKey, name).Result()
+		if err != nil {
+			return "", fmt.Errorf("rmq queue failed to add consumer %s %s: %s", queue, tag, err)
+		}
+		if added == 1 {
+			break
+		}
+		if attempts == maxConsumerNameAttempts {
+			return "", fmt.Errorf("rmq queue failed to add consumer %s %s: name %s is taken", queue, tag, name)
+		}
+		name = queue.consumerNaming.retry(name)
+	}
 
-	// add consumer to list of consumers of this queue
-	if redisErrIsNil(queue.redisClient.SAdd(queue.consumersKey, name)) {
-		log.Panicf("rmq queue failed to add consumer %s %s", queue, tag)
+	queue.localConsumersLock.Lock()
+	if queue.localConsumers == nil {
+		queue.localConsumers = map[string]bool{}
 	}
+	queue.localConsumers[name] = true
+	queue.localConsumersLock.Unlock()
 
-	// log.Printf("rmq queue added consumer %s %s", queue, name)
-	return name
+	queue.logger.debugf("queue added consumer %s %s", queue, name)
+	return name, nil
 }
 
 func (queue *redisQueue) RemoveAllConsumers() int {
 	result := queue.redisClient.Del(queue.consumersKey)
-	if redisErrIsNil(result) {
+	if queue.logger.redisErrIsNil(result) {
 		return 0
 	}
+
+	queue.localConsumersLock.Lock()
+	queue.localConsumers = nil
+	queue.localConsumersLock.Unlock()
 	return int(result.Val())
 }
 
-func (queue *redisQueue) consume() {
+// consume moves deliveries from ready to unacked and into deliveryChan, keeping
+// up to prefetchLimit deliveries buffered
+func (queue *redisQueue) consume(deliveryChan chan Delivery, prefetchLimit int) {
+	defer queue.fetcherWaitGroup.Done()
+	backoff := newPollBackoff(queue.pollDuration, queue.maxPollDuration)
 	for {
-		batchSize := queue.batchSize()
-		wantMore := queue.consumeBatch(batchSize)
+		wantMore, empty := false, false
+		if !queue.IsPaused() {
+			batchSize := queue.batchSize(deliveryChan, prefetchLimit)
+			wantMore = queue.consumeBatch(deliveryChan, batchSize)
+			empty = batchSize == 0 && len(deliveryChan) < prefetchLimit // not just waiting for consumers
+			queue.checkDrained(empty)
+		}
 
 		if !wantMore {
-			time.Sleep(queue.pollDuration)
+			time.Sleep(backoff.next(empty))
+		}
+
+		if atomic.LoadInt32(&queue.consumingStopped) == 1 {
+			close(deliveryChan)
+			// return the buffered deliveries unless consumers should consume them
+			if atomic.LoadInt32(&queue.consumingDrained) == 0 {
+				queue.returnBuffered(deliveryChan)
+			}
+			queue.logger.debugf("queue stopped consuming %s", queue)
+			return
+		}
+	}
+}
+
+// consumeBlocking is similar to consume, but waits in BRPOPLPUSH for new
+// deliveries instead of sleeping when the queue is empty
+func (queue *redisQueue) consumeBlocking(deliveryChan chan Delivery, prefetchLimit int) {
+	defer queue.fetcherWaitGroup.Done()
+	for {
+		if !queue.IsPaused() && len(deliveryChan) < prefetchLimit {
+			queue.checkDrained(!queue.consumeOneBlocking(deliveryChan))
+		} else {
+			time.Sleep(blockingWaitDuration)
 		}
 
 		if atomic.LoadInt32(&queue.consumingStopped) == 1 {
-			close(queue.deliveryChan)
-			// drain the channel
-			for len(queue.deliveryChan) > 0 {
-				<-queue.deliveryChan
+			close(deliveryChan)
+			// return the buffered deliveries unless consumers should consume them
+			if atomic.LoadInt32(&queue.consumingDrained) == 0 {
+				queue.returnBuffered(deliveryChan)
 			}
-			// log.Printf("rmq queue stopped consuming %s", queue)
 			return
 		}
 	}
 }
 
+// consumeOneBlocking consumes the next ready delivery into deliveryChan. If
+// there's none it waits up to pollDuration for one to be published without
+// priority, prioritized ones are seen after that wait at the latest. Returns
+// false if the wait timed out
+func (queue *redisQueue) consumeOneBlocking(deliveryChan chan Delivery) bool {
+	token := queue.deadlineToken()
+	result, readyKey := queue.consumeOne(token)
+	if queue.logger.redisErrIsNil(result) {
+		// BRPOPLPUSH even where BLMOVE is supported, as the redis client only
+		// extends its read timeout for the blocking commands it knows. Blocking
+		// commands can't run in scripts, so the visibility deadline gets
+		// recorded right afterwards
+		result = queue.redisClient.BRPopLPush(queue.readyKey, queue.unackedKey, queue.pollDuration)
+		if queue.logger.redisErrIsNil(result) {
+			return false // timed out
+		}
+		queue.setVisibilityDeadline(token, result.Val())
+	}
+
+	delivery, ok := queue.fetched(result.Val(), readyKey, token)
+	if !ok {
+		return true
+	}
+	deliveryChan <- delivery
+	return true
+}
+
 func (queue *redisQueue) consumeForDelayedQueue() {
+	defer queue.fetcherWaitGroup.Done()
+	backoff := newPollBackoff(queue.pollDuration, queue.maxPollDuration)
 	for {
-		batchSize := queue.batchSizeForDelayedQueue()
-		wantMore := queue.consumeBatchForDelayedQueue(batchSize)
+		wantMore, empty, polled := false, false, false
+		if !queue.IsPaused() {
+			batchSize := queue.batchSizeForDelayedQueue()
+			wantMore = queue.consumeBatchForDelayedQueue(batchSize)
+			empty = batchSize == 0 && len(queue.deliveryChanForDelayedQueue) < queue.prefetchLimit
+			polled = batchSize > 0
+		}
 
 		if !wantMore {
-			time.Sleep(queue.pollDuration)
+			wait := backoff.next(empty)
+			if polled {
+				wait = queue.delayedWait(wait)
+			}
+			queue.waitDelayed(wait)
 		}
 
 		if atomic.LoadInt32(&queue.consumingStopped) == 1 {
 			close(queue.deliveryChanForDelayedQueue)
-			// drain the channel
-			for len(queue.deliveryChanForDelayedQueue) > 0 {
-				<-queue.deliveryChanForDelayedQueue
+			// return the buffered deliveries unless consumers should consume them
+			if atomic.LoadInt32(&queue.consumingDrained) == 0 {
+				queue.returnBuffered(queue.deliveryChanForDelayedQueue)
 			}
-			// log.Printf("rmq queue stopped consuming %s", queue)
+			queue.logger.debugf("queue stopped consuming %s", queue)
 			return
 		}
 	}
 }
 
-func (queue *redisQueue) batchSize() int {
-	prefetchCount := len(queue.deliveryChan)
-	prefetchLimit := queue.prefetchLimit - prefetchCount
+// delayedWait returns how long to wait after a poll which left no due delayed
+// deliveries behind: until the next delayed delivery is due, but at most the
+// given poll duration or maxDelayedWait if that's set and longer
+func (queue *redisQueue) delayedWait(pollDuration time.Duration) time.Duration {
+	wait := pollDuration
+	if queue.maxDelayedWait > wait {
+		wait = queue.maxDelayedWait
+	}
+
+	next, err := queue.redisClient.ZRangeWithScores(queue.delayedKey, 0, 0).Result()
+	if err != nil {
+		return pollDuration
+	}
+	if len(next) == 0 {
+		return wait // nothing delayed
+	}
+	if due := time.Unix(0, int64(next[0].Score)).Sub(queue.now()); due < wait {
+		wait = due
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// waitDelayed sleeps for wait, or until deliveries got delayed through this
+// queue instance or it stops consuming
+func (queue *redisQueue) waitDelayed(wait time.Duration) {
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-queue.delayedWakeup:
+	}
+}
+
+// wakeDelayed wakes the delayed poller waiting on wakeup unless a wakeup is
+// already pending, does nothing for a nil wakeup
+func wakeDelayed(wakeup chan struct{}) {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// pollBackoff returns how long to sleep between polls, doubling the duration
+// for consecutive polls of an empty queue up to max
+type pollBackoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newPollBackoff(min, max time.Duration) *pollBackoff {
+	return &pollBackoff{min: min, max: max, current: min}
+}
+
+// next returns the duration to sleep after a poll, empty tells whether the
+// poll found the queue empty
+func (backoff *pollBackoff) next(empty bool) time.Duration {
+	if !empty {
+		backoff.current = backoff.min
+		return backoff.min
+	}
+
+	duration := backoff.current
+	if backoff.current *= 2; backoff.current > backoff.max || backoff.current <= 0 {
+		backoff.current = backoff.max
+	}
+	if duration > backoff.max {
+		return backoff.max
+	}
+	return duration
+}
+
+func (queue *redisQueue) batchSize(deliveryChan chan Delivery, prefetchLimit int) int {
+	prefetchCount := len(deliveryChan)
+	if prefetchCount >= prefetchLimit {
+		queue.backpressure(prefetchCount, prefetchLimit)
+		return 0
+	}
+	prefetchLimit -= prefetchCount
 	// TODO: ignore ready count here and just return prefetchLimit?
 	if readyCount := queue.ReadyCount(); readyCount < prefetchLimit {
 		return readyCount
@@ -407,6 +2328,10 @@ func (queue *redisQueue) batchSize() int {
 
 func (queue *redisQueue) batchSizeForDelayedQueue() int {
 	prefetchCount := len(queue.deliveryChanForDelayedQueue)
+	if prefetchCount >= queue.prefetchLimit {
+		queue.backpressure(prefetchCount, queue.prefetchLimit)
+		return 0
+	}
 	prefetchLimit := queue.prefetchLimit - prefetchCount
 	// TODO: ignore ready count here and just return prefetchLimit?
 	if readyCount := queue.DelayedCount(); readyCount < prefetchLimit {
@@ -415,63 +2340,308 @@ func (queue *redisQueue) batchSizeForDelayedQueue() int {
 	return prefetchLimit
 }
 
+// backpressure calls the backpressure hook if set
+func (queue *redisQueue) backpressure(bufferLen, prefetchLimit int) {
+	if queue.onBackpressure != nil {
+		queue.onBackpressure(queue.name, bufferLen, prefetchLimit)
+	}
+}
+
 // consumeBatch tries to read batchSize deliveries, returns true if any and all were consumed
-func (queue *redisQueue) consumeBatch(batchSize int) bool {
+func (queue *redisQueue) consumeBatch(deliveryChan chan Delivery, batchSize int) bool {
 	if batchSize == 0 {
 		return false
 	}
 
 	for i := 0; i < batchSize; i++ {
-		result := queue.redisClient.RPopLPush(queue.readyKey, queue.unackedKey)
-		if redisErrIsNil(result) {
-			// debug(fmt.Sprintf("rmq queue consumed last batch %s %d", queue, i)) // COMMENTOUT
+		token := queue.deadlineToken()
+		result, readyKey := queue.consumeOne(token)
+		if queue.logger.redisErrIsNil(result) {
+			queue.logger.debugf("queue consumed last batch %s %d", queue, i)
 			return false
 		}
 
-		// debug(fmt.Sprintf("consume %d/%d %s %s", i, batchSize, result.Val(), queue)) // COMMENTOUT
-		queue.deliveryChan <- newDelivery(
-			result.Val(),
-			queue.unackedKey,
-			queue.delayedKey,
-			queue.rejectedKey,
-			queue.pushKey,
-			queue.redisClient,
-		)
+		queue.logger.debugf("consume %d/%d %s %s", i, batchSize, result.Val(), queue)
+		delivery, ok := queue.fetched(result.Val(), readyKey, token)
+		if !ok {
+			continue
+		}
+		deliveryChan <- delivery
+	}
+
+	queue.logger.debugf("queue consumed batch %s %d", queue, batchSize)
+	return true
+}
+
+// newDelivery returns a delivery of this queue with the given payload
+func (queue *redisQueue) newDelivery(payload string) *wrapDelivery {
+	delivery := newDelivery(
+		queue.name,
+		payload,
+		queue.unackedKey,
+		queue.delayedKey,
+		queue.rejectedKey,
+		queue.pushKey,
+		queue.redisClient,
+		queue.counters,
+	)
+	delivery.readyKey = queue.readyKey
+	delivery.deadlinesKey = queue.deadlinesKey
+	delivery.deadLetterKey = queue.deadLetterKey
+	delivery.maxAttempts = queue.maxAttempts
+	delivery.maxRejected = queue.maxRejected
+	delivery.rejectedPolicy = queue.rejectedPolicy
+	delivery.maxPushHops = queue.maxPushHops
+	delivery.onStateChange = queue.onStateChange
+	delivery.onProcessed = queue.onProcessed
+	delivery.lpos = queue.lpos
+	delivery.logger = queue.logger
+	delivery.delayedWakeup = queue.delayedWakeup
+	delivery.serverClock = queue.serverClock
+	delivery.envelope = queue.envelope
+	delivery.message = unmarshalEnvelope(queue.envelope, payload)
+	return delivery
+}
+
+// fetched returns the delivery of a payload which was just moved to unacked
+// from the ready list at readyKey, false if it got dropped because its TTL
+// passed. Requeued deliveries go back to that list to keep their priority.
+// token is the one its visibility deadline got recorded with, if any
+func (queue *redisQueue) fetched(payload, readyKey, token string) (*wrapDelivery, bool) {
+	delivery := queue.newDelivery(payload)
+	delivery.readyKey = readyKey
+	delivery.deadline = deadlineMember(token, payload)
+	if queue.dropExpired(delivery) {
+		return nil, false
+	}
+	queue.mustTouch()
+	count(&queue.counters.Consumed, true)
+	return delivery, true
+}
+
+// deadlineToken returns a new token to record the visibility deadline of a
+// delivery with when fetching it, empty if the queue has no visibility
+// timeout. Tokens tell deliveries with equal payloads apart
+func (queue *redisQueue) deadlineToken() string {
+	if queue.visibilityTimeout <= 0 {
+		return ""
+	}
+	return uniuri.NewLen(16)
+}
+
+// deadlineMember returns the member of the visibility deadline of payload in
+// the deadlines sorted set, empty if it was fetched without token
+func deadlineMember(token, payload string) string {
+	if token == "" {
+		return ""
+	}
+	return token + ":" + payload
+}
+
+// setVisibilityDeadline records when the delivery of payload, fetched with
+// token, returns to ready if it doesn't get acked, see SetVisibilityTimeout.
+// Only used after blocking fetches, which can't record it in the same script
+func (queue *redisQueue) setVisibilityDeadline(token, payload string) {
+	if token == "" {
+		return
+	}
+	queue.logger.redisErrIsNil(queue.redisClient.ZAdd(queue.deadlinesKey, redis.Z{
+		Score:  queue.visibilityDeadline(),
+		Member: deadlineMember(token, payload),
+	}))
+}
+
+// visibilityDeadline returns the score of the visibility deadline of a
+// delivery fetched now
+func (queue *redisQueue) visibilityDeadline() float64 {
+	return unixScore(time.Now().Add(queue.visibilityTimeout))
+}
+
+// returnInvisibleLoop returns deliveries whose visibility deadline passed
+// until consuming stops
+func (queue *redisQueue) returnInvisibleLoop() {
+	defer queue.fetcherWaitGroup.Done()
+
+	interval := queue.visibilityTimeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	for atomic.LoadInt32(&queue.consumingStopped) == 0 {
+		time.Sleep(interval)
+		queue.returnInvisible(time.Now())
+	}
+}
+
+// returnInvisible moves deliveries whose visibility deadline passed before
+// now from unacked back to ready, returns the number of returned deliveries.
+// Deadlines are members like token:payload, the ones of deliveries which
+// aren't unacked anymore just get removed
+func (queue *redisQueue) returnInvisible(now time.Time) int {
+	result := queue.redisClient.Eval(
+		returnedLua+`local val = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[2])
+local count = 0
+for i = 1, #val do
+    redis.call('zrem', KEYS[1], val[i])
+    local separator = string.find(val[i], ':', 1, true)
+    if separator then
+        local payload = string.sub(val[i], separator + 1)
+        if redis.call('lrem', KEYS[2], 1, payload) == 1 then
+            redis.call('lpush', KEYS[3], returned(payload))
+            count = count + 1
+        end
+    end
+end
+return count`,
+		[]string{queue.deadlinesKey, queue.unackedKey, queue.readyKey},
+		envelopePrefix,
+		now.UnixNano(),
+	)
+	if queue.logger.redisErrIsNil(result) {
+		return 0
 	}
+	returned, _ := result.Val().(int64)
+	return int(returned)
+}
 
-	// debug(fmt.Sprintf("rmq queue consumed batch %s %d", queue, batchSize)) // COMMENTOUT
+// dropExpired removes the fetched delivery from unacked if its TTL passed
+func (queue *redisQueue) dropExpired(delivery *wrapDelivery) bool {
+	if !delivery.Expired() {
+		return false
+	}
+	queue.logger.redisErrIsNil(delivery.ack(queue.redisClient))
+	count(&queue.counters.Expired, true)
 	return true
 }
 
-func (queue *redisQueue) moveFromSortedSetToList(from string, to string, now time.Time, batchSize int) *redis.Cmd {
+// consumeOne moves the next ready delivery of the highest priority to unacked
+// returns the result of the first command which didn't find the list empty
+// and the key of the ready list it moved the delivery from. With a token the
+// visibility deadline gets recorded along, see deadlineToken
+func (queue *redisQueue) consumeOne(token string) (*redis.StringCmd, string) {
+	var result *redis.StringCmd
+	for priority := len(queue.priorityKeys) - 1; priority >= 0; priority-- {
+		result = queue.fetchOne(queue.priorityKeys[priority], token)
+		if result.Err() != redis.Nil {
+			return result, queue.priorityKeys[priority]
+		}
+	}
+	return result, queue.readyKey
+}
+
+// fetchVisibleScript moves the oldest delivery of the ready list at KEYS[1] to
+// the unacked list at KEYS[2] and records its visibility deadline ARGV[1] in
+// the sorted set at KEYS[3] as ARGV[2]:delivery. Returns the delivery, nil if
+// the ready list is empty
+const fetchVisibleScript = `local value = redis.call('rpoplpush', KEYS[1], KEYS[2])
+if not value then
+    return false
+end
+redis.call('zadd', KEYS[3], ARGV[1], ARGV[2] .. ':' .. value)
+return value`
+
+// fetchOne moves the oldest delivery of the ready list at key to unacked like
+// popPush. With a token its visibility deadline gets recorded in the same
+// script, so it can't be unacked without one
+func (queue *redisQueue) fetchOne(key, token string) *redis.StringCmd {
+	if token == "" {
+		return queue.popPush(key, queue.unackedKey)
+	}
+	cmd := redis.NewStringCmd("eval", fetchVisibleScript, 3, key, queue.unackedKey, queue.deadlinesKey, queue.visibilityDeadline(), token)
+	queue.redisClient.Process(cmd)
+	return cmd
+}
+
+// unixScore returns the sorted set score of deliveries due at the given time,
+// which is in unix nanoseconds. Scores are float64 which only keep 53 bits, so
+// current times get rounded to multiples of 256ns, ties to even. Deliveries
+// due more than that far apart keep their order, ones due at most 256ns apart
+// may get the same score and are ordered by their value instead. Scores stay in nanoseconds, as changing the
+// unit would make the deliveries delayed by older versions due far too late
+func unixScore(at time.Time) float64 {
+	return float64(at.UnixNano())
+}
+
+// serverTimeScript returns the TIME of the redis server. It's read through a
+// script with the delayed key, so in a cluster it's the clock of the node
+// holding the delayed deliveries
+const serverTimeScript = `return redis.call('time')`
+
+// serverTime returns the time of the redis server holding key, the local time
+// if reading it fails
+func serverTime(redisClient redis.UniversalClient, key string, logger *logging) time.Time {
+	result := redisClient.Eval(serverTimeScript, []string{key})
+	values, ok := result.Val().([]interface{})
+	if result.Err() != nil || !ok || len(values) != 2 {
+		logger.Printf("rmq failed to read the redis server time, using the local time: %v", result.Err())
+		return time.Now()
+	}
+
+	seconds, err1 := strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
+	micros, err2 := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+	if err1 != nil || err2 != nil {
+		logger.Printf("rmq failed to parse the redis server time %v, using the local time", values)
+		return time.Now()
+	}
+	return time.Unix(seconds, micros*int64(time.Microsecond))
+}
+
+// moveFromSortedSetToList moves up to batchSize members of from which are due
+// at now to the list to. Returns the moved members each followed by its score.
+// With a token their visibility deadlines get recorded along, the one of the
+// i-th moved member with the token followed by i, see delayedDeadlineToken
+func (queue *redisQueue) moveFromSortedSetToList(from string, to string, now time.Time, batchSize int, token string) *redis.Cmd {
 	return queue.redisClient.Eval(
-		`-- Get all of the messages with an expired "score"...
-local val = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1])
--- If we have values in the array, we will remove batchSize of them from the first queue
--- and add them onto the destination queue in chunks of 100, which moves
--- batchSize of the appropriate messages onto the destination queue very safely.
-if(next(val) ~= nil) then
-    redis.call('zremrangebyrank', KEYS[1], 0, ARGV[2] - 1)
-    for i = 1, ARGV[2], 100 do
-        redis.call('lpush', KEYS[2], unpack(val, i, math.min(i+99, ARGV[2])))
+		`-- Get up to batchSize of the messages with an expired "score"...
+local val = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, ARGV[2])
+local members = {}
+for i = 1, #val, 2 do
+    members[#members + 1] = val[i]
+end
+-- If we have values in the array, we will remove exactly those members from the first
+-- queue and add them onto the destination queue in chunks of ARGV[3], which moves the
+-- appropriate messages onto the destination queue very safely. Members which aren't due
+-- yet stay untouched.
+for i = 1, #members, ARGV[3] do
+    local last = math.min(i + ARGV[3] - 1, #members)
+    redis.call('zrem', KEYS[1], unpack(members, i, last))
+    redis.call('lpush', KEYS[2], unpack(members, i, last))
+end
+if ARGV[5] ~= '' then
+    for i = 1, #members do
+        redis.call('zadd', KEYS[3], ARGV[4], ARGV[5] .. i .. ':' .. members[i])
     end
 end
 return val`,
-		[]string{from, to},
+		[]string{from, to, queue.deadlinesKey},
 		now.UnixNano(),
 		batchSize,
+		queue.delayedChunkSize,
+		queue.visibilityDeadline(),
+		token,
 	)
 }
 
+// delayedDeadlineToken returns the token the visibility deadline of the i-th
+// delivery moved by moveFromSortedSetToList with token got recorded with,
+// counting from zero
+func delayedDeadlineToken(token string, i int) string {
+	if token == "" {
+		return ""
+	}
+	return token + strconv.Itoa(i+1)
+}
+
 // consumeBatchForDelayedQueue tries to read batchSize deliveries, returns true if any and all were consumed
 func (queue *redisQueue) consumeBatchForDelayedQueue(batchSize int) bool {
 	if batchSize == 0 {
 		return false
 	}
 
-	result := queue.moveFromSortedSetToList(queue.delayedKey, queue.unackedKey, time.Now(), batchSize)
-	if redisErrIsNil(result) {
-		// debug(fmt.Sprintf("rmq queue consumed last batch %s %d", queue, i)) // COMMENTOUT
+	now := queue.now()
+	token := queue.deadlineToken()
+	result := queue.moveFromSortedSetToList(queue.delayedKey, queue.unackedKey, now, batchSize, token)
+	if queue.logger.redisErrIsNil(result) {
+		queue.logger.debugf("queue consumed no delayed deliveries %s", queue)
 		return false
 	}
 
@@ -480,45 +2650,126 @@ func (queue *redisQueue) consumeBatchForDelayedQueue(batchSize int) bool {
 		return false
 	}
 
-	for _, value := range values {
-		payload, ok := value.(string)
+	for i := 0; i+1 < len(values); i += 2 {
+		payload, ok := values[i].(string)
 		if !ok {
 			return false
 		}
+		if score, ok := values[i+1].(string); ok {
+			if scheduled, err := strconv.ParseFloat(score, 64); err == nil {
+				queue.counters.delayLag(now.Sub(time.Unix(0, int64(scheduled))))
+			}
+		}
 
-		queue.deliveryChanForDelayedQueue <- newDelivery(
-			payload,
-			queue.unackedKey,
-			queue.delayedKey,
-			queue.rejectedKey,
-			queue.pushKey,
-			queue.redisClient,
-		)
+		delivery, ok := queue.fetched(payload, queue.readyKey, delayedDeadlineToken(token, i/2))
+		if !ok {
+			continue
+		}
+		queue.deliveryChanForDelayedQueue <- delivery
 	}
 
 	return true
 }
 
-func (queue *redisQueue) consumerConsume(consumer Consumer) {
+// consumerConsume passes the deliveries of deliveryChan to the consumer and
+// counts them on handle unless it's nil
+func (queue *redisQueue) consumerConsume(deliveryChan chan Delivery, consumer Consumer, handle *ConsumerHandle) {
 	queue.increaseConsumerCount()
 	defer queue.decreaseConsumerCount()
-	for delivery := range queue.deliveryChan {
-		// debug(fmt.Sprintf("consumer consume %s %s", delivery, consumer)) // COMMENTOUT
-		consumer.Consume(delivery)
+	for {
+		delivery, ok := queue.nextDelivery(deliveryChan, handle)
+		if !ok {
+			return
+		}
+		queue.logger.debugf("consumer consume %s %s", delivery, consumer)
+		queue.consumerConsumeDelivery(consumer, delivery)
+		handle.consumed()
+	}
+}
+
+func (queue *redisQueue) consumerConsumeDelayedQueue(consumer Consumer, handle *ConsumerHandle) {
+	queue.consumerConsume(queue.deliveryChanForDelayedQueue, consumer, handle)
+}
+
+// nextDelivery returns the next delivery of deliveryChan to consume, false
+// once the channel got closed, the consumers got stopped or the consumer of
+// handle got removed. A delivery which was received while stopping gets
+// returned to ready instead. handle may be nil
+func (queue *redisQueue) nextDelivery(deliveryChan chan Delivery, handle *ConsumerHandle) (Delivery, bool) {
+	select {
+	case delivery, ok := <-deliveryChan:
+		if !ok {
+			return nil, false
+		}
+		if atomic.LoadInt32(&queue.consumersStopped) == 1 || handle.isRemoved() {
+			queue.returnDelivery(delivery)
+			return nil, false
+		}
+		return delivery, true
+	case <-queue.consumersStop:
+		return nil, false
+	case <-handle.removing():
+		return nil, false
 	}
 }
 
-func (queue *redisQueue) consumerConsumeDelayedQueue(consumer Consumer) {
+// consumerConsumeConcurrently consumes each delivery in its own goroutine, but
+// only as many at once as the semaphore allows
+func (queue *redisQueue) consumerConsumeConcurrently(deliveryChan chan Delivery, semaphore chan struct{}, consumer Consumer) {
 	queue.increaseConsumerCount()
 	defer queue.decreaseConsumerCount()
-	for delivery := range queue.deliveryChanForDelayedQueue {
-		// debug(fmt.Sprintf("consumer consume %s %s", delivery, consumer)) // COMMENTOUT
+	for {
+		delivery, ok := queue.nextDelivery(deliveryChan, nil)
+		if !ok {
+			return
+		}
+		semaphore <- struct{}{}
+		queue.increaseConsumerCount()
+		go func(delivery Delivery) {
+			defer queue.decreaseConsumerCount()
+			queue.consumerConsumeDelivery(consumer, delivery)
+			<-semaphore
+		}(delivery)
+	}
+}
+
+// consumerConsumeDelivery passes the delivery to the consumer, within a span
+// if it was published with a trace context. Recovers if the consumer panics
+func (queue *redisQueue) consumerConsumeDelivery(consumer Consumer, delivery Delivery) {
+	defer queue.recoverConsume(delivery)
+
+	wrapped, ok := delivery.(*wrapDelivery)
+	if !ok || queue.tracer == nil || wrapped.message.Trace == nil {
 		consumer.Consume(delivery)
+		return
+	}
+
+	ctx, end := queue.tracer.StartConsume(wrapped.ctx, queue.name, wrapped.message.Trace)
+	defer end()
+	wrapped.ctx = ctx
+	consumer.Consume(delivery)
+}
+
+// recoverConsume recovers from a panic while consuming the delivery and
+// passes it to the panic handler, or logs it and rejects the delivery so it
+// doesn't stay unacked. Must be deferred directly
+func (queue *redisQueue) recoverConsume(delivery Delivery) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	if queue.onPanic != nil {
+		queue.onPanic(recovered, delivery)
+		return
 	}
+	queue.logger.Printf("rmq queue %s consumer panicked consuming %s: %v", queue, delivery.Payload(), recovered)
+	delivery.Reject()
 }
 
-func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Duration, consumer BatchConsumer) {
+func (queue *redisQueue) consumerBatchConsume(minSize, batchSize int, timeout time.Duration, consumer BatchConsumer) {
 	batch := make([]Delivery, 0)
+	firstAt := time.Time{} // when the first delivery of the batch was added
 	timer := time.NewTimer(timeout)
 	stopTimer(timer) // timer not active yet
 
@@ -527,31 +2778,50 @@ func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Durati
 	for {
 		select {
 		case <-timer.C:
-			// debug("batch timer fired") // COMMENTOUT
+			queue.logger.debugf("batch timer fired")
+			if len(batch) < minSize && time.Since(firstAt) < timeout*maxBatchWaits {
+				timer.Reset(timeout) // wait for more deliveries
+				continue
+			}
 			// consume batch below
 
+		case <-queue.consumersStop:
+			queue.returnBatch(batch) // consumers stopped, return the pending deliveries
+			stopTimer(timer)
+			return
+
 		case delivery, ok := <-queue.deliveryChan:
 			if !ok {
-				// debug("batch channel closed") // COMMENTOUT
+				queue.logger.debugf("batch channel closed")
+				if len(batch) > 0 { // don't abandon the pending deliveries in unacked
+					consumer.Consume(batch)
+				}
+				stopTimer(timer)
+				return
+			}
+			if atomic.LoadInt32(&queue.consumersStopped) == 1 {
+				queue.returnBatch(append(batch, delivery))
+				stopTimer(timer)
 				return
 			}
 
 			batch = append(batch, delivery)
-			// debug(fmt.Sprintf("batch consume added delivery %d", len(batch))) // COMMENTOUT
+			queue.logger.debugf("batch consume added delivery %d", len(batch))
 
 			if len(batch) == 1 { // added first delivery
+				firstAt = time.Now()
 				timer.Reset(timeout) // set timer to fire
 			}
 
 			if len(batch) < batchSize {
-				// debug(fmt.Sprintf("batch consume wait %d < %d", len(batch), batchSize)) // COMMENTOUT
+				queue.logger.debugf("batch consume wait %d < %d", len(batch), batchSize)
 				continue
 			}
 
 			// consume batch below
 		}
 
-		// debug(fmt.Sprintf("batch consume consume %d", len(batch))) // COMMENTOUT
+		queue.logger.debugf("batch consume consume %d", len(batch))
 		consumer.Consume(batch)
 
 		batch = batch[:0] // reset batch
@@ -559,8 +2829,9 @@ func (queue *redisQueue) consumerBatchConsume(batchSize int, timeout time.Durati
 	}
 }
 
-func (queue *redisQueue) consumerBatchConsumeDelayedQueue(batchSize int, timeout time.Duration, consumer BatchConsumer) {
+func (queue *redisQueue) consumerBatchConsumeDelayedQueue(minSize, batchSize int, timeout time.Duration, consumer BatchConsumer) {
 	batch := make([]Delivery, 0)
+	firstAt := time.Time{} // when the first delivery of the batch was added
 	timer := time.NewTimer(timeout)
 	stopTimer(timer) // timer not active yet
 
@@ -569,31 +2840,50 @@ func (queue *redisQueue) consumerBatchConsumeDelayedQueue(batchSize int, timeout
 	for {
 		select {
 		case <-timer.C:
-			// debug("batch timer fired") // COMMENTOUT
+			queue.logger.debugf("batch timer fired")
+			if len(batch) < minSize && time.Since(firstAt) < timeout*maxBatchWaits {
+				timer.Reset(timeout) // wait for more deliveries
+				continue
+			}
 			// consume batch below
 
+		case <-queue.consumersStop:
+			queue.returnBatch(batch) // consumers stopped, return the pending deliveries
+			stopTimer(timer)
+			return
+
 		case delivery, ok := <-queue.deliveryChanForDelayedQueue:
 			if !ok {
-				// debug("batch channel closed") // COMMENTOUT
+				queue.logger.debugf("batch channel closed")
+				if len(batch) > 0 { // don't abandon the pending deliveries in unacked
+					consumer.Consume(batch)
+				}
+				stopTimer(timer)
+				return
+			}
+			if atomic.LoadInt32(&queue.consumersStopped) == 1 {
+				queue.returnBatch(append(batch, delivery))
+				stopTimer(timer)
 				return
 			}
 
 			batch = append(batch, delivery)
-			// debug(fmt.Sprintf("batch consume added delivery %d", len(batch))) // COMMENTOUT
+			queue.logger.debugf("batch consume added delivery %d", len(batch))
 
 			if len(batch) == 1 { // added first delivery
+				firstAt = time.Now()
 				timer.Reset(timeout) // set timer to fire
 			}
 
 			if len(batch) < batchSize {
-				// debug(fmt.Sprintf("batch consume wait %d < %d", len(batch), batchSize)) // COMMENTOUT
+				queue.logger.debugf("batch consume wait %d < %d", len(batch), batchSize)
 				continue
 			}
 
 			// consume batch below
 		}
 
-		// debug(fmt.Sprintf("batch consume consume %d", len(batch))) // COMMENTOUT
+		queue.logger.debugf("batch consume consume %d", len(batch))
 		consumer.Consume(batch)
 
 		batch = batch[:0] // reset batch
@@ -601,6 +2891,64 @@ func (queue *redisQueue) consumerBatchConsumeDelayedQueue(batchSize int, timeout
 	}
 }
 
+// returnBuffered moves the deliveries left in the closed deliveryChan from
+// unacked back to the consuming end of ready, keeping their order. Returns the
+// number of returned deliveries
+func (queue *redisQueue) returnBuffered(deliveryChan chan Delivery) int {
+	var deliveries []Delivery
+	for delivery := range deliveryChan {
+		deliveries = append(deliveries, delivery)
+	}
+	return queue.returnBatch(deliveries)
+}
+
+// returnBatch moves the given fetched deliveries, oldest first, from unacked
+// back to the consuming end of ready, so the oldest gets consumed first again.
+// Returns the number of returned deliveries
+func (queue *redisQueue) returnBatch(deliveries []Delivery) int {
+	returned := 0
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		if queue.returnDelivery(deliveries[i]) {
+			returned++
+		}
+	}
+	return returned
+}
+
+// returnDelivery moves a fetched delivery which didn't get consumed from
+// unacked back to the consuming end of its ready list in a single script, so
+// it can't end up in both. Returns false if it wasn't unacked anymore
+func (queue *redisQueue) returnDelivery(delivery Delivery) bool {
+	wrapped, ok := delivery.(*wrapDelivery)
+	if !ok {
+		return false
+	}
+	result := queue.redisClient.Eval(requeueFrontScript, []string{queue.unackedKey, wrapped.readyKey, queue.deadlinesKey}, wrapped.payload, wrapped.deadline)
+	if queue.logger.redisErrIsNil(result) {
+		return false
+	}
+	returned, _ := result.Val().(int64)
+	return returned == 1
+}
+
+// waitTimeout waits for the WaitGroup up to timeout, returns false on timeout
+func waitTimeout(waitGroup *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
 func stopTimer(timer *time.Timer) {
 	if timer.Stop() {
 		return
@@ -622,9 +2970,9 @@ func (queue *redisQueue) deleteRedisList(key string) int {
 	}
 
 	// delete elements without blocking
-	for todo := total; todo > 0; todo -= purgeBatchSize {
+	for todo := total; todo > 0; todo -= queue.purgeBatchSize {
 		// minimum of purgeBatchSize and todo
-		batchSize := purgeBatchSize
+		batchSize := queue.purgeBatchSize
 		if batchSize > todo {
 			batchSize = todo
 		}
@@ -646,9 +2994,9 @@ func (queue *redisQueue) deleteRedisZSet(key string) int {
 	}
 
 	// delete elements without blocking
-	for todo := total; todo > 0; todo -= purgeBatchSize {
+	for todo := total; todo > 0; todo -= queue.purgeBatchSize {
 		// minimum of purgeBatchSize and todo
-		batchSize := purgeBatchSize
+		batchSize := queue.purgeBatchSize
 		if batchSize > todo {
 			batchSize = todo
 		}
@@ -660,19 +3008,33 @@ func (queue *redisQueue) deleteRedisZSet(key string) int {
 	return total
 }
 
-// redisErrIsNil returns false if there is no error, true if the result error is nil and panics if there's another error
-func redisErrIsNil(result redis.Cmder) bool {
-	switch result.Err() {
-	case nil:
-		return false
-	case redis.Nil:
-		return true
-	default:
-		log.Panicf("rmq redis error is not nil %#v", result.Err())
-		return false
+// ErrWrongKeyType is what a *KeyTypeError unwraps to, so on Go 1.13 and
+// later errors.Is(err, ErrWrongKeyType) reports any of them
+var ErrWrongKeyType = errors.New("rmq redis key holds the wrong kind of value")
+
+// KeyTypeError is returned if redis refused a command with WRONGTYPE because
+// a key used by rmq holds another kind of value, probably as another
+// application uses the same key. Keys are the keys used by that command
+type KeyTypeError struct {
+	Keys []string
+}
+
+func (err *KeyTypeError) Error() string {
+	if len(err.Keys) == 1 {
+		return fmt.Sprintf("%s: %s", ErrWrongKeyType, err.Keys[0])
 	}
+	return fmt.Sprintf("%s: one of %s", ErrWrongKeyType, strings.Join(err.Keys, ", "))
 }
 
-//func debug(message string) {
-//	log.Printf("rmq debug: %s", message) // COMMENTOUT
-//}
+func (err *KeyTypeError) Unwrap() error {
+	return ErrWrongKeyType
+}
+
+// keyTypeError returns a *KeyTypeError with the given keys if err is a
+// WRONGTYPE error, err otherwise
+func keyTypeError(err error, keys ...string) error {
+	if err == nil || !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return err
+	}
+	return &KeyTypeError{Keys: keys}
+}
@@ -1,12 +1,19 @@
 package rmq
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "github.com/adjust/gocheck"
+	"github.com/go-redis/redis"
 )
 
 func TestQueueSuite(t *testing.T) {
@@ -49,6 +56,128 @@ func (suite *QueueSuite) TestConnections(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestConnectionWithRedisOptions(c *C) {
+	connection, err := OpenConnectionWithRedisOptions("opts-conn", &redis.Options{
+		Addr: fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")),
+		DB:   2,
+	})
+	c.Assert(err, IsNil)
+	redisConnection := connection.(*redisConnection)
+	c.Check(redisConnection.Check(), Equals, true)
+
+	// heartbeat and connection set live in the configured db
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")),
+		DB:   2,
+	})
+	defer redisClient.Close()
+	c.Check(redisClient.Exists(redisConnection.heartbeatKey).Val(), Equals, int64(1))
+	c.Check(redisClient.SIsMember(connectionsKey, redisConnection.Name).Val(), Equals, true)
+
+	queue := connection.OpenQueue("opts-q")
+	queue.PurgeReady()
+	c.Check(queue.Publish("opts-d1"), Equals, true)
+	c.Check(redisClient.LLen(queue.(*redisQueue).readyKey).Val(), Equals, int64(1))
+	c.Check(queue.PurgeReady(), Equals, 1)
+
+	redisConnection.StopHeartbeat()
+	redisClient.Del(redisConnection.heartbeatKey)
+	redisClient.SRem(connectionsKey, redisConnection.Name)
+}
+
+func (suite *QueueSuite) TestConnectionWithRedisOptionsError(c *C) {
+	connection, err := OpenConnectionWithRedisOptions("opts-err", &redis.Options{Addr: "127.0.0.1:1"})
+	c.Check(connection, IsNil)
+	c.Check(err, ErrorMatches, "rmq connection failed to reach redis opts-err-.*")
+}
+
+func (suite *QueueSuite) TestOpenConnectionE(c *C) {
+	connection, err := OpenConnectionE("open-e-err", "tcp", "127.0.0.1:1", 1)
+	c.Check(connection, IsNil)
+	c.Check(err, ErrorMatches, "rmq connection failed to reach redis open-e-err-.*")
+
+	redisClient := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	connection, err = OpenConnectionWithRedisClientE("open-e-client-err", redisClient)
+	c.Check(connection, IsNil)
+	c.Check(err, ErrorMatches, "rmq connection failed to reach redis open-e-client-err-.*")
+	redisClient.Close()
+
+	connection, err = OpenConnectionE("open-e-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	c.Assert(err, IsNil)
+	c.Check(connection.(*redisConnection).Check(), Equals, true)
+	c.Check(connection.Close(), Equals, true)
+}
+
+func (suite *QueueSuite) TestConnectionWithPrefix(c *C) {
+	conn1 := OpenConnectionWithPrefix("prefix1", "prefix-conn1", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	conn2 := OpenConnectionWithPrefix("prefix2", "prefix-conn2", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	conn1.CloseAllQueues()
+	conn2.CloseAllQueues()
+	c.Check(conn1.heartbeatKey, Equals, "prefix1::connection::"+conn1.Name+"::heartbeat")
+	c.Check(conn1.GetConnections(), DeepEquals, []string{conn1.Name})
+	c.Check(conn2.GetConnections(), DeepEquals, []string{conn2.Name})
+
+	queue1 := conn1.OpenQueue("prefix-q1").(*redisQueue)
+	queue2 := conn2.OpenQueue("prefix-q1").(*redisQueue)
+	conn2.OpenQueue("prefix-q2")
+	c.Check(queue1.readyKey, Equals, "prefix1::queue::[prefix-q1]::ready")
+	c.Check(conn1.GetOpenQueues(), DeepEquals, []string{"prefix-q1"})
+	c.Check(conn2.GetOpenQueues(), HasLen, 2)
+
+	queue1.PurgeReady()
+	queue2.PurgeReady()
+	c.Check(queue1.Publish("prefix-d1"), Equals, true)
+	c.Check(queue1.ReadyCount(), Equals, 1)
+	c.Check(queue2.ReadyCount(), Equals, 0)
+	c.Check(conn1.CollectStats(conn1.GetOpenQueues()).QueueStats["prefix-q1"].ReadyCount, Equals, 1)
+	c.Check(conn2.CollectStats(conn2.GetOpenQueues()).QueueStats["prefix-q1"].ReadyCount, Equals, 0)
+
+	// cleaners only clean connections with the same prefix
+	conn1.StopHeartbeat()
+	c.Check(NewCleaner(conn2).Clean(), IsNil)
+	c.Check(conn1.GetConnections(), DeepEquals, []string{conn1.Name})
+
+	c.Check(queue1.PurgeReady(), Equals, 1)
+	conn1.Close()
+	conn1.CloseAllQueues()
+	conn2.CloseAllQueues()
+	conn2.StopHeartbeat()
+	conn2.Close()
+}
+
+func (suite *QueueSuite) TestConnectionDatabases(c *C) {
+	conn1 := OpenConnection("db-conn1", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	conn2 := OpenConnection("db-conn2", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 2)
+	conn2.CloseAllQueues()
+	c.Check(conn1.redisClient.SIsMember(conn1.connectionsKey, conn2.Name).Val(), Equals, false)
+	c.Check(conn2.GetConnections(), DeepEquals, []string{conn2.Name})
+
+	queue1 := conn1.OpenQueue("db-q1").(*redisQueue)
+	queue2 := conn2.OpenQueue("db-q1").(*redisQueue)
+	conn2.OpenQueue("db-q2")
+	c.Check(conn1.redisClient.SIsMember(conn1.allQueuesKey, "db-q2").Val(), Equals, false)
+	c.Check(conn2.GetOpenQueues(), HasLen, 2)
+
+	queue1.PurgeReady()
+	queue2.PurgeReady()
+	c.Check(queue1.Publish("db-d1"), Equals, true)
+	c.Check(queue1.ReadyCount(), Equals, 1)
+	c.Check(queue2.ReadyCount(), Equals, 0)
+	c.Check(conn1.CollectStats([]string{"db-q1"}).QueueStats["db-q1"].ReadyCount, Equals, 1)
+	c.Check(conn2.CollectStats(conn2.GetOpenQueues()).QueueStats["db-q1"].ReadyCount, Equals, 0)
+
+	// cleaners only clean connections of their database
+	conn1.StopHeartbeat()
+	c.Check(NewCleaner(conn2).Clean(), IsNil)
+	c.Check(conn1.redisClient.SIsMember(conn1.connectionsKey, conn1.Name).Val(), Equals, true)
+
+	c.Check(queue1.PurgeReady(), Equals, 1)
+	conn1.Close()
+	conn2.CloseAllQueues()
+	conn2.StopHeartbeat()
+	conn2.Close()
+}
+
 func (suite *QueueSuite) TestConnectionQueues(c *C) {
 	connection := OpenConnection("conn-q-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	c.Assert(connection, NotNil)
@@ -87,6 +216,76 @@ func (suite *QueueSuite) TestConnectionQueues(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestConnectionClose(c *C) {
+	connection := OpenConnection("close-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	c.Check(connection.OpenQueue("close-q"), NotNil) // replaced by the queue opened again
+	queue := connection.OpenQueue("close-q").(*redisQueue)
+	c.Check(connection.queues, DeepEquals, []*redisQueue{queue})
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	queue.PurgeRejected()
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("close-d%d", i)), Equals, true)
+	}
+	c.Check(queue.PublishToDelayedQueue("close-delayed", time.Hour), Equals, true)
+	c.Check(queue.redisClient.LPush(queue.rejectedKey, "close-rejected").Err(), IsNil)
+
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestConsumer("close-cons")
+	consumer.AutoAck = false
+	queue.AddConsumer("close-cons", consumer)
+	multi := ConsumeQueues([]Queue{connection.OpenQueue("close-multi-q")}, time.Millisecond, NewTestConsumer("close-multi-cons"))
+	time.Sleep(50 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	c.Check(connection.Close(), Equals, true)
+	c.Check(multi.StopConsuming(), Equals, false) // stopped by closing
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(connection.Check(), Equals, false)
+	c.Check(connection.GetConsumingQueues(), HasLen, 0)
+	c.Check(strings.Contains(strings.Join(connection.GetOpenQueues(), ","), "close-q"), Equals, true) // not closed
+	for _, name := range connection.GetConnections() {
+		c.Check(name, Not(Equals), connection.Name)
+	}
+	c.Check(connection.Close(), Equals, false)
+
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	queue.PurgeRejected()
+}
+
+func (suite *QueueSuite) TestConnectionCloseWithTimeout(c *C) {
+	connection := OpenConnection("close-timeout-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("close-timeout-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.Publish("close-timeout-d"), Equals, true)
+
+	consuming, release := make(chan struct{}), make(chan struct{})
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("close-timeout-cons", NewAckConsumer(func(delivery Delivery) error {
+		close(consuming)
+		<-release
+		return nil
+	}))
+	<-consuming
+
+	// the consumer is still busy, so nothing gets returned yet
+	c.Check(connection.CloseWithTimeout(50*time.Millisecond), Equals, false)
+	c.Check(connection.Check(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	close(release)
+	c.Check(connection.CloseWithTimeout(5*time.Second), Equals, true)
+	c.Check(connection.Check(), Equals, false)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 0)
+}
+
 func (suite *QueueSuite) TestQueue(c *C) {
 	connection := OpenConnection("queue-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	c.Assert(connection, NotNil)
@@ -195,9 +394,3340 @@ func (suite *QueueSuite) TestConsumer(c *C) {
 	c.Check(consumer.LastDelivery.Payload(), Equals, "cons-d5")
 	c.Check(consumer.LastDelivery.Delay(100*time.Millisecond), Equals, true)
 	c.Check(queue.UnackedCount(), Equals, 0)
-	c.Check(queue.DelayedCount(), Equals, 1)
-	c.Check(queue.PurgeDelayed(), Equals, 1)
-	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.PurgeDelayed(), Equals, 1)
+	c.Check(queue.DelayedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestCounters(c *C) {
+	connection := OpenConnection("counters-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("counters-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	c.Check(connection.Counters()["counters-q"], Equals, QueueCounters{})
+
+	for i := 0; i < 4; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("counters-d%d", i)), Equals, true)
+	}
+	c.Check(connection.OpenQueue("counters-q").PublishToDelayedQueue("counters-d4", time.Millisecond), Equals, true)
+
+	consumer := NewTestConsumer("counters-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("counters-cons", consumer)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 5)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, false) // failed acks don't count
+	c.Check(consumer.LastDeliveries[1].Reject(), Equals, true)
+	c.Check(consumer.LastDeliveries[2].Push(), Equals, true) // no push queue, rejects
+	c.Check(consumer.LastDeliveries[3].Delay(time.Hour), Equals, true)
+
+	counters := connection.Counters()
+	c.Check(counters["counters-q"].DelayLagCount, Equals, int64(1)) // counters-d4
+	counters["counters-q"] = withoutDelayLag(counters["counters-q"])
+	c.Check(counters, DeepEquals, map[string]QueueCounters{
+		"counters-q": {Published: 5, Consumed: 5, Acked: 1, Rejected: 2, Delayed: 1},
+	})
+	c.Check(withoutDelayLag(queue.Counters()), Equals, QueueCounters{Published: 5, Consumed: 5, Acked: 1, Rejected: 2, Delayed: 1})
+
+	queue.StopConsuming()
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+// withoutDelayLag returns the counters with the delay lag fields zeroed, as
+// the lag depends on timing
+func withoutDelayLag(counters QueueCounters) QueueCounters {
+	counters.DelayLagCount, counters.DelayLagTotal, counters.DelayLagMax = 0, 0, 0
+	return counters
+}
+
+func (suite *QueueSuite) TestStateCounts(c *C) {
+	connection := OpenConnection("state-counts-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("state-counts-q").(*redisQueue)
+	pushQueue := connection.OpenQueue("state-counts-push-q").(*redisQueue)
+	queue.SetPushQueue(pushQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	pushQueue.PurgeReady()
+	c.Check(queue.Counters().StateCounts(), DeepEquals, map[State]int64{Acked: 0, Rejected: 0, Delayed: 0, Pushed: 0, Requeued: 0})
+
+	for i := 0; i < 6; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("state-counts-d%d", i)), Equals, true)
+	}
+	consumer := NewTestConsumer("state-counts-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("state-counts-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	queue.StopConsuming()
+	c.Assert(consumer.LastDeliveries, HasLen, 6)
+
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[1].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[1].Reject(), Equals, false) // failed calls don't count
+	c.Check(consumer.LastDeliveries[2].Reject(), Equals, true)
+	c.Check(consumer.LastDeliveries[3].Delay(time.Hour), Equals, true)
+	c.Check(consumer.LastDeliveries[4].Push(), Equals, true)
+	c.Check(consumer.LastDeliveries[5].RequeueFront(), Equals, true)
+
+	stateCounts := queue.Counters().StateCounts()
+	c.Check(stateCounts, DeepEquals, map[State]int64{Acked: 2, Rejected: 1, Delayed: 1, Pushed: 1, Requeued: 1})
+	c.Check(Pushed.String(), Equals, "Pushed")
+
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+	pushQueue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPriority(c *C) {
+	connection := OpenConnection("prio-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("prio-q").(*redisQueue)
+	queue.SetMaxPriority(2)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("prio-d1"), Equals, true)
+	c.Check(queue.PublishWithPriority("prio-d2", 2), Equals, true)
+	c.Check(queue.PublishWithPriority("prio-d3", 1), Equals, true)
+	c.Check(queue.PublishWithPriority("prio-d4", 0), Equals, true)
+	c.Check(queue.PublishWithPriority("prio-d5", 5), Equals, true)  // capped to 2
+	c.Check(queue.PublishWithPriority("prio-d6", -1), Equals, true) // capped to 0
+	c.Check(queue.ReadyCount(), Equals, 6)
+
+	consumer := NewTestConsumer("prio-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("prio-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 6)
+	payloads := []string{}
+	for _, delivery := range consumer.LastDeliveries {
+		payloads = append(payloads, delivery.Payload())
+	}
+	c.Check(payloads, DeepEquals, []string{"prio-d2", "prio-d5", "prio-d3", "prio-d1", "prio-d4", "prio-d6"})
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 6)
+
+	queue.StopConsuming()
+	c.Check(queue.ReturnAllUnacked(), Equals, 6)
+	c.Check(queue.PurgeReady(), Equals, 6)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishFront(c *C) {
+	connection := OpenConnection("front-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("front-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("front-d1"), Equals, true)
+	for i := 2; i <= 4; i++ {
+		c.Check(queue.PublishFront(fmt.Sprintf("front-d%d", i)), Equals, true)
+	}
+	c.Check(queue.Counters().Published, Equals, int64(4))
+
+	deliveries, err := queue.Fetch(4)
+	c.Check(err, IsNil)
+	payloads := []string{}
+	for _, delivery := range deliveries {
+		payloads = append(payloads, delivery.Payload())
+		c.Check(delivery.Ack(), Equals, true)
+	}
+	c.Check(payloads, DeepEquals, []string{"front-d4", "front-d3", "front-d2", "front-d1"})
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishWithTTL(c *C) {
+	connection := OpenConnection("ttl-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("ttl-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.PublishWithTTL("ttl-d1", 20*time.Millisecond), Equals, true)
+	c.Check(queue.PublishWithTTL("ttl-d2", time.Minute), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	time.Sleep(30 * time.Millisecond)
+
+	consumer := NewTestConsumer("ttl-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("ttl-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "ttl-d2")
+	c.Check(consumer.LastDelivery.Expired(), Equals, false)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 1) // expired delivery got dropped
+	c.Check(queue.counters.snapshot().Expired, Equals, int64(1))
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPeek(c *C) {
+	connection := OpenConnection("peek-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("peek-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	peeked, err := queue.PeekReady(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{})
+	peeked, err = queue.PeekRejected(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{})
+
+	c.Check(queue.Publish("peek-d1"), Equals, true)
+	c.Check(queue.Publish("peek-d2"), Equals, true)
+	c.Check(queue.PublishWithTTL("peek-d3", time.Minute), Equals, true)
+	peeked, err = queue.PeekReady(2)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{"peek-d1", "peek-d2"})
+	peeked, err = queue.PeekReady(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{"peek-d1", "peek-d2", "peek-d3"})
+	peeked, err = queue.PeekReady(0)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{})
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	queue.SetMaxPriority(1)
+	c.Check(queue.PublishWithPriority("peek-d4", 1), Equals, true)
+	peeked, err = queue.PeekReady(2)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{"peek-d4", "peek-d1"})
+
+	c.Check(queue.redisClient.LPush(queue.rejectedKey, "peek-r1", "peek-r2").Err(), IsNil)
+	peeked, err = queue.PeekRejected(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{"peek-r1", "peek-r2"})
+	c.Check(queue.ReturnRejected(1), Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 1)
+	peeked, _ = queue.PeekRejected(10)
+	c.Check(peeked, DeepEquals, []string{"peek-r2"})
+
+	c.Check(queue.PurgeReady(), Equals, 5)
+	c.Check(queue.PurgeRejected(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnRejectedMatching(c *C) {
+	connection := OpenConnection("matching-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("matching-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	// more than a page, oldest first
+	tenantA, tenantB := []string{}, []string{}
+	for i := 0; i < 250; i++ {
+		payload := fmt.Sprintf("b-%d", i)
+		if i%2 == 0 {
+			payload = fmt.Sprintf("a-%d", i)
+			tenantA = append(tenantA, payload)
+		} else {
+			tenantB = append(tenantB, payload)
+		}
+		c.Check(queue.redisClient.LPush(queue.rejectedKey, newMessage(payload).marshal()).Err(), IsNil)
+	}
+	isTenantA := func(payload string) bool { return strings.HasPrefix(payload, "a-") }
+
+	returned, err := queue.ReturnRejectedMatching(isTenantA, 3)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 3)
+	peeked, _ := queue.PeekReady(10)
+	c.Check(peeked, DeepEquals, tenantA[:3])
+
+	returned, err = queue.ReturnRejectedMatching(isTenantA, 1000)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 122)
+	peeked, _ = queue.PeekReady(1000)
+	c.Check(peeked, DeepEquals, tenantA)
+	peeked, _ = queue.PeekRejected(1000)
+	c.Check(peeked, DeepEquals, tenantB)
+
+	returned, err = queue.ReturnRejectedMatching(isTenantA, 1000)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 0)
+
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRecordRejectedBy(c *C) {
+	connection := OpenConnection("rejected-by-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("rejected-by-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.SetRecordRejectedBy(true)
+
+	c.Check(queue.Publish("rejected-by-d1"), Equals, true)
+	fetched, err := queue.Fetch(1) // not consumed by a consumer
+	c.Check(err, IsNil)
+	c.Assert(fetched, HasLen, 1)
+	c.Check(fetched[0].Reject(), Equals, true)
+
+	queue.StartConsuming(10, time.Millisecond)
+	tagged := NewTestConsumer("rejected-by-worker")
+	tagged.AutoAck = false
+	queue.AddConsumer("rejected-by-worker", tagged)
+	c.Check(queue.Publish("rejected-by-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(tagged.LastDeliveries, HasLen, 1)
+	c.Check(tagged.LastDelivery.Reject(), Equals, true)
+
+	rejected, err := queue.PeekRejectedDeliveries(10)
+	c.Check(err, IsNil)
+	c.Assert(rejected, HasLen, 2)
+	c.Check(rejected[0].Payload, Equals, "rejected-by-d1")
+	c.Check(rejected[0].RejectedBy(), Equals, "")
+	c.Check(rejected[1].Payload, Equals, "rejected-by-d2")
+	c.Check(rejected[1].RejectedBy(), Equals, "rejected-by-worker")
+	c.Check(rejected[1].Message().Payload, Equals, "rejected-by-d2")
+	payloads, err := queue.PeekRejected(10)
+	c.Check(err, IsNil)
+	c.Check(payloads, DeepEquals, []string{"rejected-by-d1", "rejected-by-d2"})
+
+	queue.StopConsuming()
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPeekDelayed(c *C) {
+	connection := OpenConnection("peek-delayed-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("peek-delayed-q").(*redisQueue)
+	queue.PurgeDelayed()
+
+	peeked, err := queue.PeekDelayed(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []DelayedDelivery{})
+
+	// scores which are exact as float64
+	first, second := time.Unix(1700000000, 0), time.Unix(1700000100, 0)
+	c.Check(queue.PublishAt("peek-delayed-d2", second), Equals, true)
+	c.Check(queue.redisClient.ZAdd(queue.delayedKey, redis.Z{
+		Score:  float64(first.UnixNano()),
+		Member: newMessage("peek-delayed-d1").marshal(),
+	}).Err(), IsNil)
+
+	peeked, err = queue.PeekDelayed(10)
+	c.Check(err, IsNil)
+	c.Assert(peeked, HasLen, 2)
+	c.Check(peeked[0].Payload, Equals, "peek-delayed-d1")
+	c.Check(peeked[0].RunAt.UnixNano(), Equals, first.UnixNano())
+	c.Check(peeked[1].Payload, Equals, "peek-delayed-d2")
+	c.Check(peeked[1].RunAt.UnixNano(), Equals, second.UnixNano())
+
+	peeked, err = queue.PeekDelayed(1)
+	c.Check(err, IsNil)
+	c.Check(peeked, HasLen, 1)
+	peeked, err = queue.PeekDelayed(0)
+	c.Check(err, IsNil)
+	c.Check(peeked, HasLen, 0)
+	c.Check(queue.DelayedCount(), Equals, 2)
+
+	// other times get rounded to the precision of the float64 score
+	third := time.Unix(1700000200, 123)
+	c.Check(queue.PublishAt("peek-delayed-d3", third), Equals, true)
+	peeked, err = queue.PeekDelayed(10)
+	c.Check(err, IsNil)
+	c.Assert(peeked, HasLen, 3)
+	c.Check(peeked[2].RunAt.UnixNano(), Equals, int64(unixScore(third)))
+	c.Check(peeked[2].RunAt.Equal(third), Equals, false)
+	c.Check(third.Sub(peeked[2].RunAt) < 256*time.Nanosecond, Equals, true)
+	c.Check(peeked[2].RunAt.Sub(third) < 256*time.Nanosecond, Equals, true)
+
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishAt(c *C) {
+	connection := OpenConnection("at-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("at-q").(*redisQueue)
+	queue.PurgeDelayed()
+
+	now := time.Now()
+	c.Check(queue.PublishAt("at-d1", now.Add(60*time.Millisecond)), Equals, true)
+	c.Check(queue.PublishAt("at-d2", now.Add(20*time.Millisecond)), Equals, true)
+	c.Check(queue.DelayedCount(), Equals, 2)
+
+	consumer := NewTestConsumer("at-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("at-cons", consumer)
+	time.Sleep(40 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "at-d2")
+	c.Check(queue.DelayedCount(), Equals, 1)
+
+	time.Sleep(40 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "at-d1")
+	c.Check(queue.DelayedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishToDelayedQueueBatch(c *C) {
+	connection := OpenConnection("delayed-batch-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("delayed-batch-q").(*redisQueue)
+	queue.SetEnvelope(JSONEnvelope{})
+	queue.PurgeDelayed()
+
+	added, err := queue.PublishToDelayedQueueBatch(nil)
+	c.Check(err, IsNil)
+	c.Check(added, Equals, 0)
+
+	items := []DelayedItem{
+		{Payload: "delayed-batch-d1", Delay: time.Hour},
+		{Payload: "delayed-batch-d2", Delay: time.Minute},
+		{Payload: "delayed-batch-d3", Delay: 0},
+		{Payload: "delayed-batch-d4", Delay: 24 * time.Hour},
+	}
+	before := time.Now()
+	added, err = queue.PublishToDelayedQueueBatch(items)
+	after := time.Now()
+	c.Check(err, IsNil)
+	c.Check(added, Equals, 4)
+	c.Check(queue.DelayedCount(), Equals, 4)
+	delayed, err := queue.PeekDelayed(4)
+	c.Check(err, IsNil)
+	c.Assert(delayed, HasLen, 4)
+	for i, index := range []int{2, 1, 0, 3} { // by delay
+		item := items[index]
+		c.Check(delayed[i].Payload, Equals, item.Payload)
+		c.Check(delayed[i].RunAt.Before(before.Add(item.Delay).Add(-time.Microsecond)), Equals, false, Commentf("%s", item.Payload))
+		c.Check(delayed[i].RunAt.After(after.Add(item.Delay).Add(time.Microsecond)), Equals, false, Commentf("%s", item.Payload))
+	}
+
+	// duplicates are separate deliveries, as they're published with an id
+	added, err = queue.PublishToDelayedQueueBatch([]DelayedItem{
+		{Payload: "delayed-batch-d1", Delay: time.Minute},
+		{Payload: "delayed-batch-d5", Delay: time.Minute},
+		{Payload: "delayed-batch-d5", Delay: 2 * time.Hour},
+	})
+	c.Check(err, IsNil)
+	c.Check(added, Equals, 3)
+	c.Check(queue.DelayedCount(), Equals, 7)
+	queue.PurgeDelayed()
+
+	// without ids duplicates only reschedule, the last occurrence wins
+	queue.SetEnvelope(RawEnvelope{})
+	added, err = queue.PublishToDelayedQueueBatch([]DelayedItem{
+		{Payload: "delayed-batch-d1", Delay: time.Hour},
+		{Payload: "delayed-batch-d1", Delay: time.Minute},
+		{Payload: "delayed-batch-d5", Delay: time.Minute},
+		{Payload: "delayed-batch-d5", Delay: 2 * time.Hour},
+	})
+	c.Check(err, IsNil)
+	c.Check(added, Equals, 2)
+	c.Check(queue.DelayedCount(), Equals, 2)
+	score, err := queue.redisClient.ZScore(queue.delayedKey, "delayed-batch-d1").Result()
+	c.Check(err, IsNil)
+	c.Check(score < unixScore(time.Now().Add(time.Hour)), Equals, true)
+	score, err = queue.redisClient.ZScore(queue.delayedKey, "delayed-batch-d5").Result()
+	c.Check(err, IsNil)
+	c.Check(score > unixScore(time.Now().Add(time.Hour)), Equals, true)
+
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+// fixedServerTimeClient reports a fixed time as the time of the redis server
+type fixedServerTimeClient struct {
+	redis.UniversalClient
+	at time.Time
+}
+
+func (client fixedServerTimeClient) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	if script != serverTimeScript {
+		return client.UniversalClient.Eval(script, keys, args...)
+	}
+	return redis.NewCmdResult([]interface{}{fmt.Sprint(client.at.Unix()), fmt.Sprint(client.at.Nanosecond() / 1000)}, nil)
+}
+
+func (suite *QueueSuite) TestServerClock(c *C) {
+	connection := OpenConnection("server-clock-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	serverNow := time.Now().Add(24 * time.Hour).Truncate(time.Microsecond) // the clock of the server is far ahead
+	redisClient := fixedServerTimeClient{UniversalClient: connection.redisClient, at: serverNow}
+	queue := newQueue("", "server-clock-q", "server-clock-conn", "rmq::connection::server-clock-conn::queues", redisClient, &QueueCounters{})
+	queue.PurgeDelayed()
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	c.Check(serverTime(redisClient, queue.delayedKey, nil).Equal(serverNow), Equals, true)
+
+	score := func(payload string) float64 {
+		member, found, err := queue.findDelayed(payload)
+		c.Check(err, IsNil)
+		c.Check(found, Equals, true)
+		score, err := queue.redisClient.ZScore(queue.delayedKey, member).Result()
+		c.Check(err, IsNil)
+		return score
+	}
+
+	c.Check(queue.PublishToDelayedQueue("server-clock-local", time.Minute), Equals, true)
+	c.Check(score("server-clock-local") < unixScore(serverNow), Equals, true)
+
+	queue.SetServerClock(true)
+	c.Check(queue.PublishToDelayedQueue("server-clock-d1", time.Minute), Equals, true)
+	c.Check(score("server-clock-d1"), Equals, unixScore(serverNow.Add(time.Minute)))
+	added, err := queue.PublishToDelayedQueueBatch([]DelayedItem{{Payload: "server-clock-d2", Delay: time.Hour}})
+	c.Check(err, IsNil)
+	c.Check(added, Equals, 1)
+	c.Check(score("server-clock-d2"), Equals, unixScore(serverNow.Add(time.Hour)))
+	c.Check(queue.RescheduleDelayed("server-clock-d2", 2*time.Hour), Equals, true)
+	c.Check(score("server-clock-d2"), Equals, unixScore(serverNow.Add(2*time.Hour)))
+
+	c.Check(queue.Publish("server-clock-ready"), Equals, true)
+	fetched, err := queue.Fetch(1)
+	c.Check(err, IsNil)
+	c.Assert(fetched, HasLen, 1)
+	c.Check(fetched[0].Delay(time.Second), Equals, true)
+	delayed, err := queue.PeekDelayed(10)
+	c.Check(err, IsNil)
+	c.Assert(delayed, HasLen, 4)
+	c.Check(delayed[1].Payload, Equals, "server-clock-ready") // after local, before d1
+	c.Check(unixScore(delayed[1].RunAt), Equals, unixScore(serverNow.Add(time.Second)))
+
+	// due by the server clock although it isn't by the local one
+	c.Check(queue.PublishAt("server-clock-due", serverNow.Add(-time.Minute)), Equals, true)
+	deliveryChan := make(chan Delivery, 10)
+	queue.deliveryChanForDelayedQueue = deliveryChan
+	c.Check(queue.consumeBatchForDelayedQueue(10), Equals, true)
+	c.Assert(deliveryChan, HasLen, 2)
+	payloads := []string{(<-deliveryChan).Payload(), (<-deliveryChan).Payload()}
+	sort.Strings(payloads)
+	c.Check(payloads, DeepEquals, []string{"server-clock-due", "server-clock-local"})
+	c.Check(queue.DelayedCount(), Equals, 3)
+
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestUnixScorePrecision(c *C) {
+	at := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, apart := range []time.Duration{time.Millisecond, time.Microsecond, 512 * time.Nanosecond} {
+		for i := 0; i < 1000; i++ {
+			earlier := at.Add(time.Duration(i) * time.Nanosecond)
+			c.Check(unixScore(earlier) < unixScore(earlier.Add(apart)), Equals, true, Commentf("%s apart", apart))
+		}
+	}
+	c.Check(unixScore(at), Equals, unixScore(at.Add(time.Nanosecond))) // below the precision
+
+	// exactly 256ns apart both are ties, rounded to the same even multiple
+	c.Check(unixScore(at.Add(384*time.Nanosecond)), Equals, unixScore(at.Add(640*time.Nanosecond)))
+}
+
+func (suite *QueueSuite) TestPublishAtOrdering(c *C) {
+	connection := OpenConnection("at-order-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("at-order-q").(*redisQueue)
+	queue.PurgeDelayed()
+
+	// published latest first with payloads sorting the other way round
+	now := time.Now().Add(20 * time.Millisecond)
+	payloads := []string{"at-order-e", "at-order-d", "at-order-c", "at-order-b", "at-order-a"}
+	for i := len(payloads) - 1; i >= 0; i-- {
+		c.Check(queue.PublishAt(payloads[i], now.Add(time.Duration(i)*time.Millisecond)), Equals, true)
+	}
+
+	delayed, err := queue.PeekDelayed(10)
+	c.Check(err, IsNil)
+	c.Assert(delayed, HasLen, 5)
+	for i, delivery := range delayed {
+		c.Check(delivery.Payload, Equals, payloads[i])
+	}
+
+	consumer := NewTestConsumer("at-order-cons")
+	queue.StartConsuming(10, 50*time.Millisecond) // all due at once
+	queue.AddConsumer("at-order-cons", consumer)
+	time.Sleep(150 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 5)
+	for i, delivery := range consumer.LastDeliveries {
+		c.Check(delivery.Payload(), Equals, payloads[i])
+	}
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestCancelAndRescheduleDelayed(c *C) {
+	connection := OpenConnection("cancel-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("cancel-q").(*redisQueue)
+	queue.SetEnvelope(JSONEnvelope{})
+	queue.PurgeDelayed()
+
+	c.Check(queue.PublishToDelayedQueue("cancel-d1", 20*time.Millisecond), Equals, true)
+	c.Check(queue.PublishToDelayedQueue("cancel-d2", 20*time.Millisecond), Equals, true)
+	cancelled, err := queue.CancelDelayed("cancel-d1")
+	c.Check(err, IsNil)
+	c.Check(cancelled, Equals, true)
+	cancelled, err = queue.CancelDelayed("cancel-d1")
+	c.Check(err, IsNil)
+	c.Check(cancelled, Equals, false)
+	c.Check(queue.RescheduleDelayed("cancel-d2", 80*time.Millisecond), Equals, true)
+	c.Check(queue.RescheduleDelayed("cancel-d3", 80*time.Millisecond), Equals, false)
+	c.Check(queue.DelayedCount(), Equals, 1)
+
+	// deliveries delayed by consumers are found by their payload too, equal
+	// payloads are cancelled one at a time
+	c.Check(queue.Publish("cancel-d3"), Equals, true)
+	c.Check(queue.Publish("cancel-d3"), Equals, true)
+	deliveries, err := queue.Fetch(2)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 2)
+	c.Check(deliveries[0].Delay(time.Hour), Equals, true)
+	c.Check(deliveries[1].Delay(time.Hour), Equals, true)
+	c.Check(queue.RescheduleDelayed("cancel-d3", 2*time.Hour), Equals, true)
+	for i := 0; i < 2; i++ {
+		cancelled, err = queue.CancelDelayed("cancel-d3")
+		c.Check(err, IsNil)
+		c.Check(cancelled, Equals, true)
+	}
+	cancelled, err = queue.CancelDelayed("cancel-d3")
+	c.Check(err, IsNil)
+	c.Check(cancelled, Equals, false)
+	c.Check(queue.DelayedCount(), Equals, 1)
+
+	consumer := NewTestConsumer("cancel-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("cancel-cons", consumer)
+	time.Sleep(40 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 0)
+	c.Check(queue.DelayedCount(), Equals, 1)
+
+	time.Sleep(60 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "cancel-d2")
+	c.Check(queue.DelayedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnRejectedWithRate(c *C) {
+	connection := OpenConnection("rate-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("rate-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	c.Check(queue.redisClient.LPush(queue.rejectedKey, "rate-d1", "rate-d2", "rate-d3", "rate-d4", "rate-d5").Err(), IsNil)
+
+	// fake clock which gets interrupted on the second sleep
+	ctx, cancel := context.WithCancel(context.Background())
+	sleeps := []time.Duration{}
+	sleep := func(ctx context.Context, duration time.Duration) bool {
+		sleeps = append(sleeps, duration)
+		if len(sleeps) == 2 {
+			cancel()
+			return false
+		}
+		return true
+	}
+	c.Check(queue.returnRejectedPaced(ctx, 5, 250*time.Millisecond, sleep), Equals, 2)
+	c.Check(sleeps, DeepEquals, []time.Duration{250 * time.Millisecond, 250 * time.Millisecond})
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.RejectedCount(), Equals, 3)
+
+	c.Check(queue.ReturnRejectedWithRate(ctx, 3, 1000), Equals, 0) // already cancelled
+	c.Check(queue.ReturnRejectedWithRate(context.Background(), 5, 1000), Equals, 3)
+	c.Check(queue.ReadyCount(), Equals, 5)
+	c.Check(queue.RejectedCount(), Equals, 0)
+
+	c.Check(queue.PurgeReady(), Equals, 5)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDeadLetterQueue(c *C) {
+	connection := OpenConnection("dlq-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("dlq-q").(*redisQueue)
+	deadLetterQueue := connection.OpenQueue("dlq-dead-q").(*redisQueue)
+	c.Check(queue.SetDeadLetterQueueE(NewTestQueue("dlq-test-q"), 2), ErrorMatches, "rmq queue .* can't use \\*rmq.TestQueue as dead letter queue, .*")
+	c.Check(queue.SetDeadLetterQueueE(queue, 2), ErrorMatches, "rmq queue .* can't be its own dead letter queue")
+	c.Check(queue.deadLetterKey, Equals, "")
+	queue.SetDeadLetterQueue(deadLetterQueue, 2)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	deadLetterQueue.PurgeReady()
+
+	consumer := NewTestConsumer("dlq-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("dlq-cons", consumer)
+
+	c.Check(queue.Publish("dlq-d1"), Equals, true)
+	c.Check(queue.Publish("dlq-d2"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].Reject(), Equals, true)
+	failed, err := Deliveries(consumer.LastDeliveries[1:]).Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 2) // first attempt
+	c.Check(deadLetterQueue.ReadyCount(), Equals, 0)
+
+	c.Check(queue.ReturnAllRejected(), Equals, 2)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 4)
+	c.Check(consumer.LastDeliveries[2].Payload(), Equals, "dlq-d1")
+	c.Check(consumer.LastDeliveries[2].Reject(), Equals, true)
+	failed, err = Deliveries(consumer.LastDeliveries[3:]).Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(deadLetterQueue.ReadyCount(), Equals, 2) // second attempt
+
+	peeked, err := deadLetterQueue.PeekReady(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{"dlq-d1", "dlq-d2"})
+
+	queue.StopConsuming()
+	c.Check(deadLetterQueue.PurgeReady(), Equals, 2)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestSetPushQueueE(c *C) {
+	queue := newQueue("", "push-e-q", "push-e-conn", "queues", nil, &QueueCounters{})
+	c.Check(queue.SetPushQueueE(NewTestQueue("push-e-test")), ErrorMatches, `rmq queue \[push-e-q conn:push-e-conn\] can't push to \*rmq.TestQueue, .*`)
+	c.Check(queue.pushKey, Equals, "")
+
+	pushQueue := newQueue("", "push-e-push-q", "push-e-conn", "queues", nil, &QueueCounters{})
+	c.Check(queue.SetPushQueueE(pushQueue), IsNil)
+	c.Check(queue.pushKey, Equals, pushQueue.readyKey)
+}
+
+func (suite *QueueSuite) TestSetPushQueueByName(c *C) {
+	connection := OpenConnection("push-name-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("push-name-q").(*redisQueue)
+	c.Check(queue.SetPushQueueByName(""), ErrorMatches, ".*can't push to a queue without name")
+	c.Check(queue.SetPushQueueByName("push-name-q"), ErrorMatches, ".*can't push to itself")
+	c.Check(queue.pushKey, Equals, "")
+
+	c.Check(queue.SetPushQueueByName("push-name-target-q"), IsNil)
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	// opened elsewhere, like another service consuming the push queue
+	targetConnection := OpenConnection("push-name-target-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	target := targetConnection.OpenQueue("push-name-target-q").(*redisQueue)
+	target.PurgeReady()
+	c.Check(queue.pushKey, Equals, target.readyKey)
+
+	c.Check(queue.Publish("push-name-d1"), Equals, true)
+	deliveryChan := make(chan Delivery, 1)
+	c.Check(queue.consumeBatch(deliveryChan, 1), Equals, true)
+	c.Check((<-deliveryChan).Push(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	payloads, err := target.PeekReady(1)
+	c.Check(err, IsNil)
+	c.Check(payloads, DeepEquals, []string{"push-name-d1"})
+	c.Check(target.PurgeReady(), Equals, 1)
+	connection.StopHeartbeat()
+	targetConnection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestSetEnvelope(c *C) {
+	connection := OpenConnection("envelope-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("envelope-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	queue.SetEnvelope(RawEnvelope{})
+	c.Check(queue.Publish("envelope-raw"), Equals, true)
+	c.Check(queue.PublishWithHeaders("envelope-raw-headers", map[string]string{"h": "v"}), Equals, true)
+	c.Check(queue.redisClient.LRange(queue.readyKey, 0, -1).Val(), DeepEquals, []string{"envelope-raw-headers", "envelope-raw"})
+	queue.SetEnvelope(nil) // back to the default, readable by older consumers
+	c.Check(queue.Publish("envelope-compat"), Equals, true)
+	c.Check(queue.redisClient.LIndex(queue.readyKey, 0).Val(), Equals, "envelope-compat")
+	c.Check(queue.PublishWithHeaders("envelope-compat-headers", map[string]string{"h": "v"}), Equals, true)
+	c.Check(queue.redisClient.LIndex(queue.readyKey, 0).Val(), Matches, envelopePrefix+".*")
+	queue.SetEnvelope(JSONEnvelope{})
+	c.Check(queue.Publish("envelope-json"), Equals, true)
+	c.Check(queue.redisClient.LIndex(queue.readyKey, 0).Val(), Matches, envelopePrefix+".*")
+
+	deliveryChan := make(chan Delivery, 5)
+	c.Check(queue.consumeBatch(deliveryChan, 5), Equals, true)
+	deliveries := []Delivery{<-deliveryChan, <-deliveryChan, <-deliveryChan, <-deliveryChan, <-deliveryChan}
+	c.Check(deliveries[0].Message(), DeepEquals, Message{Payload: "envelope-raw"})
+	c.Check(deliveries[1].Message(), DeepEquals, Message{Payload: "envelope-raw-headers"})
+	c.Check(deliveries[2].Message(), DeepEquals, Message{Payload: "envelope-compat"})
+	c.Check(deliveries[3].Payload(), Equals, "envelope-compat-headers")
+	c.Check(deliveries[3].Message().Headers, DeepEquals, map[string]string{"h": "v"})
+	enveloped := deliveries[4]
+	c.Check(enveloped.Payload(), Equals, "envelope-json")
+	c.Check(enveloped.Message().ID, HasLen, 16)
+	c.Check(enveloped.Message().EnqueuedAt, Not(Equals), int64(0))
+	for _, delivery := range deliveries {
+		c.Check(delivery.Ack(), Equals, true)
+	}
+	c.Check(queue.UnackedCount(), Equals, 0)
+	connection.StopHeartbeat()
+}
+
+// wrongTypeClient fails all commands as if all keys held another kind of value
+type wrongTypeClient struct {
+	redis.UniversalClient
+}
+
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+func (client wrongTypeClient) SAdd(key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, errWrongType)
+}
+
+func (client wrongTypeClient) LRange(key string, start, stop int64) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(nil, errWrongType)
+}
+
+func (client wrongTypeClient) ZRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd {
+	return redis.NewZSliceCmdResult(nil, errWrongType)
+}
+
+func (client wrongTypeClient) LRem(key string, count int64, value interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, errWrongType)
+}
+
+func (client wrongTypeClient) RPopLPush(source, destination string) *redis.StringCmd {
+	return redis.NewStringResult("", errWrongType)
+}
+
+func (client wrongTypeClient) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	return redis.NewCmdResult(nil, errWrongType)
+}
+
+func (suite *QueueSuite) TestWrongKeyType(c *C) {
+	queue := newQueue("", "wrong-type-q", "wrong-type-conn", "rmq::connection::wrong-type-conn::queues", wrongTypeClient{}, &QueueCounters{})
+	checkKeyTypeError := func(err error, keys ...string) {
+		c.Assert(err, FitsTypeOf, &KeyTypeError{})
+		c.Check(err.(*KeyTypeError).Keys, DeepEquals, keys)
+		c.Check(err.(*KeyTypeError).Unwrap(), Equals, ErrWrongKeyType)
+	}
+
+	_, err := queue.PeekReady(1)
+	checkKeyTypeError(err, queue.readyKey)
+	c.Check(err, ErrorMatches, "rmq redis key holds the wrong kind of value: rmq::queue::\\[wrong-type-q\\]::ready")
+	_, err = queue.PeekRejected(1)
+	checkKeyTypeError(err, queue.rejectedKey)
+	_, err = queue.PeekDelayed(1)
+	checkKeyTypeError(err, queue.delayedKey)
+	_, err = queue.Fetch(1)
+	checkKeyTypeError(err, queue.queuesKey)
+	_, err = queue.ReturnRejectedMatching(func(string) bool { return true }, 1)
+	checkKeyTypeError(err, queue.rejectedKey)
+	_, err = queue.returnRejectedValue("wrong-type-d1")
+	checkKeyTypeError(err, queue.rejectedKey, queue.readyKey)
+	c.Check(err, ErrorMatches, "rmq redis key holds the wrong kind of value: one of .*::rejected, .*::ready")
+
+	err = queue.newDelivery(newMessage("wrong-type-d1").marshal()).AckE()
+	checkKeyTypeError(err, queue.unackedKey)
+
+	c.Check(keyTypeError(nil, "key"), IsNil)
+	c.Check(keyTypeError(errors.New("ERR other"), "key"), ErrorMatches, "ERR other")
+}
+
+func (suite *QueueSuite) TestMoveIsAtomic(c *C) {
+	connection := OpenConnection("atomic-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("atomic-q").(*redisQueue)
+	pushQueue := connection.OpenQueue("atomic-push-q").(*redisQueue)
+	queue.SetPushQueue(pushQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	pushQueue.PurgeReady()
+	c.Check(queue.ReturnAllUnacked(), Equals, 0)
+	c.Check(queue.redisClient.LPush(queue.unackedKey, "atomic-d1").Err(), IsNil)
+
+	evals := 0
+	delivery := queue.newDelivery("atomic-d1")
+	delivery.redisClient = crashingClient{evals: &evals}
+	c.Check(delivery.Push(), Equals, false)
+	c.Check(delivery.Reject(), Equals, false)
+	c.Check(delivery.Delay(time.Minute), Equals, false)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(pushQueue.ReadyCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(evals, Equals, 3) // each move is a single command
+
+	delivery.redisClient = queue.redisClient
+	c.Check(delivery.Push(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(pushQueue.ReadyCount(), Equals, 1)
+
+	// not unacked anymore, so it doesn't get moved again
+	c.Check(delivery.Reject(), Equals, false)
+	c.Check(queue.RejectedCount(), Equals, 0)
+
+	c.Check(pushQueue.PurgeReady(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPushCycle(c *C) {
+	connection := OpenConnection("push-cycle-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queueA := connection.OpenQueue("push-cycle-a").(*redisQueue)
+	queueB := connection.OpenQueue("push-cycle-b").(*redisQueue)
+	for _, queue := range []*redisQueue{queueA, queueB} {
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		c.Check(queue.ReturnAllUnacked(), Equals, 0)
+		queue.PurgeReady()
+		queue.SetMaxPushHops(3)
+	}
+	c.Check(queueA.SetPushQueueE(queueA), ErrorMatches, ".*can't push to itself")
+	c.Check(queueA.pushKey, Equals, "")
+	c.Check(queueA.SetPushQueueE(queueB), IsNil)
+	c.Check(queueB.SetPushQueueE(queueA), IsNil)
+
+	c.Check(queueA.Publish("push-cycle-d1"), Equals, true)
+	queues := []*redisQueue{queueA, queueB}
+	for hop := 0; hop < 3; hop++ {
+		deliveries, err := queues[hop%2].Fetch(1)
+		c.Check(err, IsNil)
+		c.Assert(deliveries, HasLen, 1)
+		c.Check(deliveries[0].Push(), Equals, true)
+		c.Check(queues[(hop+1)%2].ReadyCount(), Equals, 1)
+	}
+
+	// the fourth push exceeds the limit and rejects instead
+	deliveries, err := queueB.Fetch(1)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Check(deliveries[0].Payload(), Equals, "push-cycle-d1")
+	c.Check(deliveries[0].Push(), Equals, true)
+	c.Check(queueA.ReadyCount(), Equals, 0)
+	c.Check(queueB.ReadyCount(), Equals, 0)
+	c.Check(queueB.UnackedCount(), Equals, 0)
+	rejected, err := queueB.PeekRejected(10)
+	c.Check(err, IsNil)
+	c.Check(rejected, DeepEquals, []string{"push-cycle-d1"})
+	c.Check(queueA.Counters().Pushed+queueB.Counters().Pushed, Equals, int64(3))
+	c.Check(queueB.Counters().Rejected, Equals, int64(1))
+
+	queueB.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAckDuplicatePayloads(c *C) {
+	connection := OpenConnection("dup-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("dup-q").(*redisQueue)
+	queue.SetEnvelope(JSONEnvelope{})
+	queue.PurgeReady()
+	c.Check(queue.ReturnAllUnacked(), Equals, 0)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("dup-d"), Equals, true)
+	c.Check(queue.Publish("dup-d"), Equals, true)
+
+	consumer := NewTestConsumer("dup-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("dup-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "dup-d")
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "dup-d")
+
+	c.Check(consumer.LastDeliveries[0].AckE(), IsNil)
+	c.Check(consumer.LastDeliveries[0].AckE(), Equals, ErrDeliveryNotFound) // doesn't remove the other one
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, false)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(consumer.LastDeliveries[1].AckE(), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumerConcurrency(c *C) {
+	connection := OpenConnection("concurrency-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("concurrency-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 20; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("concurrency-d%d", i)), Equals, true)
+	}
+
+	var running, maxRunning, consumed int32
+	consumer := NewAckConsumer(func(delivery Delivery) error {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&consumed, 1)
+		return nil
+	})
+
+	queue.StartConsuming(20, time.Millisecond)
+	queue.AddConsumerWithConcurrency("concurrency-cons", 3, consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.StopConsuming(), Equals, true)
+	queue.WaitForConsuming()
+	c.Check(atomic.LoadInt32(&running), Equals, int32(0))
+	c.Check(atomic.LoadInt32(&maxRunning), Equals, int32(3))
+	c.Check(int(atomic.LoadInt32(&consumed))+queue.ReadyCount(), Equals, 20)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestFetch(c *C) {
+	connection := OpenConnection("fetch-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("fetch-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("fetch-d%d", i)), Equals, true)
+	}
+
+	for _, count := range []int{0, -1} {
+		deliveries, err := queue.Fetch(count)
+		c.Check(err, IsNil)
+		c.Check(deliveries, DeepEquals, []Delivery{})
+	}
+	c.Check(queue.ReadyCount(), Equals, 5)
+
+	deliveries, err := queue.Fetch(3)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 3)
+	c.Check(deliveries[0].Payload(), Equals, "fetch-d0")
+	c.Check(deliveries[2].Payload(), Equals, "fetch-d2")
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 3)
+	c.Check(connection.GetConsumingQueues(), DeepEquals, []string{"fetch-q"})
+
+	c.Check(deliveries[0].Ack(), Equals, true)
+	c.Check(deliveries[1].Reject(), Equals, true)
+	failed, err := Deliveries(deliveries[2:]).Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	deliveries, err = queue.Fetch(5)
+	c.Check(err, IsNil)
+	c.Check(deliveries, HasLen, 2)
+	failed, err = Deliveries(deliveries).Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+
+	deliveries, err = queue.Fetch(5)
+	c.Check(err, IsNil)
+	c.Check(deliveries, HasLen, 0)
+	c.Check(queue.Counters().Consumed, Equals, int64(5))
+
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeN(c *C) {
+	connection := OpenConnection("consume-n-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("consume-n-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("consume-n-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("consume-n-cons")
+	consumed, err := queue.ConsumeN(3, 0, consumer)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, 3)
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "consume-n-d0")
+	c.Check(consumer.LastDeliveries[2].Payload(), Equals, "consume-n-d2")
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	// stops early once ready and unacked are empty
+	consumed, err = queue.ConsumeN(10, 0, consumer)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, 2)
+	c.Check(consumer.LastDeliveries, HasLen, 5)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	consumed, err = queue.ConsumeN(10, 0, consumer)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, 0)
+
+	// fetches in batches
+	for i := 0; i < consumeNBatchSize+50; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("consume-n-b%d", i)), Equals, true)
+	}
+	consumed, err = queue.ConsumeN(consumeNBatchSize+20, 0, consumer)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, consumeNBatchSize+20)
+	c.Check(queue.ReadyCount(), Equals, 30)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	queue.PurgeReady()
+
+	// waits for unacked deliveries until the timeout
+	c.Check(queue.Publish("consume-n-u0"), Equals, true)
+	c.Check(queue.Publish("consume-n-u1"), Equals, true)
+	keeper := NewTestConsumer("consume-n-keeper")
+	keeper.AutoAck = false
+	start := time.Now()
+	consumed, err = queue.ConsumeN(10, 200*time.Millisecond, keeper)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, 2)
+	c.Check(time.Since(start) >= 200*time.Millisecond, Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	// consumes unacked deliveries once they got returned
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		queue.ReturnAllUnacked()
+	}()
+	consumed, err = queue.ConsumeN(10, 5*time.Second, consumer)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, 2)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "consume-n-u1")
+	c.Check(queue.UnackedCount(), Equals, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestLocalConsumerCount(c *C) {
+	connection := OpenConnection("local-count-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("local-count-q").(*redisQueue)
+	other := connection.OpenQueue("local-count-q").(*redisQueue)
+	queue.RemoveAllConsumers()
+	c.Check(queue.LocalConsumerCount(), Equals, 0)
+
+	queue.StartConsuming(10, time.Millisecond)
+	other.StartConsuming(10, time.Millisecond)
+	name1 := queue.AddConsumer("local-count-cons", NewTestConsumer("local-count-cons"))
+	queue.AddBatchConsumer("local-count-cons", 10, NewTestBatchConsumer())
+	otherName := other.AddConsumer("local-count-cons", NewTestConsumer("local-count-cons"))
+	c.Check(queue.LocalConsumerCount(), Equals, 2)
+	c.Check(other.LocalConsumerCount(), Equals, 1)
+	c.Check(queue.GetConsumers(), HasLen, 3)
+
+	c.Check(queue.RemoveConsumer(name1), Equals, true)
+	c.Check(queue.LocalConsumerCount(), Equals, 1)
+	c.Check(queue.RemoveConsumer(otherName), Equals, true) // not added through queue
+	c.Check(queue.LocalConsumerCount(), Equals, 1)
+	c.Check(queue.RemoveAllConsumers(), Equals, 1)
+	c.Check(queue.LocalConsumerCount(), Equals, 0)
+
+	queue.StopConsuming()
+	other.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumerHandle(c *C) {
+	connection := OpenConnection("handle-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("handle-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.RemoveAllConsumers()
+
+	queue.StartConsuming(10, time.Millisecond)
+	handle := queue.AddConsumerWithHandle("handle-cons", NewTestConsumer("handle-cons"))
+	c.Check(handle.Name(), Matches, "handle-cons-.*")
+	c.Check(queue.GetConsumers(), DeepEquals, []string{handle.Name()})
+	c.Check(handle.Deliveries(), Equals, int64(0))
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("handle-d%d", i)), Equals, true)
+	}
+	c.Check(queue.PublishToDelayedQueue("handle-d5", time.Millisecond), Equals, true)
+	time.Sleep(50 * time.Millisecond)
+	c.Check(handle.Deliveries(), Equals, int64(6))
+
+	c.Check(handle.Remove(), Equals, true)
+	c.Check(queue.GetConsumers(), HasLen, 0)
+	c.Check(handle.Remove(), Equals, false)
+
+	// the removed consumer doesn't consume anymore
+	for i := 6; i < 9; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("handle-d%d", i)), Equals, true)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Check(handle.Deliveries(), Equals, int64(6))
+
+	queue.StopConsuming()
+	queue.WaitForConsuming()
+	c.Check(queue.ReadyCount(), Equals, 3)
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumerWeight(c *C) {
+	connection := OpenConnection("weight-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("weight-q").(*redisQueue)
+	queue.PurgeReady()
+
+	// all consumers get added before there are deliveries to share
+	consumed := make([]int32, 3)
+	queue.StartConsuming(10, time.Millisecond)
+	for i, weight := range []int{1, 2, 3} {
+		i := i
+		queue.AddConsumerWithWeight("weight-cons", weight, NewAckConsumer(func(delivery Delivery) error {
+			atomic.AddInt32(&consumed[i], 1)
+			return nil
+		}))
+	}
+
+	for i := 0; i < 600; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("weight-d%d", i)), Equals, true)
+	}
+
+	for j := 0; j < 500 && queue.ReadyCount()+queue.UnackedCount() > 0; j++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(queue.StopConsuming(), Equals, true)
+	queue.WaitForConsuming()
+
+	// busy consumers get skipped, so the shares are only roughly proportional
+	total := int32(0)
+	for i, weight := range []int32{1, 2, 3} {
+		share := atomic.LoadInt32(&consumed[i])
+		total += share
+		c.Check(share > weight*100-60 && share < weight*100+60, Equals, true, Commentf("consumer %d got %d", i, share))
+	}
+	c.Check(total, Equals, int32(600))
+
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestWeightedDispatcher(c *C) {
+	deliveryChan := make(chan Delivery)
+	dispatcher := newWeightedDispatcher(deliveryChan, make(chan struct{}), func(Delivery) bool { return true })
+	heavy, light := dispatcher.add(2), dispatcher.add(0) // at least 1
+
+	go func() {
+		for i := 0; i < 6; i++ {
+			deliveryChan <- NewTestDeliveryString(fmt.Sprintf("weighted-d%d", i))
+		}
+		close(deliveryChan)
+	}()
+
+	// smooth weighted round robin interleaves the consumers
+	c.Check((<-heavy).Payload(), Equals, "weighted-d0")
+	c.Check((<-light).Payload(), Equals, "weighted-d1")
+	c.Check((<-heavy).Payload(), Equals, "weighted-d2")
+	c.Check((<-heavy).Payload(), Equals, "weighted-d3")
+	c.Check((<-light).Payload(), Equals, "weighted-d4")
+	c.Check((<-heavy).Payload(), Equals, "weighted-d5")
+
+	_, ok := <-heavy
+	c.Check(ok, Equals, false)
+	_, ok = <-light
+	c.Check(ok, Equals, false)
+	_, ok = <-dispatcher.add(1) // closed right away
+	c.Check(ok, Equals, false)
+}
+
+func (suite *QueueSuite) TestWeightedDispatcherBusy(c *C) {
+	deliveryChan := make(chan Delivery)
+	stop := make(chan struct{})
+	returned := make(chan Delivery, 1)
+	dispatcher := newWeightedDispatcher(deliveryChan, stop, func(delivery Delivery) bool {
+		returned <- delivery
+		return true
+	})
+	heavy, light := dispatcher.add(2), dispatcher.add(1)
+
+	// heavy is chosen but never receives, so light gets all deliveries
+	go func() {
+		for i := 0; i < 3; i++ {
+			deliveryChan <- NewTestDeliveryString(fmt.Sprintf("busy-d%d", i))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case delivery := <-light:
+			c.Check(delivery.Payload(), Equals, fmt.Sprintf("busy-d%d", i))
+		case <-time.After(5 * time.Second):
+			c.Fatalf("light consumer didn't get busy-d%d", i)
+		}
+	}
+
+	// once stopped a delivery nobody takes gets returned
+	close(stop)
+	deliveryChan <- NewTestDeliveryString("busy-d3")
+	select {
+	case delivery := <-returned:
+		c.Check(delivery.Payload(), Equals, "busy-d3")
+	case <-time.After(5 * time.Second):
+		c.Fatal("busy-d3 didn't get returned")
+	}
+
+	close(deliveryChan)
+	_, ok := <-heavy
+	c.Check(ok, Equals, false)
+	_, ok = <-light
+	c.Check(ok, Equals, false)
+}
+
+func (suite *QueueSuite) TestRequeueFront(c *C) {
+	connection := OpenConnection("requeue-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("requeue-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.ReturnAllUnacked(), Equals, 0)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("requeue-d1"), Equals, true)
+	c.Check(queue.Publish("requeue-d2"), Equals, true)
+	c.Check(queue.Publish("requeue-d3"), Equals, true)
+
+	deliveryChan := make(chan Delivery, 10)
+	c.Check(queue.consumeBatch(deliveryChan, 2), Equals, true)
+	first, second := <-deliveryChan, <-deliveryChan
+	c.Check(second.Payload(), Equals, "requeue-d2")
+	c.Check(second.RequeueFront(), Equals, true)
+	c.Check(first.Reject(), Equals, true)
+	c.Check(queue.ReturnAllRejected(), Equals, 1) // to the back
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	c.Check(queue.consumeBatch(deliveryChan, 3), Equals, true)
+	c.Check((<-deliveryChan).Payload(), Equals, "requeue-d2")
+	c.Check((<-deliveryChan).Payload(), Equals, "requeue-d3")
+	c.Check((<-deliveryChan).Payload(), Equals, "requeue-d1")
+	c.Check(queue.counters.snapshot().Requeued, Equals, int64(1))
+
+	c.Check(queue.ReturnAllUnacked(), Equals, 3)
+	c.Check(queue.PurgeReady(), Equals, 3)
+
+	// back to the list of its priority, only while it's unacked
+	queue.SetMaxPriority(1)
+	c.Check(queue.PublishWithPriority("requeue-p1", 1), Equals, true)
+	c.Check(queue.consumeBatch(deliveryChan, 1), Equals, true)
+	prioritized := <-deliveryChan
+	c.Check(prioritized.RequeueFront(), Equals, true)
+	c.Check(queue.redisClient.LRange(queue.priorityKeys[1], 0, -1).Val(), DeepEquals, []string{"requeue-p1"})
+	c.Check(queue.redisClient.LLen(queue.readyKey).Val(), Equals, int64(0))
+	c.Check(prioritized.RequeueFront(), Equals, false)
+	c.Check(queue.redisClient.LLen(queue.priorityKeys[1]).Val(), Equals, int64(1))
+	c.Check(queue.PurgeReady(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRequeue(c *C) {
+	connection := OpenConnection("requeue-back-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("requeue-back-q").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.ReturnAllUnacked(), Equals, 0)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("requeue-back-d1"), Equals, true)
+	c.Check(queue.Publish("requeue-back-d2"), Equals, true)
+	c.Check(queue.Publish("requeue-back-d3"), Equals, true)
+
+	deliveryChan := make(chan Delivery, 10)
+	c.Check(queue.consumeBatch(deliveryChan, 1), Equals, true)
+	first := <-deliveryChan
+	c.Check(first.Payload(), Equals, "requeue-back-d1")
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(first.Requeue(), Equals, true)
+	c.Check(first.Requeue(), Equals, false) // not unacked anymore
+	c.Check(first.Ack(), Equals, false)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 3)
+	c.Check(queue.counters.snapshot().Requeued, Equals, int64(1))
+
+	c.Check(queue.consumeBatch(deliveryChan, 3), Equals, true) // to the back
+	c.Check((<-deliveryChan).Payload(), Equals, "requeue-back-d2")
+	c.Check((<-deliveryChan).Payload(), Equals, "requeue-back-d3")
+	c.Check((<-deliveryChan).Payload(), Equals, "requeue-back-d1")
+
+	c.Check(queue.ReturnAllUnacked(), Equals, 3)
+	c.Check(queue.PurgeReady(), Equals, 3)
+
+	// behind the other deliveries of its priority, forgetting its deadline
+	queue.SetMaxPriority(1)
+	queue.SetVisibilityTimeout(time.Hour)
+	queue.redisClient.Del(queue.deadlinesKey)
+	c.Check(queue.PublishWithPriority("requeue-back-p1", 1), Equals, true)
+	c.Check(queue.PublishWithPriority("requeue-back-p2", 1), Equals, true)
+	c.Check(queue.consumeBatch(deliveryChan, 1), Equals, true)
+	prioritized := <-deliveryChan
+	c.Check(prioritized.Payload(), Equals, "requeue-back-p1")
+	c.Check(queue.redisClient.ZCard(queue.deadlinesKey).Val(), Equals, int64(1))
+	c.Check(prioritized.Requeue(), Equals, true)
+	c.Check(queue.redisClient.ZCard(queue.deadlinesKey).Val(), Equals, int64(0))
+	c.Check(queue.redisClient.LRange(queue.priorityKeys[1], 0, -1).Val(), DeepEquals, []string{"requeue-back-p1", "requeue-back-p2"})
+	c.Check(queue.redisClient.LLen(queue.readyKey).Val(), Equals, int64(0))
+	c.Check(queue.PurgeReady(), Equals, 2)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnAllUnackedWhileAcking(c *C) {
+	connection := OpenConnection("return-unacked-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("return-unacked-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	const total = 200
+	for i := 0; i < total; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("return-unacked-d%d", i)), Equals, true)
+	}
+	deliveryChan := make(chan Delivery, total)
+	c.Check(queue.consumeBatch(deliveryChan, total), Equals, true)
+	close(deliveryChan)
+	c.Check(queue.UnackedCount(), Equals, total)
+
+	var acked int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for delivery := range deliveryChan {
+			if delivery.Ack() {
+				atomic.AddInt64(&acked, 1)
+			}
+		}
+	}()
+	returned := queue.ReturnAllUnacked()
+	<-done
+
+	c.Check(returned+int(atomic.LoadInt64(&acked)), Equals, total)
+	c.Check(queue.ReadyCount(), Equals, returned)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.PurgeReady(), Equals, returned)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnUnacked(c *C) {
+	connection := OpenConnection("return-some-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("return-some-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	for i := 0; i < 10; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("return-some-d%d", i)), Equals, true)
+	}
+	deliveries, err := queue.Fetch(10)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 10)
+	c.Check(queue.UnackedCount(), Equals, 10)
+
+	c.Check(queue.ReturnUnacked(0), Equals, 0)
+	c.Check(queue.ReturnUnacked(3), Equals, 3)
+	c.Check(queue.UnackedCount(), Equals, 7)
+	c.Check(queue.ReadyCount(), Equals, 3)
+	peeked, err := queue.PeekReady(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{"return-some-d0", "return-some-d1", "return-some-d2"}) // fetched first
+
+	c.Check(deliveries[0].Ack(), Equals, false) // returned
+	c.Check(deliveries[3].Ack(), Equals, true)
+	c.Check(queue.ReturnUnacked(10), Equals, 6)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.PurgeReady(), Equals, 9)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishWithHeaders(c *C) {
+	connection := OpenConnection("headers-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("headers-q").(*redisQueue)
+	pushQueue := connection.OpenQueue("headers-push-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+	pushQueue.PurgeReady()
+	queue.SetPushQueue(pushQueue)
+	headers := map[string]string{"route": "eu", "trace": "t1"}
+
+	c.Check(queue.Publish("headers-plain"), Equals, true)
+	c.Check(queue.PublishWithHeaders("headers-d1", headers), Equals, true)
+	deliveries, err := queue.Fetch(2)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 2)
+	c.Check(deliveries[0].Headers(), IsNil)
+	c.Check(deliveries[1].Payload(), Equals, "headers-d1")
+	c.Check(deliveries[1].Headers(), DeepEquals, headers)
+	c.Check(deliveries[0].Ack(), Equals, true)
+
+	// through reject and return
+	c.Check(deliveries[1].Reject(), Equals, true)
+	c.Check(queue.ReturnRejected(1), Equals, 1)
+	deliveries, err = queue.Fetch(1)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Check(deliveries[0].Headers(), DeepEquals, headers)
+
+	// through push
+	c.Check(deliveries[0].Push(), Equals, true)
+	deliveries, err = pushQueue.Fetch(1)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Check(deliveries[0].Payload(), Equals, "headers-d1")
+	c.Check(deliveries[0].Headers(), DeepEquals, headers)
+	c.Check(deliveries[0].Ack(), Equals, true)
+
+	// through a delay cycle
+	consumed := make(chan Delivery, 2)
+	consumer := NewCustomTestConsumer(func(delivery Delivery) {
+		consumed <- delivery
+		if len(consumed) == 1 {
+			delivery.Delay(time.Millisecond)
+			return
+		}
+		delivery.Ack()
+	})
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	queue.AddConsumer("headers-cons", consumer)
+	c.Check(queue.PublishWithHeaders("headers-d2", headers), Equals, true)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(consumed, HasLen, 2)
+	for i := 0; i < 2; i++ {
+		delivery := <-consumed
+		c.Check(delivery.Payload(), Equals, "headers-d2")
+		c.Check(delivery.Headers(), DeepEquals, headers)
+	}
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDeliveryCount(c *C) {
+	connection := OpenConnection("delivery-count-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("delivery-count-q").(*redisQueue)
+	queue.SetEnvelope(JSONEnvelope{})
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("delivery-count-d1"), Equals, true)
+	c.Check(queue.redisClient.LPush(queue.readyKey, "delivery-count-plain").Err(), IsNil)
+	deliveryChan := make(chan Delivery, 2)
+	for i := 0; i < 3; i++ {
+		c.Check(queue.consumeBatch(deliveryChan, 2), Equals, true)
+		first, plain := <-deliveryChan, <-deliveryChan
+		c.Check(first.Payload(), Equals, "delivery-count-d1")
+		c.Check(first.DeliveryCount(), Equals, i)
+		c.Check(plain.Payload(), Equals, "delivery-count-plain")
+		c.Check(plain.DeliveryCount(), Equals, 0) // no envelope to keep the count
+		c.Check(queue.ReturnAllUnacked(), Equals, 2)
+	}
+
+	c.Check(queue.consumeBatch(deliveryChan, 2), Equals, true)
+	first, plain := <-deliveryChan, <-deliveryChan
+	c.Check(first.DeliveryCount(), Equals, 3)
+	c.Check(first.Ack(), Equals, true)
+	c.Check(plain.Ack(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturned(c *C) {
+	connection := OpenConnection("returned-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	returned := func(value string) string {
+		result, err := connection.redisClient.Eval(returnedLua+`return returned(ARGV[2])`, []string{"returned-key"}, envelopePrefix, value).Result()
+		c.Assert(err, IsNil)
+		return result.(string)
+	}
+
+	// the count gets added and incremented without touching the other fields
+	message := Message{ID: "id", Payload: `p,"returns":5}`, Expires: 1700000000123456789, Headers: map[string]string{"h": `,"returns":7}`}}
+	value := returned(message.marshal())
+	message.Returns = 1
+	c.Check(unmarshalEnvelope(JSONEnvelope{}, value), DeepEquals, message)
+	value = returned(value)
+	message.Returns = 2
+	c.Check(unmarshalEnvelope(JSONEnvelope{}, value), DeepEquals, message)
+	c.Check(returned(envelopePrefix+`{}`), Equals, envelopePrefix+`{"returns":1}`)
+
+	// values not written by JSONEnvelope stay unchanged
+	for _, value := range []string{
+		"plain",
+		envelopePrefix + "{broken",
+		envelopePrefix + `"string"`,
+		envelopePrefix + `[1,2]`,
+		envelopePrefix + `{"returns":2,"payload":"p"}`,
+	} {
+		c.Check(returned(value), Equals, value)
+	}
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOnStateChange(c *C) {
+	connection := OpenConnection("state-change-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("state-change-q").(*redisQueue)
+	pushQueue := connection.OpenQueue("state-change-push-q")
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	queue.PurgeRejected()
+	pushQueue.PurgeReady()
+	queue.SetPushQueue(pushQueue)
+
+	changes := []string{}
+	queue.SetOnStateChange(func(payload string, from, to State) {
+		changes = append(changes, fmt.Sprintf("%s %s>%s", payload, from, to))
+	})
+
+	for _, payload := range []string{"ack", "delay", "reject", "push", "requeue"} {
+		c.Check(queue.Publish(payload), Equals, true)
+	}
+	deliveryChan := make(chan Delivery, 5)
+	c.Check(queue.consumeBatch(deliveryChan, 5), Equals, true)
+	acked := <-deliveryChan
+	c.Check(acked.Ack(), Equals, true)
+	c.Check(acked.Ack(), Equals, false) // no change
+	c.Check((<-deliveryChan).Delay(time.Hour), Equals, true)
+	c.Check((<-deliveryChan).Reject(), Equals, true)
+	c.Check((<-deliveryChan).Push(), Equals, true)
+	c.Check((<-deliveryChan).RequeueFront(), Equals, true)
+
+	c.Check(changes, DeepEquals, []string{
+		"ack Unacked>Acked",
+		"delay Unacked>Delayed",
+		"reject Unacked>Rejected",
+		"push Unacked>Pushed",
+		"requeue Unacked>Requeued",
+	})
+
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	queue.PurgeRejected()
+	pushQueue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOnProcessed(c *C) {
+	connection := OpenConnection("processed-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("processed-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	durations := map[State]time.Duration{}
+	queue.SetOnProcessed(func(payload string, to State, duration time.Duration) {
+		durations[to] = duration
+	})
+
+	c.Check(queue.Publish("processed-ack"), Equals, true)
+	c.Check(queue.Publish("processed-reject"), Equals, true)
+	deliveries, err := queue.Fetch(2)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 2)
+
+	age := deliveries[0].Age()
+	time.Sleep(20 * time.Millisecond)
+	c.Check(deliveries[0].Age() >= age+20*time.Millisecond, Equals, true)
+
+	c.Check(deliveries[0].Ack(), Equals, true)
+	c.Check(deliveries[1].Reject(), Equals, true)
+	c.Check(deliveries[0].Ack(), Equals, false) // no change
+	c.Assert(durations, HasLen, 2)
+	c.Check(durations[Acked] >= 20*time.Millisecond, Equals, true)
+	c.Check(durations[Acked] < time.Second, Equals, true)
+	c.Check(durations[Rejected] >= durations[Acked], Equals, true)
+
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumePanic(c *C) {
+	connection := OpenConnection("consume-panic-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("consume-panic-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	var lock sync.Mutex
+	acked := []string{}
+	consumer := NewCustomTestConsumer(func(delivery Delivery) {
+		if strings.HasSuffix(delivery.Payload(), "-panic") {
+			panic("injected panic")
+		}
+		lock.Lock()
+		acked = append(acked, delivery.Payload())
+		lock.Unlock()
+		delivery.Ack()
+	})
+
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("consume-panic-cons", consumer)
+	c.Check(queue.Publish("consume-panic-d1"), Equals, true)
+	c.Check(queue.Publish("consume-panic-d2-panic"), Equals, true)
+	c.Check(queue.Publish("consume-panic-d3"), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	c.Check(acked, DeepEquals, []string{"consume-panic-d1", "consume-panic-d3"})
+	lock.Unlock()
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1) // rejected by default
+
+	recovered := make(chan interface{}, 1)
+	queue.SetConsumePanicHandler(func(value interface{}, delivery Delivery) {
+		c.Check(delivery.Payload(), Equals, "consume-panic-d4-panic")
+		c.Check(delivery.Ack(), Equals, true) // up to the handler instead of rejected
+		recovered <- value
+	})
+	c.Check(queue.Publish("consume-panic-d4-panic"), Equals, true)
+	c.Check(queue.Publish("consume-panic-d5"), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(recovered, HasLen, 1)
+	c.Check(<-recovered, Equals, "injected panic")
+	lock.Lock()
+	c.Check(acked, HasLen, 3)
+	lock.Unlock()
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	queue.StopConsuming()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOnBackpressure(c *C) {
+	connection := OpenConnection("backpressure-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("backpressure-q").(*redisQueue)
+	queue.PurgeReady()
+
+	var calls int32
+	var lastLen, lastLimit int32
+	queue.SetOnBackpressure(func(queueName string, bufferLen, prefetchLimit int) {
+		c.Check(queueName, Equals, "backpressure-q")
+		atomic.StoreInt32(&lastLen, int32(bufferLen))
+		atomic.StoreInt32(&lastLimit, int32(prefetchLimit))
+		atomic.AddInt32(&calls, 1)
+	})
+
+	// nothing ready, not full: no backpressure
+	queue.StartConsuming(2, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&calls), Equals, int32(0))
+
+	for i := 0; i < 10; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("backpressure-d%d", i)), Equals, true)
+	}
+	consumer := NewTestConsumer("backpressure-cons")
+	consumer.AutoFinish = false
+	queue.AddConsumer("backpressure-cons", consumer)
+
+	// the slow consumer blocks on the first delivery and the buffer fills up
+	time.Sleep(50 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&calls) > 0, Equals, true)
+	c.Check(atomic.LoadInt32(&lastLen), Equals, int32(2))
+	c.Check(atomic.LoadInt32(&lastLimit), Equals, int32(2))
+
+	queue.SetOnBackpressure(nil)
+	consumer.Finish()
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumeQueues(c *C) {
+	connection := OpenConnection("multi-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queues := []Queue{}
+	for i, load := range []int{30, 5, 1} {
+		queue := connection.OpenQueue(fmt.Sprintf("multi-q%d", i))
+		queue.PurgeReady()
+		for j := 0; j < load; j++ {
+			c.Check(queue.Publish(fmt.Sprintf("q%d", i)), Equals, true)
+		}
+		queues = append(queues, queue)
+	}
+
+	consumer := NewTestConsumer("multi-cons")
+	multi := ConsumeQueues(queues, time.Millisecond, consumer)
+	for i := 0; i < 100 && len(consumer.LastDeliveries) < 36; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(consumer.LastDeliveries, HasLen, 36)
+
+	// one per queue and round, skipping the empty ones
+	payloads := []string{}
+	for _, delivery := range consumer.LastDeliveries[:11] {
+		payloads = append(payloads, delivery.Payload())
+	}
+	c.Check(payloads, DeepEquals, []string{"q0", "q1", "q2", "q0", "q1", "q0", "q1", "q0", "q1", "q0", "q1"})
+	for _, queue := range queues {
+		c.Check(queue.ReadyCount(), Equals, 0)
+		c.Check(queue.UnackedCount(), Equals, 0)
+	}
+
+	added := connection.OpenQueue("multi-q3")
+	added.PurgeReady()
+	c.Check(multi.AddQueue(added), Equals, true)
+	c.Check(multi.AddQueue(added), Equals, false)
+	c.Check(multi.RemoveQueue(queues[0]), Equals, true)
+	c.Check(multi.RemoveQueue(queues[0]), Equals, false)
+	c.Check(added.Publish("q3"), Equals, true)
+	c.Check(queues[0].Publish("q0"), Equals, true)
+	time.Sleep(50 * time.Millisecond)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "q3")
+	c.Check(queues[0].ReadyCount(), Equals, 1) // removed
+
+	c.Check(multi.StopConsuming(), Equals, true)
+	c.Check(multi.StopConsuming(), Equals, false)
+	c.Check(added.Publish("q3"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(added.ReadyCount(), Equals, 1)
+
+	queues[0].PurgeReady()
+	added.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestWaitForConsumingWithTimeout(c *C) {
+	connection := OpenConnection("wait-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("wait-q")
+	queue.PurgeReady()
+
+	consumer := NewTestConsumer("wait-cons")
+	consumer.AutoFinish = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	queue.AddConsumer("wait-cons", consumer)
+	c.Check(queue.Publish("wait-d"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+
+	c.Check(queue.StopConsuming(), Equals, true)
+	start := time.Now()
+	c.Check(queue.WaitForConsumingWithTimeout(50*time.Millisecond), Equals, false) // consumer is stuck
+	c.Check(time.Since(start) < time.Second, Equals, true)
+
+	consumer.Finish()
+	c.Check(queue.WaitForConsumingWithTimeout(time.Second), Equals, true)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRecoverUnacked(c *C) {
+	connection := OpenConnection("recover-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("recover-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	// left unacked by a previous run with the same connection name
+	c.Check(queue.redisClient.LPush(queue.unackedKey, "recover-d1", "recover-d2").Err(), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	recovered, err := queue.RecoverUnacked()
+	c.Check(err, IsNil)
+	c.Check(recovered, Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	consumer := NewTestConsumer("recover-cons")
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	queue.AddConsumer("recover-cons", consumer)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "recover-d1")
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "recover-d2")
+
+	_, err = queue.RecoverUnacked()
+	c.Check(err, NotNil) // deliveries might be in flight now
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRecoverUnackedOrdered(c *C) {
+	connection := OpenConnection("recover-ordered-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("recover-ordered-q").(*redisQueue)
+	queue.SetEnvelope(JSONEnvelope{})
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	// a previous run fetched d1 to d3 and left them unacked, d4 and d5 got
+	// published in the meantime
+	for i := 1; i <= 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("recover-ordered-d%d", i)), Equals, true)
+	}
+	deliveries, err := queue.Fetch(3)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 3)
+
+	recovered, err := queue.RecoverUnackedOrdered()
+	c.Check(err, IsNil)
+	c.Check(recovered, Equals, 3)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 5)
+
+	consumer := NewTestConsumer("recover-ordered-cons")
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	queue.AddConsumer("recover-ordered-cons", consumer)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 5)
+	for i, delivery := range consumer.LastDeliveries {
+		c.Check(delivery.Payload(), Equals, fmt.Sprintf("recover-ordered-d%d", i+1))
+		returns := 0
+		if i < 3 {
+			returns = 1 // recovered
+		}
+		c.Check(delivery.DeliveryCount(), Equals, returns)
+	}
+
+	_, err = queue.RecoverUnackedOrdered()
+	c.Check(err, NotNil) // deliveries might be in flight now
+
+	queue.StopConsuming()
+	queue.WaitForConsuming()
+	recovered, err = queue.RecoverUnackedOrdered()
+	c.Check(err, IsNil) // stopped
+	c.Check(recovered, Equals, 0)
+
+	// more than fit in one script, recovered before higher priorities
+	priorities := connection.OpenQueue("recover-ordered-priority-q").(*redisQueue)
+	priorities.SetMaxPriority(1)
+	priorities.PurgeReady()
+	priorities.ReturnAllUnacked()
+	priorities.PurgeReady()
+	for i := 0; i < returnBatchSize+2; i++ {
+		c.Check(priorities.Publish(fmt.Sprintf("recover-ordered-p%d", i)), Equals, true)
+	}
+	deliveries, err = priorities.Fetch(returnBatchSize + 1)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, returnBatchSize+1)
+	c.Check(priorities.PublishWithPriority("recover-ordered-high", 1), Equals, true)
+
+	recovered, err = priorities.RecoverUnackedOrdered()
+	c.Check(err, IsNil)
+	c.Check(recovered, Equals, returnBatchSize+1)
+	c.Check(priorities.UnackedCount(), Equals, 0)
+	deliveries, err = priorities.Fetch(returnBatchSize + 3)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, returnBatchSize+3)
+	for i := 0; i <= returnBatchSize; i++ {
+		c.Check(deliveries[i].Payload(), Equals, fmt.Sprintf("recover-ordered-p%d", i))
+	}
+	c.Check(deliveries[returnBatchSize+1].Payload(), Equals, "recover-ordered-high")
+	c.Check(deliveries[returnBatchSize+2].Payload(), Equals, fmt.Sprintf("recover-ordered-p%d", returnBatchSize+1))
+	failed, err := Deliveries(deliveries).Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	connection.StopHeartbeat()
+}
+
+// closedWithin returns whether the channel gets closed within timeout
+func closedWithin(channel <-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-channel:
+		return true
+	default:
+	}
+	select {
+	case <-channel:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (suite *QueueSuite) TestDrainedChan(c *C) {
+	connection := OpenConnection("drained-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("drained-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	queue.SetDrainedSettle(10 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("drained-d%d", i)), Equals, true)
+	}
+	drained := queue.DrainedChan()
+	consumer := NewTestConsumer("drained-cons")
+	consumer.SleepDuration = 10 * time.Millisecond
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	queue.AddConsumer("drained-cons", consumer)
+
+	time.Sleep(20 * time.Millisecond)
+	c.Check(closedWithin(drained, 0), Equals, false) // deliveries still unacked
+	c.Check(closedWithin(drained, time.Second), Equals, true)
+	c.Check(consumer.LastDeliveries, HasLen, 5)
+	c.Check(queue.DrainedChan(), Equals, drained) // stays closed while drained
+
+	// re-armed by new deliveries
+	c.Check(queue.Publish("drained-d5"), Equals, true)
+	time.Sleep(5 * time.Millisecond)
+	drainedAgain := queue.DrainedChan()
+	c.Check(drainedAgain, Not(Equals), drained)
+	c.Check(closedWithin(drainedAgain, time.Second), Equals, true)
+	c.Check(consumer.LastDeliveries, HasLen, 6)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestQueueDiscovery(c *C) {
+	connection := OpenConnectionWithPrefix("discovery", "discovery-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	connection.CloseAllQueues()
+	connection.CloseAllQueuesInConnection()
+
+	queues, err := connection.GetOpenQueuesE()
+	c.Check(err, IsNil)
+	c.Check(queues, DeepEquals, []string{})
+	queues, err = connection.GetConsumingQueuesE()
+	c.Check(err, IsNil)
+	c.Check(queues, DeepEquals, []string{})
+
+	c.Check(connection.redisClient.SAdd(connection.allQueuesKey, "discovery-q1", "discovery-q2").Err(), IsNil)
+	c.Check(connection.redisClient.SAdd(connection.queuesKey, "discovery-q2").Err(), IsNil)
+	queues, err = connection.GetOpenQueuesE()
+	c.Check(err, IsNil)
+	sort.Strings(queues)
+	c.Check(queues, DeepEquals, []string{"discovery-q1", "discovery-q2"})
+	queues, err = connection.GetConsumingQueuesE()
+	c.Check(err, IsNil)
+	c.Check(queues, DeepEquals, []string{"discovery-q2"})
+	c.Check(connection.GetConsumingQueues(), DeepEquals, []string{"discovery-q2"})
+
+	connection.CloseAllQueues()
+	connection.CloseAllQueuesInConnection()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestOrphanedKeys(c *C) {
+	connection := OpenConnectionWithPrefix("orphan", "orphan-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	connection.CloseAllQueues()
+	queue := connection.OpenQueue("orphan-open").(*redisQueue)
+	queue.PurgeReady()
+	c.Check(queue.Publish("orphan-d1"), Equals, true)
+	odd := connection.OpenQueue("orphan]::odd").(*redisQueue) // looks like a key of orphan
+	odd.PurgeReady()
+	c.Check(odd.Publish("orphan-d5"), Equals, true)
+
+	// left over by a queue which got removed from the set of open queues
+	gone := connection.openQueue("orphan-gone")
+	c.Check(gone.Publish("orphan-d2"), Equals, true)
+	c.Check(gone.PublishToDelayedQueue("orphan-d3", time.Hour), Equals, true)
+	c.Check(connection.redisClient.LPush(gone.rejectedKey, "orphan-d4").Err(), IsNil)
+
+	orphaned, err := connection.FindOrphanedKeys()
+	c.Check(err, IsNil)
+	sort.Strings(orphaned)
+	c.Check(orphaned, DeepEquals, []string{gone.delayedKey, gone.readyKey, gone.rejectedKey})
+
+	deleted, err := connection.PruneOrphanedKeys()
+	c.Check(err, IsNil)
+	c.Check(deleted, Equals, 3)
+	orphaned, err = connection.FindOrphanedKeys()
+	c.Check(err, IsNil)
+	c.Check(orphaned, DeepEquals, []string{})
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(odd.ReadyCount(), Equals, 1)
+
+	queue.PurgeReady()
+	odd.PurgeReady()
+	connection.CloseAllQueues()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMaxRejected(c *C) {
+	connection := OpenConnection("max-rejected-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("max-rejected-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	consume := func(n int) []Delivery {
+		for i := 0; i < n; i++ {
+			c.Check(queue.Publish(fmt.Sprintf("max-rejected-d%d", i)), Equals, true)
+		}
+		deliveryChan := make(chan Delivery, n)
+		c.Check(queue.consumeBatch(deliveryChan, n), Equals, true)
+		close(deliveryChan)
+		deliveries := []Delivery{}
+		for delivery := range deliveryChan {
+			deliveries = append(deliveries, delivery)
+		}
+		return deliveries
+	}
+	rejected := func() []string {
+		payloads := []string{}
+		for _, value := range queue.redisClient.LRange(queue.rejectedKey, 0, -1).Val() {
+			payloads = append(payloads, unmarshalEnvelope(JSONEnvelope{}, value).Payload)
+		}
+		return payloads
+	}
+
+	queue.SetMaxRejected(3, DropOldestRejected)
+	for _, delivery := range consume(5) {
+		c.Check(delivery.Reject(), Equals, true)
+	}
+	c.Check(rejected(), DeepEquals, []string{"max-rejected-d4", "max-rejected-d3", "max-rejected-d2"})
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.PurgeRejected()
+	failed, err := Deliveries(consume(5)).Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(rejected(), DeepEquals, []string{"max-rejected-d4", "max-rejected-d3", "max-rejected-d2"})
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.PurgeRejected()
+	queue.SetMaxRejected(2, RefuseNewRejected)
+	deliveries := consume(3)
+	c.Check(deliveries[0].Reject(), Equals, true)
+	c.Check(deliveries[1].Push(), Equals, true) // no push queue, so rejected
+	c.Check(deliveries[2].Reject(), Equals, false)
+	c.Check(rejected(), DeepEquals, []string{"max-rejected-d1", "max-rejected-d0"})
+	c.Check(queue.UnackedCount(), Equals, 1)
+	failed, err = Deliveries(deliveries[2:]).Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 1)
+	c.Check(deliveries[2].Ack(), Equals, true)
+
+	queue.PurgeRejected()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReadyAndDelayedConsumers(c *C) {
+	connection := OpenConnection("split-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("split-q")
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	readyConsumer := NewTestConsumer("split-ready-cons")
+	delayedConsumer := NewTestConsumer("split-delayed-cons")
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	queue.AddReadyConsumer("split-ready-cons", readyConsumer)
+	queue.AddDelayedConsumer("split-delayed-cons", delayedConsumer)
+
+	c.Check(queue.Publish("split-ready"), Equals, true)
+	c.Check(queue.PublishToDelayedQueue("split-delayed", time.Millisecond), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(readyConsumer.LastDeliveries, HasLen, 1)
+	c.Check(readyConsumer.LastDelivery.Payload(), Equals, "split-ready")
+	c.Assert(delayedConsumer.LastDeliveries, HasLen, 1)
+	c.Check(delayedConsumer.LastDelivery.Payload(), Equals, "split-delayed")
+	c.Check(readyConsumer.LastDelivery.Queue(), Equals, "split-q")
+	c.Check(delayedConsumer.LastDelivery.Queue(), Equals, "split-q")
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestStartConsumingDelayedOnly(c *C) {
+	connection := OpenConnection("delayed-only-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("delayed-only-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	c.Check(queue.StartConsumingWithOptions(StartConsumingOptions{PrefetchLimit: 10, PollDuration: time.Millisecond}), Equals, ErrNothingToConsume)
+	c.Check(queue.StartConsumingWithOptions(StartConsumingOptions{PrefetchLimit: 10, PollDuration: time.Millisecond, Delayed: true}), IsNil)
+	c.Check(queue.StartConsumingWithOptions(StartConsumingOptions{PrefetchLimit: 10, PollDuration: time.Millisecond, Delayed: true}), Equals, ErrAlreadyConsuming)
+	_, open := <-queue.deliveryChan
+	c.Check(open, Equals, false) // no immediate fetcher
+
+	consumer := NewTestConsumer("delayed-only-cons")
+	prefetchConsumer := NewTestConsumer("delayed-only-prefetch-cons")
+	c.Check(queue.AddConsumer("delayed-only-cons", consumer), Not(Equals), "")
+	c.Check(queue.AddConsumerWithPrefetch("delayed-only-prefetch-cons", 5, prefetchConsumer), Not(Equals), "")
+	c.Check(queue.Publish("delayed-only-ready"), Equals, true)
+	c.Check(queue.PublishToDelayedQueue("delayed-only-delayed", time.Millisecond), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 1) // not fetched
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(len(consumer.LastDeliveries)+len(prefetchConsumer.LastDeliveries), Equals, 1)
+	c.Check(queue.DelayedCount(), Equals, 0)
+
+	c.Check(queue.StopConsumingAndDrain(time.Second), IsNil) // tears down the started fetchers only
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+// delayedPeekCountingClient counts the peeks of the delayed poller at the
+// next delayed delivery
+type delayedPeekCountingClient struct {
+	redis.UniversalClient
+	peeks *int32
+}
+
+func (client delayedPeekCountingClient) ZRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd {
+	atomic.AddInt32(client.peeks, 1)
+	return client.UniversalClient.ZRangeWithScores(key, start, stop)
+}
+
+func (suite *QueueSuite) TestDelayedPollerWaitsForNextDue(c *C) {
+	connection := OpenConnection("delayed-wait-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	peeks := int32(0)
+	redisClient := delayedPeekCountingClient{UniversalClient: connection.redisClient, peeks: &peeks}
+	queue := newQueue("", "delayed-wait-q", "delayed-wait-conn", "rmq::connection::delayed-wait-conn::queues", redisClient, &QueueCounters{})
+	queue.SetMaxDelayedWait(time.Hour)
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	c.Check(queue.PublishToDelayedQueue("delayed-wait-far", time.Hour), Equals, true)
+	c.Check(queue.StartConsumingWithOptions(StartConsumingOptions{PrefetchLimit: 10, PollDuration: time.Millisecond, Delayed: true}), IsNil)
+	time.Sleep(100 * time.Millisecond)
+	c.Check(atomic.LoadInt32(&peeks) <= 2, Equals, true) // not polling every millisecond
+
+	// delaying through the queue wakes the poller up for the earlier delivery
+	c.Check(queue.PublishToDelayedQueue("delayed-wait-near", 20*time.Millisecond), Equals, true)
+	time.Sleep(60 * time.Millisecond)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(atomic.LoadInt32(&peeks) <= 5, Equals, true)
+
+	start := time.Now()
+	c.Check(queue.StopConsuming(), Equals, true)
+	queue.fetcherWaitGroup.Wait()
+	c.Check(time.Since(start) < time.Second, Equals, true) // not waiting for the far delivery
+
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDelayedPollerDefaultWait(c *C) {
+	connection := OpenConnection("delayed-default-wait-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("delayed-default-wait-q").(*redisQueue)
+	other := connection.OpenQueue("delayed-default-wait-q").(*redisQueue)
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	c.Check(queue.PublishToDelayedQueue("delayed-default-wait-far", time.Hour), Equals, true)
+	c.Check(queue.StartConsumingWithOptions(StartConsumingOptions{PrefetchLimit: 10, PollDuration: 10 * time.Millisecond, Delayed: true}), IsNil)
+	time.Sleep(20 * time.Millisecond)
+
+	// delayed through another instance, seen within the poll duration
+	c.Check(other.PublishToDelayedQueue("delayed-default-wait-near", 10*time.Millisecond), Equals, true)
+	time.Sleep(200 * time.Millisecond)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	c.Check(queue.StopConsuming(), Equals, true)
+	queue.fetcherWaitGroup.Wait()
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestBatchConsumerFlushesOnStop(c *C) {
+	connection := OpenConnection("batch-flush-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("batch-flush-q")
+	queue.PurgeReady()
+
+	consumer := NewTestBatchConsumer()
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	queue.AddBatchConsumerWithTimeout("batch-flush-cons", 10, time.Hour, consumer)
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("batch-flush-d%d", i)), Equals, true)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Check(consumer.LastBatch, HasLen, 0) // waiting for more
+
+	c.Check(queue.StopConsuming(), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastBatch, HasLen, 3)
+	failed, err := consumer.LastBatch.Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	consumer.Finish()
+	c.Check(queue.WaitForConsumingWithTimeout(time.Second), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestConsumerTagGenerator(c *C) {
+	connection := OpenConnection("tag-gen-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("tag-gen-q")
+	queue.RemoveAllConsumers()
+	// applies to queues opened before
+	connection.SetConsumerTagGenerator(func(tag string) string {
+		return tag + "@host-42"
+	})
+
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	c.Check(queue.AddConsumer("tag-gen-cons", NewTestConsumer("tag-gen-cons")), Equals, "tag-gen-cons@host-42")
+	c.Check(queue.GetConsumers(), DeepEquals, []string{"tag-gen-cons@host-42"})
+
+	// taken names get a token appended
+	connection.SetConsumerTokenLength(10)
+	name := queue.AddConsumer("tag-gen-cons", NewTestConsumer("tag-gen-cons"))
+	c.Check(name, Matches, "tag-gen-cons@host-42-[a-zA-Z0-9]{10}")
+	c.Check(queue.GetConsumers(), HasLen, 2)
+
+	connection.SetConsumerTagGenerator(nil)
+	c.Check(queue.AddConsumer("tag-gen-cons", NewTestConsumer("tag-gen-cons")), Matches, "tag-gen-cons-[a-zA-Z0-9]{10}")
+	connection.SetConsumerTokenLength(0)
+	c.Check(queue.AddConsumer("tag-gen-cons", NewTestConsumer("tag-gen-cons")), Matches, "tag-gen-cons-[a-zA-Z0-9]{6}")
+	c.Check(queue.GetConsumers(), HasLen, 4)
+
+	queue.StopConsuming()
+	queue.RemoveAllConsumers()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPing(c *C) {
+	connection := OpenConnection("ping-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	c.Check(connection.Ping(), IsNil)
+	c.Check(connection.Healthy(), Equals, true)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRedisClient(c *C) {
+	connection := OpenConnection("redis-client-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	c.Check(connection.RedisClient().Ping().Err(), IsNil)
+	c.Check(NewTestConnection().RedisClient(), IsNil)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPingClosedClient(c *C) {
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:1"})
+	c.Check(redisClient.Close(), IsNil)
+	connection := newConnection("", "ping-closed-conn", redisClient)
+	c.Check(connection.Ping(), NotNil)
+	c.Check(connection.Healthy(), Equals, false)
+}
+
+// failingSAddClient fails all SADDs as if redis was unreachable
+type failingSAddClient struct {
+	redis.UniversalClient
+}
+
+func (client failingSAddClient) SAdd(key string, members ...interface{}) *redis.IntCmd {
+	return redis.NewIntResult(0, errors.New("injected failure"))
+}
+
+func (suite *QueueSuite) TestStartConsumingE(c *C) {
+	queue := newQueue("", "start-e-q", "start-e-conn", "rmq::connection::start-e-conn::queues", failingSAddClient{}, &QueueCounters{})
+	c.Check(queue.StartConsumingE(10, time.Millisecond), ErrorMatches, "injected failure")
+	c.Check(queue.deliveryChan, IsNil) // can be retried
+	c.Check(func() { queue.StartConsuming(10, time.Millisecond) }, PanicMatches, ".*injected failure")
+
+	_, err := queue.AddConsumerE("start-e-cons", NewTestConsumer("start-e-cons"))
+	c.Check(err, ErrorMatches, ".*call StartConsuming first.*")
+	queue.deliveryChan = make(chan Delivery) // as if consuming
+	_, err = queue.AddConsumerE("start-e-cons", NewTestConsumer("start-e-cons"))
+	c.Check(err, ErrorMatches, ".*failed to add consumer.*injected failure")
+	c.Check(func() { queue.AddConsumer("start-e-cons", NewTestConsumer("start-e-cons")) }, PanicMatches, ".*injected failure")
+}
+
+func (suite *QueueSuite) TestAddConsumerBeforeStartConsuming(c *C) {
+	connection := OpenConnection("not-consuming-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("not-consuming-q").(*redisQueue)
+	queue.RemoveAllConsumers()
+
+	c.Check(queue.AddConsumer("not-consuming-cons", NewTestConsumer("not-consuming-cons")), Equals, "")
+	c.Check(queue.AddBatchConsumer("not-consuming-cons", 10, NewTestBatchConsumer()), Equals, "")
+	c.Check(queue.AddConsumerWithHandle("not-consuming-cons", NewTestConsumer("not-consuming-cons")), IsNil)
+	_, err := queue.AddBatchConsumerE("not-consuming-cons", 10, NewTestBatchConsumer())
+	c.Check(err, Equals, ErrNotConsuming)
+	c.Check(queue.GetConsumers(), HasLen, 0)
+
+	queue.SetStrict(true)
+	c.Check(func() { queue.AddConsumer("not-consuming-cons", NewTestConsumer("not-consuming-cons")) }, PanicMatches, ".*call StartConsuming first")
+
+	// works once consuming
+	queue.StartConsuming(10, time.Millisecond)
+	c.Check(queue.AddConsumer("not-consuming-cons", NewTestConsumer("not-consuming-cons")), Not(Equals), "")
+	c.Check(queue.GetConsumers(), HasLen, 1)
+
+	queue.StopConsuming()
+	queue.RemoveAllConsumers()
+	connection.StopHeartbeat()
+}
+
+// capturingLogger records the messages logged to it, Panicf panics like
+// log.Panicf does
+type capturingLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (logger *capturingLogger) Printf(format string, v ...interface{}) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.messages = append(logger.messages, fmt.Sprintf(format, v...))
+}
+
+func (logger *capturingLogger) Panicf(format string, v ...interface{}) {
+	logger.Printf(format, v...)
+	panic(fmt.Sprintf(format, v...))
+}
+
+func (logger *capturingLogger) reset() []string {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	messages := logger.messages
+	logger.messages = nil
+	return messages
+}
+
+func (suite *QueueSuite) TestSetLogger(c *C) {
+	connection := OpenConnection("logger-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("logger-q").(*redisQueue) // opened before setting the logger
+	queue.PurgeReady()
+
+	logger := &capturingLogger{}
+	connection.SetLogger(logger)
+	c.Check(queue.AddConsumer("logger-cons", NewTestConsumer("logger-cons")), Equals, "")
+	messages := logger.reset()
+	c.Assert(messages, HasLen, 1)
+	c.Check(messages[0], Matches, `rmq queue \[logger-q conn:logger-conn-.*\] failed to add consumer logger-cons, call StartConsuming first`)
+
+	// redis errors are logged before panicking, also on hijacked connections
+	hijacked := connection.hijackConnection("logger-hijacked-conn")
+	hijacked.redisClient = wrongTypeClient{}
+	c.Check(func() { hijacked.OpenQueue("logger-q") }, PanicMatches, "rmq connection failed to open queue logger-q: .*")
+	messages = logger.reset()
+	c.Assert(messages, HasLen, 1)
+	c.Check(messages[0], Matches, "rmq connection failed to open queue logger-q: rmq redis key holds the wrong kind of value: rmq::queues")
+}
+
+func (suite *QueueSuite) TestSetDebug(c *C) {
+	connection := OpenConnection("debug-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("debug-q").(*redisQueue)
+	queue.PurgeReady()
+	logger := &capturingLogger{}
+	connection.SetLogger(logger)
+
+	c.Check(queue.Publish("debug-d1"), Equals, true)
+	c.Check(logger.reset(), HasLen, 0) // off by default
+
+	connection.SetDebug(true)
+	c.Check(queue.Publish("debug-d2"), Equals, true)
+	messages := logger.reset()
+	c.Assert(messages, HasLen, 1)
+	c.Check(messages[0], Matches, `rmq debug: publish debug-d2 \[debug-q conn:debug-conn-.*\]`)
+
+	connection.SetDebug(false)
+	c.Check(queue.Publish("debug-d3"), Equals, true)
+	c.Check(logger.reset(), HasLen, 0)
+
+	os.Setenv("RMQ_DEBUG", "1")
+	defer os.Unsetenv("RMQ_DEBUG")
+	envConnection := OpenConnection("debug-env-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	envConnection.SetLogger(logger)
+	c.Check(envConnection.OpenQueue("debug-q").Publish("debug-d4"), Equals, true)
+	messages = logger.reset()
+	c.Assert(messages, HasLen, 1)
+	c.Check(messages[0], Matches, `rmq debug: publish debug-d4 \[debug-q conn:debug-env-conn-.*\]`)
+	queue.PurgeReady()
+}
+
+// purgeCountingClient pretends all lists and sorted sets have 250 members and
+// counts the commands removing them
+type purgeCountingClient struct {
+	redis.UniversalClient
+	removes *int
+}
+
+func (client purgeCountingClient) LLen(key string) *redis.IntCmd {
+	return redis.NewIntResult(250, nil)
+}
+
+func (client purgeCountingClient) ZCount(key, min, max string) *redis.IntCmd {
+	return redis.NewIntResult(250, nil)
+}
+
+func (client purgeCountingClient) LTrim(key string, start, stop int64) *redis.StatusCmd {
+	*client.removes++
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (client purgeCountingClient) ZRemRangeByRank(key string, start, stop int64) *redis.IntCmd {
+	*client.removes++
+	return redis.NewIntResult(stop-start+1, nil)
+}
+
+func (suite *QueueSuite) TestPurgeBatchSize(c *C) {
+	removes := 0
+	queue := newQueue("", "purge-batch-q", "purge-batch-conn", "rmq::connection::purge-batch-conn::queues", purgeCountingClient{removes: &removes}, &QueueCounters{})
+	c.Check(queue.PurgeReady(), Equals, 250)
+	c.Check(removes, Equals, 3)
+
+	queue.SetPurgeBatchSize(50)
+	removes = 0
+	c.Check(queue.PurgeRejected(), Equals, 250)
+	c.Check(removes, Equals, 5)
+	removes = 0
+	c.Check(queue.PurgeDelayed(), Equals, 250)
+	c.Check(removes, Equals, 5)
+
+	queue.SetPurgeBatchSize(0)
+	removes = 0
+	c.Check(queue.PurgeReady(), Equals, 250)
+	c.Check(removes, Equals, 3)
+}
+
+// versionClient runs commands on redis but reports the given server version,
+// to test ackLastScript against servers too old for LPOS
+type versionClient struct {
+	*redis.Client
+	version string
+}
+
+func (client versionClient) Info(section ...string) *redis.StringCmd {
+	return redis.NewStringResult("# Server\r\nredis_version:"+client.version+"\r\nredis_mode:standalone\r\n", nil)
+}
+
+func newVersionClient(version string) versionClient {
+	return versionClient{
+		Client: redis.NewClient(&redis.Options{
+			Addr: fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")),
+		}),
+		version: version,
+	}
+}
+
+func (suite *QueueSuite) TestAckLast(c *C) {
+	redisClient := newVersionClient("6.2.1")
+	defer redisClient.Close()
+	queue := newQueue("", "lpos-q", "lpos-conn", "rmq::connection::lpos-conn::queues", redisClient, &QueueCounters{})
+	redisClient.Del(queue.unackedKey, queue.deadlinesKey)
+	redisClient.LPush(queue.unackedKey, "dup", "other", "dup") // fetched first is at the tail
+
+	// plain payloads remove the occurrence closest to the tail and its deadline
+	delivery := queue.newDelivery("dup")
+	delivery.deadline = deadlineMember("first", "dup")
+	redisClient.ZAdd(queue.deadlinesKey, redis.Z{Score: 1, Member: delivery.deadline}, redis.Z{Score: 2, Member: deadlineMember("second", "dup")})
+	c.Check(delivery.AckE(), IsNil)
+	c.Check(redisClient.LRange(queue.unackedKey, 0, -1).Val(), DeepEquals, []string{"dup", "other"})
+	c.Check(redisClient.ZRange(queue.deadlinesKey, 0, -1).Val(), DeepEquals, []string{deadlineMember("second", "dup")})
+
+	redisClient.RPush(queue.unackedKey, "last")
+	c.Check(queue.newDelivery("dup").AckE(), IsNil)
+	c.Check(redisClient.LRange(queue.unackedKey, 0, -1).Val(), DeepEquals, []string{"other", "last"})
+	c.Check(queue.newDelivery("dup").AckE(), Equals, ErrDeliveryNotFound)
+	c.Check(queue.Counters().Acked, Equals, int64(2))
+
+	// payloads with a unique id keep using LREM
+	enveloped := newMessage("dup").marshal()
+	redisClient.LPush(queue.unackedKey, enveloped)
+	c.Check(queue.newDelivery(enveloped).AckE(), IsNil)
+	c.Check(redisClient.LRange(queue.unackedKey, 0, -1).Val(), DeepEquals, []string{"other", "last"})
+	c.Check(redisClient.LRem(queue.unackedKey, 0, ackedTombstone).Val(), Equals, int64(0))
+
+	// deliveries acked in batches take the same path
+	redisClient.LPush(queue.unackedKey, "dup")
+	redisClient.RPush(queue.unackedKey, "dup", "dup")
+	failed, err := Deliveries{queue.newDelivery("dup"), queue.newDelivery("dup")}.Ack()
+	c.Check(failed, Equals, 0)
+	c.Check(err, IsNil)
+	c.Check(redisClient.LRange(queue.unackedKey, 0, -1).Val(), DeepEquals, []string{"dup", "other", "last"})
+
+	redisClient.Del(queue.unackedKey, queue.deadlinesKey)
+}
+
+func (suite *QueueSuite) TestAckLastUnsupported(c *C) {
+	redisClient := newVersionClient("6.0.5")
+	defer redisClient.Close()
+	queue := newQueue("", "lpos-old-q", "lpos-old-conn", "rmq::connection::lpos-old-conn::queues", redisClient, &QueueCounters{})
+	redisClient.Del(queue.unackedKey)
+	redisClient.LPush(queue.unackedKey, "dup", "other", "dup")
+
+	// older servers fall back to removing the occurrence closest to the head
+	c.Check(queue.newDelivery("dup").AckE(), IsNil)
+	c.Check(redisClient.LRange(queue.unackedKey, 0, -1).Val(), DeepEquals, []string{"other", "dup"})
+
+	redisClient.Del(queue.unackedKey)
+}
+
+func (suite *QueueSuite) TestRedisVersionAtLeast(c *C) {
+	c.Check(redisVersionAtLeast("redis_version:6.0.6\r\n", lposVersion), Equals, true)
+	c.Check(redisVersionAtLeast("redis_version:6.0.10\r\n", lposVersion), Equals, true)
+	c.Check(redisVersionAtLeast("redis_version:7.0.0\r\n", lposVersion), Equals, true)
+	c.Check(redisVersionAtLeast("redis_version:6.0.5\r\n", lposVersion), Equals, false)
+	c.Check(redisVersionAtLeast("redis_version:5.0.14\r\n", lposVersion), Equals, false)
+	c.Check(redisVersionAtLeast("redis_mode:standalone\r\n", lposVersion), Equals, false)
+}
+
+// lmoveClient reports the given redis version and records the commands it gets
+// to move list elements instead of running them
+type lmoveClient struct {
+	redis.UniversalClient
+	version  string
+	commands *[][]interface{}
+}
+
+func (client lmoveClient) Info(section ...string) *redis.StringCmd {
+	return redis.NewStringResult("# Server\r\nredis_version:"+client.version+"\r\n", nil)
+}
+
+func (client lmoveClient) Process(cmd redis.Cmder) error {
+	*client.commands = append(*client.commands, cmd.Args())
+	return nil
+}
+
+func (client lmoveClient) RPopLPush(source, destination string) *redis.StringCmd {
+	*client.commands = append(*client.commands, []interface{}{"rpoplpush", source, destination})
+	return redis.NewStringResult("moved", nil)
+}
+
+func (suite *QueueSuite) TestPopPush(c *C) {
+	commands := [][]interface{}{}
+	queue := newQueue("", "lmove-q", "lmove-conn", "rmq::connection::lmove-conn::queues", lmoveClient{version: "6.2.0", commands: &commands}, &QueueCounters{})
+	queue.popPush("lmove-from", "lmove-to")
+	c.Check(commands, DeepEquals, [][]interface{}{{"lmove", "lmove-from", "lmove-to", "right", "left"}})
+
+	// older servers fall back to RPOPLPUSH
+	commands = [][]interface{}{}
+	queue = newQueue("", "lmove-old-q", "lmove-old-conn", "rmq::connection::lmove-old-conn::queues", lmoveClient{version: "6.0.16", commands: &commands}, &QueueCounters{})
+	c.Check(queue.popPush("lmove-from", "lmove-to").Val(), Equals, "moved")
+	c.Check(commands, DeepEquals, [][]interface{}{{"rpoplpush", "lmove-from", "lmove-to"}})
+
+	c.Check(redisVersionAtLeast("redis_version:6.2.0\r\n", lmoveVersion), Equals, true)
+	c.Check(redisVersionAtLeast("redis_version:6.1.9\r\n", lmoveVersion), Equals, false)
+}
+
+func (suite *QueueSuite) TestLmove(c *C) {
+	connection := OpenConnection("lmove-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	defer connection.StopHeartbeat()
+	c.Check(connection.lmove.checked, Equals, true) // on open
+	if !connection.lmove.supported {
+		c.Skip("redis doesn't support LMOVE")
+	}
+
+	queue := connection.OpenQueue("lmove-q").(*redisQueue)
+	c.Check(queue.lmove, Equals, connection.lmove)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	c.Check(queue.ReturnAllUnacked(), Equals, 0)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("lmove-d1"), Equals, true)
+	c.Check(queue.Publish("lmove-d2"), Equals, true)
+	deliveries, err := queue.Fetch(2)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 2)
+	c.Check(deliveries[0].Payload(), Equals, "lmove-d1") // oldest first
+	failed, err := Deliveries(deliveries).Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(queue.ReturnRejected(2), Equals, 2)
+	peeked, err := queue.PeekReady(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{"lmove-d1", "lmove-d2"})
+	c.Check(queue.PurgeReady(), Equals, 2)
+}
+
+// crashingClient fails all scripts as if the connection broke while sending
+// them. Other commands panic, as delaying mustn't send any
+type crashingClient struct {
+	redis.UniversalClient
+	evals *int
+}
+
+func (client crashingClient) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	*client.evals++
+	return redis.NewCmdResult(nil, errors.New("connection reset"))
+}
+
+func (suite *QueueSuite) TestDelayCrash(c *C) {
+	evals := 0
+	queue := newQueue("", "delay-crash-q", "delay-crash-conn", "rmq::connection::delay-crash-conn::queues", crashingClient{evals: &evals}, &QueueCounters{})
+	delivery := queue.newDelivery("delay-crash-d1")
+
+	// the move is a single command, so there's no state in between
+	c.Check(delivery.Delay(time.Minute), Equals, false)
+	c.Check(evals, Equals, 1)
+	c.Check(queue.Counters().Delayed, Equals, int64(0))
+}
+
+func (suite *QueueSuite) TestDelayNotUnacked(c *C) {
+	connection := OpenConnection("delay-unacked-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("delay-unacked-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	c.Check(queue.ReturnAllUnacked(), Equals, 0)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("delay-unacked-d1"), Equals, true)
+	deliveries, err := queue.Fetch(1)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Check(deliveries[0].Delay(time.Hour), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.DelayedCount(), Equals, 1)
+
+	// not unacked anymore, so it doesn't get delayed again
+	c.Check(deliveries[0].Delay(time.Hour), Equals, false)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.Counters().Delayed, Equals, int64(1))
+
+	queue.PurgeDelayed()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDefaultBatchTimeout(c *C) {
+	connection := OpenConnection("batch-timeout-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("batch-timeout-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.SetDefaultBatchTimeout(50 * time.Millisecond)
+	c.Check(queue.batchTimeout, Equals, 50*time.Millisecond)
+
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestBatchConsumer()
+	queue.AddBatchConsumer("batch-timeout-cons", 10, consumer)
+	c.Check(queue.Publish("batch-timeout-d1"), Equals, true)
+
+	// a partial batch gets consumed after 50ms instead of the default second
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(consumer.LastBatch, HasLen, 1)
+	failed, err := consumer.LastBatch.Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	consumer.Finish()
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestSemantics(c *C) {
+	connection := OpenConnection("semantics-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	checkQueueSemantics(c, connection.OpenQueue("semantics-q"), func() {
+		time.Sleep(20 * time.Millisecond)
+	})
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMoveDueDelayed(c *C) {
+	connection := OpenConnection("move-due-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("move-due-q").(*redisQueue)
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	queue.SetDelayedChunkSize(2)
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.PublishToDelayedQueue(fmt.Sprintf("move-due-d%d", i), 0), Equals, true)
+	}
+	c.Check(queue.PublishToDelayedQueue("move-due-later", time.Hour), Equals, true)
+
+	// fewer due than batchSize, the one which isn't due yet stays
+	result := queue.moveFromSortedSetToList(queue.delayedKey, queue.unackedKey, time.Now(), 10, "")
+	c.Check(result.Err(), IsNil)
+	c.Check(dueMembers(result), DeepEquals, []interface{}{"move-due-d0", "move-due-d1", "move-due-d2"})
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	// more due than batchSize, only batchSize get moved
+	c.Check(queue.PublishToDelayedQueue("move-due-d3", 0), Equals, true)
+	c.Check(queue.PublishToDelayedQueue("move-due-d4", 0), Equals, true)
+	result = queue.moveFromSortedSetToList(queue.delayedKey, queue.unackedKey, time.Now(), 1, "")
+	c.Check(dueMembers(result), DeepEquals, []interface{}{"move-due-d3"})
+	c.Check(queue.DelayedCount(), Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 4)
+
+	c.Check(queue.PurgeDelayed(), Equals, 2)
+	c.Check(queue.ReturnAllUnacked(), Equals, 4)
+	c.Check(queue.PurgeReady(), Equals, 4)
+	connection.StopHeartbeat()
+}
+
+// dueMembers returns the members moved by moveFromSortedSetToList without
+// their scores
+func dueMembers(result *redis.Cmd) []interface{} {
+	values, _ := result.Val().([]interface{})
+	members := []interface{}{}
+	for i := 0; i < len(values); i += 2 {
+		members = append(members, memberPayload(values[i]))
+	}
+	return members
+}
+
+// memberPayload returns the payload of a delayed set member
+func memberPayload(member interface{}) string {
+	value, _ := member.(string)
+	return unmarshalEnvelope(JSONEnvelope{}, value).Payload
+}
+
+func (suite *QueueSuite) TestDelayLag(c *C) {
+	connection := OpenConnection("delay-lag-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("delay-lag-q").(*redisQueue)
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	before := queue.Counters()
+	c.Check(queue.PublishAt("delay-lag-d1", time.Now().Add(-time.Second)), Equals, true)
+	c.Check(queue.PublishAt("delay-lag-d2", time.Now().Add(-3*time.Second)), Equals, true)
+	queue.deliveryChanForDelayedQueue = make(chan Delivery, 2)
+	c.Check(queue.consumeBatchForDelayedQueue(10), Equals, true)
+	c.Check(queue.deliveryChanForDelayedQueue, HasLen, 2)
+
+	counters := queue.Counters()
+	c.Check(counters.DelayLagCount-before.DelayLagCount, Equals, int64(2))
+	c.Check(counters.DelayLagMax >= 3*time.Second, Equals, true)
+	c.Check(counters.DelayLagMax < 4*time.Second, Equals, true)
+	lagTotal := counters.DelayLagTotal - before.DelayLagTotal
+	c.Check(lagTotal >= 4*time.Second, Equals, true)
+	c.Check(lagTotal < 5*time.Second, Equals, true)
+	if before.DelayLagCount == 0 {
+		c.Check(counters.DelayLagAvg() >= 2*time.Second, Equals, true)
+	}
+
+	c.Check(queue.ReturnAllUnacked(), Equals, 2)
+	c.Check(queue.PurgeReady(), Equals, 2)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestDelayLagCounters(c *C) {
+	counters := &QueueCounters{}
+	c.Check(counters.snapshot().DelayLagAvg(), Equals, time.Duration(0))
+	counters.delayLag(time.Second)
+	counters.delayLag(3 * time.Second)
+	counters.delayLag(2 * time.Second)
+	snapshot := counters.snapshot()
+	c.Check(snapshot.DelayLagCount, Equals, int64(3))
+	c.Check(snapshot.DelayLagMax, Equals, 3*time.Second)
+	c.Check(snapshot.DelayLagAvg(), Equals, 2*time.Second)
+}
+
+func (suite *QueueSuite) TestMoveDueDelayedKeepsFuture(c *C) {
+	connection := OpenConnection("keep-future-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("keep-future-q").(*redisQueue)
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	now := time.Now()
+	c.Check(queue.PublishAt("keep-future-later1", now.Add(time.Minute)), Equals, true)
+	c.Check(queue.PublishAt("keep-future-due1", now.Add(-time.Second)), Equals, true)
+	c.Check(queue.PublishAt("keep-future-later2", now.Add(time.Hour)), Equals, true)
+	c.Check(queue.PublishAt("keep-future-due2", now.Add(-time.Millisecond)), Equals, true)
+	c.Check(queue.PublishAt("keep-future-later3", now.Add(2*time.Hour)), Equals, true)
+
+	result := queue.moveFromSortedSetToList(queue.delayedKey, queue.unackedKey, now, 10, "")
+	c.Check(dueMembers(result), DeepEquals, []interface{}{"keep-future-due1", "keep-future-due2"})
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	delayed := queue.redisClient.ZRangeWithScores(queue.delayedKey, 0, -1).Val()
+	c.Assert(delayed, HasLen, 3)
+	for i, later := range []time.Time{now.Add(time.Minute), now.Add(time.Hour), now.Add(2 * time.Hour)} {
+		c.Check(memberPayload(delayed[i].Member), Equals, fmt.Sprintf("keep-future-later%d", i+1))
+		c.Check(delayed[i].Score, Equals, float64(later.UnixNano()))
+	}
+
+	c.Check(queue.PurgeDelayed(), Equals, 3)
+	c.Check(queue.ReturnAllUnacked(), Equals, 2)
+	c.Check(queue.PurgeReady(), Equals, 2)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestVisibilityTimeout(c *C) {
+	connection := OpenConnection("visibility-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("visibility-q").(*redisQueue)
+	queue.SetEnvelope(JSONEnvelope{})
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	queue.SetVisibilityTimeout(time.Hour)
+
+	c.Check(queue.Publish("visibility-d1"), Equals, true)
+	c.Check(queue.Publish("visibility-d2"), Equals, true)
+	deliveryChan := make(chan Delivery, 2)
+	queue.consumeBatch(deliveryChan, 2)
+	c.Assert(deliveryChan, HasLen, 2)
+	c.Check(queue.UnackedCount(), Equals, 2)
+	first := <-deliveryChan
+	c.Check(first.Ack(), Equals, true)
+
+	c.Check(queue.returnInvisible(time.Now()), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	c.Check(queue.returnInvisible(time.Now().Add(2*time.Hour)), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.redisClient.ZCard(queue.deadlinesKey).Val(), Equals, int64(0))
+
+	queue.consumeBatch(deliveryChan, 1)
+	c.Assert(deliveryChan, HasLen, 2)
+	second, redelivered := <-deliveryChan, <-deliveryChan
+	c.Check(redelivered.Payload(), Equals, second.Payload())
+	c.Check(second.DeliveryCount(), Equals, 0)
+	c.Check(redelivered.DeliveryCount(), Equals, 1)
+	c.Check(redelivered.Ack(), Equals, true)
+	c.Check(second.Ack(), Equals, false) // already redelivered and acked
+	c.Check(queue.UnackedCount(), Equals, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestVisibilityDeadlines(c *C) {
+	connection := OpenConnection("deadlines-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("deadlines-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+	queue.redisClient.Del(queue.deadlinesKey)
+	queue.SetVisibilityTimeout(time.Hour)
+	deadlines := func() int64 { return queue.redisClient.ZCard(queue.deadlinesKey).Val() }
+
+	// equal plain payloads get a deadline each, removed along with the delivery
+	for i := 0; i < 6; i++ {
+		c.Check(queue.Publish("deadlines-dup"), Equals, true)
+	}
+	deliveries, err := queue.Fetch(6)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 6)
+	c.Check(deadlines(), Equals, int64(6))
+	c.Check(deliveries[0].Ack(), Equals, true)
+	c.Check(deliveries[1].Reject(), Equals, true)
+	c.Check(deliveries[2].Delay(time.Hour), Equals, true)
+	c.Check(deliveries[3].Requeue(), Equals, true)
+	c.Check(deliveries[4].RequeueFront(), Equals, true)
+	c.Check(deadlines(), Equals, int64(1))
+	c.Check(queue.returnInvisible(time.Now().Add(2*time.Hour)), Equals, 1)
+	c.Check(deadlines(), Equals, int64(0))
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	// delayed deliveries get deadlines when they are fetched
+	c.Check(queue.PurgeReady(), Equals, 3)
+	c.Check(queue.PurgeRejected(), Equals, 1)
+	c.Check(queue.redisClient.ZAdd(queue.delayedKey, redis.Z{Score: 0, Member: "deadlines-delayed"}).Err(), IsNil)
+	queue.deliveryChanForDelayedQueue = make(chan Delivery, 10)
+	c.Check(queue.consumeBatchForDelayedQueue(10), Equals, true)
+	c.Assert(queue.deliveryChanForDelayedQueue, HasLen, 1)
+	delayed := <-queue.deliveryChanForDelayedQueue
+	c.Check(deadlines(), Equals, int64(1))
+	c.Check(delayed.Ack(), Equals, true)
+	c.Check(deadlines(), Equals, int64(0))
+	c.Check(queue.PurgeDelayed(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestMigrateQueue(c *C) {
+	srcConnection := OpenConnection("migrate-src-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	dstConnection := OpenConnection("migrate-dst-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 2)
+	src := srcConnection.OpenQueue("migrate-q").(*redisQueue)
+	dst := dstConnection.OpenQueue("migrate-q").(*redisQueue)
+	for _, queue := range []*redisQueue{src, dst} {
+		queue.PurgeReady()
+		queue.PurgeRejected()
+		queue.PurgeDelayed()
+	}
+
+	c.Check(src.Publish("migrate-r1"), Equals, true)
+	c.Check(src.Publish("migrate-r2"), Equals, true)
+	c.Check(src.Publish("migrate-r3"), Equals, true)
+	c.Check(src.redisClient.LPush(src.rejectedKey, "migrate-x1").Err(), IsNil)
+	runAt := time.Now().Add(time.Hour)
+	c.Check(src.PublishAt("migrate-d1", runAt), Equals, true)
+	c.Check(src.PublishAt("migrate-d2", runAt.Add(time.Minute)), Equals, true)
+
+	// left over by a failed migration, its delivery is older than all ready ones
+	c.Check(src.redisClient.LPush(src.readyKey+migratingSuffix, "migrate-r0").Err(), IsNil)
+
+	moved, err := MigrateQueue(src, dst)
+	c.Check(err, IsNil)
+	c.Check(moved, Equals, 7)
+
+	c.Check(src.ReadyCount(), Equals, 0)
+	c.Check(src.RejectedCount(), Equals, 0)
+	c.Check(src.DelayedCount(), Equals, 0)
+	c.Check(src.redisClient.Exists(src.readyKey+migratingSuffix).Val(), Equals, int64(0))
+
+	ready, err := dst.PeekReady(10)
+	c.Check(err, IsNil)
+	c.Check(ready, DeepEquals, []string{"migrate-r0", "migrate-r1", "migrate-r2", "migrate-r3"})
+	rejected, err := dst.PeekRejected(10)
+	c.Check(err, IsNil)
+	c.Check(rejected, DeepEquals, []string{"migrate-x1"})
+	delayed := dst.redisClient.ZRangeWithScores(dst.delayedKey, 0, -1).Val()
+	c.Assert(delayed, HasLen, 2)
+	c.Check(memberPayload(delayed[0].Member), Equals, "migrate-d1")
+	c.Check(delayed[0].Score, Equals, float64(runAt.UnixNano()))
+	c.Check(memberPayload(delayed[1].Member), Equals, "migrate-d2")
+	c.Check(delayed[1].Score, Equals, float64(runAt.Add(time.Minute).UnixNano()))
+
+	moved, err = MigrateQueue(src, dst)
+	c.Check(err, IsNil)
+	c.Check(moved, Equals, 0)
+
+	_, err = MigrateQueue(src, NewTestQueue("migrate-q"))
+	c.Check(err, NotNil)
+	_, err = MigrateQueue(src, srcConnection.OpenQueue("migrate-q"))
+	c.Check(err, ErrorMatches, "rmq can't migrate queue .* to itself")
+
+	// more deliveries than fit in a batch keep their order
+	c.Check(dst.PurgeReady(), Equals, 4)
+	payloads := []string{}
+	for i := 0; i < 2*migrateBatchSize+1; i++ {
+		payloads = append(payloads, fmt.Sprintf("migrate-b%d", i))
+		c.Check(src.Publish(payloads[i]), Equals, true)
+	}
+	moved, err = MigrateQueue(src, dst)
+	c.Check(err, IsNil)
+	c.Check(moved, Equals, len(payloads))
+	ready, err = dst.PeekReady(len(payloads) + 1)
+	c.Check(err, IsNil)
+	c.Check(ready, DeepEquals, payloads)
+
+	dst.PurgeReady()
+	dst.PurgeRejected()
+	dst.PurgeDelayed()
+	srcConnection.StopHeartbeat()
+	dstConnection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestQueueInterface(c *C) {
+	connection := OpenConnection("iface-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	var queue Queue = connection.OpenQueue("iface-q")
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	queue.RemoveAllConsumers()
+
+	c.Check(queue.Publish("iface-d1"), Equals, true)
+	c.Check(queue.PublishToDelayedQueue("iface-d2", time.Minute), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.PurgeDelayed(), Equals, 1)
+
+	consumer := NewTestConsumer("iface-cons")
+	consumer.AutoAck = false
+	queue.StartConsuming(10, time.Millisecond)
+	name := queue.AddConsumer("iface-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.GetConsumers(), DeepEquals, []string{name})
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.StopConsuming(), Equals, true)
+	queue.WaitForConsuming()
+	c.Check(queue.ReturnAllUnacked(), Equals, 1)
+	c.Check(queue.RemoveConsumer(name), Equals, true)
+	c.Check(queue.RemoveAllConsumers(), Equals, 0)
+	c.Check(queue.PurgeReady(), Equals, 1)
+
+	var testQueue Queue = NewTestQueue("iface-test-q")
+	c.Check(testQueue.Publish("iface-d3"), Equals, true)
+	c.Check(testQueue.ReadyCount(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRetry(c *C) {
+	connection := OpenConnection("retry-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("retry-q").(*redisQueue)
+	deadLetterQueue := connection.OpenQueue("retry-dead-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+	deadLetterQueue.PurgeReady()
+	c.Check(queue.ReturnAllUnacked(), Equals, 0)
+	queue.PurgeReady()
+
+	c.Check(queue.Publish("retry-d1"), Equals, true)
+	deliveryChan := make(chan Delivery, 1)
+	c.Check(queue.consumeBatch(deliveryChan, 1), Equals, true)
+	delivery := <-deliveryChan
+
+	for _, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		before := time.Now()
+		state, err := delivery.Retry(time.Minute, 3, deadLetterQueue)
+		c.Check(err, IsNil)
+		c.Check(state, Equals, Delayed)
+		c.Check(queue.UnackedCount(), Equals, 0)
+
+		delayed := queue.redisClient.ZRangeWithScores(queue.delayedKey, 0, -1).Val()
+		c.Assert(delayed, HasLen, 1)
+		c.Check(delayed[0].Score >= float64(before.Add(backoff).UnixNano()), Equals, true)
+		c.Check(delayed[0].Score <= float64(time.Now().Add(backoff).UnixNano()), Equals, true)
+
+		// consume it again ahead of time
+		values, _ := queue.moveFromSortedSetToList(queue.delayedKey, queue.unackedKey, time.Now().Add(time.Hour), 1, "").Val().([]interface{})
+		c.Assert(values, HasLen, 2) // member and score
+		delivery = queue.newDelivery(values[0].(string))
+		c.Check(delivery.Payload(), Equals, "retry-d1")
+	}
+
+	state, err := delivery.Retry(time.Minute, 3, deadLetterQueue)
+	c.Check(err, IsNil)
+	c.Check(state, Equals, Pushed)
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	peeked, _ := deadLetterQueue.PeekReady(10)
+	c.Check(peeked, DeepEquals, []string{"retry-d1"})
+
+	state, err = queue.newDelivery("retry-d2").Retry(time.Minute, 0, NewTestQueue("retry-test-q"))
+	c.Check(err, ErrorMatches, "rmq delivery .* can't be moved to \\*rmq.TestQueue, .*")
+	c.Check(state, Equals, Unacked)
+
+	c.Check(deadLetterQueue.PurgeReady(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRetryBackoff(c *C) {
+	c.Check(retryBackoff(time.Minute, 1), Equals, time.Minute)
+	c.Check(retryBackoff(time.Minute, 3), Equals, 4*time.Minute)
+	c.Check(retryBackoff(time.Minute, 12), Equals, maxRetryBackoff)
+	c.Check(retryBackoff(time.Second, 1000), Equals, maxRetryBackoff) // doesn't overflow
+	c.Check(retryBackoff(48*time.Hour, 1), Equals, maxRetryBackoff)
+	c.Check(retryBackoff(0, 1000), Equals, time.Duration(0))
+	c.Check(retryBackoff(-time.Second, 1000), Equals, -time.Second)
+}
+
+func (suite *QueueSuite) TestPollBackoff(c *C) {
+	backoff := newPollBackoff(time.Millisecond, 5*time.Millisecond)
+	sleeps := []time.Duration{}
+	for _, empty := range []bool{true, true, true, true, true, false, true, true} {
+		sleeps = append(sleeps, backoff.next(empty))
+	}
+	c.Check(sleeps, DeepEquals, []time.Duration{
+		time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond,
+		time.Millisecond, // reset as soon as there are deliveries
+		time.Millisecond, 2 * time.Millisecond,
+	})
+
+	// no backoff
+	backoff = newPollBackoff(time.Millisecond, time.Millisecond)
+	c.Check(backoff.next(true), Equals, time.Millisecond)
+	c.Check(backoff.next(true), Equals, time.Millisecond)
+}
+
+func (suite *QueueSuite) TestStartConsumingWithBackoff(c *C) {
+	connection := OpenConnection("backoff-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("backoff-q").(*redisQueue)
+	queue.PurgeReady()
+
+	consumer := NewTestConsumer("backoff-cons")
+	c.Check(queue.StartConsumingWithBackoff(10, time.Millisecond, 20*time.Millisecond), Equals, true)
+	queue.AddConsumer("backoff-cons", consumer)
+	time.Sleep(50 * time.Millisecond) // backed off to max
+	c.Check(queue.Publish("backoff-d1"), Equals, true)
+	time.Sleep(30 * time.Millisecond) // consumed within max poll duration
+	c.Check(consumer.LastDeliveries, HasLen, 1)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestStartConsumingBlocking(c *C) {
+	connection := OpenConnection("blocking-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+
+	// waits until a delivery published while the queue is idle gets consumed
+	latency := func(queue Queue) time.Duration {
+		consumer := NewTestConsumer("blocking-cons")
+		queue.AddConsumer("blocking-cons", consumer)
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		c.Check(queue.Publish("blocking-d"), Equals, true)
+		for len(consumer.LastDeliveries) == 0 && time.Since(start) < 5*time.Second {
+			time.Sleep(time.Millisecond)
+		}
+		c.Check(consumer.LastDeliveries, HasLen, 1)
+		return time.Since(start)
+	}
+
+	pollQueue := connection.OpenQueue("blocking-poll-q")
+	pollQueue.PurgeReady()
+	c.Check(pollQueue.StartConsuming(10, time.Second), Equals, true)
+	pollLatency := latency(pollQueue)
+
+	blockingQueue := connection.OpenQueue("blocking-q")
+	blockingQueue.PurgeReady()
+	c.Check(blockingQueue.StartConsumingBlocking(10, time.Second), Equals, true)
+	blockingLatency := latency(blockingQueue)
+
+	c.Check(pollLatency > 500*time.Millisecond, Equals, true)
+	c.Check(blockingLatency < 100*time.Millisecond, Equals, true)
+	c.Check(blockingLatency < pollLatency, Equals, true)
+
+	c.Check(pollQueue.StopConsumingAndDrain(5*time.Second), IsNil)
+	c.Check(blockingQueue.StopConsumingAndDrain(5*time.Second), IsNil)
+	c.Check(blockingQueue.Publish("blocking-after-stop"), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(blockingQueue.ReadyCount(), Equals, 1) // not consumed anymore
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishBounded(c *C) {
+	connection := OpenConnection("bounded-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("bounded-q").(*redisQueue)
+	queue.PurgeReady()
+
+	published, err := queue.PublishBounded("bounded-d1", 0)
+	c.Check(err, IsNil)
+	c.Check(published, Equals, false)
+
+	c.Check(queue.Publish("bounded-d1"), Equals, true)
+	published, err = queue.PublishBounded("bounded-d2", 3) // one below
+	c.Check(err, IsNil)
+	c.Check(published, Equals, true)
+	published, err = queue.PublishBounded("bounded-d3", 3) // one below
+	c.Check(err, IsNil)
+	c.Check(published, Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	published, err = queue.PublishBounded("bounded-d4", 3) // exactly at
+	c.Check(err, IsNil)
+	c.Check(published, Equals, false)
+	c.Check(queue.Publish("bounded-d4"), Equals, true)
+	published, err = queue.PublishBounded("bounded-d5", 3) // one above
+	c.Check(err, IsNil)
+	c.Check(published, Equals, false)
+	c.Check(queue.ReadyCount(), Equals, 4)
+	c.Check(queue.Counters().Published, Equals, int64(4))
+
+	payloads, err := queue.PeekReady(4)
+	c.Check(err, IsNil)
+	c.Check(payloads, DeepEquals, []string{"bounded-d1", "bounded-d2", "bounded-d3", "bounded-d4"})
+	c.Check(queue.PurgeReady(), Equals, 4)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPublishUnique(c *C) {
+	connection := OpenConnection("unique-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("unique-q").(*redisQueue)
+	otherQueue := connection.OpenQueue("unique-other-q").(*redisQueue)
+	queue.PurgeReady()
+	otherQueue.PurgeReady()
+	connection.redisClient.Del(
+		strings.Replace(strings.Replace(queueDedupTemplate, phQueue, "unique-q", 1), phDedup, "k1", 1),
+		strings.Replace(strings.Replace(queueDedupTemplate, phQueue, "unique-q", 1), phDedup, "k2", 1),
+		strings.Replace(strings.Replace(queueDedupTemplate, phQueue, "unique-other-q", 1), phDedup, "k1", 1),
+	)
+
+	published, err := queue.PublishUnique("k1", "unique-d1", 50*time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(published, Equals, true)
+	published, err = queue.PublishUnique("k1", "unique-d1", 50*time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(published, Equals, false)
+	c.Check(queue.ReadyCount(), Equals, 1)
+
+	// dedup keys are per queue
+	published, err = otherQueue.PublishUnique("k1", "unique-d1", 50*time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(published, Equals, true)
+	c.Check(otherQueue.ReadyCount(), Equals, 1)
+
+	time.Sleep(60 * time.Millisecond)
+	published, err = queue.PublishUnique("k1", "unique-d1", 50*time.Millisecond)
+	c.Check(err, IsNil)
+	c.Check(published, Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 2)
+
+	// no window means forever
+	published, _ = queue.PublishUnique("k2", "unique-d2", 0)
+	c.Check(published, Equals, true)
+	published, _ = queue.PublishUnique("k2", "unique-d2", 0)
+	c.Check(published, Equals, false)
+	c.Check(queue.ReadyCount(), Equals, 3)
+
+	c.Check(queue.PurgeReady(), Equals, 3)
+	c.Check(otherQueue.PurgeReady(), Equals, 1)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestSharedRedisClient(c *C) {
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")),
+		DB:   1,
+	})
+	defer redisClient.Close()
+
+	// queues and deliveries must be able to share the very same client
+	queue := newQueue("", "shared-q", "shared-conn", "shared-queues", redisClient, &QueueCounters{})
+	delivery := newDelivery(queue.name, "shared-d", queue.unackedKey, queue.delayedKey, queue.rejectedKey, queue.pushKey, queue.redisClient, queue.counters)
+	c.Check(queue.redisClient, Equals, redis.UniversalClient(redisClient))
+	c.Check(delivery.redisClient, Equals, queue.redisClient)
+}
+
+func (suite *QueueSuite) TestKeyHashTag(c *C) {
+	c.Check(keyHashTag("plain"), Equals, "plain")
+	c.Check(keyHashTag("a{b}c{d}"), Equals, "b")
+	c.Check(keyHashTag("a{}c{d}"), Equals, "a{}c{d}")
+	c.Check(keyHashTag("a{b"), Equals, "a{b")
+
+	c.Check(newQueue("", "things", "conn-abc", "queues", nil, nil).inSameSlot(), Equals, false)
+	c.Check(newQueue("", "{things}", "conn-abc", "queues", nil, nil).inSameSlot(), Equals, true)
+	c.Check(newQueue("", "{things}", "conn-{abc}", "queues", nil, nil).inSameSlot(), Equals, false)
+}
+
+func (suite *QueueSuite) TestOpenQueueClusterHashTag(c *C) {
+	// nothing listens there, so opening fails on the first command sent
+	redisClient := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"127.0.0.1:1"}, MaxRedirects: -1})
+	defer redisClient.Close()
+	connection := &redisConnection{Name: "cluster-conn", allQueuesKey: queuesKey, redisClient: redisClient, logger: newLogging()}
+
+	queue, err := connection.OpenQueueE("things")
+	c.Check(queue, IsNil)
+	c.Check(err, ErrorMatches, "rmq queue things needs a hash tag like {things} .*")
+	c.Check(connection.queues, HasLen, 0)
+
+	_, err = connection.OpenQueueE("{things}")
+	c.Check(err, ErrorMatches, ".*connection refused.*")
+	c.Check(connection.queues, HasLen, 0)
+}
+
+func (suite *QueueSuite) TestDelayedHashTag(c *C) {
+	connection := OpenConnection("tag-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("{tag-q}").(*redisQueue)
+	c.Assert(queue.inSameSlot(), Equals, true)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	c.Check(queue.PublishToDelayedQueue("tag-d1", time.Millisecond), Equals, true)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	time.Sleep(2 * time.Millisecond)
+
+	result := queue.moveFromSortedSetToList(queue.delayedKey, queue.unackedKey, time.Now(), 1, "")
+	c.Assert(result.Err(), IsNil)
+	c.Check(dueMembers(result), DeepEquals, []interface{}{"tag-d1"})
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 1)
+	c.Check(queue.ReturnAllUnacked(), Equals, 1)
+	c.Check(queue.PurgeReady(), Equals, 1)
+
+	connection.StopHeartbeat()
+}
+
+type testTracer struct {
+	consumed []string
+}
+
+type testTraceKey struct{}
+
+func (tracer *testTracer) Inject(ctx context.Context) map[string]string {
+	return map[string]string{"trace": ctx.Value(testTraceKey{}).(string)}
+}
+
+func (tracer *testTracer) StartConsume(ctx context.Context, queue string, traceContext map[string]string) (context.Context, func()) {
+	return context.WithValue(ctx, testTraceKey{}, traceContext["trace"]+"/consume"), func() {
+		tracer.consumed = append(tracer.consumed, queue)
+	}
+}
+
+func (suite *QueueSuite) TestTracing(c *C) {
+	connection := OpenConnection("trace-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("trace-q").(*redisQueue)
+	queue.PurgeReady()
+
+	tracer := &testTracer{}
+	ctx := context.WithValue(context.Background(), testTraceKey{}, "publish")
+	c.Check(queue.PublishWithTrace(ctx, "trace-d1"), Equals, true) // no tracer yet
+	queue.SetTracer(tracer)
+	c.Check(queue.PublishWithTrace(ctx, "trace-d2"), Equals, true)
+
+	consumer := NewTestConsumer("trace-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("trace-cons", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 2)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "trace-d1")
+	c.Check(consumer.LastDeliveries[0].Context().Value(testTraceKey{}), IsNil)
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "trace-d2")
+	c.Check(consumer.LastDeliveries[1].Context().Value(testTraceKey{}), Equals, "publish/consume")
+	c.Check(tracer.consumed, DeepEquals, []string{"trace-q"})
+	c.Check(queue.UnackedCount(), Equals, 0)
 
 	queue.StopConsuming()
 	connection.StopHeartbeat()
@@ -252,6 +3782,49 @@ func (suite *QueueSuite) TestMulti(c *C) {
 	connection.StopHeartbeat()
 }
 
+func (suite *QueueSuite) TestConsumerPrefetch(c *C) {
+	connection := OpenConnection("prefetch-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("prefetch-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 20; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("prefetch-d%d", i)), Equals, true)
+	}
+
+	queue.StartConsuming(2, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 18)
+	c.Check(queue.UnackedCount(), Equals, 2)
+
+	slowConsumer := NewTestConsumer("prefetch-slow")
+	slowConsumer.AutoAck = false
+	slowConsumer.AutoFinish = false
+	queue.AddConsumerWithPrefetch("prefetch-slow", 1, slowConsumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(slowConsumer.LastDeliveries, HasLen, 1)
+	c.Check(queue.ReadyCount(), Equals, 16) // one consuming, one prefetched
+	c.Check(queue.UnackedCount(), Equals, 4)
+
+	fastConsumer := NewTestConsumer("prefetch-fast")
+	fastConsumer.AutoAck = false
+	fastConsumer.AutoFinish = false
+	queue.AddConsumerWithPrefetch("prefetch-fast", 5, fastConsumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(fastConsumer.LastDeliveries, HasLen, 1)
+	c.Check(queue.ReadyCount(), Equals, 10) // one consuming, five prefetched
+	c.Check(queue.UnackedCount(), Equals, 10)
+
+	c.Check(slowConsumer.LastDelivery.Ack(), Equals, true)
+	slowConsumer.Finish()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(slowConsumer.LastDeliveries, HasLen, 2)
+	c.Check(queue.ReadyCount(), Equals, 9) // slow consumer refilled its single slot
+	c.Check(queue.UnackedCount(), Equals, 10)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestBatch(c *C) {
 	connection := OpenConnection("batch-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	queue := connection.OpenQueue("batch-q").(*redisQueue)
@@ -301,6 +3874,390 @@ func (suite *QueueSuite) TestBatch(c *C) {
 	c.Check(queue.RejectedCount(), Equals, 3)
 }
 
+func (suite *QueueSuite) TestBatchAckReject(c *C) {
+	connection := OpenConnection("batch-ack-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("batch-ack-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+	var ackedHooks int32
+	queue.SetOnStateChange(func(payload string, from, to State) {
+		if from == Unacked && to == Acked {
+			atomic.AddInt32(&ackedHooks, 1)
+		}
+	})
+
+	for i := 0; i < 6; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("batch-ack-d%d", i)), Equals, true)
+	}
+
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestBatchConsumer()
+	queue.AddBatchConsumerWithTimeout("batch-ack-cons", 3, 10*time.Millisecond, consumer)
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastBatch, HasLen, 3)
+	c.Check(queue.UnackedCount(), Equals, 6)
+
+	batch := consumer.LastBatch
+	failed, err := batch.Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 3)
+	c.Check(atomic.LoadInt32(&ackedHooks), Equals, int32(3)) // like acking one by one
+	c.Check(queue.Counters().Acked, Equals, int64(3))
+	failed, err = batch.Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 3) // already acked
+	failed, err = batch.Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 3)
+	c.Check(queue.RejectedCount(), Equals, 0)
+
+	consumer.Finish()
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(consumer.LastBatch, HasLen, 3)
+	failed, err = consumer.LastBatch.Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 3)
+
+	consumer.Finish()
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+// roundTripCountingClient counts single LREMs and pipelines
+type roundTripCountingClient struct {
+	redis.UniversalClient
+	roundTrips *int
+}
+
+func (client roundTripCountingClient) LRem(key string, count int64, value interface{}) *redis.IntCmd {
+	*client.roundTrips++
+	return client.UniversalClient.LRem(key, count, value)
+}
+
+func (client roundTripCountingClient) Pipeline() redis.Pipeliner {
+	*client.roundTrips++
+	return client.UniversalClient.Pipeline()
+}
+
+func (suite *QueueSuite) TestTotalCount(c *C) {
+	connection := OpenConnection("total-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	roundTrips := 0
+	redisClient := roundTripCountingClient{UniversalClient: connection.redisClient, roundTrips: &roundTrips}
+	queue := newQueue("", "total-q", "total-conn", "rmq::connection::total-conn::queues", redisClient, &QueueCounters{})
+	queue.SetMaxPriority(1)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	for i := 0; i < 4; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("total-d%d", i)), Equals, true)
+	}
+	c.Check(queue.PublishWithPriority("total-p1", 1), Equals, true)
+	c.Check(queue.PublishToDelayedQueue("total-delayed", time.Hour), Equals, true)
+	deliveries, err := queue.Fetch(3)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 3)
+	c.Check(deliveries[2].Reject(), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 2)
+	c.Check(queue.UnackedCount(), Equals, 2)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	roundTrips = 0
+	total, err := queue.TotalCountE(false)
+	c.Check(err, IsNil)
+	c.Check(total, Equals, 5)
+	c.Check(roundTrips, Equals, 1)
+	c.Check(queue.TotalCount(true), Equals, 6)
+
+	failed, err := Deliveries(deliveries[:2]).Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+	c.Check(queue.TotalCount(true), Equals, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestAckAll(c *C) {
+	connection := OpenConnection("ack-all-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	roundTrips := 0
+	redisClient := roundTripCountingClient{UniversalClient: connection.redisClient, roundTrips: &roundTrips}
+	queue1 := newQueue("", "ack-all-q1", "ack-all-conn", "rmq::connection::ack-all-conn::queues", redisClient, &QueueCounters{})
+	queue2 := newQueue("", "ack-all-q2", "ack-all-conn", "rmq::connection::ack-all-conn::queues", redisClient, &QueueCounters{})
+	queue1.PurgeReady()
+	queue1.ReturnAllUnacked()
+	queue1.PurgeReady()
+	queue2.PurgeReady()
+	queue2.ReturnAllUnacked()
+	queue2.PurgeReady()
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue1.Publish(fmt.Sprintf("ack-all-q1-d%d", i)), Equals, true)
+		c.Check(queue2.Publish(fmt.Sprintf("ack-all-q2-d%d", i)), Equals, true)
+	}
+	deliveryChan := make(chan Delivery, 10)
+	c.Check(queue1.consumeBatch(deliveryChan, 5), Equals, true)
+	c.Check(queue2.consumeBatch(deliveryChan, 5), Equals, true)
+	close(deliveryChan)
+	deliveries := []Delivery{NewTestDeliveryString("ack-all-test")}
+	for delivery := range deliveryChan {
+		deliveries = append(deliveries, delivery)
+	}
+	c.Check(deliveries[1].Ack(), Equals, true) // acked before, isn't counted
+
+	roundTrips = 0
+	acked, err := AckAll(deliveries)
+	c.Check(err, IsNil)
+	c.Check(acked, Equals, 10)
+	c.Check(roundTrips, Equals, 1) // one per connection
+	c.Check(queue1.UnackedCount(), Equals, 0)
+	c.Check(queue2.UnackedCount(), Equals, 0)
+	c.Check(queue1.counters.snapshot().Acked, Equals, int64(5))
+	c.Check(queue2.counters.snapshot().Acked, Equals, int64(5))
+	c.Check(deliveries[0].(*TestDelivery).State, Equals, Acked)
+
+	acked, err = AckAll(deliveries)
+	c.Check(err, IsNil)
+	c.Check(acked, Equals, 0)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) BenchmarkAckAll(c *C) {
+	suite.benchmarkAck(c, "bench-ack-all", func(deliveries []Delivery) {
+		AckAll(deliveries)
+	})
+}
+
+func (suite *QueueSuite) BenchmarkAckOneByOne(c *C) {
+	suite.benchmarkAck(c, "bench-ack-one", func(deliveries []Delivery) {
+		for _, delivery := range deliveries {
+			delivery.Ack()
+		}
+	})
+}
+
+// benchmarkAck acks c.N deliveries in batches of 500 using ack and reports
+// the round trips per delivery
+func (suite *QueueSuite) benchmarkAck(c *C, name string, ack func([]Delivery)) {
+	connection := OpenConnection(name+"-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	roundTrips := 0
+	redisClient := roundTripCountingClient{UniversalClient: connection.redisClient, roundTrips: &roundTrips}
+	queue := newQueue("", name+"-q", name+"-conn", "rmq::connection::"+name+"-conn::queues", redisClient, &QueueCounters{})
+	queue.PurgeReady()
+	queue.ReturnAllUnacked()
+	queue.PurgeReady()
+
+	const batchSize = 500
+	total := 0
+	for done := 0; done < c.N; done += batchSize {
+		c.StopTimer()
+		size := batchSize
+		if c.N-done < size {
+			size = c.N - done
+		}
+		for i := 0; i < size; i++ {
+			queue.Publish(name + "-d")
+		}
+		deliveryChan := make(chan Delivery, size)
+		queue.consumeBatch(deliveryChan, size)
+		close(deliveryChan)
+		deliveries := make([]Delivery, 0, size)
+		for delivery := range deliveryChan {
+			deliveries = append(deliveries, delivery)
+		}
+		roundTrips = 0
+		c.StartTimer()
+
+		ack(deliveries)
+		total += roundTrips
+	}
+
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Logf("%d deliveries acked in %d round trips", c.N, total)
+	connection.StopHeartbeat()
+}
+
+// payloadsConsumer returns a batch consumer which acks the batches and sends
+// their payloads to batches
+func payloadsConsumer(batches chan []string) BatchConsumer {
+	return funcBatchConsumer(func(batch Deliveries) {
+		payloads := []string{}
+		for _, delivery := range batch {
+			payloads = append(payloads, delivery.Payload())
+		}
+		batch.Ack()
+		batches <- payloads
+	})
+}
+
+// nextBatch returns the payloads of the next batch, fails if there's none
+// within a few seconds
+func nextBatch(c *C, batches chan []string) []string {
+	select {
+	case payloads := <-batches:
+		return payloads
+	case <-time.After(5 * time.Second):
+		c.Fatal("no batch consumed")
+		return nil
+	}
+}
+
+func (suite *QueueSuite) TestBatchMinSizeTooFew(c *C) {
+	connection := OpenConnection("batch-min-few-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("batch-min-few-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	const timeout = 50 * time.Millisecond
+	batches := make(chan []string, 10)
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddBatchConsumerWithOptions("batch-min-few-cons", 3, 5, timeout, payloadsConsumer(batches))
+
+	// the timeout fires a few times with too few before the third arrives
+	c.Check(queue.Publish("batch-min-few-d0"), Equals, true)
+	c.Check(queue.Publish("batch-min-few-d1"), Equals, true)
+	time.Sleep(3 * timeout)
+	c.Check(queue.Publish("batch-min-few-d2"), Equals, true)
+	c.Check(nextBatch(c, batches), DeepEquals, []string{"batch-min-few-d0", "batch-min-few-d1", "batch-min-few-d2"})
+
+	// consumed anyway after waiting maxBatchWaits timeouts
+	start := time.Now()
+	c.Check(queue.Publish("batch-min-few-d3"), Equals, true)
+	c.Check(nextBatch(c, batches), DeepEquals, []string{"batch-min-few-d3"})
+	c.Check(time.Since(start) >= maxBatchWaits*timeout, Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestBatchMinSizeEnough(c *C) {
+	connection := OpenConnection("batch-min-enough-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("batch-min-enough-q").(*redisQueue)
+	queue.PurgeRejected()
+	queue.PurgeReady()
+
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("batch-min-enough-d%d", i)), Equals, true)
+	}
+
+	// below maxSize, so consumed once the timeout fired
+	const timeout = 50 * time.Millisecond
+	batches := make(chan []string, 10)
+	start := time.Now()
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddBatchConsumerWithOptions("batch-min-enough-cons", 2, 5, timeout, payloadsConsumer(batches))
+	c.Check(nextBatch(c, batches), HasLen, 3)
+	c.Check(time.Since(start) >= timeout, Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestRejectedDeliveries(c *C) {
+	connection := OpenConnection("rejected-deliveries-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("rejected-deliveries-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	for i := 1; i <= 4; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("rejected-deliveries-d%d", i)), Equals, true)
+	}
+	deliveries, err := queue.Fetch(4)
+	c.Check(err, IsNil)
+	failed, err := Deliveries(deliveries).Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 4)
+
+	for _, count := range []int{0, -1} {
+		none, err := queue.RejectedDeliveries(count)
+		c.Check(err, IsNil)
+		c.Check(none, DeepEquals, []Delivery{})
+	}
+
+	// rejecting inspected deliveries doesn't count attempts for dead letters
+	deadQueue := connection.OpenQueue("rejected-deliveries-dead-q").(*redisQueue)
+	deadQueue.PurgeReady()
+	queue.SetDeadLetterQueue(deadQueue, 1)
+	changes := []string{}
+	queue.SetOnStateChange(func(payload string, from, to State) {
+		changes = append(changes, fmt.Sprintf("%s %s->%s", payload, from, to))
+	})
+	counters := queue.Counters()
+
+	inspected, err := queue.RejectedDeliveries(3)
+	c.Check(err, IsNil)
+	c.Assert(inspected, HasLen, 3)
+	c.Check(inspected[0].Payload(), Equals, "rejected-deliveries-d1")
+	c.Check(inspected[1].Payload(), Equals, "rejected-deliveries-d2")
+	c.Check(inspected[2].Payload(), Equals, "rejected-deliveries-d3")
+	c.Check(queue.RejectedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0) // not unacked, the cleaner doesn't return them to ready
+
+	c.Check(inspected[0].Ack(), Equals, true)          // dropped
+	c.Check(inspected[1].RequeueFront(), Equals, true) // reprocessed
+	c.Check(inspected[0].Ack(), Equals, false)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	inspected, err = queue.RejectedDeliveries(1)
+	c.Check(err, IsNil)
+	c.Assert(inspected, HasLen, 1)
+	c.Check(inspected[0].Payload(), Equals, "rejected-deliveries-d4")
+	c.Check(inspected[0].Reject(), Equals, true)
+	c.Check(deadQueue.ReadyCount(), Equals, 0)
+	payloads, err := queue.PeekRejected(1)
+	c.Check(err, IsNil)
+	c.Check(payloads, DeepEquals, []string{"rejected-deliveries-d4"})
+
+	c.Check(queue.Counters(), Equals, counters)
+	c.Check(changes, DeepEquals, []string{
+		"rejected-deliveries-d1 Inspected->Acked",
+		"rejected-deliveries-d2 Inspected->Requeued",
+		"rejected-deliveries-d4 Inspected->Rejected",
+	})
+
+	// left alone, returns to the oldest end of rejected on close
+	c.Check(connection.Close(), Equals, true)
+	payloads, err = queue.PeekRejected(2)
+	c.Check(err, IsNil)
+	c.Check(payloads, DeepEquals, []string{"rejected-deliveries-d3", "rejected-deliveries-d4"})
+
+	c.Check(queue.PurgeReady(), Equals, 1)
+	c.Check(queue.PurgeRejected(), Equals, 2)
+}
+
+func (suite *QueueSuite) TestReturnInspected(c *C) {
+	connection := OpenConnection("return-inspected-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("return-inspected-q").(*redisQueue)
+	queue.PurgeRejected()
+	for i := 0; i < 2*returnBatchSize+1; i++ {
+		c.Check(queue.redisClient.LPush(queue.rejectedKey, fmt.Sprintf("return-inspected-d%d", i)).Err(), IsNil)
+	}
+
+	// returned in several chunks, keeping their order
+	inspected, err := queue.RejectedDeliveries(2*returnBatchSize + 1)
+	c.Check(err, IsNil)
+	c.Check(inspected, HasLen, 2*returnBatchSize+1)
+	c.Check(queue.RejectedCount(), Equals, 0)
+	c.Check(queue.returnInspected(), Equals, 2*returnBatchSize+1)
+	payloads, err := queue.PeekRejected(2)
+	c.Check(err, IsNil)
+	c.Check(payloads, DeepEquals, []string{"return-inspected-d0", "return-inspected-d1"})
+	c.Check(queue.returnInspected(), Equals, 0)
+
+	c.Check(queue.PurgeRejected(), Equals, 2*returnBatchSize+1)
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestReturnRejected(c *C) {
 	connection := OpenConnection("return-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	queue := connection.OpenQueue("return-q").(*redisQueue)
@@ -355,6 +4312,66 @@ func (suite *QueueSuite) TestReturnRejected(c *C) {
 	c.Check(queue.RejectedCount(), Equals, 0)
 }
 
+func (suite *QueueSuite) TestReturnRejectedOrdered(c *C) {
+	connection := OpenConnection("return-ordered-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("return-ordered-q").(*redisQueue)
+	queue.SetEnvelope(JSONEnvelope{})
+	queue.PurgeReady()
+	queue.PurgeRejected()
+
+	payloads := func(deliveries []Delivery) []string {
+		result := []string{}
+		for _, delivery := range deliveries {
+			result = append(result, delivery.Payload())
+		}
+		return result
+	}
+	rejectInOrder := func() {
+		deliveries, err := queue.Fetch(4)
+		c.Check(err, IsNil)
+		c.Assert(deliveries, HasLen, 4)
+		for _, i := range []int{2, 0, 3, 1} {
+			c.Check(deliveries[i].Reject(), Equals, true)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("return-ordered-d%d", i)), Equals, true)
+	}
+	rejectInOrder()
+
+	// returned in rejection order
+	c.Check(queue.ReturnRejected(4), Equals, 4)
+	deliveries, err := queue.Fetch(4)
+	c.Check(err, IsNil)
+	c.Check(payloads(deliveries), DeepEquals, []string{"return-ordered-d2", "return-ordered-d0", "return-ordered-d3", "return-ordered-d1"})
+	failed, err := Deliveries(deliveries).Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+
+	for i := 0; i < 4; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("return-ordered-d%d", i)), Equals, true)
+	}
+	rejectInOrder()
+
+	// returned in publish order, the oldest rejected first
+	returned, err := queue.ReturnRejectedOrdered(3)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 3)
+	c.Check(queue.RejectedCount(), Equals, 1) // delivery 1, rejected last
+	returned, err = queue.ReturnRejectedOrdered(10)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 1)
+
+	deliveries, err = queue.Fetch(4)
+	c.Check(err, IsNil)
+	c.Check(payloads(deliveries), DeepEquals, []string{"return-ordered-d0", "return-ordered-d2", "return-ordered-d3", "return-ordered-d1"})
+	failed, err = Deliveries(deliveries).Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	connection.StopHeartbeat()
+}
+
 func (suite *QueueSuite) TestPushQueue(c *C) {
 	connection := OpenConnection("push", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	queue1 := connection.OpenQueue("queue1").(*redisQueue)
@@ -393,6 +4410,7 @@ func (suite *QueueSuite) TestPushQueue(c *C) {
 func (suite *QueueSuite) TestConsuming(c *C) {
 	connection := OpenConnection("consume", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	queue := connection.OpenQueue("consume-q").(*redisQueue)
+	queue.PurgeReady()
 
 	c.Check(queue.StopConsuming(), Equals, false)
 
@@ -404,6 +4422,7 @@ func (suite *QueueSuite) TestConsuming(c *C) {
 func (suite *QueueSuite) TestStopConsuming(c *C) {
 	connection := OpenConnection("consume", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	queue := connection.OpenQueue("consume-q").(*redisQueue)
+	queue.PurgeReady()
 
 	c.Check(queue.StopConsuming(), Equals, false)
 
@@ -428,11 +4447,17 @@ func (suite *QueueSuite) TestStopConsuming(c *C) {
 	c.Check(queue.StopConsuming(), Equals, true)
 	c.Check(queue.ReadyCount(), Equals, 0)
 	c.Check(queue.UnackedCount(), Equals, 8)
+
+	// the buffered deliveries get returned after stopping
+	queue.WaitForConsuming()
+	queue.fetcherWaitGroup.Wait()
+	queue.PurgeReady()
 }
 
 func (suite *QueueSuite) TestWaitForConsuming(c *C) {
 	connection := OpenConnection("consume", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
 	queue := connection.OpenQueue("consume-q").(*redisQueue)
+	queue.PurgeReady()
 
 	c.Check(queue.StopConsuming(), Equals, false)
 
@@ -456,8 +4481,140 @@ func (suite *QueueSuite) TestWaitForConsuming(c *C) {
 	time.Sleep(25 * time.Millisecond)
 	c.Check(queue.StopConsuming(), Equals, true)
 	queue.WaitForConsuming()
+	c.Check(queue.ReadyCount(), Equals, 7) // buffered deliveries got returned
+	c.Check(queue.UnackedCount(), Equals, 0)
+}
+
+func (suite *QueueSuite) TestStopConsumingReturnsBuffered(c *C) {
+	connection := OpenConnection("consume", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("consume-buffered-q").(*redisQueue)
+	queue.PurgeReady()
+
+	for i := 0; i < 10; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("buffered-d%d", i)), Equals, true)
+	}
+	queue.StartConsuming(6, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 4)
+	c.Check(queue.UnackedCount(), Equals, 6)
+
+	c.Check(queue.StopConsuming(), Equals, true)
+	queue.WaitForConsuming()
+	c.Check(queue.ReadyCount(), Equals, 10)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	queue = connection.OpenQueue("consume-buffered-q").(*redisQueue)
+	consumer := NewTestConsumer("buffered-cons")
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("buffered-cons", consumer)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(consumer.LastDeliveries, HasLen, 10)
+	for i, delivery := range consumer.LastDeliveries {
+		c.Check(delivery.Payload(), Equals, fmt.Sprintf("buffered-d%d", i)) // order kept
+	}
+
+	queue.StopConsuming()
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestPauseResume(c *C) {
+	connection := OpenConnection("pause", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("pause-q").(*redisQueue)
+	queue.PurgeReady()
+	queue.PurgeDelayed()
+
+	c.Check(queue.Pause(), Equals, false) // not consuming
+	queue.StartConsuming(10, time.Millisecond)
+	consumer := NewTestConsumer("pause-cons")
+	consumerName := queue.AddConsumer("pause-cons", consumer)
+
+	c.Check(queue.IsPaused(), Equals, false)
+	c.Check(queue.Pause(), Equals, true)
+	c.Check(queue.Pause(), Equals, false)
+	c.Check(queue.IsPaused(), Equals, true)
+	time.Sleep(5 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("pause-d%d", i)), Equals, true)
+	}
+	c.Check(queue.PublishToDelayedQueue("pause-d5", time.Millisecond), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.ReadyCount(), Equals, 5)
+	c.Check(queue.DelayedCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(consumer.LastDeliveries, HasLen, 0)
+	c.Check(queue.GetConsumers(), DeepEquals, []string{consumerName})
+
+	c.Check(queue.Resume(), Equals, true)
+	c.Check(queue.Resume(), Equals, false)
+	c.Check(queue.IsPaused(), Equals, false)
+	time.Sleep(10 * time.Millisecond)
 	c.Check(queue.ReadyCount(), Equals, 0)
-	c.Check(queue.UnackedCount(), Equals, 7)
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(consumer.LastDeliveries, HasLen, 6)
+
+	queue.StopConsuming()
+	queue.RemoveConsumer(consumerName)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestStopConsumingAndDrain(c *C) {
+	connection := OpenConnection("drain", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("drain-q").(*redisQueue)
+	queue.PurgeReady()
+
+	c.Check(queue.StopConsumingAndDrain(time.Second), NotNil) // not consuming
+
+	for i := 0; i < 20; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("drain-d%d", i)), Equals, true)
+	}
+	queue.StartConsuming(5, 10*time.Millisecond)
+	consumer := NewTestConsumer("drain-cons")
+	consumer.SleepDuration = 5 * time.Millisecond
+	queue.AddConsumer("drain-cons", consumer)
+	time.Sleep(12 * time.Millisecond)
+
+	c.Check(queue.StopConsumingAndDrain(time.Second), IsNil)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.ReadyCount()+len(consumer.LastDeliveries), Equals, 20) // nothing dropped
+	c.Check(queue.StopConsumingAndDrain(time.Second), NotNil)            // already stopped
+
+	queue = connection.OpenQueue("drain-q").(*redisQueue)
+	queue.PurgeReady()
+	for i := 0; i < 20; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("drain-d%d", i)), Equals, true)
+	}
+	queue.StartConsuming(5, time.Millisecond)
+	consumer = NewTestConsumer("drain-stuck")
+	consumer.AutoAck = false
+	consumer.AutoFinish = false
+	queue.AddConsumer("drain-stuck", consumer)
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.UnackedCount(), Equals, 6)
+
+	c.Check(queue.StopConsumingAndDrain(10*time.Millisecond), NotNil)
+	c.Check(queue.UnackedCount(), Equals, 1) // the one stuck consuming
+	c.Check(queue.ReadyCount(), Equals, 19)
+
+	consumer.Finish()
+	c.Check(queue.WaitForConsumingWithTimeout(time.Second), Equals, true)
+	c.Check(consumer.LastDeliveries, HasLen, 1) // stopped consumers don't take returned deliveries
+	c.Check(queue.ReadyCount(), Equals, 19)
+	connection.StopHeartbeat()
+}
+
+func (suite *QueueSuite) TestReturnBufferedOtherDeliveries(c *C) {
+	connection := OpenConnection("return-other-conn", "tcp", fmt.Sprintf("%s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT")), 1)
+	queue := connection.OpenQueue("return-other-q").(*redisQueue)
+	queue.PurgeReady()
+
+	// deliveries not backed by redis can't be returned, but don't panic
+	deliveryChan := make(chan Delivery, 1)
+	deliveryChan <- NewTestDelivery("return-other-d1")
+	close(deliveryChan)
+	c.Check(queue.returnBuffered(deliveryChan), Equals, 0)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	connection.StopHeartbeat()
 }
 
 func (suite *QueueSuite) BenchmarkQueue(c *C) {
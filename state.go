@@ -10,4 +10,6 @@ const (
 	Delayed
 	Rejected
 	Pushed
+	Requeued
+	Inspected // taken out of rejected by RejectedDeliveries
 )
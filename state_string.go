@@ -4,9 +4,9 @@ package rmq
 
 import "strconv"
 
-const _State_name = "UnackedAckedDelayedRejectedPushed"
+const _State_name = "UnackedAckedDelayedRejectedPushedRequeuedInspected"
 
-var _State_index = [...]uint8{0, 7, 12, 19, 27, 33}
+var _State_index = [...]uint8{0, 7, 12, 19, 27, 33, 41, 50}
 
 func (i State) String() string {
 	if i < 0 || i >= State(len(_State_index)-1) {
@@ -24,6 +24,7 @@ type ConnectionStats map[string]ConnectionStat
 type QueueStat struct {
 	ReadyCount      int `json:"ready"`
 	RejectedCount   int `json:"rejected"`
+	DelayedCount    int `json:"delayed"`
 	connectionStats ConnectionStats
 }
 
@@ -81,7 +82,9 @@ func CollectStats(queueList []string, mainConnection *redisConnection) Stats {
 	stats := NewStats()
 	for _, queueName := range queueList {
 		queue := mainConnection.openQueue(queueName)
-		stats.QueueStats[queueName] = NewQueueStat(queue.ReadyCount(), queue.RejectedCount())
+		queueStat := NewQueueStat(queue.ReadyCount(), queue.RejectedCount())
+		queueStat.DelayedCount = queue.DelayedCount()
+		stats.QueueStats[queueName] = queueStat
 	}
 
 	connectionNames := mainConnection.GetConnections()
@@ -33,6 +33,7 @@ func (suite *StatsSuite) TestStats(c *C) {
 	q2.Publish("stats-d2")
 	q2.Publish("stats-d3")
 	q2.Publish("stats-d4")
+	q2.PublishToDelayedQueue("stats-d5", time.Hour)
 	time.Sleep(10 * time.Millisecond)
 	consumer.LastDeliveries[0].Ack()
 	consumer.LastDeliveries[1].Reject()
@@ -45,6 +46,7 @@ func (suite *StatsSuite) TestStats(c *C) {
 	c.Check(html, Matches, ".*queue.*ready.*connection.*unacked.*consumers.*q2.*0.*1.*1.*2.*conn2.*1.*2.*")
 
 	stats = CollectStats([]string{"stats-q1", "stats-q2"}, connection)
+	c.Check(stats.QueueStats["stats-q2"].DelayedCount, Equals, 1)
 
 	for key, _ := range stats.QueueStats {
 		c.Check(key, Matches, "stats.*")
@@ -61,6 +63,7 @@ func (suite *StatsSuite) TestStats(c *C) {
 	*/
 
 	q2.StopConsuming()
+	q2.PurgeDelayed()
 	connection.StopHeartbeat()
 	conn1.StopHeartbeat()
 	conn2.StopHeartbeat()
@@ -1,6 +1,11 @@
 package rmq
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
 
 type TestConnection struct {
 	queues map[string]*TestQueue
@@ -22,6 +27,11 @@ func (connection TestConnection) OpenQueue(name string) Queue {
 	return queue
 }
 
+// OpenQueueE is similar to OpenQueue, test queues can always be opened
+func (connection TestConnection) OpenQueueE(name string) (Queue, error) {
+	return connection.OpenQueue(name), nil
+}
+
 func (connection TestConnection) CollectStats(queueList []string) Stats {
 	return Stats{}
 }
@@ -53,3 +63,67 @@ func (connection TestConnection) Reset() {
 func (connection TestConnection) GetOpenQueues() []string {
 	return []string{}
 }
+
+func (connection TestConnection) SetConsumerTagGenerator(generator func(tag string) string) {
+}
+
+func (connection TestConnection) SetConsumerTokenLength(length int) {
+}
+
+func (connection TestConnection) SetLogger(logger Logger) {
+}
+
+func (connection TestConnection) SetDebug(debug bool) {
+}
+
+func (connection TestConnection) Ping() error {
+	return nil
+}
+
+func (connection TestConnection) RedisClient() redis.UniversalClient {
+	return nil
+}
+
+func (connection TestConnection) Healthy() bool {
+	return true
+}
+
+func (connection TestConnection) GetOpenQueuesE() ([]string, error) {
+	return []string{}, nil
+}
+
+func (connection TestConnection) GetConsumingQueuesE() ([]string, error) {
+	return []string{}, nil
+}
+
+func (connection TestConnection) FindOrphanedKeys() ([]string, error) {
+	return []string{}, nil
+}
+
+func (connection TestConnection) PruneOrphanedKeys() (int, error) {
+	return 0, nil
+}
+
+func (connection TestConnection) Counters() map[string]QueueCounters {
+	return map[string]QueueCounters{}
+}
+
+// StopAllConsuming stops consuming on all opened queues, their consumers
+// consume synchronously so the returned channel is closed already
+func (connection TestConnection) StopAllConsuming() <-chan struct{} {
+	for _, queue := range connection.queues {
+		queue.StopConsuming()
+	}
+	finishedChan := make(chan struct{})
+	close(finishedChan)
+	return finishedChan
+}
+
+func (connection TestConnection) Close() bool {
+	<-connection.StopAllConsuming()
+	return true
+}
+
+func (connection TestConnection) CloseWithTimeout(timeout time.Duration) bool {
+	return connection.Close()
+}
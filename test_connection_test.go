@@ -2,6 +2,7 @@ package rmq
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/adjust/gocheck"
 )
@@ -40,3 +41,12 @@ func (suite *ConnectionSuite) TestConnection(c *C) {
 	c.Check(connection.GetDelivery("things", 0), Equals, "blab")
 	c.Check(connection.GetDelivery("things", 1), Equals, "rmq.TestConnection: delivery not found: things[1]")
 }
+
+func (suite *ConnectionSuite) TestClose(c *C) {
+	connection := NewTestConnection()
+	queue := connection.OpenQueue("things")
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	<-connection.StopAllConsuming()
+	c.Check(queue.StopConsuming(), Equals, false) // stopped already
+	c.Check(connection.Close(), Equals, true)
+}
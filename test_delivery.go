@@ -1,13 +1,17 @@
 package rmq
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 )
 
 type TestDelivery struct {
-	State   State
-	payload string
+	State     State
+	payload   string
+	queue     *TestQueue // nil unless consumed from a test queue
+	fetchedAt time.Time
+	attempts  int // number of previous Retry calls
 }
 
 func NewTestDelivery(content interface{}) *TestDelivery {
@@ -25,7 +29,8 @@ func NewTestDelivery(content interface{}) *TestDelivery {
 
 func NewTestDeliveryString(payload string) *TestDelivery {
 	return &TestDelivery{
-		payload: payload,
+		payload:   payload,
+		fetchedAt: time.Now(),
 	}
 }
 
@@ -33,33 +38,144 @@ func (delivery *TestDelivery) Payload() string {
 	return delivery.payload
 }
 
+// Queue returns the name of the test queue the delivery was consumed from,
+// empty for deliveries created with NewTestDelivery
+func (delivery *TestDelivery) Queue() string {
+	if delivery.queue == nil {
+		return ""
+	}
+	return delivery.queue.name
+}
+
+func (delivery *TestDelivery) Context() context.Context {
+	return context.Background()
+}
+
+func (delivery *TestDelivery) Expired() bool {
+	return false
+}
+
+// Age returns how long ago the delivery got created or consumed from a test
+// queue
+func (delivery *TestDelivery) Age() time.Duration {
+	return time.Since(delivery.fetchedAt)
+}
+
+// Message returns the payload without metadata
+func (delivery *TestDelivery) Message() Message {
+	return Message{Payload: delivery.payload}
+}
+
+// DeliveryCount returns 0 as unacked deliveries of test queues never return
+// to ready
+func (delivery *TestDelivery) DeliveryCount() int {
+	return 0
+}
+
+// Headers returns nil as test queues don't keep headers
+func (delivery *TestDelivery) Headers() map[string]string {
+	return nil
+}
+
 func (delivery *TestDelivery) Ack() bool {
 	if delivery.State == Unacked {
 		delivery.State = Acked
+		if delivery.queue != nil {
+			delivery.queue.ack(delivery.payload)
+		}
 		return true
 	}
 	return false
 }
 
+func (delivery *TestDelivery) AckE() error {
+	if !delivery.Ack() {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
 func (delivery *TestDelivery) Reject() bool {
 	if delivery.State == Unacked {
 		delivery.State = Rejected
+		if delivery.queue != nil {
+			delivery.queue.reject(delivery.payload)
+		}
 		return true
 	}
 	return false
 }
 
-func (delivery *TestDelivery) Delay(_ time.Duration) bool {
+func (delivery *TestDelivery) Delay(duration time.Duration) bool {
 	if delivery.State == Unacked {
 		delivery.State = Delayed
+		if delivery.queue != nil {
+			delivery.queue.delay(delivery.payload, duration)
+		}
 		return true
 	}
 	return false
 }
 
+func (delivery *TestDelivery) Requeue() bool {
+	if delivery.State == Unacked {
+		delivery.State = Requeued
+		if delivery.queue != nil {
+			delivery.queue.requeue(delivery.payload)
+		}
+		return true
+	}
+	return false
+}
+
+func (delivery *TestDelivery) RequeueFront() bool {
+	if delivery.State == Unacked {
+		delivery.State = Requeued
+		if delivery.queue != nil {
+			delivery.queue.requeueFront(delivery.payload)
+		}
+		return true
+	}
+	return false
+}
+
+// Retry delays the delivery like Delivery.Retry, by backoff doubled for each
+// previous attempt. Once it got retried more than maxAttempts times it gets
+// published to dlq instead, or rejected if dlq is nil
+func (delivery *TestDelivery) Retry(backoff time.Duration, maxAttempts int, dlq Queue) (State, error) {
+	if delivery.State != Unacked {
+		return delivery.State, nil
+	}
+
+	delivery.attempts++
+	switch {
+	case delivery.attempts <= maxAttempts:
+		delivery.State = Delayed
+		if delivery.queue != nil {
+			delivery.queue.retry(delivery.payload, delivery.attempts, retryBackoff(backoff, delivery.attempts))
+		}
+	case dlq == nil:
+		delivery.State = Rejected
+		if delivery.queue != nil {
+			delivery.queue.reject(delivery.payload)
+		}
+	default:
+		delivery.State = Pushed
+		if delivery.queue != nil {
+			delivery.queue.deadLetter(delivery.payload, dlq)
+		} else {
+			dlq.Publish(delivery.payload)
+		}
+	}
+	return delivery.State, nil
+}
+
 func (delivery *TestDelivery) Push() bool {
 	if delivery.State == Unacked {
 		delivery.State = Pushed
+		if delivery.queue != nil {
+			delivery.State = delivery.queue.push(delivery.payload)
+		}
 		return true
 	}
 	return false
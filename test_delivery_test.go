@@ -19,6 +19,14 @@ func (suite *DeliverySuite) TestDeliveryPayload(c *C) {
 	delivery = NewTestDelivery("p23")
 	c.Check(delivery.Ack(), Equals, true)
 	c.Check(delivery.Payload(), Equals, "p23")
+	c.Check(delivery.Queue(), Equals, "")
+}
+
+func (suite *DeliverySuite) TestDeliveryAge(c *C) {
+	delivery := NewTestDelivery("p")
+	age := delivery.Age()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(delivery.Age() >= age+10*time.Millisecond, Equals, true)
 }
 
 func (suite *DeliverySuite) TestDeliveryAck(c *C) {
@@ -53,3 +61,46 @@ func (suite *DeliverySuite) TestDeliveryDelay(c *C) {
 	c.Check(delivery.Reject(), Equals, false)
 	c.Check(delivery.State, Equals, Delayed)
 }
+
+func (suite *DeliverySuite) TestDeliveryRetry(c *C) {
+	delivery := NewTestDelivery("p")
+	state, err := delivery.Retry(time.Second, 1, nil)
+	c.Check(err, IsNil)
+	c.Check(state, Equals, Delayed)
+
+	delivery.State = Unacked // consumed again
+	state, err = delivery.Retry(time.Second, 1, nil)
+	c.Check(err, IsNil)
+	c.Check(state, Equals, Rejected)
+
+	deadLetterQueue := NewTestQueue("dead-q")
+	delivery = NewTestDelivery("p")
+	state, err = delivery.Retry(time.Second, 0, deadLetterQueue)
+	c.Check(err, IsNil)
+	c.Check(state, Equals, Pushed)
+	c.Check(deadLetterQueue.LastDeliveries, DeepEquals, []string{"p"})
+
+	state, err = delivery.Retry(time.Second, 0, deadLetterQueue)
+	c.Check(err, IsNil)
+	c.Check(state, Equals, Pushed) // unchanged
+	c.Check(deadLetterQueue.LastDeliveries, HasLen, 1)
+}
+
+func (suite *DeliverySuite) TestDeliveries(c *C) {
+	acked := NewTestDelivery("p1")
+	c.Check(acked.Ack(), Equals, true)
+	deliveries := Deliveries{NewTestDelivery("p2"), acked, NewTestDelivery("p3")}
+	failed, err := deliveries.Ack()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 1)
+	failed, err = deliveries.Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 3)
+
+	deliveries = Deliveries{NewTestDelivery("p4"), NewTestDelivery("p5")}
+	failed, err = deliveries.Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+	c.Check(deliveries[0].(*TestDelivery).State, Equals, Rejected)
+	c.Check(deliveries[1].(*TestDelivery).State, Equals, Rejected)
+}
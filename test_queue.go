@@ -1,14 +1,66 @@
 package rmq
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
 
+// TestQueue is an in memory queue to test producers and consumers without
+// redis. Consumers get the ready deliveries synchronously on Publish, on
+// AddConsumer and on Poll, one by one and in turns. Batch consumers get all
+// ready deliveries up to their batch size at once, without waiting for more
 type TestQueue struct {
 	name           string
-	LastDeliveries []string
+	LastDeliveries []string // all published payloads
+
+	lock      sync.Mutex
+	now       func() time.Time
+	ready     []string // in the order they get consumed
+	delayed   []testDelayed
+	rejected  []string // oldest first
+	unacked   int
+	attempts  map[string]int // by payload, of deliveries retried with Retry
+	counters  QueueCounters
+	pushQueue Queue
+	consuming bool
+	paused    bool
+	polling   bool // set while consumers consume, deliveries published meanwhile get consumed afterwards
+	consumers []testQueueConsumer
+	next      int           // index of the consumer to get the next delivery
+	drained   chan struct{} // nil unless returned by DrainedChan and not closed yet
+}
+
+type testDelayed struct {
+	payload string
+	at      time.Time
+}
+
+type testQueueConsumer struct {
+	name          string
+	consumer      Consumer
+	batchConsumer BatchConsumer   // used instead of consumer if set
+	batchSize     int             // of batch consumers
+	handle        *ConsumerHandle // nil unless added with AddConsumerWithHandle
+}
+
+// consume passes the deliveries to the consumer, which is a single one
+// unless it's a batch consumer
+func (consumer testQueueConsumer) consume(deliveries Deliveries) {
+	if consumer.batchConsumer != nil {
+		consumer.batchConsumer.Consume(deliveries)
+	} else {
+		consumer.consumer.Consume(deliveries[0])
+	}
+	for range deliveries {
+		consumer.handle.consumed()
+	}
 }
 
 func NewTestQueue(name string) *TestQueue {
-	queue := &TestQueue{name: name}
+	queue := &TestQueue{name: name, now: time.Now}
 	queue.Reset()
 	return queue
 }
@@ -17,62 +69,837 @@ func (queue *TestQueue) String() string {
 	return queue.name
 }
 
+// SetClock replaces the clock used to schedule delayed deliveries, call Poll
+// after advancing it to consume the deliveries which became due
+func (queue *TestQueue) SetClock(now func() time.Time) {
+	queue.lock.Lock()
+	queue.now = now
+	queue.lock.Unlock()
+}
+
 func (queue *TestQueue) Publish(payload string) bool {
+	queue.lock.Lock()
 	queue.LastDeliveries = append(queue.LastDeliveries, payload)
+	queue.ready = append(queue.ready, payload)
+	queue.counters.Published++
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return true
+}
+
+// PublishFront is similar to Publish, but the delivery gets consumed before
+// the ready ones
+func (queue *TestQueue) PublishFront(payload string) bool {
+	queue.lock.Lock()
+	queue.LastDeliveries = append(queue.LastDeliveries, payload)
+	queue.ready = append([]string{payload}, queue.ready...)
+	queue.counters.Published++
+	queue.lock.Unlock()
+
+	queue.Poll()
 	return true
 }
 
+func (queue *TestQueue) PublishWithPriority(payload string, priority int) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) PublishWithTTL(payload string, ttl time.Duration) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) PublishUnique(dedupKey, payload string, window time.Duration) (bool, error) {
+	return queue.Publish(payload), nil
+}
+
+func (queue *TestQueue) PublishBounded(payload string, maxReady int) (bool, error) {
+	if queue.ReadyCount() >= maxReady {
+		return false, nil
+	}
+	return queue.Publish(payload), nil
+}
+
+func (queue *TestQueue) PublishWithTrace(ctx context.Context, payload string) bool {
+	return queue.Publish(payload)
+}
+
+func (queue *TestQueue) PublishWithHeaders(payload string, headers map[string]string) bool {
+	return queue.Publish(payload)
+}
+
 func (queue *TestQueue) PublishToDelayedQueue(payload string, delayedTime time.Duration) bool {
-	return queue.Publish(string(payload))
+	queue.lock.Lock()
+	at := queue.now().Add(delayedTime)
+	queue.lock.Unlock()
+	return queue.PublishAt(payload, at)
+}
+
+func (queue *TestQueue) PublishAt(payload string, runAt time.Time) bool {
+	queue.lock.Lock()
+	queue.LastDeliveries = append(queue.LastDeliveries, payload)
+	queue.delayed = append(queue.delayed, testDelayed{payload: payload, at: runAt})
+	queue.counters.Published++
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return true
+}
+
+func (queue *TestQueue) PublishToDelayedQueueBatch(items []DelayedItem) (int, error) {
+	for _, item := range items {
+		queue.PublishToDelayedQueue(item.Payload, item.Delay)
+	}
+	return len(items), nil
+}
+
+func (queue *TestQueue) CancelDelayed(payload string) (bool, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i, delayed := range queue.delayed {
+		if delayed.payload == payload {
+			queue.delayed = append(queue.delayed[:i], queue.delayed[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (queue *TestQueue) RescheduleDelayed(payload string, newDelay time.Duration) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i, delayed := range queue.delayed {
+		if delayed.payload == payload {
+			queue.delayed[i].at = queue.now().Add(newDelay)
+			return true
+		}
+	}
+	return false
 }
 
 func (queue *TestQueue) SetPushQueue(pushQueue Queue) {
+	queue.lock.Lock()
+	queue.pushQueue = pushQueue
+	queue.lock.Unlock()
+}
+
+func (queue *TestQueue) SetPushQueueE(pushQueue Queue) error {
+	if pushQueue == Queue(queue) {
+		return fmt.Errorf("rmq queue %s can't push to itself", queue)
+	}
+	queue.SetPushQueue(pushQueue)
+	return nil
+}
+
+// SetPushQueueByName pushes to a new test queue with the given name, which
+// isn't shared with other test queues of that name
+func (queue *TestQueue) SetPushQueueByName(name string) error {
+	if name == "" {
+		return fmt.Errorf("rmq queue %s can't push to a queue without name", queue)
+	}
+	if name == queue.name {
+		return fmt.Errorf("rmq queue %s can't push to itself", queue)
+	}
+	queue.SetPushQueue(NewTestQueue(name))
+	return nil
+}
+
+func (queue *TestQueue) SetEnvelope(envelope Envelope) {
+}
+
+func (queue *TestQueue) SetMaxPushHops(maxHops int) {
+}
+
+func (queue *TestQueue) SetRecordRejectedBy(record bool) {
+}
+
+func (queue *TestQueue) SetMaxPriority(maxPriority int) {
+}
+
+func (queue *TestQueue) SetDeadLetterQueue(deadLetterQueue Queue, maxAttempts int) {
+}
+
+func (queue *TestQueue) SetDeadLetterQueueE(deadLetterQueue Queue, maxAttempts int) error {
+	return nil
+}
+
+func (queue *TestQueue) SetOnStateChange(onStateChange func(payload string, from, to State)) {
+}
+
+func (queue *TestQueue) SetOnProcessed(onProcessed func(payload string, to State, duration time.Duration)) {
+}
+
+func (queue *TestQueue) SetConsumePanicHandler(onPanic func(recovered interface{}, delivery Delivery)) {
+}
+
+func (queue *TestQueue) SetOnBackpressure(onBackpressure func(queueName string, bufferLen, prefetchLimit int)) {
+}
+
+func (queue *TestQueue) SetMaxRejected(maxRejected int, policy RejectedPolicy) {
+}
+
+func (queue *TestQueue) SetDelayedChunkSize(chunkSize int) {
+}
+
+func (queue *TestQueue) SetMaxDelayedWait(maxWait time.Duration) {
+}
+
+func (queue *TestQueue) SetServerClock(serverClock bool) {
+}
+
+func (queue *TestQueue) SetVisibilityTimeout(timeout time.Duration) {
+}
+
+func (queue *TestQueue) SetDefaultBatchTimeout(timeout time.Duration) {
+}
+
+func (queue *TestQueue) SetPurgeBatchSize(batchSize int) {
+}
+
+func (queue *TestQueue) SetDrainedSettle(settle time.Duration) {
+}
+
+// DrainedChan returns a channel which gets closed once there are no ready
+// and unacked deliveries, right away if there are none now. Test queues don't
+// wait for a settle duration
+func (queue *TestQueue) DrainedChan() <-chan struct{} {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.drained == nil {
+		queue.drained = make(chan struct{})
+	}
+	drained := queue.drained
+	queue.checkDrained()
+	return drained
+}
+
+// checkDrained closes the drained channel if there are no ready and unacked
+// deliveries, must be called locked
+func (queue *TestQueue) checkDrained() {
+	if queue.drained != nil && len(queue.ready) == 0 && queue.unacked == 0 {
+		close(queue.drained)
+		queue.drained = nil
+	}
+}
+
+func (queue *TestQueue) SetStrict(strict bool) {
+}
+
+func (queue *TestQueue) SetEphemeral(idle time.Duration) {
+}
+
+func (queue *TestQueue) SetTracer(tracer Tracer) {
 }
 
 func (queue *TestQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
-	return true
+	return queue.StartConsumingE(prefetchLimit, pollDuration) == nil
+}
+
+func (queue *TestQueue) StartConsumingE(prefetchLimit int, pollDuration time.Duration) error {
+	queue.lock.Lock()
+	if queue.consuming {
+		queue.lock.Unlock()
+		return ErrAlreadyConsuming
+	}
+	queue.consuming = true
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return nil
+}
+
+func (queue *TestQueue) StartConsumingWithBackoff(prefetchLimit int, pollDuration, maxPollDuration time.Duration) bool {
+	return queue.StartConsuming(prefetchLimit, pollDuration)
+}
+
+func (queue *TestQueue) StartConsumingBlocking(prefetchLimit int, blockTimeout time.Duration) bool {
+	return queue.StartConsuming(prefetchLimit, blockTimeout)
+}
+
+// StartConsumingWithOptions is similar to StartConsumingE, test queues don't
+// tell immediate and delayed deliveries apart once they are due
+func (queue *TestQueue) StartConsumingWithOptions(options StartConsumingOptions) error {
+	if !options.Immediate && !options.Delayed {
+		return ErrNothingToConsume
+	}
+	return queue.StartConsumingE(options.PrefetchLimit, options.PollDuration)
 }
 
 func (queue *TestQueue) StopConsuming() bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	stopped := queue.consuming
+	queue.consuming = false
+	return stopped
+}
+
+func (queue *TestQueue) StopConsumingAndDrain(timeout time.Duration) error {
+	if !queue.StopConsuming() {
+		return fmt.Errorf("rmq queue failed to stop consuming %s", queue)
+	}
+	return nil
+}
+
+func (queue *TestQueue) Pause() bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if !queue.consuming {
+		return false
+	}
+	queue.paused = true
 	return true
 }
 
+func (queue *TestQueue) Resume() bool {
+	queue.lock.Lock()
+	queue.paused = false
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return true
+}
+
+func (queue *TestQueue) IsPaused() bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.paused
+}
+
 func (queue *TestQueue) WaitForConsuming() {
 	return
 }
 
+func (queue *TestQueue) WaitForConsumingWithTimeout(timeout time.Duration) bool {
+	return true
+}
+
+// AddConsumer adds a consumer which gets its deliveries synchronously, see
+// TestQueue. Unlike on redis queues it can be called before StartConsuming
 func (queue *TestQueue) AddConsumer(tag string, consumer Consumer) string {
-	return ""
+	queue.lock.Lock()
+	name := fmt.Sprintf("%s-%d", tag, len(queue.consumers))
+	queue.consumers = append(queue.consumers, testQueueConsumer{name: name, consumer: consumer})
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return name
 }
 
+func (queue *TestQueue) AddConsumerE(tag string, consumer Consumer) (string, error) {
+	return queue.AddConsumer(tag, consumer), nil
+}
+
+func (queue *TestQueue) AddConsumerWithHandle(tag string, consumer Consumer) *ConsumerHandle {
+	queue.lock.Lock()
+	handle := newConsumerHandle(fmt.Sprintf("%s-%d", tag, len(queue.consumers)), queue)
+	queue.consumers = append(queue.consumers, testQueueConsumer{name: handle.name, consumer: consumer, handle: handle})
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return handle
+}
+
+// AddReadyConsumer is the same as AddConsumer, consumers of test queues
+// consume both ready and delayed deliveries
+func (queue *TestQueue) AddReadyConsumer(tag string, consumer Consumer) string {
+	return queue.AddConsumer(tag, consumer)
+}
+
+// AddDelayedConsumer is the same as AddConsumer, see AddReadyConsumer
+func (queue *TestQueue) AddDelayedConsumer(tag string, consumer Consumer) string {
+	return queue.AddConsumer(tag, consumer)
+}
+
+func (queue *TestQueue) AddConsumerWithPrefetch(tag string, prefetch int, consumer Consumer) string {
+	return queue.AddConsumer(tag, consumer)
+}
+
+func (queue *TestQueue) AddConsumerWithConcurrency(tag string, concurrency int, consumer Consumer) string {
+	return queue.AddConsumer(tag, consumer)
+}
+
+func (queue *TestQueue) AddConsumerWithWeight(tag string, weight int, consumer Consumer) string {
+	return queue.AddConsumer(tag, consumer)
+}
+
+// AddBatchConsumer adds a batch consumer which gets up to batchSize of the
+// ready deliveries synchronously, see TestQueue
 func (queue *TestQueue) AddBatchConsumer(tag string, batchSize int, consumer BatchConsumer) string {
-	return ""
+	name, _ := queue.AddBatchConsumerE(tag, batchSize, consumer)
+	return name
 }
 
+// AddBatchConsumerWithTimeout is the same as AddBatchConsumer, batches of test
+// queues don't wait for more deliveries
 func (queue *TestQueue) AddBatchConsumerWithTimeout(tag string, batchSize int, timeout time.Duration, consumer BatchConsumer) string {
-	return ""
+	return queue.AddBatchConsumer(tag, batchSize, consumer)
+}
+
+// AddBatchConsumerWithOptions is the same as AddBatchConsumer with maxSize as
+// batch size, batches of test queues don't wait for minSize deliveries
+func (queue *TestQueue) AddBatchConsumerWithOptions(tag string, minSize, maxSize int, timeout time.Duration, consumer BatchConsumer) string {
+	return queue.AddBatchConsumer(tag, maxSize, consumer)
+}
+
+func (queue *TestQueue) AddBatchConsumerE(tag string, batchSize int, consumer BatchConsumer) (string, error) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	queue.lock.Lock()
+	name := fmt.Sprintf("%s-%d", tag, len(queue.consumers))
+	queue.consumers = append(queue.consumers, testQueueConsumer{name: name, batchConsumer: consumer, batchSize: batchSize})
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return name, nil
+}
+
+// Fetch returns up to count ready deliveries, also the delayed ones which are
+// due, without passing them to consumers
+func (queue *TestQueue) Fetch(count int) ([]Delivery, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.moveDue()
+
+	deliveries := []Delivery{}
+	for len(deliveries) < count && len(queue.ready) > 0 {
+		deliveries = append(deliveries, queue.consumeReady())
+	}
+	return deliveries, nil
+}
+
+// consumeReady takes the next ready delivery, must be called locked with
+// ready deliveries
+func (queue *TestQueue) consumeReady() *TestDelivery {
+	payload := queue.ready[0]
+	queue.ready = queue.ready[1:]
+	queue.unacked++
+	queue.counters.Consumed++
+	return &TestDelivery{payload: payload, queue: queue, fetchedAt: time.Now(), attempts: queue.attempts[payload]}
+}
+
+func (queue *TestQueue) ConsumeN(n int, timeout time.Duration, consumer Consumer) (int, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	timedOut := func() bool { return !deadline.IsZero() && !time.Now().Before(deadline) }
+
+	consumed := 0
+	for consumed < n && !timedOut() {
+		deliveries, _ := queue.Fetch(1)
+		if len(deliveries) == 0 {
+			if queue.UnackedCount() == 0 {
+				return consumed, nil
+			}
+			time.Sleep(time.Millisecond) // until a delivery gets returned
+			continue
+		}
+		consumer.Consume(deliveries[0])
+		consumed++
+	}
+	return consumed, nil
+}
+
+// Poll makes delayed deliveries which are due ready and passes all ready
+// deliveries to the consumers if consuming. Returns the number of consumed
+// deliveries
+func (queue *TestQueue) Poll() int {
+	queue.lock.Lock()
+	if queue.polling {
+		queue.lock.Unlock()
+		return 0 // called by a consumer, the outer poll consumes the rest
+	}
+	queue.polling = true
+	queue.lock.Unlock()
+	defer func() {
+		queue.lock.Lock()
+		queue.polling = false
+		queue.lock.Unlock()
+	}()
+
+	consumed := 0
+	for {
+		consumer, deliveries := queue.nextDeliveries()
+		if len(deliveries) == 0 {
+			return consumed
+		}
+		consumer.consume(deliveries)
+		consumed += len(deliveries)
+	}
+}
+
+// nextDeliveries takes the deliveries the next consumer gets, none if the
+// queue isn't consuming or there are no consumers or ready deliveries
+func (queue *TestQueue) nextDeliveries() (testQueueConsumer, Deliveries) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.moveDue()
+	if !queue.consuming || queue.paused || len(queue.consumers) == 0 || len(queue.ready) == 0 {
+		return testQueueConsumer{}, nil
+	}
+
+	consumer := queue.consumers[queue.next%len(queue.consumers)]
+	queue.next++
+	deliveries := Deliveries{queue.consumeReady()}
+	for len(deliveries) < consumer.batchSize && len(queue.ready) > 0 {
+		deliveries = append(deliveries, queue.consumeReady())
+	}
+	return consumer, deliveries
+}
+
+// moveDue moves the due delayed deliveries to ready, must be called locked
+func (queue *TestQueue) moveDue() {
+	now := queue.now()
+	delayed := queue.delayed[:0]
+	for _, delivery := range queue.delayed {
+		if delivery.at.After(now) {
+			delayed = append(delayed, delivery)
+		} else {
+			queue.ready = append(queue.ready, delivery.payload)
+		}
+	}
+	queue.delayed = delayed
+}
+
+// settle is called by deliveries which left unacked, must be called locked
+func (queue *TestQueue) settle(counter *int64) {
+	queue.unacked--
+	*counter++
+	queue.checkDrained()
+}
+
+func (queue *TestQueue) ack(payload string) {
+	queue.lock.Lock()
+	queue.settle(&queue.counters.Acked)
+	delete(queue.attempts, payload)
+	queue.lock.Unlock()
+}
+
+func (queue *TestQueue) reject(payload string) {
+	queue.lock.Lock()
+	queue.settle(&queue.counters.Rejected)
+	queue.rejected = append(queue.rejected, payload)
+	queue.lock.Unlock()
+}
+
+// retry delays the payload like delay and keeps its number of attempts for
+// the next delivery
+func (queue *TestQueue) retry(payload string, attempts int, duration time.Duration) {
+	queue.lock.Lock()
+	if queue.attempts == nil {
+		queue.attempts = map[string]int{}
+	}
+	queue.attempts[payload] = attempts
+	queue.lock.Unlock()
+
+	queue.delay(payload, duration)
+}
+
+// deadLetter publishes the payload to the dead letter queue dlq
+func (queue *TestQueue) deadLetter(payload string, dlq Queue) {
+	queue.lock.Lock()
+	queue.settle(&queue.counters.Pushed)
+	delete(queue.attempts, payload)
+	queue.lock.Unlock()
+
+	dlq.Publish(payload)
+}
+
+func (queue *TestQueue) delay(payload string, duration time.Duration) {
+	queue.lock.Lock()
+	queue.settle(&queue.counters.Delayed)
+	queue.delayed = append(queue.delayed, testDelayed{payload: payload, at: queue.now().Add(duration)})
+	queue.lock.Unlock()
+}
+
+func (queue *TestQueue) requeue(payload string) {
+	queue.lock.Lock()
+	queue.settle(&queue.counters.Requeued)
+	queue.ready = append(queue.ready, payload)
+	queue.lock.Unlock()
+}
+
+func (queue *TestQueue) requeueFront(payload string) {
+	queue.lock.Lock()
+	queue.settle(&queue.counters.Requeued)
+	queue.ready = append([]string{payload}, queue.ready...)
+	queue.lock.Unlock()
+}
+
+// push publishes the payload to the push queue, or rejects it if there's none
+func (queue *TestQueue) push(payload string) State {
+	queue.lock.Lock()
+	pushQueue := queue.pushQueue
+	if pushQueue == nil {
+		queue.lock.Unlock()
+		queue.reject(payload)
+		return Rejected
+	}
+	queue.settle(&queue.counters.Pushed)
+	queue.lock.Unlock()
+
+	pushQueue.Publish(payload)
+	return Pushed
 }
 
 func (queue *TestQueue) ReturnRejected(count int) int {
-	return 0
+	queue.lock.Lock()
+	if count > len(queue.rejected) {
+		count = len(queue.rejected)
+	}
+	if count < 0 {
+		count = 0
+	}
+	queue.ready = append(queue.ready, queue.rejected[:count]...)
+	queue.rejected = queue.rejected[count:]
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return count
+}
+
+// RejectedDeliveries takes up to count of the oldest rejected deliveries out
+// of the rejected list, they count as unacked until acked or moved
+func (queue *TestQueue) RejectedDeliveries(count int) ([]Delivery, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	deliveries := []Delivery{}
+	for len(deliveries) < count && len(queue.rejected) > 0 {
+		deliveries = append(deliveries, &TestDelivery{payload: queue.rejected[0], queue: queue, fetchedAt: time.Now(), attempts: queue.attempts[queue.rejected[0]]})
+		queue.rejected = queue.rejected[1:]
+		queue.unacked++
+	}
+	return deliveries, nil
+}
+
+func (queue *TestQueue) ReturnRejectedMatching(pred func(payload string) bool, max int) (int, error) {
+	queue.lock.Lock()
+	returned := 0
+	rejected := []string{}
+	for _, payload := range queue.rejected {
+		if returned < max && pred(payload) {
+			queue.ready = append(queue.ready, payload)
+			returned++
+		} else {
+			rejected = append(rejected, payload)
+		}
+	}
+	queue.rejected = rejected
+	queue.lock.Unlock()
+
+	queue.Poll()
+	return returned, nil
+}
+
+// ReturnRejectedOrdered is similar to ReturnRejected, test queues don't keep
+// publish times so deliveries keep the order they were rejected in
+func (queue *TestQueue) ReturnRejectedOrdered(count int) (int, error) {
+	return queue.ReturnRejected(count), nil
+}
+
+func (queue *TestQueue) ReturnRejectedWithRate(ctx context.Context, count int, perSecond int) int {
+	return queue.ReturnRejected(count)
 }
 
 func (queue *TestQueue) ReturnAllRejected() int {
+	return queue.ReturnRejected(queue.RejectedCount())
+}
+
+// ReturnAllUnacked returns 0 as unacked deliveries of test queues are always
+// held by consumers
+func (queue *TestQueue) ReturnAllUnacked() int {
 	return 0
 }
 
-func (queue *TestQueue) PurgeReady() int {
+// ReturnUnacked returns 0 like ReturnAllUnacked
+func (queue *TestQueue) ReturnUnacked(count int) int {
 	return 0
 }
 
+func (queue *TestQueue) RecoverUnacked() (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) RecoverUnackedOrdered() (int, error) {
+	return 0, nil
+}
+
+func (queue *TestQueue) GetConsumers() []string {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	names := []string{}
+	for _, consumer := range queue.consumers {
+		names = append(names, consumer.name)
+	}
+	return names
+}
+
+func (queue *TestQueue) RemoveConsumer(name string) bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i, consumer := range queue.consumers {
+		if consumer.name == name {
+			queue.consumers = append(queue.consumers[:i:i], queue.consumers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (queue *TestQueue) LocalConsumerCount() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.consumers)
+}
+
+func (queue *TestQueue) RemoveAllConsumers() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	removed := len(queue.consumers)
+	queue.consumers = nil
+	return removed
+}
+
+func (queue *TestQueue) Counters() QueueCounters {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.counters
+}
+
+// ReadyCount returns the number of ready deliveries which didn't get consumed
+// yet, unlike len(LastDeliveries) which counts all published deliveries
+func (queue *TestQueue) ReadyCount() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.ready)
+}
+
+func (queue *TestQueue) RejectedCount() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.rejected)
+}
+
+func (queue *TestQueue) UnackedCount() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.unacked
+}
+
+func (queue *TestQueue) DelayedCount() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.delayed)
+}
+
+func (queue *TestQueue) TotalCount(includeRejected bool) int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	total := len(queue.ready) + queue.unacked + len(queue.delayed)
+	if includeRejected {
+		total += len(queue.rejected)
+	}
+	return total
+}
+
+func (queue *TestQueue) TotalCountE(includeRejected bool) (int, error) {
+	return queue.TotalCount(includeRejected), nil
+}
+
+func (queue *TestQueue) PurgeReady() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	purged := len(queue.ready)
+	queue.ready = nil
+	return purged
+}
+
 func (queue *TestQueue) PurgeRejected() int {
-	return 0
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	purged := len(queue.rejected)
+	queue.rejected = nil
+	return purged
+}
+
+func (queue *TestQueue) PurgeDelayed() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	purged := len(queue.delayed)
+	queue.delayed = nil
+	return purged
+}
+
+// PeekReady returns up to count of the ready deliveries which didn't get
+// consumed yet in the order they get consumed, unlike LastDeliveries which
+// keeps all published payloads
+func (queue *TestQueue) PeekReady(count int) ([]string, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return peekSlice(queue.ready, count), nil
+}
+
+func (queue *TestQueue) PeekRejected(count int) ([]string, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return peekSlice(queue.rejected, count), nil
+}
+
+func (queue *TestQueue) PeekRejectedDeliveries(count int) ([]RejectedDelivery, error) {
+	payloads, _ := queue.PeekRejected(count)
+	deliveries := make([]RejectedDelivery, len(payloads))
+	for i, payload := range payloads {
+		deliveries[i] = RejectedDelivery{Payload: payload, message: Message{Payload: payload}}
+	}
+	return deliveries, nil
+}
+
+func (queue *TestQueue) PeekDelayed(count int) ([]DelayedDelivery, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	deliveries := make([]DelayedDelivery, len(queue.delayed))
+	for i, delayed := range queue.delayed {
+		deliveries[i] = DelayedDelivery{Payload: delayed.payload, RunAt: delayed.at}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool { return deliveries[i].RunAt.Before(deliveries[j].RunAt) })
+
+	if count > len(deliveries) {
+		count = len(deliveries)
+	}
+	if count < 0 {
+		count = 0
+	}
+	return deliveries[:count], nil
+}
+
+// peekSlice returns a copy of the first count payloads
+func peekSlice(payloads []string, count int) []string {
+	if count > len(payloads) {
+		count = len(payloads)
+	}
+	if count < 0 {
+		count = 0
+	}
+	return append([]string{}, payloads[:count]...)
 }
 
 func (queue *TestQueue) Close() bool {
 	return false
 }
 
+// Reset drops all deliveries and counters, consumers stay
 func (queue *TestQueue) Reset() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
 	queue.LastDeliveries = []string{}
+	queue.ready = nil
+	queue.delayed = nil
+	queue.rejected = nil
+	queue.unacked = 0
+	queue.attempts = nil
+	queue.counters = QueueCounters{}
 }
@@ -0,0 +1,453 @@
+package rmq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/adjust/gocheck"
+)
+
+func TestMemoryQueueSuite(t *testing.T) {
+	TestingSuiteT(&MemoryQueueSuite{}, t)
+}
+
+type MemoryQueueSuite struct{}
+
+func (suite *MemoryQueueSuite) TestSemantics(c *C) {
+	queue := NewTestQueue("memory-q")
+	checkQueueSemantics(c, queue, func() {
+		time.Sleep(5 * time.Millisecond) // for the delay to pass
+		queue.Poll()
+	})
+}
+
+func (suite *MemoryQueueSuite) TestClock(c *C) {
+	now := time.Unix(1000, 0)
+	queue := NewTestQueue("memory-clock-q")
+	queue.SetClock(func() time.Time { return now })
+	consumer := NewTestConsumer("memory-clock-cons")
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	queue.AddConsumer("memory-clock-cons", consumer)
+
+	c.Check(queue.PublishToDelayedQueue("memory-d1", time.Hour), Equals, true)
+	c.Check(queue.PublishAt("memory-d2", now.Add(time.Minute)), Equals, true)
+	c.Check(queue.DelayedCount(), Equals, 2)
+	c.Check(queue.Poll(), Equals, 0)
+
+	now = now.Add(time.Minute)
+	c.Check(queue.Poll(), Equals, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "memory-d2")
+	now = now.Add(time.Hour)
+	c.Check(queue.Poll(), Equals, 1)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "memory-d1")
+	c.Check(queue.DelayedCount(), Equals, 0)
+}
+
+func (suite *MemoryQueueSuite) TestConsumers(c *C) {
+	queue := NewTestQueue("memory-cons-q")
+	pushQueue := NewTestQueue("memory-push-q")
+	queue.SetPushQueue(pushQueue)
+	first, second := NewTestConsumer("first"), NewTestConsumer("second")
+	c.Check(queue.AddConsumer("first", first), Equals, "first-0")
+	c.Check(queue.AddConsumer("second", second), Equals, "second-1")
+	c.Check(queue.Publish("memory-d1"), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 1) // not consuming yet
+
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	c.Check(queue.Publish("memory-d2"), Equals, true)
+	c.Check(first.LastDeliveries, HasLen, 1) // in turns
+	c.Check(first.LastDelivery.Queue(), Equals, "memory-cons-q")
+	c.Check(second.LastDeliveries, HasLen, 1)
+
+	second.AutoAck = false
+	queue.Publish("memory-d3")
+	queue.Publish("memory-d4")
+	c.Check(second.LastDelivery.Push(), Equals, true)
+	c.Check(pushQueue.LastDeliveries, DeepEquals, []string{"memory-d4"})
+	c.Check(queue.Counters(), Equals, QueueCounters{Published: 4, Consumed: 4, Acked: 3, Pushed: 1})
+
+	c.Check(queue.Pause(), Equals, true)
+	queue.Publish("memory-d5")
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.Resume(), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.GetConsumers(), DeepEquals, []string{"first-0", "second-1"})
+	c.Check(queue.RemoveConsumer("first-0"), Equals, true)
+	c.Check(queue.RemoveAllConsumers(), Equals, 1)
+}
+
+// checkQueueSemantics runs the same scenario against redis and test queues to
+// keep them in line, poll waits until the queue passed on ready deliveries
+func checkQueueSemantics(c *C, queue Queue, poll func()) {
+	queue.PurgeReady()
+	queue.PurgeRejected()
+	queue.PurgeDelayed()
+
+	consumer := NewTestConsumer("semantics-cons")
+	consumer.AutoAck = false
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, true)
+	c.Check(queue.StartConsuming(10, time.Millisecond), Equals, false)
+	queue.AddConsumer("semantics-cons", consumer)
+
+	for _, payload := range []string{"semantics-d1", "semantics-d2", "semantics-d3"} {
+		c.Check(queue.Publish(payload), Equals, true)
+	}
+	poll()
+	c.Assert(consumer.LastDeliveries, HasLen, 3)
+	c.Check(consumer.LastDeliveries[0].Payload(), Equals, "semantics-d1")
+	c.Check(consumer.LastDeliveries[1].Payload(), Equals, "semantics-d2")
+	c.Check(consumer.LastDeliveries[2].Payload(), Equals, "semantics-d3")
+	c.Check(queue.ReadyCount(), Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 3)
+
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, true)
+	c.Check(consumer.LastDeliveries[0].Ack(), Equals, false)
+	c.Check(consumer.LastDeliveries[1].Reject(), Equals, true)
+	c.Check(consumer.LastDeliveries[2].Push(), Equals, true) // no push queue, rejects
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 2)
+	rejected, err := queue.PeekRejected(1)
+	c.Check(err, IsNil)
+	c.Check(rejected, DeepEquals, []string{"semantics-d2"}) // oldest first
+
+	c.Check(queue.ReturnRejected(1), Equals, 1)
+	poll()
+	c.Assert(consumer.LastDeliveries, HasLen, 4)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "semantics-d2")
+	c.Check(consumer.LastDelivery.Delay(time.Millisecond), Equals, true)
+	poll()
+	c.Assert(consumer.LastDeliveries, HasLen, 5)
+	c.Check(consumer.LastDelivery.Payload(), Equals, "semantics-d2")
+	c.Check(consumer.LastDelivery.Ack(), Equals, true)
+	c.Check(queue.DelayedCount(), Equals, 0)
+	c.Check(withoutDelayLag(queue.Counters()), Equals, QueueCounters{Published: 3, Consumed: 5, Acked: 2, Rejected: 2, Delayed: 1})
+
+	c.Check(queue.StopConsuming(), Equals, true)
+	c.Check(queue.Publish("semantics-d4"), Equals, true)
+	poll()
+	c.Check(consumer.LastDeliveries, HasLen, 5)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.PurgeReady(), Equals, 1)
+	c.Check(queue.PurgeRejected(), Equals, 1)
+}
+
+func (suite *MemoryQueueSuite) TestConsumerHandle(c *C) {
+	queue := NewTestQueue("memory-handle-q")
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	handle := queue.AddConsumerWithHandle("memory-handle-cons", NewTestConsumer("memory-handle-cons"))
+	c.Check(handle.Name(), Equals, "memory-handle-cons-0")
+
+	c.Check(queue.Publish("memory-d1"), Equals, true)
+	c.Check(queue.Publish("memory-d2"), Equals, true)
+	c.Check(handle.Deliveries(), Equals, int64(2))
+
+	c.Check(handle.Remove(), Equals, true)
+	c.Check(queue.Publish("memory-d3"), Equals, true)
+	c.Check(handle.Deliveries(), Equals, int64(2))
+	c.Check(queue.ReadyCount(), Equals, 1)
+}
+
+// funcBatchConsumer consumes batches with a function
+type funcBatchConsumer func(batch Deliveries)
+
+func (consumer funcBatchConsumer) Consume(batch Deliveries) {
+	consumer(batch)
+}
+
+func (suite *MemoryQueueSuite) TestBatchConsumer(c *C) {
+	queue := NewTestQueue("memory-batch-q")
+	for i := 0; i < 5; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("memory-d%d", i)), Equals, true)
+	}
+
+	batches := [][]string{}
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	name := queue.AddBatchConsumer("memory-batch-cons", 2, funcBatchConsumer(func(batch Deliveries) {
+		payloads := []string{}
+		for _, delivery := range batch {
+			payloads = append(payloads, delivery.Payload())
+		}
+		batches = append(batches, payloads)
+		failed, err := batch.Ack()
+		c.Check(err, IsNil)
+		c.Check(failed, Equals, 0)
+	}))
+	c.Check(name, Equals, "memory-batch-cons-0")
+	c.Check(batches, DeepEquals, [][]string{{"memory-d0", "memory-d1"}, {"memory-d2", "memory-d3"}, {"memory-d4"}})
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.Counters().Acked, Equals, int64(5))
+}
+
+func (suite *MemoryQueueSuite) TestBatchConsumerWithOptions(c *C) {
+	queue := NewTestQueue("memory-batch-options-q")
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("memory-d%d", i)), Equals, true)
+	}
+
+	// batches don't wait for minSize
+	batches := [][]string{}
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	queue.AddBatchConsumerWithOptions("memory-batch-options-cons", 2, 2, time.Hour, funcBatchConsumer(func(batch Deliveries) {
+		payloads := []string{}
+		for _, delivery := range batch {
+			payloads = append(payloads, delivery.Payload())
+		}
+		batches = append(batches, payloads)
+		batch.Ack()
+	}))
+	c.Check(batches, DeepEquals, [][]string{{"memory-d0", "memory-d1"}, {"memory-d2"}})
+
+	c.Check(queue.Publish("memory-d3"), Equals, true)
+	c.Check(batches, DeepEquals, [][]string{{"memory-d0", "memory-d1"}, {"memory-d2"}, {"memory-d3"}})
+	c.Check(queue.UnackedCount(), Equals, 0)
+}
+
+func (suite *MemoryQueueSuite) TestConsumerPanic(c *C) {
+	queue := NewTestQueue("memory-panic-q")
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	queue.AddConsumer("memory-panic-cons", NewCustomTestConsumer(func(delivery Delivery) {
+		panic("consumer failed")
+	}))
+	c.Check(func() { queue.Publish("memory-d1") }, PanicMatches, "consumer failed")
+
+	// the queue is still usable
+	c.Check(queue.RemoveAllConsumers(), Equals, 1)
+	c.Check(queue.Publish("memory-d2"), Equals, true)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 1)
+}
+
+func (suite *MemoryQueueSuite) TestRetry(c *C) {
+	now := time.Unix(1000, 0)
+	queue := NewTestQueue("memory-retry-q")
+	deadLetterQueue := NewTestQueue("memory-retry-dead-q")
+	queue.SetClock(func() time.Time { return now })
+	c.Check(queue.Publish("memory-d1"), Equals, true)
+
+	for _, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		deliveries, _ := queue.Fetch(1)
+		c.Assert(deliveries, HasLen, 1)
+		state, err := deliveries[0].Retry(time.Minute, 2, deadLetterQueue)
+		c.Check(err, IsNil)
+		c.Check(state, Equals, Delayed)
+		delayed, _ := queue.PeekDelayed(1)
+		c.Check(delayed, DeepEquals, []DelayedDelivery{{Payload: "memory-d1", RunAt: now.Add(backoff)}})
+		now = now.Add(backoff)
+	}
+
+	deliveries, _ := queue.Fetch(1)
+	c.Assert(deliveries, HasLen, 1)
+	state, err := deliveries[0].Retry(time.Minute, 2, deadLetterQueue)
+	c.Check(err, IsNil)
+	c.Check(state, Equals, Pushed)
+	c.Check(queue.TotalCount(true), Equals, 0)
+	c.Check(queue.Counters().Delayed, Equals, int64(2))
+	c.Check(deadLetterQueue.LastDeliveries, DeepEquals, []string{"memory-d1"})
+}
+
+func (suite *MemoryQueueSuite) TestFetch(c *C) {
+	queue := NewTestQueue("memory-fetch-q")
+	c.Check(queue.Publish("memory-d1"), Equals, true)
+	c.Check(queue.Publish("memory-d2"), Equals, true)
+	c.Check(queue.Publish("memory-d3"), Equals, true)
+
+	deliveries, err := queue.Fetch(2)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 2)
+	c.Check(deliveries[0].Payload(), Equals, "memory-d1")
+	c.Check(queue.UnackedCount(), Equals, 2)
+	c.Check(deliveries[0].Ack(), Equals, true)
+	c.Check(deliveries[1].Reject(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(queue.RejectedCount(), Equals, 1)
+
+	deliveries, err = queue.Fetch(2)
+	c.Check(err, IsNil)
+	c.Check(deliveries, HasLen, 1)
+	c.Check(queue.ReadyCount(), Equals, 0)
+}
+
+func (suite *MemoryQueueSuite) TestReadyCount(c *C) {
+	queue := NewTestQueue("memory-ready-q")
+	c.Check(queue.Publish("memory-d1"), Equals, true)
+	c.Check(queue.Publish("memory-d2"), Equals, true)
+	_, err := queue.Fetch(1)
+	c.Check(err, IsNil)
+
+	// consumed deliveries are only kept in LastDeliveries
+	c.Check(queue.ReadyCount(), Equals, 1)
+	peeked, err := queue.PeekReady(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []string{"memory-d2"})
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"memory-d1", "memory-d2"})
+}
+
+func (suite *MemoryQueueSuite) TestConsumeN(c *C) {
+	queue := NewTestQueue("memory-consume-n-q")
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("memory-d%d", i)), Equals, true)
+	}
+
+	consumer := NewTestConsumer("memory-cons")
+	consumed, err := queue.ConsumeN(2, 0, consumer)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, 2)
+	c.Check(queue.ReadyCount(), Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 0)
+
+	// waits for the unacked delivery until the timeout
+	keeper := NewTestConsumer("memory-keeper")
+	keeper.AutoAck = false
+	consumed, err = queue.ConsumeN(2, 50*time.Millisecond, keeper)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, 1)
+	c.Check(queue.UnackedCount(), Equals, 1)
+
+	// returns once it got acked
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		keeper.LastDelivery.Ack()
+	}()
+	consumed, err = queue.ConsumeN(2, 0, consumer)
+	c.Check(err, IsNil)
+	c.Check(consumed, Equals, 0)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	c.Check(consumer.LastDeliveries, HasLen, 2)
+}
+
+func (suite *MemoryQueueSuite) TestTotalCount(c *C) {
+	queue := NewTestQueue("memory-total-q")
+	for i := 0; i < 3; i++ {
+		c.Check(queue.Publish(fmt.Sprintf("memory-d%d", i)), Equals, true)
+	}
+	c.Check(queue.PublishToDelayedQueue("memory-delayed", time.Hour), Equals, true)
+	deliveries, err := queue.Fetch(2)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 2)
+	c.Check(deliveries[1].Reject(), Equals, true)
+
+	c.Check(queue.TotalCount(false), Equals, 3) // 1 ready, 1 unacked, 1 delayed
+	total, err := queue.TotalCountE(true)
+	c.Check(err, IsNil)
+	c.Check(total, Equals, 4)
+}
+
+func (suite *MemoryQueueSuite) TestDrainedChan(c *C) {
+	queue := NewTestQueue("memory-drained-q")
+	c.Check(closedWithin(queue.DrainedChan(), 0), Equals, true) // empty
+
+	c.Check(queue.Publish("memory-d1"), Equals, true)
+	drained := queue.DrainedChan()
+	deliveries, err := queue.Fetch(1)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Check(closedWithin(drained, 0), Equals, false) // delivery unacked
+
+	c.Check(deliveries[0].Ack(), Equals, true)
+	c.Check(closedWithin(drained, 0), Equals, true)
+}
+
+func (suite *MemoryQueueSuite) TestPublishBounded(c *C) {
+	queue := NewTestQueue("memory-bounded-q")
+	published, err := queue.PublishBounded("memory-d1", 1)
+	c.Check(err, IsNil)
+	c.Check(published, Equals, true)
+	published, err = queue.PublishBounded("memory-d2", 1)
+	c.Check(err, IsNil)
+	c.Check(published, Equals, false)
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"memory-d1"})
+}
+
+func (suite *MemoryQueueSuite) TestPublishFront(c *C) {
+	queue := NewTestQueue("memory-front-q")
+	c.Check(queue.Publish("memory-d1"), Equals, true)
+	c.Check(queue.PublishFront("memory-d2"), Equals, true)
+	c.Check(queue.PublishFront("memory-d3"), Equals, true)
+	c.Check(queue.LastDeliveries, DeepEquals, []string{"memory-d1", "memory-d2", "memory-d3"})
+
+	deliveries, err := queue.Fetch(3)
+	c.Check(err, IsNil)
+	c.Assert(deliveries, HasLen, 3)
+	c.Check(deliveries[0].Payload(), Equals, "memory-d3")
+	c.Check(deliveries[1].Payload(), Equals, "memory-d2")
+	c.Check(deliveries[2].Payload(), Equals, "memory-d1")
+}
+
+func (suite *MemoryQueueSuite) TestPeekDelayed(c *C) {
+	now := time.Unix(1000, 0)
+	queue := NewTestQueue("memory-peek-delayed-q")
+	queue.SetClock(func() time.Time { return now })
+	c.Check(queue.PublishAt("memory-d2", now.Add(time.Hour)), Equals, true)
+	c.Check(queue.PublishAt("memory-d1", now.Add(time.Minute)), Equals, true)
+
+	peeked, err := queue.PeekDelayed(10)
+	c.Check(err, IsNil)
+	c.Check(peeked, DeepEquals, []DelayedDelivery{
+		{Payload: "memory-d1", RunAt: now.Add(time.Minute)},
+		{Payload: "memory-d2", RunAt: now.Add(time.Hour)},
+	})
+	peeked, err = queue.PeekDelayed(1)
+	c.Check(err, IsNil)
+	c.Check(peeked, HasLen, 1)
+	c.Check(queue.DelayedCount(), Equals, 2)
+}
+
+func (suite *MemoryQueueSuite) TestReturnRejectedMatching(c *C) {
+	queue := NewTestQueue("memory-matching-q")
+	for _, payload := range []string{"a-1", "b-2", "a-3", "a-4"} {
+		c.Check(queue.Publish(payload), Equals, true)
+	}
+	c.Check(queue.StartConsuming(10, time.Second), Equals, true)
+	consumer := NewCustomTestConsumer(func(delivery Delivery) { delivery.Reject() })
+	queue.AddConsumer("memory-matching-cons", consumer)
+	c.Check(queue.RejectedCount(), Equals, 4)
+	queue.StopConsuming()
+
+	returned, err := queue.ReturnRejectedMatching(func(payload string) bool { return payload[0] == 'a' }, 2)
+	c.Check(err, IsNil)
+	c.Check(returned, Equals, 2)
+	peeked, _ := queue.PeekReady(10)
+	c.Check(peeked, DeepEquals, []string{"a-1", "a-3"})
+	peeked, _ = queue.PeekRejected(10)
+	c.Check(peeked, DeepEquals, []string{"b-2", "a-4"})
+}
+
+func (suite *MemoryQueueSuite) TestRejectedDeliveries(c *C) {
+	queue := NewTestQueue("memory-rejected-deliveries-q")
+	for _, payload := range []string{"memory-d1", "memory-d2", "memory-d3"} {
+		c.Check(queue.Publish(payload), Equals, true)
+	}
+	deliveries, _ := queue.Fetch(3)
+	failed, err := Deliveries(deliveries).Reject()
+	c.Check(err, IsNil)
+	c.Check(failed, Equals, 0)
+
+	inspected, err := queue.RejectedDeliveries(2)
+	c.Check(err, IsNil)
+	c.Assert(inspected, HasLen, 2)
+	c.Check(inspected[0].Payload(), Equals, "memory-d1")
+	c.Check(inspected[0].Ack(), Equals, true)
+	c.Check(inspected[1].RequeueFront(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	peeked, _ := queue.PeekReady(10)
+	c.Check(peeked, DeepEquals, []string{"memory-d2"})
+	peeked, _ = queue.PeekRejected(10)
+	c.Check(peeked, DeepEquals, []string{"memory-d3"})
+}
+
+func (suite *MemoryQueueSuite) TestRequeue(c *C) {
+	queue := NewTestQueue("memory-requeue-q")
+	for _, payload := range []string{"memory-d1", "memory-d2", "memory-d3"} {
+		c.Check(queue.Publish(payload), Equals, true)
+	}
+	deliveries, _ := queue.Fetch(2)
+	c.Assert(deliveries, HasLen, 2)
+	c.Check(deliveries[0].Requeue(), Equals, true)
+	c.Check(deliveries[0].Requeue(), Equals, false)
+	c.Check(deliveries[1].RequeueFront(), Equals, true)
+	c.Check(queue.UnackedCount(), Equals, 0)
+	peeked, _ := queue.PeekReady(10)
+	c.Check(peeked, DeepEquals, []string{"memory-d2", "memory-d3", "memory-d1"})
+	c.Check(queue.Counters().Requeued, Equals, int64(2))
+}
@@ -0,0 +1,14 @@
+package rmq
+
+import "context"
+
+// Tracer links the consumption of a delivery to its publishing. Set it on both
+// the publishing and the consuming queue, see _example/tracing.go for an
+// OpenTelemetry implementation
+type Tracer interface {
+	// Inject returns the trace context of ctx to be published along with a payload
+	Inject(ctx context.Context) map[string]string
+	// StartConsume starts a span as child of the trace context which was
+	// published along with the consumed payload and returns a function to end it
+	StartConsume(ctx context.Context, queue string, traceContext map[string]string) (context.Context, func())
+}
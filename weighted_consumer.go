@@ -0,0 +1,125 @@
+package rmq
+
+import (
+	"reflect"
+	"sync"
+)
+
+// weightedDispatcher distributes the deliveries of a delivery channel to the
+// consumers added with AddConsumerWithWeight proportionally to their weights
+// using smooth weighted round robin. If the chosen consumer is busy the
+// delivery goes to the first consumer ready to take it instead, so a slow
+// consumer doesn't hold back the others
+type weightedDispatcher struct {
+	deliveryChan chan Delivery
+	stop         <-chan struct{}     // closed once the consumers got stopped
+	returnFunc   func(Delivery) bool // for deliveries received after stopping
+
+	lock      sync.Mutex
+	consumers []*weightedConsumer
+	total     int  // sum of the weights of the consumers
+	closed    bool // set once the delivery channel got closed
+}
+
+type weightedConsumer struct {
+	weight       int
+	current      int // grows by weight each round, reduced by the total when chosen
+	deliveryChan chan Delivery
+}
+
+func newWeightedDispatcher(deliveryChan chan Delivery, stop <-chan struct{}, returnFunc func(Delivery) bool) *weightedDispatcher {
+	return &weightedDispatcher{deliveryChan: deliveryChan, stop: stop, returnFunc: returnFunc}
+}
+
+// add returns the channel of a new consumer with the given weight, it's
+// closed once the delivery channel got closed and drained. Dispatching starts
+// with the first consumer
+func (dispatcher *weightedDispatcher) add(weight int) chan Delivery {
+	if weight < 1 {
+		weight = 1
+	}
+
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	deliveryChan := make(chan Delivery)
+	if dispatcher.closed {
+		close(deliveryChan)
+		return deliveryChan
+	}
+	dispatcher.consumers = append(dispatcher.consumers, &weightedConsumer{weight: weight, deliveryChan: deliveryChan})
+	dispatcher.total += weight
+	if len(dispatcher.consumers) == 1 {
+		go dispatcher.dispatch()
+	}
+	return deliveryChan
+}
+
+func (dispatcher *weightedDispatcher) dispatch() {
+	for delivery := range dispatcher.deliveryChan {
+		dispatcher.send(delivery)
+	}
+
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	dispatcher.closed = true
+	for _, consumer := range dispatcher.consumers {
+		close(consumer.deliveryChan)
+	}
+}
+
+// send passes the delivery to the next consumer, or to any other consumer
+// ready to take it first if that one is busy. Once the consumers got stopped
+// the delivery gets returned instead
+func (dispatcher *weightedDispatcher) send(delivery Delivery) {
+	chosen := dispatcher.next()
+	select {
+	case chosen.deliveryChan <- delivery:
+		return
+	default:
+	}
+
+	dispatcher.lock.Lock()
+	consumers := append([]*weightedConsumer(nil), dispatcher.consumers...)
+	dispatcher.lock.Unlock()
+
+	cases := make([]reflect.SelectCase, 0, len(consumers)+1)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(dispatcher.stop)})
+	for _, consumer := range consumers {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(consumer.deliveryChan), Send: reflect.ValueOf(delivery)})
+	}
+	chosenCase, _, _ := reflect.Select(cases)
+	if chosenCase == 0 {
+		dispatcher.returnFunc(delivery)
+		return
+	}
+	dispatcher.charge(chosen, consumers[chosenCase-1])
+}
+
+// next returns the consumer to pass the next delivery to
+func (dispatcher *weightedDispatcher) next() *weightedConsumer {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+
+	var chosen *weightedConsumer
+	for _, consumer := range dispatcher.consumers {
+		consumer.current += consumer.weight
+		if chosen == nil || consumer.current > chosen.current {
+			chosen = consumer
+		}
+	}
+	chosen.current -= dispatcher.total
+	return chosen
+}
+
+// charge moves the share of a delivery from the chosen consumer to the one
+// which took it instead
+func (dispatcher *weightedDispatcher) charge(chosen, took *weightedConsumer) {
+	if chosen == took {
+		return
+	}
+
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	chosen.current += dispatcher.total
+	took.current -= dispatcher.total
+}